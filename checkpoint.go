@@ -0,0 +1,421 @@
+package uniswap_v3_simulator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const DefaultCheckpointInterval = 100000
+
+var (
+	ErrStateUnavailable   = errors.New("pool state unavailable at block")
+	ErrCheckpointNotFound = errors.New("checkpoint not found")
+)
+
+// Checkpoint 同步到 BlockNum 时保存的 checkpoint. 只保存上一个 checkpoint 之后修改过的 pool,
+// 第一个 checkpoint 保存所有 pool, 每个 pool 在 BlockNum 的状态是不晚于 BlockNum 的最后一个 PoolCheckpoint
+type Checkpoint struct {
+	ID       uint   `gorm:"primarykey"`
+	BlockNum uint64 `gorm:"uniqueIndex"`
+	// 序号, 从 1 开始, 用于 KeepEvery
+	Seq       uint64
+	Pools     int
+	CreatedAt time.Time
+}
+
+// PoolCheckpoint pool 在 BlockNum 结束时的完整状态, BlockNum 为所属 Checkpoint 的区块
+type PoolCheckpoint struct {
+	ID          uint   `gorm:"primarykey"`
+	PoolAddress string `gorm:"uniqueIndex:idx_checkpoint_pool_block"`
+	BlockNum    uint64 `gorm:"uniqueIndex:idx_checkpoint_pool_block"`
+	State       []byte
+}
+
+// CheckpointRetention checkpoint 保留策略, 两个条件满足一个就保留, 最新的 checkpoint 总是保留
+type CheckpointRetention struct {
+	// 保留最近的 KeepLast 个, 0 表示保留所有
+	KeepLast int
+	// 另外保留序号是 KeepEvery 倍数的 checkpoint, 0 表示不保留
+	KeepEvery uint64
+}
+
+func (r CheckpointRetention) keep(checkpoint *Checkpoint, fromLatest int) bool {
+	if r.KeepLast == 0 || fromLatest < r.KeepLast {
+		return true
+	}
+	return r.KeepEvery > 0 && checkpoint.Seq%r.KeepEvery == 0
+}
+
+func newPoolCheckpoint(pool *CorePool, blockNum uint64) (*PoolCheckpoint, error) {
+	state, err := json.Marshal(pool)
+	if err != nil {
+		return nil, err
+	}
+	return &PoolCheckpoint{
+		PoolAddress: pool.PoolAddress,
+		BlockNum:    blockNum,
+		State:       state,
+	}, nil
+}
+
+// Pool 恢复 checkpoint 中的 pool, 与数据库无关
+func (c *PoolCheckpoint) Pool() (*CorePool, error) {
+	pool := &CorePool{}
+	err := json.Unmarshal(c.State, pool)
+	if err != nil {
+		return nil, err
+	}
+	pool.Model = gorm.Model{}
+	pool.HasCreated = false
+	if pool.TickManager == nil {
+		pool.TickManager = NewTickManager()
+	}
+	if pool.PositionManager == nil {
+		pool.PositionManager = NewPositionManager()
+	}
+	return pool, nil
+}
+
+// SetCheckpointInterval 同步时每 interval 个区块保存一次 checkpoint, 0 表示不自动保存
+func (pm *Simulator) SetCheckpointInterval(interval uint64) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.checkpointInterval = interval
+}
+
+// SetCheckpointRetention 设置保留策略, 下一次保存 checkpoint 时删除不需要保留的
+func (pm *Simulator) SetCheckpointRetention(retention CheckpointRetention) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.checkpointRetention = retention
+}
+
+// Checkpoints 按区块排序的所有 checkpoint
+func (pm *Simulator) Checkpoints() ([]*Checkpoint, error) {
+	return pm.store.Checkpoints()
+}
+
+func (pm *Simulator) loadCheckpoints() error {
+	last, err := pm.store.LastCheckpoint()
+	if err != nil {
+		return err
+	}
+	pm.lastCheckpoint, pm.checkpointSeq = 0, 0
+	if last != nil {
+		pm.lastCheckpoint = last.BlockNum
+		pm.checkpointSeq = last.Seq
+	}
+	return nil
+}
+
+// FlushPools 时调用, 记录上一个 checkpoint 之后修改过的 pool
+func (pm *Simulator) markCheckpointPools() {
+	for address := range pm.dirtyPools {
+		pm.checkpointPools[address] = true
+	}
+}
+
+// 同步到 blockNum 时调用, 距离上一个 checkpoint 超过 interval 时保存
+func (pm *Simulator) maybeCheckpoint(blockNum uint64) error {
+	if pm.checkpointInterval == 0 || blockNum < pm.lastCheckpoint+pm.checkpointInterval {
+		return nil
+	}
+	return pm.checkpoint(blockNum)
+}
+
+// Checkpoint 持久化当前状态, 在已同步的区块保存 checkpoint
+func (pm *Simulator) Checkpoint() (uint64, error) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	blockNum, err := pm.MaxSyncedBlockNum()
+	if err != nil {
+		return 0, err
+	}
+	return blockNum, pm.checkpoint(blockNum)
+}
+
+func (pm *Simulator) checkpoint(blockNum uint64) error {
+	err := pm.FlushPools()
+	if err != nil {
+		return err
+	}
+	if blockNum <= pm.lastCheckpoint && pm.checkpointSeq > 0 {
+		return nil
+	}
+	var pools []*CorePool
+	if pm.checkpointSeq == 0 {
+		for _, pool := range pm.Pools {
+			pools = append(pools, pool)
+		}
+	} else {
+		for address := range pm.checkpointPools {
+			// 已经回滚删除的 pool 没有状态
+			if pool, ok := pm.Pools[common.HexToAddress(address)]; ok {
+				pools = append(pools, pool)
+			}
+		}
+	}
+	checkpoint := &Checkpoint{BlockNum: blockNum, Seq: pm.checkpointSeq + 1, Pools: len(pools), CreatedAt: time.Now()}
+	rows := make([]*PoolCheckpoint, 0, len(pools))
+	for _, pool := range pools {
+		row, err := newPoolCheckpoint(pool, blockNum)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, row)
+	}
+	checkpoints, err := pm.store.Checkpoints()
+	if err != nil {
+		return err
+	}
+	checkpoints = append(checkpoints, checkpoint)
+	err = pm.store.Update(func(tx StoreTx) error {
+		err := tx.SaveCheckpoint(checkpoint, rows)
+		if err != nil {
+			return err
+		}
+		return pm.pruneCheckpoints(tx, checkpoints)
+	})
+	if err != nil {
+		logrus.Errorf("failed save checkpoint %d %s", blockNum, err)
+		return err
+	}
+	logrus.Infof("checkpoint: %d, pools: %d", blockNum, len(pools))
+	pm.lastCheckpoint = blockNum
+	pm.checkpointSeq = checkpoint.Seq
+	pm.checkpointPools = map[string]bool{}
+	return nil
+}
+
+// 按保留策略删除 checkpoint. 删除的 checkpoint 中的 pool 状态如果在下一个保留的 checkpoint 之前没有更新, 移到下一个保留的 checkpoint
+func (pm *Simulator) pruneCheckpoints(tx StoreTx, checkpoints []*Checkpoint) error {
+	keep := make([]bool, len(checkpoints))
+	for i, checkpoint := range checkpoints {
+		keep[i] = i == len(checkpoints)-1 || pm.checkpointRetention.keep(checkpoint, len(checkpoints)-1-i)
+	}
+	next := uint64(0)
+	for i := len(checkpoints) - 1; i >= 0; i-- {
+		checkpoint := checkpoints[i]
+		if keep[i] {
+			next = checkpoint.BlockNum
+			continue
+		}
+		err := tx.PruneCheckpoint(checkpoint.BlockNum, next)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("prune checkpoint: %d", checkpoint.BlockNum)
+	}
+	return nil
+}
+
+// 删除 blockNum 之后的 checkpoint, 重组回滚时调用. 其中保存的 pool 要在下一个 checkpoint 重新保存
+func (pm *Simulator) deleteCheckpointsAfter(blockNum uint64) error {
+	var addresses []string
+	err := pm.store.Update(func(tx StoreTx) error {
+		var err error
+		addresses, err = tx.DeleteCheckpointsAfter(blockNum)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		pm.checkpointPools[address] = true
+	}
+	return pm.loadCheckpoints()
+}
+
+// 每个 pool 在 blockNum 的 checkpoint 状态
+func (pm *Simulator) checkpointPoolsAt(blockNum uint64) (map[common.Address]*CorePool, error) {
+	rows, err := pm.store.PoolCheckpointsAt(blockNum)
+	if err != nil {
+		return nil, err
+	}
+	pools := map[common.Address]*CorePool{}
+	for _, row := range rows {
+		pool, err := row.Pool()
+		if err != nil {
+			return nil, err
+		}
+		pools[common.HexToAddress(row.PoolAddress)] = pool
+	}
+	return pools, nil
+}
+
+// RestoreCheckpoint 把所有 pool 恢复到 blockNum 的 checkpoint, 检查 pool 状态都不晚于 blockNum,
+// 之后的 checkpoint 删除, 从 blockNum+1 重新同步
+func (pm *Simulator) RestoreCheckpoint(blockNum uint64) error {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	checkpoint, err := pm.store.FindCheckpoint(blockNum)
+	if err != nil {
+		return err
+	}
+	if checkpoint == nil {
+		return fmt.Errorf("%w: %d", ErrCheckpointNotFound, blockNum)
+	}
+	// 先落地未保存的修改, 恢复时数据库与内存一致
+	err = pm.FlushPools()
+	if err != nil {
+		return err
+	}
+	pools, err := pm.checkpointPoolsAt(blockNum)
+	if err != nil {
+		return err
+	}
+	err = checkPoolsAt(pools, blockNum)
+	if err != nil {
+		return err
+	}
+	for address, current := range pm.Pools {
+		if _, ok := pools[address]; !ok {
+			// checkpoint 之后创建的 pool
+			delete(pm.Pools, address)
+			if current.HasCreated {
+				pm.removedPools = append(pm.removedPools, current)
+			}
+		}
+	}
+	for address, pool := range pools {
+		current, ok := pm.Pools[address]
+		if !ok {
+			pm.Pools[address] = pool
+			pm.dirtyPools[pool.PoolAddress] = pool
+			continue
+		}
+		model, created := current.Model, current.HasCreated
+		*current = *pool
+		current.Model = model
+		current.HasCreated = created
+		pm.dirtyPools[current.PoolAddress] = current
+	}
+	// checkpoint 之后的隔离记录失效, 重新同步时会再次检查
+	for address, q := range pm.quarantined {
+		if q.Reason != QuarantineManual && q.BlockNum > blockNum {
+			err = pm.clearQuarantine(address)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = pm.deleteCheckpointsAfter(blockNum)
+	if err != nil {
+		return err
+	}
+	pm.currentBlock = blockNum
+	pm.journal = nil
+	pm.journalBase = blockNum
+	err = pm.FlushPools()
+	if err != nil {
+		return err
+	}
+	pm.checkpointPools = map[string]bool{}
+	pm.tsLock.Lock()
+	pm.blockTimestamps = map[uint64]uint64{}
+	pm.tsLock.Unlock()
+	logrus.Infof("restore checkpoint: %d, pools: %d", blockNum, len(pools))
+	return nil
+}
+
+// PoolAt 返回 pool 在 blockNum 结束时的状态. 从不晚于 blockNum 的最近 checkpoint 开始, 回放之间的 logs.
+// 返回的 pool 与 Simulator 无关, 修改不会影响当前状态. 隔离的 pool 在出错的区块之后没有状态
+func (pm *Simulator) PoolAt(address common.Address, blockNum uint64) (*CorePool, error) {
+	pm.lock.Lock()
+	current, ok := pm.Pools[address]
+	var fork *CorePool
+	if ok {
+		fork = current.Clone()
+	}
+	quarantined, isQuarantined := pm.quarantined[address]
+	synced, err := pm.MaxSyncedBlockNum()
+	pm.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w %s", ErrPoolNotExists, address)
+	}
+	if blockNum > synced {
+		return nil, fmt.Errorf("%w: %d, synced %d", ErrStateUnavailable, blockNum, synced)
+	}
+	if blockNum < fork.DeployBlockNum {
+		return nil, fmt.Errorf("%w: %d, pool deployed at %d", ErrStateUnavailable, blockNum, fork.DeployBlockNum)
+	}
+	if isQuarantined {
+		// 手动隔离没有出错的 log, 最后一个 log 之后是否有被忽略的 log 未知
+		limit := quarantined.BlockNum
+		if limit == 0 {
+			limit = fork.CurrentBlockNum + 1
+		}
+		if blockNum >= limit {
+			return nil, fmt.Errorf("%w: %d, pool quarantined at %d", ErrStateUnavailable, blockNum, limit)
+		}
+	} else if blockNum >= fork.CurrentBlockNum {
+		// 当前状态在最后一个 log 之后都有效, 隔离的 pool 可能被出错的 log 修改了一部分, 需要回放
+		return fork, nil
+	}
+
+	checkpoint, err := pm.store.PoolCheckpointAt(fork.PoolAddress, blockNum)
+	if err != nil {
+		return nil, err
+	}
+	var base *CorePool
+	from := fork.DeployBlockNum
+	if checkpoint != nil {
+		base, err = checkpoint.Pool()
+		if err != nil {
+			return nil, err
+		}
+		from = checkpoint.BlockNum + 1
+	} else if fork.BootstrapBlockNum != 0 {
+		// 从链上加载之前的 logs 没有应用过
+		return nil, fmt.Errorf("%w: %d, pool loaded from chain at %d", ErrStateUnavailable, blockNum, fork.BootstrapBlockNum)
+	}
+	config := NewPoolConfig(int64(fork.TickSpacing), common.HexToAddress(fork.Token0), common.HexToAddress(fork.Token1), fork.Fee)
+	return pm.replayPool(address, config, base, from, blockNum)
+}
+
+// 在 base 上回放 [from, to] 之间的 logs, base 为 nil 时从 Initialize 开始.
+// 回放使用传入的 pool 配置, 不读取 simulator 的注册表, 不需要持有锁
+func (pm *Simulator) replayPool(address common.Address, config *PoolConfig, base *CorePool, from, to uint64) (*CorePool, error) {
+	if pm.source == nil {
+		return nil, ErrNoLogSource
+	}
+	logs, err := pm.source.FilterLogs(pm.ctx, ethereum.FilterQuery{
+		FromBlock: new(big.Int).SetUint64(from),
+		ToBlock:   new(big.Int).SetUint64(to),
+		Addresses: []common.Address{address},
+		Topics:    [][]common.Hash{{pm.InitializeID, pm.MintID, pm.BurnID, pm.SwapID, pm.FlashID, pm.CollectID, pm.SetFeeProtocolID, pm.CollectProtocolID, pm.IncreaseCardinalityID}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debugf("replay pool %s: %d - %d, %d logs", address, from, to, len(logs))
+	replay := NewSimulatorSnapshot(pm)
+	replay.history = true
+	replay.poolConfigs = map[common.Address]*PoolConfig{address: config}
+	if base != nil {
+		replay.Pools[address] = base
+	}
+	err = replay.HandleLogs(logs)
+	if err != nil {
+		return nil, err
+	}
+	if replay.IsQuarantined(address) {
+		return nil, fmt.Errorf("%w: %d, %s", ErrStateUnavailable, to, replay.quarantined[address].Error)
+	}
+	pool, ok := replay.Pools[address]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d, pool not initialized", ErrStateUnavailable, to)
+	}
+	return pool, nil
+}
@@ -0,0 +1,142 @@
+package uniswap_v3_simulator
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulator_PoolAt(t *testing.T) {
+	source := newTestLogSource(
+		testPoolCreatedLog(100),
+		testInitializeLog(101),
+		testMintLog(105, -600, 600, 1000000),
+		testMintLog(120, -60, 60, 1000),
+		testMintLog(250, -600, 600, 5),
+	)
+	pm := openTestSimulator(t, filepath.Join(t.TempDir(), "simulator.db"), source)
+	pm.startBlock = 99
+	pm.SetCheckpointInterval(50)
+	_, err := pm.SyncTo(260, 10)
+	assert.NoError(t, err)
+
+	checkpoints, err := pm.Checkpoints()
+	assert.NoError(t, err)
+	assert.Len(t, checkpoints, 3)
+	var rows []*PoolCheckpoint
+	assert.NoError(t, testDB(pm).Order("block_num").Find(&rows).Error)
+	assert.Len(t, rows, 2)
+	assert.Equal(t, uint64(110), rows[0].BlockNum)
+	assert.Equal(t, uint64(165), rows[1].BlockNum)
+
+	for block, liquidity := range map[uint64]string{
+		101: "0",       // 从 Initialize 回放
+		110: "1000000", // 从 Initialize 回放
+		120: "1001000", // checkpoint 之后回放
+		165: "1001000", // checkpoint
+		249: "1001000",
+		255: "1001005", // 当前状态
+	} {
+		pool, err := pm.PoolAt(testPool, block)
+		assert.NoError(t, err)
+		assert.Equal(t, liquidity, pool.Liquidity.String(), "block %d", block)
+	}
+	pool, err := pm.PoolAt(testPool, 130)
+	assert.NoError(t, err)
+	assert.Len(t, pool.TickManager.GetSortedTicks(), 4)
+	assert.Equal(t, uint64(120), pool.CurrentBlockNum)
+
+	// 返回的 pool 与当前状态无关
+	_, _, err = pool.Mint(testOwner.String(), -600, 600, pool.Liquidity)
+	assert.NoError(t, err)
+	assert.Equal(t, "1001005", pm.Pools[testPool].Liquidity.String())
+
+	_, err = pm.PoolAt(testPool, 261)
+	assert.ErrorIs(t, err, ErrStateUnavailable)
+	_, err = pm.PoolAt(testPool, 100)
+	assert.ErrorIs(t, err, ErrStateUnavailable)
+	_, err = pm.PoolAt(testFactory, 200)
+	assert.ErrorIs(t, err, ErrPoolNotExists)
+
+	// 回放使用 pool 自己的配置, 不读取注册表
+	pm.poolConfigs = map[common.Address]*PoolConfig{}
+	pool, err = pm.PoolAt(testPool, 110)
+	assert.NoError(t, err)
+	assert.Equal(t, "1000000", pool.Liquidity.String())
+
+	// 隔离的 pool 在最后一个 log 或出错的 log 之后没有状态, 之前的状态回放得到
+	assert.NoError(t, pm.Quarantine(testPool, ""))
+	_, err = pm.PoolAt(testPool, 255)
+	assert.ErrorIs(t, err, ErrStateUnavailable)
+	pool, err = pm.PoolAt(testPool, 250)
+	assert.NoError(t, err)
+	assert.Equal(t, "1001005", pool.Liquidity.String())
+	pm.quarantined[testPool].BlockNum = 200
+	_, err = pm.PoolAt(testPool, 200)
+	assert.ErrorIs(t, err, ErrStateUnavailable)
+	pool, err = pm.PoolAt(testPool, 199)
+	assert.NoError(t, err)
+	assert.Equal(t, "1001000", pool.Liquidity.String())
+}
+
+func TestSimulator_CheckpointRetention(t *testing.T) {
+	source := newTestLogSource(
+		testPoolCreatedLog(100),
+		testInitializeLog(101),
+		testMintLog(105, -600, 600, 1000000),
+		testMintLog(130, -600, 600, 1),
+		testMintLog(170, -600, 600, 1),
+		testMintLog(210, -600, 600, 1),
+	)
+	dbFile := filepath.Join(t.TempDir(), "simulator.db")
+	pm := openTestSimulator(t, dbFile, source)
+	pm.startBlock = 99
+	pm.SetCheckpointInterval(10)
+	pm.SetCheckpointRetention(CheckpointRetention{KeepLast: 2, KeepEvery: 3})
+	_, err := pm.SyncTo(229, 9)
+	assert.NoError(t, err)
+
+	blocks := func() []uint64 {
+		checkpoints, err := pm.Checkpoints()
+		assert.NoError(t, err)
+		var blocks []uint64
+		for _, checkpoint := range checkpoints {
+			blocks = append(blocks, checkpoint.BlockNum)
+		}
+		return blocks
+	}
+	// 每个区间结束时保存, 序号 3 6 9 12 和最后两个保留
+	assert.Equal(t, []uint64{129, 159, 189, 219, 229}, blocks())
+	// 删除的 checkpoint 中的 pool 状态移到下一个保留的 checkpoint
+	var rows []*PoolCheckpoint
+	assert.NoError(t, testDB(pm).Order("block_num").Find(&rows).Error)
+	assert.Len(t, rows, 4)
+	for i, block := range []uint64{129, 159, 189, 219} {
+		assert.Equal(t, block, rows[i].BlockNum)
+		pool, err := rows[i].Pool()
+		assert.NoError(t, err)
+		assert.Equal(t, decimal.NewFromInt(1000000+int64(i)).String(), pool.Liquidity.String())
+	}
+
+	err = pm.RestoreCheckpoint(150)
+	assert.ErrorIs(t, err, ErrCheckpointNotFound)
+	assert.NoError(t, pm.RestoreCheckpoint(159))
+	assert.Equal(t, "1000001", pm.Pools[testPool].Liquidity.String())
+	assert.Equal(t, []uint64{129, 159}, blocks())
+	synced, err := pm.MaxSyncedBlockNum()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(159), synced)
+
+	// 重启后从数据库恢复
+	reopened := openTestSimulator(t, dbFile, source)
+	assert.Equal(t, "1000001", reopened.Pools[testPool].Liquidity.String())
+
+	// 重新同步得到相同的状态
+	_, err = pm.SyncTo(229, 9)
+	assert.NoError(t, err)
+	assert.Equal(t, "1000003", pm.Pools[testPool].Liquidity.String())
+	assert.Equal(t, []uint64{129, 159, 189, 219, 229}, blocks())
+}
@@ -0,0 +1,215 @@
+package uniswap_v3_simulator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrorPolicy 解析或执行 log 失败时的处理方式
+type ErrorPolicy int
+
+const (
+	// ErrorPolicySkipPool 隔离出错的 pool, 之后的 logs 忽略, 继续同步其他 pool
+	ErrorPolicySkipPool ErrorPolicy = iota
+	// ErrorPolicyStrict 遇到第一个错误就返回, 错误中包含 log 和 pool 状态
+	ErrorPolicyStrict
+	// ErrorPolicySkipEvent 只跳过出错的 log, pool 继续处理之后的 logs, 状态可能与链上不一致
+	ErrorPolicySkipEvent
+)
+
+const (
+	QuarantineParseFailed     = "parse_failed"
+	QuarantineExecutionFailed = "execution_failed"
+)
+
+var ErrParseEvent = errors.New("failed parse event")
+
+func (p ErrorPolicy) String() string {
+	switch p {
+	case ErrorPolicyStrict:
+		return "strict"
+	case ErrorPolicySkipPool:
+		return "skip-pool"
+	case ErrorPolicySkipEvent:
+		return "skip-event"
+	}
+	return fmt.Sprintf("ErrorPolicy(%d)", int(p))
+}
+
+func ParseErrorPolicy(s string) (ErrorPolicy, error) {
+	for _, p := range []ErrorPolicy{ErrorPolicyStrict, ErrorPolicySkipPool, ErrorPolicySkipEvent} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown error policy %s", s)
+}
+
+// ErrorCounters 按 policy 跳过的统计
+type ErrorCounters struct {
+	Errors        uint64            // 所有解析和执行错误
+	SkippedEvents uint64            // skip-event 跳过的 log
+	SkippedPools  uint64            // skip-pool 隔离的 pool
+	IgnoredLogs   uint64            // 隔离的 pool 被忽略的 log
+	ByEvent       map[string]uint64 // 每种事件的错误数
+}
+
+type errorCounter struct {
+	lock     sync.Mutex
+	counters ErrorCounters
+}
+
+func (c *errorCounter) add(event string, policy ErrorPolicy) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counters.Errors += 1
+	if c.counters.ByEvent == nil {
+		c.counters.ByEvent = map[string]uint64{}
+	}
+	c.counters.ByEvent[event] += 1
+	switch policy {
+	case ErrorPolicySkipPool:
+		c.counters.SkippedPools += 1
+	case ErrorPolicySkipEvent:
+		c.counters.SkippedEvents += 1
+	}
+}
+
+func (c *errorCounter) ignore() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counters.IgnoredLogs += 1
+}
+
+func (c *errorCounter) snapshot() ErrorCounters {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	counters := c.counters
+	counters.ByEvent = make(map[string]uint64, len(c.counters.ByEvent))
+	for k, v := range c.counters.ByEvent {
+		counters.ByEvent[k] = v
+	}
+	return counters
+}
+
+func newParseError(err error) error {
+	return fmt.Errorf("%w: %s", ErrParseEvent, err)
+}
+
+func eventName(a *abi.ABI, log *types.Log) string {
+	if len(log.Topics) > 0 {
+		if event, err := a.EventByID(log.Topics[0]); err == nil {
+			return event.Name
+		}
+	}
+	return "unknown"
+}
+
+func quarantineReason(err error) string {
+	switch {
+	case errors.Is(err, ErrSwapUnresolvable):
+		return QuarantineSwapUnresolvable
+	case errors.Is(err, ErrParseEvent):
+		return QuarantineParseFailed
+	}
+	return QuarantineExecutionFailed
+}
+
+// 出错时的上下文: log 和 pool 在出错时的状态, 执行失败前 pool 可能已经被部分修改
+func errorContext(log *types.Log, pool *CorePool) string {
+	ctx := map[string]interface{}{"log": log}
+	if pool != nil {
+		ctx["pool"] = map[string]interface{}{
+			"sqrtPriceX96":         pool.SqrtPriceX96,
+			"tickCurrent":          pool.TickCurrent,
+			"liquidity":            pool.Liquidity,
+			"feeGrowthGlobal0X128": pool.FeeGrowthGlobal0X128,
+			"feeGrowthGlobal1X128": pool.FeeGrowthGlobal1X128,
+			"currentBlockNum":      pool.CurrentBlockNum,
+			"ticks":                len(pool.TickManager.Ticks),
+		}
+	}
+	bs, _ := json.Marshal(ctx)
+	return string(bs)
+}
+
+// SetErrorPolicy 设置解析或执行 log 失败时的处理方式, 默认 ErrorPolicySkipPool.
+// 同步中的 HandleLogs 和 fork 在处理下一个错误时使用新的 policy
+func (pm *Simulator) SetErrorPolicy(policy ErrorPolicy) {
+	atomic.StoreInt32(&pm.errorPolicy, int32(policy))
+}
+
+func (pm *Simulator) ErrorPolicy() ErrorPolicy {
+	return ErrorPolicy(atomic.LoadInt32(&pm.errorPolicy))
+}
+
+// ErrorCounters 按 policy 跳过的统计
+func (pm *Simulator) ErrorCounters() ErrorCounters {
+	return pm.errCounter.snapshot()
+}
+
+// 按 policy 处理 log 的错误, 返回 nil 时继续处理下一个 log
+func (pm *Simulator) logError(log *types.Log, pool *CorePool, err error) error {
+	policy := pm.ErrorPolicy()
+	event := eventName(&pm.Abi, log)
+	pm.errCounter.add(event, policy)
+	switch policy {
+	case ErrorPolicyStrict:
+		poolErr := asPoolError(log, err)
+		poolErr.Context = errorContext(log, pool)
+		logrus.Errorf("%s event failed: %s, context: %s", event, poolErr, poolErr.Context)
+		return poolErr
+	case ErrorPolicySkipEvent:
+		logrus.Warnf("skip %s event, tx: %s  pool: %s, %s", event, log.TxHash, log.Address, err)
+	default:
+		pm.quarantine(log.Address, log, quarantineReason(err), err)
+	}
+	return nil
+}
+
+// 已经存在的 pool 再次 Initialize 不修改状态, 不隔离 pool; strict 时返回错误, 其他 policy 跳过该 log
+func duplicateInitialize(policy ErrorPolicy, log *types.Log, pool *CorePool) error {
+	if policy == ErrorPolicyStrict {
+		poolErr := asPoolError(log, ErrPoolExists)
+		poolErr.Context = errorContext(log, pool)
+		return poolErr
+	}
+	logrus.Warnf("skip duplicate initialize, tx: %s  pool: %s", log.TxHash, log.Address)
+	return nil
+}
+
+// fork 使用 simulator 的 policy, 隔离的 pool 只在 fork 中生效
+func (s *SimulatorFork) logError(log *types.Log, pool *CorePool, err error) error {
+	policy := s.simulator.ErrorPolicy()
+	event := eventName(&s.simulator.Abi, log)
+	s.errCounter.add(event, policy)
+	switch policy {
+	case ErrorPolicyStrict:
+		poolErr := asPoolError(log, err)
+		poolErr.Context = errorContext(log, pool)
+		return poolErr
+	case ErrorPolicySkipEvent:
+		logrus.Warnf("fork skip %s event, tx: %s  pool: %s, %s", event, log.TxHash, log.Address, err)
+	default:
+		s.quarantined[log.Address] = &QuarantinedPool{
+			PoolAddress: log.Address.String(),
+			TxHash:      log.TxHash.String(),
+			BlockNum:    log.BlockNumber,
+			LogIndex:    log.Index,
+			Reason:      quarantineReason(err),
+			Error:       err.Error(),
+		}
+	}
+	return nil
+}
+
+func (s *SimulatorFork) ErrorCounters() ErrorCounters {
+	return s.errCounter.snapshot()
+}
@@ -0,0 +1,70 @@
+package uniswap_v3_simulator
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+var (
+	ErrPoolExists       = errors.New("pool exists")
+	ErrPoolNotExists    = errors.New("pool not exists")
+	ErrSwapUnresolvable = errors.New("failed find swap solution")
+
+	ErrTickNotInitialized    = errors.New("tick not initialized")
+	ErrInvalidMintAmount     = errors.New("mint amount should greater than 0")
+	ErrNegativeAmountRequest = errors.New("amounts requested should be positive")
+
+	// 与合约 require 的错误信息相同
+	ErrAlreadyInitialized = errors.New("AI")
+	ErrTickOutOfRange     = errors.New("TICK")
+	ErrTicksMisordered    = errors.New("TLU")
+	ErrTickLowerTooLow    = errors.New("TLM")
+	ErrTickUpperTooHigh   = errors.New("TUM")
+	ErrRatioMin           = errors.New("RATIO_MIN")
+	ErrRatioMax           = errors.New("RATIO_MAX")
+	ErrRatioCurrent       = errors.New("RATIO_CURRENT")
+	ErrLiquidityOverflow  = errors.New("LO") // tick 的 liquidityGross 超过 maxLiquidityPerTick
+	ErrLiquiditySub       = errors.New("LS") // position 的 liquidity 不足
+	ErrNoPosition         = errors.New("NP") // poke 没有 liquidity 的 position
+	ErrNoLiquidity        = errors.New("L")  // flash 时 pool 没有 liquidity
+)
+
+// PoolError 处理 log 时的错误, 记录 pool 和 log 的位置, 可以用 errors.Is 判断具体的错误
+type PoolError struct {
+	Pool     common.Address
+	TxHash   common.Hash
+	BlockNum uint64
+	LogIndex uint
+	Err      error
+	// ErrorPolicyStrict 时记录 log 和 pool 出错时的状态
+	Context string
+}
+
+func (e *PoolError) Error() string {
+	return fmt.Sprintf("pool %s, block %d, tx %s, log %d: %s", e.Pool, e.BlockNum, e.TxHash, e.LogIndex, e.Err)
+}
+
+func (e *PoolError) Unwrap() error {
+	return e.Err
+}
+
+func newPoolError(log *types.Log, err error) error {
+	return asPoolError(log, err)
+}
+
+func asPoolError(log *types.Log, err error) *PoolError {
+	var poolErr *PoolError
+	if errors.As(err, &poolErr) {
+		return poolErr
+	}
+	return &PoolError{
+		Pool:     log.Address,
+		TxHash:   log.TxHash,
+		BlockNum: log.BlockNumber,
+		LogIndex: log.Index,
+		Err:      err,
+	}
+}
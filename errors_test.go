@@ -0,0 +1,129 @@
+package uniswap_v3_simulator
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulator_PoolErrors(t *testing.T) {
+	pm := openTestSimulator(t, filepath.Join(t.TempDir(), "simulator.db"), nil)
+	pm.SetErrorPolicy(ErrorPolicyStrict)
+	assert.NoError(t, pm.HandleLogs([]types.Log{testPoolCreatedLog(100), testInitializeLog(101)}))
+
+	initialize := testInitializeLog(102)
+	initialize.TxHash = common.HexToHash("0x1234")
+	err := pm.HandleLogs([]types.Log{initialize})
+	assert.ErrorIs(t, err, ErrPoolExists)
+	var poolErr *PoolError
+	assert.True(t, errors.As(err, &poolErr))
+	assert.Equal(t, testPool, poolErr.Pool)
+	assert.Equal(t, initialize.TxHash, poolErr.TxHash)
+	assert.Equal(t, uint64(102), poolErr.BlockNum)
+	assert.Equal(t, uint(1), poolErr.LogIndex)
+	assert.Contains(t, poolErr.Context, `"tickCurrent":0`)
+
+	err = pm.HandleLogs([]types.Log{testMintLog(103, 600, -600, 1000)})
+	assert.ErrorIs(t, err, ErrTicksMisordered)
+	err = pm.HandleLogs([]types.Log{testMintLog(103, -887280, 600, 1000)})
+	assert.ErrorIs(t, err, ErrTickLowerTooLow)
+
+	// fork 返回相同的错误
+	fork := NewSimulatorSnapshot(pm)
+	err = fork.HandleLogs([]types.Log{testMintLog(103, 600, -600, 1000)})
+	assert.ErrorIs(t, err, ErrTicksMisordered)
+	assert.True(t, errors.As(err, &poolErr))
+	assert.Equal(t, uint(2), poolErr.LogIndex)
+
+	err = pm.HandleLogs([]types.Log{testMintLog(104, -600, 600, 1000), testSwapLog(105, 5, 5, 1000)})
+	assert.ErrorIs(t, err, ErrSwapUnresolvable)
+}
+
+func TestSimulator_ErrorPolicy(t *testing.T) {
+	badMint := testMintLog(103, 600, -600, 1000)
+	logs := []types.Log{testPoolCreatedLog(100), testInitializeLog(101), testMintLog(102, -600, 600, 1000), badMint, testMintLog(104, -60, 60, 1000), testSwapLog(105, 5, 5, 1000)}
+
+	// skip-pool: 隔离 pool, 之后的 logs 忽略
+	pm := openTestSimulator(t, filepath.Join(t.TempDir(), "simulator.db"), nil)
+	assert.Equal(t, ErrorPolicySkipPool, pm.ErrorPolicy())
+	assert.NoError(t, pm.HandleLogs(logs))
+	assert.Equal(t, "1000", pm.Pools[testPool].Liquidity.String())
+	assert.Equal(t, QuarantineExecutionFailed, pm.QuarantinedPools()[0].Reason)
+	counters := pm.ErrorCounters()
+	assert.Equal(t, uint64(1), counters.Errors)
+	assert.Equal(t, uint64(1), counters.SkippedPools)
+	assert.Equal(t, uint64(2), counters.IgnoredLogs)
+	assert.Equal(t, map[string]uint64{"Mint": 1}, counters.ByEvent)
+
+	// skip-event: 只跳过出错的 log
+	pm = openTestSimulator(t, filepath.Join(t.TempDir(), "simulator.db"), nil)
+	pm.SetErrorPolicy(ErrorPolicySkipEvent)
+	assert.NoError(t, pm.HandleLogs(logs))
+	assert.Equal(t, "2000", pm.Pools[testPool].Liquidity.String())
+	assert.Empty(t, pm.QuarantinedPools())
+	counters = pm.ErrorCounters()
+	assert.Equal(t, uint64(2), counters.Errors)
+	assert.Equal(t, uint64(2), counters.SkippedEvents)
+	assert.Equal(t, map[string]uint64{"Mint": 1, "Swap": 1}, counters.ByEvent)
+
+	// fork 使用 simulator 的 policy
+	fork := NewSimulatorSnapshot(pm)
+	assert.NoError(t, fork.HandleLogs([]types.Log{badMint}))
+	assert.Equal(t, uint64(1), fork.ErrorCounters().SkippedEvents)
+	pm.SetErrorPolicy(ErrorPolicyStrict)
+	assert.ErrorIs(t, fork.HandleLogs([]types.Log{badMint}), ErrTicksMisordered)
+
+	policy, err := ParseErrorPolicy("skip-event")
+	assert.NoError(t, err)
+	assert.Equal(t, ErrorPolicySkipEvent, policy)
+	_, err = ParseErrorPolicy("ignore")
+	assert.Error(t, err)
+}
+
+func TestSimulator_ErrorPolicyPoolSetup(t *testing.T) {
+	// 没有 PoolCreated 和 caller 时无法读取配置, 和 policy 无关, 直接返回, 不隔离 pool
+	logs := []types.Log{testInitializeLog(101), testMintLog(102, -600, 600, 1000)}
+	for _, policy := range []ErrorPolicy{ErrorPolicySkipPool, ErrorPolicyStrict} {
+		pm := openTestSimulator(t, filepath.Join(t.TempDir(), "simulator.db"), nil)
+		pm.SetErrorPolicy(policy)
+		err := pm.HandleLogs(logs)
+		assert.ErrorIs(t, err, ErrPoolConfigUnavailable)
+		var poolErr *PoolError
+		assert.True(t, errors.As(err, &poolErr))
+		assert.Equal(t, uint64(101), poolErr.BlockNum)
+		assert.False(t, pm.IsQuarantined(testPool))
+		assert.Equal(t, uint64(0), pm.ErrorCounters().Errors)
+		assert.ErrorIs(t, NewSimulatorSnapshot(pm).HandleLogs(logs), ErrPoolConfigUnavailable)
+	}
+
+	// 从链上加载的 pool 读取不到 position, 读取错误返回给调用方
+	pm := openTestSimulator(t, filepath.Join(t.TempDir(), "simulator.db"), nil)
+	assert.NoError(t, pm.HandleLogs([]types.Log{testPoolCreatedLog(100), testInitializeLog(101)}))
+	pm.Pools[testPool].BootstrapBlockNum = 101
+	assert.ErrorIs(t, NewSimulatorSnapshot(pm).HandleLogs([]types.Log{testMintLog(102, -600, 600, 1000)}), ErrNoContractCaller)
+	assert.ErrorIs(t, pm.HandleLogs([]types.Log{testMintLog(102, -600, 600, 1000)}), ErrNoContractCaller)
+	assert.False(t, pm.IsQuarantined(testPool))
+	assert.Equal(t, uint64(0), pm.ErrorCounters().Errors)
+}
+
+func TestSimulator_DuplicateInitialize(t *testing.T) {
+	pm := openTestSimulator(t, filepath.Join(t.TempDir(), "simulator.db"), nil)
+	assert.NoError(t, pm.HandleLogs([]types.Log{testPoolCreatedLog(100), testInitializeLog(101), testMintLog(102, -600, 600, 1000)}))
+
+	// 重复的 Initialize 只跳过, 不隔离 pool, 也不修改状态
+	fork := NewSimulatorSnapshot(pm)
+	assert.NoError(t, fork.HandleLogs([]types.Log{testInitializeLog(103), testMintLog(104, -60, 60, 1000)}))
+	assert.False(t, fork.IsQuarantined(testPool))
+	assert.Equal(t, "2000", fork.Pools[testPool].Liquidity.String())
+	assert.NoError(t, pm.HandleLogs([]types.Log{testInitializeLog(103), testMintLog(104, -60, 60, 1000)}))
+	assert.False(t, pm.IsQuarantined(testPool))
+	assert.Equal(t, "2000", pm.Pools[testPool].Liquidity.String())
+	assert.Equal(t, uint64(0), pm.ErrorCounters().Errors)
+
+	pm.SetErrorPolicy(ErrorPolicyStrict)
+	assert.ErrorIs(t, NewSimulatorSnapshot(pm).HandleLogs([]types.Log{testInitializeLog(105)}), ErrPoolExists)
+}
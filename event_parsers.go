@@ -46,6 +46,53 @@ type UniV3BurnEvent struct {
 	Amount0   decimal.Decimal `json:"amount0"`
 	Amount1   decimal.Decimal `json:"amount1"`
 }
+type UniV3CollectEvent struct {
+	RawEvent  *types.Log      `json:"raw_event"`
+	Owner     string          `json:"owner"` // index value
+	Recipient string          `json:"recipient"`
+	TickLower int             `json:"tick_lower"`
+	TickUpper int             `json:"tick_upper"`
+	Amount0   decimal.Decimal `json:"amount0"`
+	Amount1   decimal.Decimal `json:"amount1"`
+}
+type UniV3SetFeeProtocolEvent struct {
+	RawEvent        *types.Log `json:"raw_event"`
+	FeeProtocol0Old uint8      `json:"fee_protocol0_old"`
+	FeeProtocol1Old uint8      `json:"fee_protocol1_old"`
+	FeeProtocol0New uint8      `json:"fee_protocol0_new"`
+	FeeProtocol1New uint8      `json:"fee_protocol1_new"`
+}
+type UniV3CollectProtocolEvent struct {
+	RawEvent  *types.Log      `json:"raw_event"`
+	Sender    string          `json:"sender"`    // index value
+	Recipient string          `json:"recipient"` // index value
+	Amount0   decimal.Decimal `json:"amount0"`
+	Amount1   decimal.Decimal `json:"amount1"`
+}
+type UniV3IncreaseObservationCardinalityNextEvent struct {
+	RawEvent                      *types.Log `json:"raw_event"`
+	ObservationCardinalityNextOld uint16     `json:"observation_cardinality_next_old"`
+	ObservationCardinalityNextNew uint16     `json:"observation_cardinality_next_new"`
+}
+type UniV3FlashEvent struct {
+	RawEvent  *types.Log      `json:"raw_event"`
+	Sender    string          `json:"sender"`    // index value
+	Recipient string          `json:"recipient"` // index value
+	Amount0   decimal.Decimal `json:"amount0"`
+	Amount1   decimal.Decimal `json:"amount1"`
+	Paid0     decimal.Decimal `json:"paid0"`
+	Paid1     decimal.Decimal `json:"paid1"`
+}
+
+// factory 的 PoolCreated 事件
+type UniV3PoolCreatedEvent struct {
+	RawEvent    *types.Log     `json:"raw_event"`
+	Token0      common.Address `json:"token0"` // index value
+	Token1      common.Address `json:"token1"` // index value
+	Fee         FeeAmount      `json:"fee"`    // index value
+	TickSpacing int            `json:"tick_spacing"`
+	Pool        common.Address `json:"pool"`
+}
 
 var (
 	int24, _   = abi.NewType("int24", "", nil)
@@ -182,6 +229,114 @@ func parseUniv3BurnEvent(log *types.Log) (*UniV3BurnEvent, error) {
 	//}
 	return parsed, nil
 }
+func parseUniv3CollectEvent(log *types.Log) (*UniV3CollectEvent, error) {
+	event := log
+	data := event.Data
+	if len(event.Topics) != 4 {
+		return nil, fmt.Errorf("topic not match,expect %d, got %d", 4, len(event.Topics))
+	}
+	if len(data) < 32*3 {
+		return nil, fmt.Errorf("data length not match,expect %d, got %d", 32*3, len(data))
+	}
+	tickLowerRaw, err := abi.ReadInteger(int24, event.Topics[2].Bytes())
+	if err != nil {
+		return nil, err
+	}
+	tickLower, ok := tickLowerRaw.(*big.Int)
+	if !ok {
+		return nil, fmt.Errorf("failed read collect.tick_lower %s, tx: %s", tickLower, event.TxHash)
+	}
+	tickUpperRaw, err := abi.ReadInteger(int24, event.Topics[3].Bytes())
+	if err != nil {
+		return nil, err
+	}
+	tickUpper, ok := tickUpperRaw.(*big.Int)
+	if !ok {
+		return nil, fmt.Errorf("failed read collect.tick_upper %s, tx: %s", tickUpper, event.TxHash)
+	}
+	parsed := &UniV3CollectEvent{
+		RawEvent:  log,
+		Owner:     hash2Addr(event.Topics[1]),
+		Recipient: common.BytesToAddress(data[:32]).Hex(),
+		TickLower: int(tickLower.Int64()),
+		TickUpper: int(tickUpper.Int64()),
+		Amount0:   decimal.NewFromBigInt(big.NewInt(0).SetBytes(data[32*1:32*2]), 0),
+		Amount1:   decimal.NewFromBigInt(big.NewInt(0).SetBytes(data[32*2:32*3]), 0),
+	}
+	return parsed, nil
+}
+func parseUniv3SetFeeProtocolEvent(log *types.Log) (*UniV3SetFeeProtocolEvent, error) {
+	event := log
+	data := event.Data
+	if len(event.Topics) != 1 {
+		return nil, fmt.Errorf("topic not match,expect %d, got %d", 1, len(event.Topics))
+	}
+	if len(data) < 32*4 {
+		return nil, fmt.Errorf("data length not match,expect %d, got %d", 32*4, len(data))
+	}
+	parsed := &UniV3SetFeeProtocolEvent{
+		RawEvent:        log,
+		FeeProtocol0Old: data[32*1-1],
+		FeeProtocol1Old: data[32*2-1],
+		FeeProtocol0New: data[32*3-1],
+		FeeProtocol1New: data[32*4-1],
+	}
+	return parsed, nil
+}
+func parseUniv3CollectProtocolEvent(log *types.Log) (*UniV3CollectProtocolEvent, error) {
+	event := log
+	data := event.Data
+	if len(event.Topics) != 3 {
+		return nil, fmt.Errorf("topic not match,expect %d, got %d", 3, len(event.Topics))
+	}
+	if len(data) < 32*2 {
+		return nil, fmt.Errorf("data length not match,expect %d, got %d", 32*2, len(data))
+	}
+	parsed := &UniV3CollectProtocolEvent{
+		RawEvent:  log,
+		Sender:    hash2Addr(event.Topics[1]),
+		Recipient: hash2Addr(event.Topics[2]),
+		Amount0:   decimal.NewFromBigInt(big.NewInt(0).SetBytes(data[:32]), 0),
+		Amount1:   decimal.NewFromBigInt(big.NewInt(0).SetBytes(data[32*1:32*2]), 0),
+	}
+	return parsed, nil
+}
+func parseUniv3IncreaseObservationCardinalityNextEvent(log *types.Log) (*UniV3IncreaseObservationCardinalityNextEvent, error) {
+	event := log
+	data := event.Data
+	if len(event.Topics) != 1 {
+		return nil, fmt.Errorf("topic not match,expect %d, got %d", 1, len(event.Topics))
+	}
+	if len(data) < 32*2 {
+		return nil, fmt.Errorf("data length not match,expect %d, got %d", 32*2, len(data))
+	}
+	parsed := &UniV3IncreaseObservationCardinalityNextEvent{
+		RawEvent:                      log,
+		ObservationCardinalityNextOld: uint16(big.NewInt(0).SetBytes(data[:32]).Uint64()),
+		ObservationCardinalityNextNew: uint16(big.NewInt(0).SetBytes(data[32*1 : 32*2]).Uint64()),
+	}
+	return parsed, nil
+}
+func parseUniv3FlashEvent(log *types.Log) (*UniV3FlashEvent, error) {
+	event := log
+	data := event.Data
+	if len(event.Topics) != 3 {
+		return nil, fmt.Errorf("topic not match,expect %d, got %d", 3, len(event.Topics))
+	}
+	if len(data) < 32*4 {
+		return nil, fmt.Errorf("data length not match,expect %d, got %d", 32*4, len(data))
+	}
+	parsed := &UniV3FlashEvent{
+		RawEvent:  log,
+		Sender:    hash2Addr(event.Topics[1]),
+		Recipient: hash2Addr(event.Topics[2]),
+		Amount0:   decimal.NewFromBigInt(big.NewInt(0).SetBytes(data[:32]), 0),
+		Amount1:   decimal.NewFromBigInt(big.NewInt(0).SetBytes(data[32*1:32*2]), 0),
+		Paid0:     decimal.NewFromBigInt(big.NewInt(0).SetBytes(data[32*2:32*3]), 0),
+		Paid1:     decimal.NewFromBigInt(big.NewInt(0).SetBytes(data[32*3:32*4]), 0),
+	}
+	return parsed, nil
+}
 func parseUniv3InitializeEvent(log *types.Log) (*UniV3InitializeEvent, error) {
 	event := log
 	data := event.Data
@@ -194,6 +349,33 @@ func parseUniv3InitializeEvent(log *types.Log) (*UniV3InitializeEvent, error) {
 	}
 	return parsed, nil
 }
+func parseUniv3PoolCreatedEvent(log *types.Log) (*UniV3PoolCreatedEvent, error) {
+	event := log
+	data := event.Data
+	if len(event.Topics) != 4 {
+		return nil, fmt.Errorf("topic not match,expect %d, got %d", 4, len(event.Topics))
+	}
+	if len(data) < 32*2 {
+		return nil, fmt.Errorf("data length not match,expect %d, got %d", 32*2, len(data))
+	}
+	tickSpacingRaw, err := abi.ReadInteger(int24, data[:32])
+	if err != nil {
+		return nil, err
+	}
+	tickSpacing, ok := tickSpacingRaw.(*big.Int)
+	if !ok {
+		return nil, fmt.Errorf("failed read pool_created.tick_spacing %s, tx: %s", tickSpacing, event.TxHash)
+	}
+	parsed := &UniV3PoolCreatedEvent{
+		RawEvent:    log,
+		Token0:      common.BytesToAddress(event.Topics[1][12:]),
+		Token1:      common.BytesToAddress(event.Topics[2][12:]),
+		Fee:         FeeAmount(big.NewInt(0).SetBytes(event.Topics[3].Bytes()).Int64()),
+		TickSpacing: int(tickSpacing.Int64()),
+		Pool:        common.BytesToAddress(data[32*1 : 32*2]),
+	}
+	return parsed, nil
+}
 func hash2Addr(hs common.Hash) string {
 	return strings.ToLower(common.BytesToAddress(hs[12:]).Hex())
 
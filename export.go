@@ -0,0 +1,422 @@
+package uniswap_v3_simulator
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/shopspring/decimal"
+)
+
+// 导出文件格式:
+//
+//	poolExportMagic | rlp(poolExportFile)
+//
+// poolExportFile.Pools 为 rlp([]poolExportEntry) 压缩后的数据, 每个 pool 单独计算 checksum.
+// 新版本只在结构体末尾增加 `rlp:"optional"` 字段, 旧版本的文件可以直接解码
+const (
+	PoolExportVersion = 1
+
+	poolExportNoCompression   = 0
+	poolExportGzipCompression = 1
+)
+
+var (
+	poolExportMagic = []byte("UV3POOLS")
+
+	ErrCorruptExport            = errors.New("corrupt pool export")
+	ErrUnsupportedExportVersion = errors.New("unsupported pool export version")
+)
+
+// PoolExport 导出文件的内容, Pools 与数据库无关, 可以直接使用或写入其他 Simulator
+type PoolExport struct {
+	Version  uint
+	BlockNum uint64
+	Pools    []*CorePool
+}
+
+type poolExportFile struct {
+	Version     uint
+	BlockNum    uint64
+	Compression uint
+	Pools       []byte
+}
+
+type poolExportEntry struct {
+	Address  string
+	Checksum common.Hash
+	// rlp(exportedPool)
+	Data []byte
+}
+
+// rlp 不支持负数, 有符号整数使用 zigzag 编码, decimal 使用 exportedInt
+type exportedInt struct {
+	Neg bool
+	Abs *big.Int
+}
+
+func newExportedInt(d decimal.Decimal) (exportedInt, error) {
+	i := d.BigInt()
+	if !decimal.NewFromBigInt(i, 0).Equal(d) {
+		return exportedInt{}, fmt.Errorf("non-integer value %s", d)
+	}
+	return exportedInt{Neg: i.Sign() < 0, Abs: i.Abs(i)}, nil
+}
+
+func (i exportedInt) Decimal() decimal.Decimal {
+	v := new(big.Int).Set(i.Abs)
+	if i.Neg {
+		v.Neg(v)
+	}
+	return decimal.NewFromBigInt(v, 0)
+}
+
+func zigzag(v int64) uint64 {
+	return uint64(v<<1) ^ uint64(v>>63)
+}
+
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+type exportedPool struct {
+	PoolAddress                string
+	Token0                     string
+	Token1                     string
+	Fee                        uint64
+	TickSpacing                uint64
+	MaxLiquidityPerTick        exportedInt
+	CurrentBlockNum            uint64
+	CurrentBlockTimestamp      uint64
+	DeployBlockNum             uint64
+	BootstrapBlockNum          uint64
+	Token0Balance              exportedInt
+	Token1Balance              exportedInt
+	SqrtPriceX96               exportedInt
+	Liquidity                  exportedInt
+	TickCurrent                uint64
+	FeeGrowthGlobal0X128       exportedInt
+	FeeGrowthGlobal1X128       exportedInt
+	FeeProtocol                uint8
+	ProtocolFeesToken0         exportedInt
+	ProtocolFeesToken1         exportedInt
+	ObservationIndex           uint16
+	ObservationCardinality     uint16
+	ObservationCardinalityNext uint16
+	Observations               []exportedObservation
+	Ticks                      []exportedTick
+	Positions                  []exportedPosition
+}
+
+type exportedObservation struct {
+	BlockTimestamp                    uint32
+	TickCumulative                    uint64
+	SecondsPerLiquidityCumulativeX128 exportedInt
+	Initialized                       bool
+}
+
+type exportedTick struct {
+	TickIndex                      uint64
+	LiquidityGross                 exportedInt
+	LiquidityNet                   exportedInt
+	FeeGrowthOutside0X128          exportedInt
+	FeeGrowthOutside1X128          exportedInt
+	TickCumulativeOutside          uint64
+	SecondsPerLiquidityOutsideX128 exportedInt
+	SecondsOutside                 uint32
+}
+
+type exportedPosition struct {
+	Owner                    string
+	TickLower                uint64
+	TickUpper                uint64
+	Liquidity                exportedInt
+	FeeGrowthInside0LastX128 exportedInt
+	FeeGrowthInside1LastX128 exportedInt
+	TokensOwed0              exportedInt
+	TokensOwed1              exportedInt
+}
+
+// 依次转换 decimal, 出现错误后不再转换
+type exportedIntEncoder struct {
+	err error
+}
+
+func (e *exportedIntEncoder) int(d decimal.Decimal) exportedInt {
+	if e.err != nil {
+		return exportedInt{}
+	}
+	i, err := newExportedInt(d)
+	if err != nil {
+		e.err = err
+	}
+	return i
+}
+
+func newExportedPool(p *CorePool) (*exportedPool, error) {
+	e := &exportedIntEncoder{}
+	pool := &exportedPool{
+		PoolAddress:                p.PoolAddress,
+		Token0:                     p.Token0,
+		Token1:                     p.Token1,
+		Fee:                        uint64(p.Fee),
+		TickSpacing:                zigzag(int64(p.TickSpacing)),
+		MaxLiquidityPerTick:        e.int(p.MaxLiquidityPerTick),
+		CurrentBlockNum:            p.CurrentBlockNum,
+		CurrentBlockTimestamp:      p.CurrentBlockTimestamp,
+		DeployBlockNum:             p.DeployBlockNum,
+		BootstrapBlockNum:          p.BootstrapBlockNum,
+		Token0Balance:              e.int(p.Token0Balance),
+		Token1Balance:              e.int(p.Token1Balance),
+		SqrtPriceX96:               e.int(p.SqrtPriceX96),
+		Liquidity:                  e.int(p.Liquidity),
+		TickCurrent:                zigzag(int64(p.TickCurrent)),
+		FeeGrowthGlobal0X128:       e.int(p.FeeGrowthGlobal0X128),
+		FeeGrowthGlobal1X128:       e.int(p.FeeGrowthGlobal1X128),
+		FeeProtocol:                p.FeeProtocol,
+		ProtocolFeesToken0:         e.int(p.ProtocolFeesToken0),
+		ProtocolFeesToken1:         e.int(p.ProtocolFeesToken1),
+		ObservationIndex:           p.ObservationIndex,
+		ObservationCardinality:     p.ObservationCardinality,
+		ObservationCardinalityNext: p.ObservationCardinalityNext,
+	}
+	if p.Observations != nil {
+		for _, o := range p.Observations.Observations {
+			pool.Observations = append(pool.Observations, exportedObservation{
+				BlockTimestamp:                    o.BlockTimestamp,
+				TickCumulative:                    zigzag(o.TickCumulative),
+				SecondsPerLiquidityCumulativeX128: e.int(o.SecondsPerLiquidityCumulativeX128),
+				Initialized:                       o.Initialized,
+			})
+		}
+	}
+	// 按 tick, position key 排序, 相同的状态导出相同的数据
+	for _, tick := range p.TickManager.GetSortedTicks() {
+		pool.Ticks = append(pool.Ticks, exportedTick{
+			TickIndex:                      zigzag(int64(tick.TickIndex)),
+			LiquidityGross:                 e.int(tick.LiquidityGross),
+			LiquidityNet:                   e.int(tick.LiquidityNet),
+			FeeGrowthOutside0X128:          e.int(tick.FeeGrowthOutside0X128),
+			FeeGrowthOutside1X128:          e.int(tick.FeeGrowthOutside1X128),
+			TickCumulativeOutside:          zigzag(tick.TickCumulativeOutside),
+			SecondsPerLiquidityOutsideX128: e.int(tick.SecondsPerLiquidityOutsideX128),
+			SecondsOutside:                 tick.SecondsOutside,
+		})
+	}
+	keys := make([]string, 0, len(p.PositionManager.Positions))
+	for key := range p.PositionManager.Positions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		owner, tickLower, tickUpper, ok := parsePositionKey(key)
+		if !ok {
+			return nil, fmt.Errorf("invalid position key %s in pool %s", key, p.PoolAddress)
+		}
+		position := p.PositionManager.Positions[key]
+		pool.Positions = append(pool.Positions, exportedPosition{
+			Owner:                    owner,
+			TickLower:                zigzag(int64(tickLower)),
+			TickUpper:                zigzag(int64(tickUpper)),
+			Liquidity:                e.int(position.Liquidity),
+			FeeGrowthInside0LastX128: e.int(position.FeeGrowthInside0LastX128),
+			FeeGrowthInside1LastX128: e.int(position.FeeGrowthInside1LastX128),
+			TokensOwed0:              e.int(position.TokensOwed0),
+			TokensOwed1:              e.int(position.TokensOwed1),
+		})
+	}
+	if e.err != nil {
+		return nil, fmt.Errorf("pool %s: %w", p.PoolAddress, e.err)
+	}
+	return pool, nil
+}
+
+// Pool 新的 pool, 写入数据库时创建
+func (p *exportedPool) Pool() *CorePool {
+	pool := &CorePool{
+		PoolAddress:                p.PoolAddress,
+		Token0:                     p.Token0,
+		Token1:                     p.Token1,
+		Fee:                        FeeAmount(p.Fee),
+		TickSpacing:                int(unzigzag(p.TickSpacing)),
+		MaxLiquidityPerTick:        p.MaxLiquidityPerTick.Decimal(),
+		CurrentBlockNum:            p.CurrentBlockNum,
+		CurrentBlockTimestamp:      p.CurrentBlockTimestamp,
+		DeployBlockNum:             p.DeployBlockNum,
+		BootstrapBlockNum:          p.BootstrapBlockNum,
+		Token0Balance:              p.Token0Balance.Decimal(),
+		Token1Balance:              p.Token1Balance.Decimal(),
+		SqrtPriceX96:               p.SqrtPriceX96.Decimal(),
+		Liquidity:                  p.Liquidity.Decimal(),
+		TickCurrent:                int(unzigzag(p.TickCurrent)),
+		FeeGrowthGlobal0X128:       p.FeeGrowthGlobal0X128.Decimal(),
+		FeeGrowthGlobal1X128:       p.FeeGrowthGlobal1X128.Decimal(),
+		FeeProtocol:                p.FeeProtocol,
+		ProtocolFeesToken0:         p.ProtocolFeesToken0.Decimal(),
+		ProtocolFeesToken1:         p.ProtocolFeesToken1.Decimal(),
+		ObservationIndex:           p.ObservationIndex,
+		ObservationCardinality:     p.ObservationCardinality,
+		ObservationCardinalityNext: p.ObservationCardinalityNext,
+		Observations:               NewOracle(),
+		TickManager:                NewTickManager(),
+		PositionManager:            NewPositionManager(),
+	}
+	for _, o := range p.Observations {
+		pool.Observations.Observations = append(pool.Observations.Observations, &Observation{
+			BlockTimestamp:                    o.BlockTimestamp,
+			TickCumulative:                    unzigzag(o.TickCumulative),
+			SecondsPerLiquidityCumulativeX128: o.SecondsPerLiquidityCumulativeX128.Decimal(),
+			Initialized:                       o.Initialized,
+		})
+	}
+	for _, t := range p.Ticks {
+		index := int(unzigzag(t.TickIndex))
+		pool.TickManager.Ticks[index] = &Tick{
+			TickIndex:                      index,
+			LiquidityGross:                 t.LiquidityGross.Decimal(),
+			LiquidityNet:                   t.LiquidityNet.Decimal(),
+			FeeGrowthOutside0X128:          t.FeeGrowthOutside0X128.Decimal(),
+			FeeGrowthOutside1X128:          t.FeeGrowthOutside1X128.Decimal(),
+			TickCumulativeOutside:          unzigzag(t.TickCumulativeOutside),
+			SecondsPerLiquidityOutsideX128: t.SecondsPerLiquidityOutsideX128.Decimal(),
+			SecondsOutside:                 t.SecondsOutside,
+		}
+	}
+	for _, position := range p.Positions {
+		key := GetPositionKey(position.Owner, int(unzigzag(position.TickLower)), int(unzigzag(position.TickUpper)))
+		pool.PositionManager.Positions[key] = &Position{
+			Liquidity:                position.Liquidity.Decimal(),
+			FeeGrowthInside0LastX128: position.FeeGrowthInside0LastX128.Decimal(),
+			FeeGrowthInside1LastX128: position.FeeGrowthInside1LastX128.Decimal(),
+			TokensOwed0:              position.TokensOwed0.Decimal(),
+			TokensOwed1:              position.TokensOwed1.Decimal(),
+		}
+	}
+	return pool
+}
+
+// ExportPools 把 pools 在 blockNum 的状态写入 w, gzip 压缩
+func ExportPools(w io.Writer, blockNum uint64, pools []*CorePool) error {
+	entries := make([]poolExportEntry, 0, len(pools))
+	for _, p := range pools {
+		pool, err := newExportedPool(p)
+		if err != nil {
+			return err
+		}
+		data, err := rlp.EncodeToBytes(pool)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, poolExportEntry{
+			Address:  p.PoolAddress,
+			Checksum: crypto.Keccak256Hash(data),
+			Data:     data,
+		})
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	err := rlp.Encode(gz, entries)
+	if err != nil {
+		return err
+	}
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(poolExportMagic)
+	if err != nil {
+		return err
+	}
+	return rlp.Encode(w, &poolExportFile{
+		Version:     PoolExportVersion,
+		BlockNum:    blockNum,
+		Compression: poolExportGzipCompression,
+		Pools:       compressed.Bytes(),
+	})
+}
+
+// ImportPools 读取 ExportPools 写入的数据, 兼容之前版本的格式
+func ImportPools(r io.Reader) (*PoolExport, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(poolExportMagic))
+	_, err := io.ReadFull(br, magic)
+	if err != nil || !bytes.Equal(magic, poolExportMagic) {
+		return nil, fmt.Errorf("%w: invalid magic", ErrCorruptExport)
+	}
+	var file poolExportFile
+	err = rlp.Decode(br, &file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCorruptExport, err)
+	}
+	if file.Version == 0 || file.Version > PoolExportVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedExportVersion, file.Version)
+	}
+	var data io.Reader
+	switch file.Compression {
+	case poolExportNoCompression:
+		data = bytes.NewReader(file.Pools)
+	case poolExportGzipCompression:
+		gz, err := gzip.NewReader(bytes.NewReader(file.Pools))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrCorruptExport, err)
+		}
+		defer gz.Close()
+		data = gz
+	default:
+		return nil, fmt.Errorf("%w: compression %d", ErrCorruptExport, file.Compression)
+	}
+	var entries []poolExportEntry
+	err = rlp.Decode(data, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCorruptExport, err)
+	}
+	export := &PoolExport{Version: file.Version, BlockNum: file.BlockNum}
+	for _, entry := range entries {
+		if crypto.Keccak256Hash(entry.Data) != entry.Checksum {
+			return nil, fmt.Errorf("%w: checksum mismatch for pool %s", ErrCorruptExport, entry.Address)
+		}
+		var pool exportedPool
+		err = rlp.DecodeBytes(entry.Data, &pool)
+		if err != nil {
+			return nil, fmt.Errorf("%w: pool %s: %s", ErrCorruptExport, entry.Address, err)
+		}
+		export.Pools = append(export.Pools, pool.Pool())
+	}
+	return export, nil
+}
+
+// ExportPools 导出当前状态, addresses 为空时导出所有 pool
+func (pm *Simulator) ExportPools(w io.Writer, addresses ...common.Address) error {
+	// 复制后释放锁, 写入期间不阻塞同步
+	pm.lock.Lock()
+	var pools []*CorePool
+	if len(addresses) == 0 {
+		for _, pool := range pm.Pools {
+			pools = append(pools, pool.Clone())
+		}
+	}
+	for _, address := range addresses {
+		pool, ok := pm.Pools[address]
+		if !ok {
+			pm.lock.Unlock()
+			return fmt.Errorf("%w %s", ErrPoolNotExists, address)
+		}
+		pools = append(pools, pool.Clone())
+	}
+	blockNum := pm.currentBlock
+	pm.lock.Unlock()
+	if len(addresses) == 0 {
+		sort.Slice(pools, func(i, j int) bool {
+			return pools[i].PoolAddress < pools[j].PoolAddress
+		})
+	}
+	return ExportPools(w, blockNum, pools)
+}
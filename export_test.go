@@ -0,0 +1,145 @@
+package uniswap_v3_simulator
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+// 固定的 pool 状态, 与 testdata 中的文件对应, 修改后需要 -update 重新生成
+func testExportPool(t *testing.T) *CorePool {
+	pm := openTestSimulator(t, filepath.Join(t.TempDir(), "simulator.db"), nil)
+	assert.NoError(t, pm.HandleLogs([]types.Log{
+		testPoolCreatedLog(100),
+		testInitializeLog(101),
+		testMintLog(102, -600, 600, 1000000),
+		testMintLog(103, -60, 60, 1000),
+		testBurnLog(104, -60, 60, 400),
+	}))
+	pool := pm.Pools[testPool]
+	large, _ := decimal.NewFromString("1606938044258990275541962092341162602522202993782792835301376") // 2^200
+	pool.FeeGrowthGlobal0X128 = large
+	pool.ProtocolFeesToken1 = decimal.NewFromInt(7)
+	pool.TickManager.Ticks[-60].FeeGrowthOutside1X128 = large
+	pool.TickManager.Ticks[-60].TickCumulativeOutside = -123456
+	return pool
+}
+
+func assertExportedPoolEqual(t *testing.T, expected, actual *CorePool) {
+	e := expected.Clone()
+	e.Model = actual.Model
+	e.HasCreated = actual.HasCreated
+	a, err := json.Marshal(actual)
+	assert.NoError(t, err)
+	b, err := json.Marshal(e)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(b), string(a))
+	assertPoolStateEqual(t, expected, actual)
+	for index := range expected.TickManager.Ticks {
+		next, initialized, err := actual.TickManager.GetNextInitializedTick(index, actual.TickSpacing, true)
+		assert.NoError(t, err)
+		assert.Equal(t, index, next)
+		assert.True(t, initialized)
+	}
+}
+
+func TestExportPools(t *testing.T) {
+	pool := testExportPool(t)
+	var buf bytes.Buffer
+	assert.NoError(t, ExportPools(&buf, 104, []*CorePool{pool}))
+
+	export, err := ImportPools(bytes.NewReader(buf.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, uint(PoolExportVersion), export.Version)
+	assert.Equal(t, uint64(104), export.BlockNum)
+	assert.Len(t, export.Pools, 1)
+	imported := export.Pools[0]
+	assertExportedPoolEqual(t, pool, imported)
+	assert.False(t, imported.HasCreated)
+	assert.Equal(t, "-1000000", imported.TickManager.Ticks[600].LiquidityNet.String())
+
+	// 导入的 pool 可以继续处理事件
+	_, _, err = imported.Mint(testOwner.String(), -600, 600, decimal.NewFromInt(1))
+	assert.NoError(t, err)
+
+	// 相同的状态导出相同的数据
+	var again bytes.Buffer
+	assert.NoError(t, ExportPools(&again, 104, []*CorePool{pool}))
+	assert.Equal(t, buf.Bytes(), again.Bytes())
+}
+
+func TestImportPools_Corrupt(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, ExportPools(&buf, 104, []*CorePool{testExportPool(t)}))
+	data := buf.Bytes()
+
+	_, err := ImportPools(bytes.NewReader(data[1:]))
+	assert.ErrorIs(t, err, ErrCorruptExport)
+	_, err = ImportPools(bytes.NewReader(data[:len(data)-10]))
+	assert.ErrorIs(t, err, ErrCorruptExport)
+
+	// 修改 pool 数据, checksum 不匹配
+	var file poolExportFile
+	assert.NoError(t, rlp.DecodeBytes(data[len(poolExportMagic):], &file))
+	var entries []poolExportEntry
+	file.Compression = poolExportNoCompression
+	entries = append(entries, poolExportEntry{Address: testPool.String(), Data: []byte{0xc0}})
+	file.Pools, _ = rlp.EncodeToBytes(entries)
+	_, err = ImportPools(bytes.NewReader(encodeTestExport(t, &file)))
+	assert.ErrorIs(t, err, ErrCorruptExport)
+
+	file.Version = PoolExportVersion + 1
+	_, err = ImportPools(bytes.NewReader(encodeTestExport(t, &file)))
+	assert.ErrorIs(t, err, ErrUnsupportedExportVersion)
+}
+
+func encodeTestExport(t *testing.T, file *poolExportFile) []byte {
+	data, err := rlp.EncodeToBytes(file)
+	assert.NoError(t, err)
+	return append(append([]byte{}, poolExportMagic...), data...)
+}
+
+// 之前版本导出的文件仍然可以导入, 得到相同的状态
+func TestImportPools_Golden(t *testing.T) {
+	pool := testExportPool(t)
+	golden := filepath.Join("testdata", "pools_v1.export")
+	if *updateGolden && PoolExportVersion == 1 {
+		var buf bytes.Buffer
+		assert.NoError(t, ExportPools(&buf, 104, []*CorePool{pool}))
+		assert.NoError(t, os.WriteFile(golden, buf.Bytes(), 0644))
+	}
+	f, err := os.Open(golden)
+	assert.NoError(t, err)
+	defer f.Close()
+	export, err := ImportPools(f)
+	assert.NoError(t, err)
+	assert.Equal(t, uint(1), export.Version)
+	assert.Equal(t, uint64(104), export.BlockNum)
+	assert.Len(t, export.Pools, 1)
+	assertExportedPoolEqual(t, pool, export.Pools[0])
+}
+
+func TestSimulator_ExportPools(t *testing.T) {
+	pm := openTestSimulator(t, filepath.Join(t.TempDir(), "simulator.db"), nil)
+	assert.NoError(t, pm.HandleLogs([]types.Log{testPoolCreatedLog(100), testInitializeLog(101), testMintLog(102, -600, 600, 1000000)}))
+	pm.currentBlock = 102
+	var buf bytes.Buffer
+	assert.NoError(t, pm.ExportPools(&buf))
+	export, err := ImportPools(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(102), export.BlockNum)
+	assert.Len(t, export.Pools, 1)
+	assertExportedPoolEqual(t, pm.Pools[testPool], export.Pools[0])
+
+	assert.ErrorIs(t, pm.ExportPools(&buf, testFactory), ErrPoolNotExists)
+}
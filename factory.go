@@ -0,0 +1,54 @@
+package uniswap_v3_simulator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var (
+	UNISWAP_V3_FACTORY  = common.HexToAddress("0x1F98431c8aD98523631AE4a59f267346ea31F984")
+	POOL_INIT_CODE_HASH = common.HexToHash("0xe34f199b19b2b4f47f68442619d555527d244f78a3297ea89325f843f87b8b54")
+	ErrNotFactoryPool   = errors.New("not a factory pool")
+)
+
+// ComputePoolAddress 与 PoolAddress.computeAddress 相同, CREATE2(factory, keccak256(abi.encode(token0, token1, fee)), initCodeHash)
+func ComputePoolAddress(factory common.Address, initCodeHash common.Hash, token0, token1 common.Address, fee FeeAmount) common.Address {
+	salt := make([]byte, 0, 96)
+	salt = append(salt, common.LeftPadBytes(token0.Bytes(), 32)...)
+	salt = append(salt, common.LeftPadBytes(token1.Bytes(), 32)...)
+	salt = append(salt, math.U256Bytes(big.NewInt(int64(fee)))...)
+	return crypto.CreateAddress2(factory, crypto.Keccak256Hash(salt), initCodeHash.Bytes())
+}
+
+// SetFactory 设置 factory 和 pool 的 init code hash, 只有 factory 部署的 pool 才会被跟踪, 用于其他链或 fork 的部署
+func (pm *Simulator) SetFactory(factory common.Address, initCodeHash common.Hash) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.factory = factory
+	pm.initCodeHash = initCodeHash
+}
+
+// 初始化 pool 时读取配置 reverted (包括带 reason 的 "execution reverted: ...") 或者不是 factory 部署的,
+// 发出 Initialize 事件的是不规范合约, simulator 和 fork 都忽略
+func isNotPoolError(err error) bool {
+	return errors.Is(err, ErrNotFactoryPool) || strings.Contains(err.Error(), "reverted")
+}
+
+// 检查从合约读取的配置是否对应 factory 部署的地址, 任何合约都可以发出 Initialize 事件
+func checkFactoryPool(factory common.Address, initCodeHash common.Hash, address common.Address, config *PoolConfig) error {
+	if bytes.Compare(config.Token0.Bytes(), config.Token1.Bytes()) >= 0 {
+		return fmt.Errorf("%w: %s, token0 %s, token1 %s", ErrNotFactoryPool, address, config.Token0, config.Token1)
+	}
+	computed := ComputePoolAddress(factory, initCodeHash, config.Token0, config.Token1, config.Fee)
+	if computed != address {
+		return fmt.Errorf("%w: %s, expect %s", ErrNotFactoryPool, address, computed)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package uniswap_v3_simulator
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputePoolAddress(t *testing.T) {
+	// USDC/WETH 0.05%
+	usdc := common.HexToAddress("0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48")
+	weth := common.HexToAddress("0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2")
+	assert.Equal(t, common.HexToAddress("0x88e6A0c2dDD26FEEb64F039a2c41296FcB3f5640"), ComputePoolAddress(UNISWAP_V3_FACTORY, POOL_INIT_CODE_HASH, usdc, weth, FeeAmount(500)))
+}
+
+func TestSimulator_RejectSpoofedPool(t *testing.T) {
+	pm := newTestSimulator(t)
+	pm.caller = newMockPoolCaller(t)
+	pm.InitializeID = TOPIC_INITIALIZE
+
+	// 不是 factory 部署的合约发出的 Initialize 被忽略
+	spoofed := testInitializeLog(100)
+	assert.NoError(t, pm.HandleLogs([]types.Log{spoofed}))
+	assert.Empty(t, pm.Pools)
+
+	// 其他地址发出的 PoolCreated 也不能注册 pool
+	created := testPoolCreatedLog(100)
+	created.Address = common.HexToAddress("0xbad")
+	assert.NoError(t, pm.HandleLogs([]types.Log{created, spoofed}))
+	assert.Empty(t, pm.Pools)
+
+	// 链上读取的配置与 CREATE2 地址一致
+	genuine := testInitializeLog(101)
+	genuine.Address = ComputePoolAddress(UNISWAP_V3_FACTORY, POOL_INIT_CODE_HASH, common.HexToAddress("0x10"), common.HexToAddress("0x20"), FeeAmount(3000))
+	assert.NoError(t, pm.HandleLogs([]types.Log{genuine}))
+	assert.Contains(t, pm.Pools, genuine.Address)
+
+	// factory 的 PoolCreated 事件
+	assert.NoError(t, pm.HandleLogs([]types.Log{testPoolCreatedLog(102), testInitializeLog(103)}))
+	assert.Contains(t, pm.Pools, testPool)
+}
+
+// fork 从链上读取配置时不注册到 simulator, 也检查 factory 地址
+func TestSimulatorFork_PoolConfigReadOnly(t *testing.T) {
+	pm := newTestSimulator(t)
+	pm.caller = newMockPoolCaller(t)
+	pm.InitializeID = TOPIC_INITIALIZE
+
+	fork := NewSimulatorSnapshot(pm)
+	assert.NoError(t, fork.HandleLogs([]types.Log{testInitializeLog(100)}))
+	assert.Empty(t, fork.Pools)
+
+	genuine := testInitializeLog(101)
+	genuine.Address = ComputePoolAddress(UNISWAP_V3_FACTORY, POOL_INIT_CODE_HASH, common.HexToAddress("0x10"), common.HexToAddress("0x20"), FeeAmount(3000))
+	assert.NoError(t, fork.HandleLogs([]types.Log{genuine}))
+	assert.Contains(t, fork.Pools, genuine.Address)
+	_, ok := pm.RegisteredPool(genuine.Address)
+	assert.False(t, ok)
+	assert.Empty(t, pm.newRegistered)
+	assert.Empty(t, pm.Pools)
+}
+
+// simulator 和 fork 使用相同的判断, 带 reason 的 revert 也忽略
+func TestIsNotPoolError(t *testing.T) {
+	assert.True(t, isNotPoolError(errors.New("execution reverted")))
+	assert.True(t, isNotPoolError(errors.New("execution reverted: not a pool")))
+	assert.True(t, isNotPoolError(fmt.Errorf("%w: %s", ErrNotFactoryPool, testPool)))
+	assert.False(t, isNotPoolError(errors.New("connection refused")))
+}
@@ -0,0 +1,71 @@
+package uniswap_v3_simulator
+
+import (
+	"math/big"
+
+	"github.com/shopspring/decimal"
+)
+
+// 合约使用 solidity 0.7.6, 除了 LowGasSafeMath, SafeCast 和 LiquidityMath 之外的算术运算不检查溢出.
+// fee growth, tick 的 outside 值, tokensOwed 和 protocolFees 都依赖溢出回绕, 以下函数把结果截断到对应的定宽整数;
+// SafeCast 和 TickMath 检查的宽度 (liquidityDelta 和 liquidityNet 为 int128, tick 为 int24) 超出范围时返回错误.
+// swap 使用 u256_math.go 中的 uint256 计算, int256 为补码, sqrtPriceX96 超过 uint160 时返回 OVERFLOW
+var (
+	two128 = new(big.Int).Lsh(big.NewInt(1), 128)
+	two160 = new(big.Int).Lsh(big.NewInt(1), 160)
+	two256 = new(big.Int).Lsh(big.NewInt(1), 256)
+)
+
+// 无符号回绕到 [0, m)
+func wrapUnsigned(x, m *big.Int) *big.Int {
+	return new(big.Int).Mod(x, m)
+}
+
+func WrapUint256(x decimal.Decimal) decimal.Decimal {
+	return decimal.NewFromBigInt(wrapUnsigned(x.BigInt(), two256), 0)
+}
+
+func WrapUint128(x decimal.Decimal) decimal.Decimal {
+	return decimal.NewFromBigInt(wrapUnsigned(x.BigInt(), two128), 0)
+}
+
+// int56 溢出回绕, tickCumulative 和 tickCumulativeOutside 为 int56
+func wrapInt56(x int64) int64 {
+	return x << 8 >> 8
+}
+
+// a + b, uint256 溢出回绕
+func AddUint256(a, b decimal.Decimal) decimal.Decimal {
+	return WrapUint256(a.Add(b))
+}
+
+// a - b, uint256 溢出回绕
+func SubUint256(a, b decimal.Decimal) decimal.Decimal {
+	return WrapUint256(a.Sub(b))
+}
+
+// a + b, uint128 溢出回绕
+func AddUint128(a, b decimal.Decimal) decimal.Decimal {
+	return WrapUint128(a.Add(b))
+}
+
+// uint160 溢出回绕, secondsPerLiquidityCumulativeX128 和 secondsPerLiquidityOutsideX128 为 uint160
+func wrapUint160(x *big.Int) decimal.Decimal {
+	return decimal.NewFromBigInt(wrapUnsigned(x, two160), 0)
+}
+
+// SafeCast.toInt128, 超出 int128 时合约 revert
+func ToInt128(x decimal.Decimal) (decimal.Decimal, error) {
+	if x.GreaterThan(MaxInt128) {
+		return ZERO, OVERFLOW
+	}
+	if x.LessThan(MinInt128) {
+		return ZERO, UNDERFLOW
+	}
+	return x, nil
+}
+
+// tick 为 int24, TickMath 只接受 [MIN_TICK, MAX_TICK]
+func isValidTick(tick int) bool {
+	return tick >= MIN_TICK && tick <= MAX_TICK
+}
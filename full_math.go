@@ -18,12 +18,7 @@ func MulDivRoundingUp(a, b, denominator decimal.Decimal) (decimal.Decimal, error
 	return result, nil
 }
 
-func Mod256Sub(a, b decimal.Decimal) (decimal.Decimal, error) {
-	if !a.GreaterThanOrEqual(ZERO) || !b.GreaterThanOrEqual(ZERO) || !a.LessThanOrEqual(MaxUint256) || !b.LessThanOrEqual(MaxUint256) {
-		return ZERO, OVERFLOW
-	}
-	two256 := decimal.NewFromInt(2).Pow(decimal.NewFromInt(256))
-	tmp1 := a.Add(two256).Sub(b).BigInt()
-	tmp1 = tmp1.Rem(tmp1, two256.BigInt())
-	return decimal.NewFromBigInt(tmp1, 0), nil
+// Mod256Sub a - b, uint256 溢出回绕. 负数按补码处理, 同 SubUint256
+func Mod256Sub(a, b decimal.Decimal) decimal.Decimal {
+	return SubUint256(a, b)
 }
@@ -7,8 +7,11 @@ require github.com/daoleno/uniswapv3-sdk v0.4.0
 require (
 	github.com/ethereum/go-ethereum v1.11.6
 	github.com/glebarez/sqlite v1.5.0
+	github.com/holiman/uint256 v1.2.2-0.20230321075855-87b91420868c
 	github.com/shopspring/decimal v1.3.1
 	github.com/sirupsen/logrus v1.9.0
 	github.com/stretchr/testify v1.8.0
+	github.com/syndtr/goleveldb v1.0.1-0.20220614013038-64ee5596c38a
+	gorm.io/driver/postgres v1.4.4
 	gorm.io/gorm v1.24.0
 )
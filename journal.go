@@ -0,0 +1,274 @@
+package uniswap_v3_simulator
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrReorgTooDeep      = errors.New("reorg deeper than confirmation depth")
+	ErrBlockNotInJournal = errors.New("block not in journal")
+)
+
+// 未确认区块的日志, 记录区块内每个 pool 第一次修改前的状态, 用于链重组时回滚
+type journalEntry struct {
+	BlockNum   uint64
+	BlockHash  common.Hash
+	ParentHash common.Hash // 通过 header 记录时才有
+	// nil 表示 pool 在该区块内创建
+	pools map[common.Address]*CorePool
+	// 该区块内隔离和注册的 pool, 回滚时撤销
+	quarantined []common.Address
+	registered  []common.Address
+}
+
+// SetConfirmationDepth 设置确认深度, 距离链头 depth 个区块以内的修改会被记录, 可以在重组时回滚.
+// depth 为 0 时关闭 journal
+func (pm *Simulator) SetConfirmationDepth(depth uint64) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.confirmations = depth
+	if depth == 0 {
+		pm.journal = nil
+	} else {
+		pm.pruneJournal()
+	}
+}
+
+func (pm *Simulator) ConfirmationDepth() uint64 {
+	return pm.confirmations
+}
+
+// 最多可以回滚到的区块
+func (pm *Simulator) journalFloor() uint64 {
+	floor := pm.journalBase
+	if pm.head > pm.confirmations && pm.head-pm.confirmations > floor {
+		floor = pm.head - pm.confirmations
+	}
+	return floor
+}
+
+func (pm *Simulator) journalEntry(blockNum uint64, blockHash common.Hash) *journalEntry {
+	if len(pm.journal) > 0 {
+		last := pm.journal[len(pm.journal)-1]
+		if last.BlockNum == blockNum {
+			if last.BlockHash == (common.Hash{}) {
+				last.BlockHash = blockHash
+			}
+			return last
+		}
+		if last.BlockNum > blockNum {
+			// 乱序的区块无法回滚
+			logrus.Warnf("journal out of order, block %d after %d", blockNum, last.BlockNum)
+			return nil
+		}
+	}
+	entry := &journalEntry{
+		BlockNum:  blockNum,
+		BlockHash: blockHash,
+		pools:     map[common.Address]*CorePool{},
+	}
+	pm.journal = append(pm.journal, entry)
+	return entry
+}
+
+// 未确认区块的记录, 已确认或关闭 journal 时返回 nil
+func (pm *Simulator) unconfirmedEntry(blockNum uint64, blockHash common.Hash) *journalEntry {
+	if pm.confirmations == 0 {
+		return nil
+	}
+	if blockNum > pm.head {
+		pm.head = blockNum
+	}
+	if blockNum+pm.confirmations <= pm.head {
+		return nil
+	}
+	return pm.journalEntry(blockNum, blockHash)
+}
+
+// 在 log 修改 pool 之前调用, 记录 pool 在当前区块第一次修改前的状态
+func (pm *Simulator) journalPool(log *types.Log) {
+	entry := pm.unconfirmedEntry(log.BlockNumber, log.BlockHash)
+	if entry == nil {
+		return
+	}
+	if _, ok := entry.pools[log.Address]; ok {
+		return
+	}
+	if pool, ok := pm.Pools[log.Address]; ok {
+		entry.pools[log.Address] = pool.Clone()
+	} else {
+		entry.pools[log.Address] = nil
+	}
+}
+
+// 记录区块 hash, 用于检测 parent hash 不一致
+func (pm *Simulator) journalHeader(header *types.Header) {
+	if pm.confirmations == 0 {
+		return
+	}
+	blockNum := header.Number.Uint64()
+	if blockNum+pm.confirmations <= pm.head {
+		return
+	}
+	entry := pm.journalEntry(blockNum, header.Hash())
+	if entry == nil {
+		return
+	}
+	entry.BlockHash = header.Hash()
+	entry.ParentHash = header.ParentHash
+}
+
+// 丢弃已确认区块的记录
+func (pm *Simulator) pruneJournal() {
+	floor := pm.journalFloor()
+	i := 0
+	for i < len(pm.journal) && pm.journal[i].BlockNum <= floor {
+		i++
+	}
+	pm.journal = pm.journal[i:]
+}
+
+// 已记录的区块 hash
+func (pm *Simulator) journalHash(blockNum uint64) (common.Hash, bool) {
+	for i := len(pm.journal) - 1; i >= 0; i-- {
+		entry := pm.journal[i]
+		if entry.BlockNum == blockNum {
+			return entry.BlockHash, entry.BlockHash != (common.Hash{})
+		}
+		if entry.BlockNum < blockNum {
+			break
+		}
+	}
+	return common.Hash{}, false
+}
+
+// Rollback 回滚到 blockHash 对应区块结束时的状态
+func (pm *Simulator) Rollback(blockHash common.Hash) error {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	for _, entry := range pm.journal {
+		if entry.BlockHash == blockHash {
+			return pm.rollbackTo(entry.BlockNum)
+		}
+	}
+	return ErrBlockNotInJournal
+}
+
+// RollbackTo 回滚到 blockNum 结束时的状态, blockNum 之后的区块需要重新同步
+func (pm *Simulator) RollbackTo(blockNum uint64) error {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	return pm.rollbackTo(blockNum)
+}
+
+func (pm *Simulator) rollbackTo(blockNum uint64) error {
+	if pm.confirmations == 0 || blockNum < pm.journalFloor() {
+		return ErrReorgTooDeep
+	}
+	i := len(pm.journal)
+	for i > 0 && pm.journal[i-1].BlockNum > blockNum {
+		i--
+		entry := pm.journal[i]
+		for addr, pool := range entry.pools {
+			pm.restorePool(addr, pool)
+		}
+		// 被回滚的交易导致的隔离和注册在 canonical 链上不一定存在
+		for _, addr := range entry.quarantined {
+			if err := pm.clearQuarantine(addr); err != nil {
+				return err
+			}
+		}
+		for _, addr := range entry.registered {
+			pm.unregisterPool(addr)
+		}
+	}
+	if i == len(pm.journal) && pm.currentBlock <= blockNum {
+		return nil
+	}
+	logrus.Infof("rollback to block %d, reverted %d blocks", blockNum, len(pm.journal)-i)
+	pm.journal = pm.journal[:i]
+	// 回滚的区块中保存的 checkpoint 已经无效
+	err := pm.deleteCheckpointsAfter(blockNum)
+	if err != nil {
+		return err
+	}
+	if pm.currentBlock > blockNum {
+		pm.currentBlock = blockNum
+	}
+	// 重组后区块时间戳可能变化
+	pm.tsLock.Lock()
+	pm.blockTimestamps = map[uint64]uint64{}
+	pm.tsLock.Unlock()
+	return pm.FlushPools()
+}
+
+func (pm *Simulator) restorePool(addr common.Address, pool *CorePool) {
+	current, ok := pm.Pools[addr]
+	if pool == nil {
+		if ok {
+			delete(pm.Pools, addr)
+			delete(pm.dirtyPools, current.PoolAddress)
+			if current.HasCreated {
+				pm.removedPools = append(pm.removedPools, current)
+			}
+		}
+		return
+	}
+	if !ok {
+		pm.Pools[addr] = pool
+		pm.dirtyPools[pool.PoolAddress] = pool
+		return
+	}
+	// 保留数据库主键, 原地恢复, 外部持有的指针仍然有效
+	model, created := current.Model, current.HasCreated
+	*current = *pool
+	current.Model = model
+	current.HasCreated = created
+	pm.dirtyPools[current.PoolAddress] = current
+}
+
+// 检查 start 的 parent hash 是否与已记录的 start-1 一致, 不一致时回滚到共同祖先, 返回新的 start
+func (pm *Simulator) checkReorg(start uint64) (uint64, error) {
+	if pm.confirmations == 0 || start == 0 {
+		return start, nil
+	}
+	headers, ok := asHeaderSource(pm.source)
+	if !ok {
+		return start, nil
+	}
+	recorded, ok := pm.journalHash(start - 1)
+	if !ok {
+		return start, nil
+	}
+	header, err := headers.HeaderByNumber(pm.ctx, big.NewInt(int64(start)))
+	if err != nil {
+		return 0, err
+	}
+	if header.ParentHash == recorded {
+		return start, nil
+	}
+	logrus.Warnf("reorg detected at block %d, parent hash %s, recorded %s", start, header.ParentHash, recorded)
+	for i := len(pm.journal) - 1; i >= 0; i-- {
+		entry := pm.journal[i]
+		if entry.BlockNum >= start || entry.BlockHash == (common.Hash{}) {
+			continue
+		}
+		canonical, err := headers.HeaderByNumber(pm.ctx, big.NewInt(int64(entry.BlockNum)))
+		if err != nil {
+			return 0, err
+		}
+		if canonical.Hash() == entry.BlockHash {
+			err = pm.rollbackTo(entry.BlockNum)
+			if err != nil {
+				return 0, err
+			}
+			return entry.BlockNum + 1, nil
+		}
+	}
+	return 0, ErrReorgTooDeep
+}
@@ -0,0 +1,123 @@
+package uniswap_v3_simulator
+
+import (
+	"context"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func newTestSimulator(t *testing.T) *Simulator {
+	store, err := NewSQLiteStore(filepath.Join(t.TempDir(), "simulator.db"))
+	assert.NoError(t, err)
+	return &Simulator{
+		Pools:           map[common.Address]*CorePool{},
+		dirtyPools:      map[string]*CorePool{},
+		blockTimestamps: map[uint64]uint64{},
+		poolConfigs:     map[common.Address]*PoolConfig{},
+		quarantined:     map[common.Address]*QuarantinedPool{},
+		checkpointPools: map[string]bool{},
+		factory:         UNISWAP_V3_FACTORY,
+		initCodeHash:    POOL_INIT_CODE_HASH,
+		store:           store,
+		ctx:             context.Background(),
+	}
+}
+
+// gorm store 的数据库, 用于检查表中的数据
+func testDB(pm *Simulator) *gorm.DB {
+	return pm.store.(*GormStore).DB()
+}
+
+func openTestSimulator(t *testing.T, dbFile string, source LogSource) *Simulator {
+	pm, err := NewSimulatorWithSource(dbFile, source, 0)
+	assert.NoError(t, err)
+	return pm
+}
+
+func TestSimulator_Rollback(t *testing.T) {
+	pm := newTestSimulator(t)
+	pm.SetConfirmationDepth(10)
+	addr := common.HexToAddress("0x0000000000000000000000000000000000000001")
+	hash := func(n uint64) common.Hash {
+		return common.BigToHash(new(big.Int).SetUint64(n))
+	}
+
+	// 100: 创建 pool
+	pm.journalPool(&types.Log{Address: addr, BlockNumber: 100, BlockHash: hash(100)})
+	pool := newTestPool(t)
+	pool.CurrentBlockNum = 100
+	pm.Pools[addr] = pool
+	pm.dirtyPools[pool.PoolAddress] = pool
+	assert.NoError(t, pm.FlushPools())
+
+	// 101: flash
+	pm.journalPool(&types.Log{Address: addr, BlockNumber: 101, BlockHash: hash(101)})
+	assert.NoError(t, pool.Flash(decimal.NewFromInt(1000), ZERO))
+	pool.CurrentBlockNum = 101
+	feeGrowth := pool.FeeGrowthGlobal0X128
+
+	// 102: mint, 同一区块多次修改只记录第一次
+	pm.journalPool(&types.Log{Address: addr, BlockNumber: 102, BlockHash: hash(102)})
+	_, _, err := pool.Mint("0xowner", -120, 120, decimal.NewFromInt(1000))
+	assert.NoError(t, err)
+	pm.journalPool(&types.Log{Address: addr, BlockNumber: 102, BlockHash: hash(102)})
+	_, _, err = pool.Mint("0xowner", -120, 120, decimal.NewFromInt(1000))
+	assert.NoError(t, err)
+	pool.CurrentBlockNum = 102
+	pm.currentBlock = 102
+
+	assert.ErrorIs(t, pm.Rollback(hash(200)), ErrBlockNotInJournal)
+	assert.ErrorIs(t, pm.RollbackTo(50), ErrReorgTooDeep)
+
+	assert.NoError(t, pm.Rollback(hash(101)))
+	assert.Same(t, pool, pm.Pools[addr])
+	assert.Equal(t, "1000000", pool.Liquidity.String())
+	assert.True(t, feeGrowth.Equal(pool.FeeGrowthGlobal0X128))
+	assert.Equal(t, uint64(101), pool.CurrentBlockNum)
+	assert.Equal(t, uint64(101), pm.CurrentBlock())
+
+	// 被移除的 log 会回滚该区块
+	assert.NoError(t, pm.HandleLogs([]types.Log{{Address: addr, BlockNumber: 101, BlockHash: hash(101), Topics: []common.Hash{pm.FlashID}, Removed: true}}))
+	assert.True(t, pool.FeeGrowthGlobal0X128.IsZero())
+
+	assert.NoError(t, pm.RollbackTo(99))
+	_, ok := pm.Pools[addr]
+	assert.False(t, ok)
+	var count int64
+	assert.NoError(t, testDB(pm).Model(&CorePool{}).Unscoped().Count(&count).Error)
+	assert.Equal(t, int64(0), count)
+}
+
+// 回滚撤销被回滚区块中的隔离和注册
+func TestSimulator_RollbackQuarantineAndRegistry(t *testing.T) {
+	pm := openTestSimulator(t, filepath.Join(t.TempDir(), "simulator.db"), nil)
+	pm.SetConfirmationDepth(10)
+	// 价格不变, 反推不出输入, 默认 policy 隔离 pool
+	assert.NoError(t, pm.HandleLogs([]types.Log{testPoolCreatedLog(100), testInitializeLog(101), testMintLog(102, -600, 600, 1000000), testSwapLog(103, 5, 0, 1000000)}))
+	assert.True(t, pm.IsQuarantined(testPool))
+	assert.NoError(t, pm.FlushPools())
+
+	assert.NoError(t, pm.RollbackTo(102))
+	assert.False(t, pm.IsQuarantined(testPool))
+	var count int64
+	assert.NoError(t, testDB(pm).Model(&QuarantinedPool{}).Unscoped().Count(&count).Error)
+	assert.Equal(t, int64(0), count)
+	_, ok := pm.RegisteredPool(testPool)
+	assert.True(t, ok)
+
+	assert.NoError(t, pm.RollbackTo(99))
+	_, ok = pm.RegisteredPool(testPool)
+	assert.False(t, ok)
+	assert.NoError(t, testDB(pm).Model(&RegisteredPool{}).Unscoped().Count(&count).Error)
+	assert.Equal(t, int64(0), count)
+
+	// 区块 0 的 log 被移除时无法回滚
+	assert.ErrorIs(t, pm.HandleLogs([]types.Log{{Address: testPool, Topics: []common.Hash{pm.FlashID}, Removed: true}}), ErrReorgTooDeep)
+}
@@ -0,0 +1,403 @@
+package uniswap_v3_simulator
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	logSegmentVersion   = 2 // 2: 保存区块时间戳
+	DefaultSegmentSize  = 10000
+	DefaultSegmentFinal = 128 // 距离链头超过这么多区块的 segment 才会缓存
+)
+
+var ErrCorruptSegment = errors.New("corrupt log segment")
+
+// CachedLogSource 把 upstream 的 logs 和所在区块的时间戳按区块区间缓存到本地文件, 每 SegmentSize 个区块一个 segment.
+// 不同的过滤条件(addresses, topics)缓存在不同的子目录中
+type CachedLogSource struct {
+	upstream    LogSource
+	dir         string
+	SegmentSize uint64
+	Finality    uint64
+	// 缺失的 segment 从 upstream 分页获取, 每次最多 ChunkSize 个区块. 0 表示使用调用方 FilterLogs 的区块范围
+	ChunkSize uint64
+	head      uint64
+	// 上一次 FilterLogs 从 segment 读到的区块时间戳
+	timestamps map[uint64]uint64
+	// 最近读取的 segment, step 小于 SegmentSize 时同一个 segment 不需要重复解码
+	lastPath       string
+	lastLogs       []types.Log
+	lastTimestamps map[uint64]uint64
+}
+
+func NewCachedLogSource(upstream LogSource, dir string) (*CachedLogSource, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &CachedLogSource{
+		upstream:    upstream,
+		dir:         dir,
+		SegmentSize: DefaultSegmentSize,
+		Finality:    DefaultSegmentFinal,
+	}, nil
+}
+
+func (s *CachedLogSource) Unwrap() LogSource {
+	return s.upstream
+}
+
+func (s *CachedLogSource) BlockNumber(ctx context.Context) (uint64, error) {
+	head, err := s.upstream.BlockNumber(ctx)
+	if err != nil {
+		return 0, err
+	}
+	s.head = head
+	return head, nil
+}
+
+func (s *CachedLogSource) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	if q.BlockHash != nil {
+		return s.upstream.FilterLogs(ctx, q)
+	}
+	from, to := filterRange(q)
+	if s.head < to {
+		_, err := s.BlockNumber(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if to > s.head {
+		to = s.head
+	}
+	dir := filepath.Join(s.dir, filterKey(q))
+	chunk := s.ChunkSize
+	if chunk == 0 {
+		chunk = to - from + 1
+	}
+	var logs []types.Log
+	s.timestamps = map[uint64]uint64{}
+	for segFrom := from - from%s.SegmentSize; segFrom <= to; segFrom += s.SegmentSize {
+		segTo := segFrom + s.SegmentSize - 1
+		lo, hi := from, to
+		if segFrom > lo {
+			lo = segFrom
+		}
+		if segTo < hi {
+			hi = segTo
+		}
+		if segTo+s.Finality > s.head {
+			// 未确认的区块不缓存
+			sub := q
+			sub.FromBlock = new(big.Int).SetUint64(lo)
+			sub.ToBlock = new(big.Int).SetUint64(hi)
+			fetched, err := s.upstream.FilterLogs(ctx, sub)
+			if err != nil {
+				return nil, err
+			}
+			logs = append(logs, fetched...)
+			continue
+		}
+		segment, timestamps, err := s.segment(ctx, q, dir, segFrom, segTo, chunk)
+		if err != nil {
+			return nil, err
+		}
+		for _, log := range segment {
+			if log.BlockNumber >= lo && log.BlockNumber <= hi {
+				logs = append(logs, log)
+				if ts, ok := timestamps[log.BlockNumber]; ok {
+					s.timestamps[log.BlockNumber] = ts
+				}
+			}
+		}
+	}
+	return logs, nil
+}
+
+// BlockTimestamps 优先使用上一次 FilterLogs 从 segment 读到的时间戳, 未缓存的区块从 upstream 获取
+func (s *CachedLogSource) BlockTimestamps(ctx context.Context, blockNumbers []uint64) (map[uint64]uint64, error) {
+	timestamps := map[uint64]uint64{}
+	var missing []uint64
+	for _, blockNumber := range blockNumbers {
+		if ts, ok := s.timestamps[blockNumber]; ok {
+			timestamps[blockNumber] = ts
+		} else {
+			missing = append(missing, blockNumber)
+		}
+	}
+	if len(missing) == 0 {
+		return timestamps, nil
+	}
+	fetched, err := fetchBlockTimestamps(ctx, s.upstream, missing)
+	if err != nil {
+		return nil, err
+	}
+	for blockNumber, ts := range fetched {
+		timestamps[blockNumber] = ts
+	}
+	return timestamps, nil
+}
+
+func (s *CachedLogSource) segment(ctx context.Context, q ethereum.FilterQuery, dir string, from, to, chunk uint64) ([]types.Log, map[uint64]uint64, error) {
+	path := filepath.Join(dir, segmentName(from, to))
+	if path == s.lastPath {
+		return s.lastLogs, s.lastTimestamps, nil
+	}
+	logs, timestamps, err := readLogSegment(path, from, to)
+	if err == nil {
+		s.lastPath, s.lastLogs, s.lastTimestamps = path, logs, timestamps
+		return logs, timestamps, nil
+	}
+	if !os.IsNotExist(err) {
+		logrus.Warnf("drop log segment %s: %s", path, err)
+	}
+	// 节点限制单次返回的 logs 数量和区块范围, 按 chunk 分页获取
+	logs = nil
+	for lo := from; lo <= to; lo += chunk {
+		hi := lo + chunk - 1
+		if hi > to {
+			hi = to
+		}
+		sub := q
+		sub.FromBlock = new(big.Int).SetUint64(lo)
+		sub.ToBlock = new(big.Int).SetUint64(hi)
+		fetched, err := s.upstream.FilterLogs(ctx, sub)
+		if err != nil {
+			return nil, nil, err
+		}
+		logs = append(logs, fetched...)
+	}
+	var blockNumbers []uint64
+	for i, log := range logs {
+		if i == 0 || log.BlockNumber != logs[i-1].BlockNumber {
+			blockNumbers = append(blockNumbers, log.BlockNumber)
+		}
+	}
+	timestamps, err = fetchBlockTimestamps(ctx, s.upstream, blockNumbers)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = writeLogSegment(path, from, to, logs, timestamps)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.lastPath, s.lastLogs, s.lastTimestamps = path, logs, timestamps
+	return logs, timestamps, nil
+}
+
+func segmentName(from, to uint64) string {
+	return fmt.Sprintf("%012d-%012d.rlp", from, to)
+}
+
+// 过滤条件的 hash, 作为子目录名
+func filterKey(q ethereum.FilterQuery) string {
+	bs, _ := rlp.EncodeToBytes([]interface{}{q.Addresses, q.Topics})
+	return common.Bytes2Hex(crypto.Keccak256(bs)[:8])
+}
+
+type logSegment struct {
+	Version    uint
+	From       uint64
+	To         uint64
+	Logs       []rlpLog
+	Timestamps []blockTimestamp // 按区块排序, upstream 无法提供的区块不保存
+	Checksum   common.Hash
+}
+
+type blockTimestamp struct {
+	BlockNum  uint64
+	Timestamp uint64
+}
+
+func segmentChecksum(logs []rlpLog, timestamps []blockTimestamp) (common.Hash, error) {
+	bs, err := rlp.EncodeToBytes([]interface{}{logs, timestamps})
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return crypto.Keccak256Hash(bs), nil
+}
+
+func writeLogSegment(path string, from, to uint64, logs []types.Log, timestamps map[uint64]uint64) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	segment := &logSegment{
+		Version: logSegmentVersion,
+		From:    from,
+		To:      to,
+		Logs:    make([]rlpLog, len(logs)),
+	}
+	for i, log := range logs {
+		segment.Logs[i] = newRlpLog(&log)
+	}
+	for blockNum, ts := range timestamps {
+		segment.Timestamps = append(segment.Timestamps, blockTimestamp{BlockNum: blockNum, Timestamp: ts})
+	}
+	sort.Slice(segment.Timestamps, func(i, j int) bool {
+		return segment.Timestamps[i].BlockNum < segment.Timestamps[j].BlockNum
+	})
+	segment.Checksum, err = segmentChecksum(segment.Logs, segment.Timestamps)
+	if err != nil {
+		return err
+	}
+	bs, err := rlp.EncodeToBytes(segment)
+	if err != nil {
+		return err
+	}
+	// 先写临时文件再重命名, 中断时不会留下不完整的 segment
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, bs, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readLogSegment(path string, from, to uint64) ([]types.Log, map[uint64]uint64, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var segment logSegment
+	err = rlp.Decode(bytes.NewReader(bs), &segment)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrCorruptSegment, err)
+	}
+	if segment.Version != logSegmentVersion {
+		return nil, nil, fmt.Errorf("%w: version %d", ErrCorruptSegment, segment.Version)
+	}
+	if segment.From != from || segment.To != to {
+		return nil, nil, fmt.Errorf("%w: range %d-%d, expect %d-%d", ErrCorruptSegment, segment.From, segment.To, from, to)
+	}
+	checksum, err := segmentChecksum(segment.Logs, segment.Timestamps)
+	if err != nil {
+		return nil, nil, err
+	}
+	if checksum != segment.Checksum {
+		return nil, nil, fmt.Errorf("%w: checksum mismatch", ErrCorruptSegment)
+	}
+	logs := make([]types.Log, len(segment.Logs))
+	for i, l := range segment.Logs {
+		if l.BlockNumber < from || l.BlockNumber > to {
+			return nil, nil, fmt.Errorf("%w: log at block %d out of range", ErrCorruptSegment, l.BlockNumber)
+		}
+		if i > 0 {
+			prev := segment.Logs[i-1]
+			if l.BlockNumber < prev.BlockNumber || (l.BlockNumber == prev.BlockNumber && l.Index <= prev.Index) {
+				return nil, nil, fmt.Errorf("%w: log %d-%d out of order", ErrCorruptSegment, l.BlockNumber, l.Index)
+			}
+		}
+		logs[i] = *l.toLog()
+	}
+	timestamps := make(map[uint64]uint64, len(segment.Timestamps))
+	for _, ts := range segment.Timestamps {
+		if ts.BlockNum < from || ts.BlockNum > to {
+			return nil, nil, fmt.Errorf("%w: timestamp at block %d out of range", ErrCorruptSegment, ts.BlockNum)
+		}
+		timestamps[ts.BlockNum] = ts.Timestamp
+	}
+	return logs, timestamps, nil
+}
+
+type LogCacheReport struct {
+	Segments int
+	// 损坏的 segment 文件, 下次读取时会重新获取
+	Corrupt []string
+	// 每个过滤条件目录中缺失的区块区间
+	Gaps map[string][][2]uint64
+}
+
+// Verify 检查所有 segment 的完整性, 以及 segment 之间是否有缺失的区间
+func (s *CachedLogSource) Verify() (*LogCacheReport, error) {
+	report := &LogCacheReport{Gaps: map[string][][2]uint64{}}
+	dirs, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(s.dir, d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var ranges [][2]uint64
+		for _, f := range files {
+			from, to, ok := parseSegmentName(f.Name())
+			if !ok {
+				continue
+			}
+			path := filepath.Join(s.dir, d.Name(), f.Name())
+			report.Segments += 1
+			_, _, err := readLogSegment(path, from, to)
+			if err != nil {
+				report.Corrupt = append(report.Corrupt, path)
+				continue
+			}
+			ranges = append(ranges, [2]uint64{from, to})
+		}
+		sort.Slice(ranges, func(i, j int) bool {
+			return ranges[i][0] < ranges[j][0]
+		})
+		for i := 1; i < len(ranges); i++ {
+			if ranges[i][0] > ranges[i-1][1]+1 {
+				report.Gaps[d.Name()] = append(report.Gaps[d.Name()], [2]uint64{ranges[i-1][1] + 1, ranges[i][0] - 1})
+			}
+		}
+	}
+	return report, nil
+}
+
+func parseSegmentName(name string) (uint64, uint64, bool) {
+	if !strings.HasSuffix(name, ".rlp") {
+		return 0, 0, false
+	}
+	parts := strings.Split(strings.TrimSuffix(name, ".rlp"), "-")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	from, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	to, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return from, to, true
+}
+
+// EnableLogCache 在当前 source 外包装本地 log 缓存, 重新同步时优先读取缓存
+func (pm *Simulator) EnableLogCache(dir string) error {
+	if pm.source == nil {
+		return ErrNoLogSource
+	}
+	cached, err := NewCachedLogSource(pm.source, dir)
+	if err != nil {
+		return err
+	}
+	// 可能被重组的区块不能缓存
+	if pm.confirmations > cached.Finality {
+		cached.Finality = pm.confirmations
+	}
+	pm.source = cached
+	return nil
+}
@@ -0,0 +1,118 @@
+package uniswap_v3_simulator
+
+import (
+	"context"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingLogSource struct {
+	*MemoryLogSource
+	calls          int
+	timestampCalls int
+}
+
+func (s *countingLogSource) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	s.calls += 1
+	return s.MemoryLogSource.FilterLogs(ctx, q)
+}
+
+func (s *countingLogSource) BlockTimestamps(ctx context.Context, blockNumbers []uint64) (map[uint64]uint64, error) {
+	s.timestampCalls += 1
+	return s.MemoryLogSource.BlockTimestamps(ctx, blockNumbers)
+}
+
+func TestCachedLogSource(t *testing.T) {
+	var logs []types.Log
+	for _, blockNumber := range []uint64{5, 9999, 10000, 15000, 25000, 35000, 50000} {
+		logs = append(logs, testMintLog(blockNumber, -600, 600, 1000))
+	}
+	upstream := &countingLogSource{MemoryLogSource: newTestLogSource(logs...)}
+	dir := t.TempDir()
+	source, err := NewCachedLogSource(upstream, dir)
+	assert.NoError(t, err)
+
+	q := ethereum.FilterQuery{FromBlock: big.NewInt(9000), ToBlock: big.NewInt(39999), Topics: [][]common.Hash{{TOPIC_MINT}}}
+	got, err := source.FilterLogs(context.Background(), q)
+	assert.NoError(t, err)
+	assert.Equal(t, logs[1:6], got)
+	assert.Equal(t, 4, upstream.calls)
+
+	// 第二次全部从缓存读取
+	got, err = source.FilterLogs(context.Background(), q)
+	assert.NoError(t, err)
+	assert.Equal(t, logs[1:6], got)
+	assert.Equal(t, 4, upstream.calls)
+
+	// 未确认的区块不缓存
+	got, err = source.FilterLogs(context.Background(), ethereum.FilterQuery{FromBlock: big.NewInt(49990), ToBlock: big.NewInt(50000), Topics: q.Topics})
+	assert.NoError(t, err)
+	assert.Equal(t, logs[6:], got)
+	assert.Equal(t, 6, upstream.calls)
+
+	report, err := source.Verify()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, report.Segments)
+	assert.Empty(t, report.Corrupt)
+	assert.Empty(t, report.Gaps)
+
+	key := filterKey(q)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, key, segmentName(20000, 29999)), []byte("broken"), 0644))
+	assert.NoError(t, os.Remove(filepath.Join(dir, key, segmentName(10000, 19999))))
+	report, err = source.Verify()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, key, segmentName(20000, 29999))}, report.Corrupt)
+	assert.Equal(t, [][2]uint64{{10000, 29999}}, report.Gaps[key])
+
+	// 损坏和缺失的 segment 重新获取
+	got, err = source.FilterLogs(context.Background(), q)
+	assert.NoError(t, err)
+	assert.Equal(t, logs[1:6], got)
+	assert.Equal(t, 8, upstream.calls)
+	report, err = source.Verify()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Corrupt)
+	assert.Empty(t, report.Gaps)
+
+	// 时间戳与 logs 一起缓存, 新的 CachedLogSource 也不需要访问 upstream
+	source, err = NewCachedLogSource(upstream, dir)
+	assert.NoError(t, err)
+	upstream.calls, upstream.timestampCalls = 0, 0
+	_, err = source.FilterLogs(context.Background(), q)
+	assert.NoError(t, err)
+	timestamps, err := source.BlockTimestamps(context.Background(), []uint64{9999, 10000, 15000, 25000, 35000})
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint64]uint64{9999: 1600119988, 10000: 1600120000, 15000: 1600180000, 25000: 1600300000, 35000: 1600420000}, timestamps)
+	assert.Equal(t, 0, upstream.calls)
+	assert.Equal(t, 0, upstream.timestampCalls)
+
+	// 不在缓存中的区块从 upstream 获取
+	timestamps, err = source.BlockTimestamps(context.Background(), []uint64{5})
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint64]uint64{5: 1600000060}, timestamps)
+	assert.Equal(t, 1, upstream.timestampCalls)
+
+	// 缺失的 segment 按 ChunkSize 分页获取
+	source, err = NewCachedLogSource(upstream, t.TempDir())
+	assert.NoError(t, err)
+	source.ChunkSize = 2500
+	upstream.calls = 0
+	got, err = source.FilterLogs(context.Background(), ethereum.FilterQuery{FromBlock: big.NewInt(10000), ToBlock: big.NewInt(10999), Topics: q.Topics})
+	assert.NoError(t, err)
+	assert.Equal(t, logs[2:3], got)
+	assert.Equal(t, 4, upstream.calls)
+
+	// 同一个 segment 之后的查询使用内存中解码过的 segment
+	assert.NoError(t, os.RemoveAll(source.dir))
+	got, err = source.FilterLogs(context.Background(), ethereum.FilterQuery{FromBlock: big.NewInt(11000), ToBlock: big.NewInt(15999), Topics: q.Topics})
+	assert.NoError(t, err)
+	assert.Equal(t, logs[3:4], got)
+	assert.Equal(t, 4, upstream.calls)
+}
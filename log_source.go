@@ -0,0 +1,562 @@
+package uniswap_v3_simulator
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+var (
+	ErrNoLogSource          = errors.New("no log source")
+	ErrUnknownLogFileFormat = errors.New("unknown log file format, expect .jsonl or .rlp")
+	ErrNoBlockTimestamp     = errors.New("no block timestamp")
+)
+
+// LogSource 提供同步所需的 logs, 可以是节点, 文件或内存
+type LogSource interface {
+	// 最新区块
+	BlockNumber(ctx context.Context) (uint64, error)
+	FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error)
+}
+
+// HeaderSource 可选, 用于检测重组
+type HeaderSource interface {
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+}
+
+// BlockTimestampSource 可选, 批量获取区块时间戳, 不存在的区块不返回
+type BlockTimestampSource interface {
+	BlockTimestamps(ctx context.Context, blockNumbers []uint64) (map[uint64]uint64, error)
+}
+
+// 包装其他 LogSource 时实现, 可选接口从被包装的 source 中查找
+type LogSourceWrapper interface {
+	Unwrap() LogSource
+}
+
+func asHeaderSource(source LogSource) (HeaderSource, bool) {
+	for source != nil {
+		if s, ok := source.(HeaderSource); ok {
+			return s, true
+		}
+		w, ok := source.(LogSourceWrapper)
+		if !ok {
+			break
+		}
+		source = w.Unwrap()
+	}
+	return nil, false
+}
+
+func asBlockTimestampSource(source LogSource) (BlockTimestampSource, bool) {
+	for source != nil {
+		if s, ok := source.(BlockTimestampSource); ok {
+			return s, true
+		}
+		w, ok := source.(LogSourceWrapper)
+		if !ok {
+			break
+		}
+		source = w.Unwrap()
+	}
+	return nil, false
+}
+
+func asContractCaller(source LogSource) (bind.ContractCaller, bool) {
+	for source != nil {
+		if s, ok := source.(bind.ContractCaller); ok {
+			return s, true
+		}
+		w, ok := source.(LogSourceWrapper)
+		if !ok {
+			break
+		}
+		source = w.Unwrap()
+	}
+	return nil, false
+}
+
+// 从 source 获取区块时间戳, 先使用 BlockTimestampSource, 缺少的再读取区块头. 无法获取的区块不返回
+func fetchBlockTimestamps(ctx context.Context, source LogSource, blockNumbers []uint64) (map[uint64]uint64, error) {
+	timestamps := map[uint64]uint64{}
+	if s, ok := asBlockTimestampSource(source); ok {
+		fetched, err := s.BlockTimestamps(ctx, blockNumbers)
+		if err != nil {
+			return nil, err
+		}
+		for blockNumber, ts := range fetched {
+			timestamps[blockNumber] = ts
+		}
+	}
+	headers, ok := asHeaderSource(source)
+	if !ok {
+		return timestamps, nil
+	}
+	for _, blockNumber := range blockNumbers {
+		if _, ok := timestamps[blockNumber]; ok {
+			continue
+		}
+		header, err := headers.HeaderByNumber(ctx, new(big.Int).SetUint64(blockNumber))
+		if err != nil {
+			return nil, err
+		}
+		timestamps[blockNumber] = header.Time
+	}
+	return timestamps, nil
+}
+
+// 节点
+type RpcLogSource struct {
+	*ethclient.Client
+	raw *rpc.Client
+}
+
+func NewRpcLogSource(rpcUrl string) (*RpcLogSource, error) {
+	raw, err := rpc.Dial(rpcUrl)
+	if err != nil {
+		return nil, err
+	}
+	return &RpcLogSource{
+		Client: ethclient.NewClient(raw),
+		raw:    raw,
+	}, nil
+}
+
+type rpcBlockTimestamp struct {
+	Timestamp hexutil.Uint64 `json:"timestamp"`
+}
+
+func (s *RpcLogSource) BlockTimestamps(ctx context.Context, blockNumbers []uint64) (map[uint64]uint64, error) {
+	timestamps := map[uint64]uint64{}
+	batchSize := 200
+	for i := 0; i < len(blockNumbers); i += batchSize {
+		end := i + batchSize
+		if end > len(blockNumbers) {
+			end = len(blockNumbers)
+		}
+		results := make([]*rpcBlockTimestamp, end-i)
+		batch := make([]rpc.BatchElem, end-i)
+		for j, blockNumber := range blockNumbers[i:end] {
+			batch[j] = rpc.BatchElem{
+				Method: "eth_getBlockByNumber",
+				Args:   []interface{}{hexutil.EncodeUint64(blockNumber), false},
+				Result: &results[j],
+			}
+		}
+		err := s.raw.BatchCallContext(ctx, batch)
+		if err != nil {
+			return nil, err
+		}
+		for j, elem := range batch {
+			if elem.Error != nil {
+				return nil, elem.Error
+			}
+			if results[j] != nil {
+				timestamps[blockNumbers[i+j]] = uint64(results[j].Timestamp)
+			}
+		}
+	}
+	return timestamps, nil
+}
+
+// 内存中的 logs, 按区块排序
+type MemoryLogSource struct {
+	Logs []types.Log
+	// logs 所在区块的时间戳, 缺少时同步返回 ErrNoBlockTimestamp
+	Timestamps map[uint64]uint64
+}
+
+func NewMemoryLogSource(logs []types.Log) *MemoryLogSource {
+	sorted := make([]types.Log, len(logs))
+	copy(sorted, logs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].BlockNumber != sorted[j].BlockNumber {
+			return sorted[i].BlockNumber < sorted[j].BlockNumber
+		}
+		return sorted[i].Index < sorted[j].Index
+	})
+	return &MemoryLogSource{
+		Logs:       sorted,
+		Timestamps: map[uint64]uint64{},
+	}
+}
+
+func (s *MemoryLogSource) BlockNumber(ctx context.Context) (uint64, error) {
+	if len(s.Logs) == 0 {
+		return 0, nil
+	}
+	return s.Logs[len(s.Logs)-1].BlockNumber, nil
+}
+
+func (s *MemoryLogSource) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	from, to := filterRange(q)
+	start := sort.Search(len(s.Logs), func(i int) bool {
+		return s.Logs[i].BlockNumber >= from
+	})
+	var logs []types.Log
+	for _, log := range s.Logs[start:] {
+		if log.BlockNumber > to {
+			break
+		}
+		if matchFilter(&log, q) {
+			logs = append(logs, log)
+		}
+	}
+	return logs, nil
+}
+
+func (s *MemoryLogSource) BlockTimestamps(ctx context.Context, blockNumbers []uint64) (map[uint64]uint64, error) {
+	timestamps := map[uint64]uint64{}
+	for _, blockNumber := range blockNumbers {
+		if ts, ok := s.Timestamps[blockNumber]; ok {
+			timestamps[blockNumber] = ts
+		}
+	}
+	return timestamps, nil
+}
+
+// 文件中的 logs, 按区块顺序存放, .jsonl 每行一个 json 格式的 types.Log, 附加 blockTimestamp 字段, .rlp 为 rlpLog 的 rlp 流.
+// 顺序读取, 不会把整个文件读入内存
+type FileLogSource struct {
+	path   string
+	file   *os.File
+	next   func() (*fileLog, error)
+	peek   *fileLog
+	lastTo uint64
+	head   *uint64
+	// 上一次 FilterLogs 读到的区块时间戳
+	timestamps map[uint64]uint64
+}
+
+// 文件中的一条 log, 没有时间戳的旧文件 timestamp 为 nil
+type fileLog struct {
+	log       *types.Log
+	timestamp *uint64
+}
+
+// jsonl 中 types.Log 之外的字段
+type jsonLogExtra struct {
+	BlockTimestamp *hexutil.Uint64 `json:"blockTimestamp,omitempty"`
+}
+
+func NewFileLogSource(path string) (*FileLogSource, error) {
+	if !strings.HasSuffix(path, ".jsonl") && !strings.HasSuffix(path, ".rlp") {
+		return nil, ErrUnknownLogFileFormat
+	}
+	s := &FileLogSource{path: path}
+	err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileLogSource) open() error {
+	if s.file != nil {
+		s.file.Close()
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.peek = nil
+	s.lastTo = 0
+	s.next = newLogReader(s.path, f)
+	return nil
+}
+
+func newLogReader(path string, r io.Reader) func() (*fileLog, error) {
+	if strings.HasSuffix(path, ".rlp") {
+		stream := rlp.NewStream(bufio.NewReader(r), 0)
+		return func() (*fileLog, error) {
+			var l rlpLog
+			err := stream.Decode(&l)
+			if err != nil {
+				return nil, err
+			}
+			parsed := &fileLog{log: l.toLog()}
+			if l.BlockTimestamp != 0 {
+				parsed.timestamp = &l.BlockTimestamp
+			}
+			return parsed, nil
+		}
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	return func() (*fileLog, error) {
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if len(strings.TrimSpace(string(line))) == 0 {
+				continue
+			}
+			var l types.Log
+			err := json.Unmarshal(line, &l)
+			if err != nil {
+				return nil, err
+			}
+			var extra jsonLogExtra
+			err = json.Unmarshal(line, &extra)
+			if err != nil {
+				return nil, err
+			}
+			parsed := &fileLog{log: &l}
+			if extra.BlockTimestamp != nil {
+				ts := uint64(*extra.BlockTimestamp)
+				parsed.timestamp = &ts
+			}
+			return parsed, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
+
+func (s *FileLogSource) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// 第一次调用时扫描整个文件
+func (s *FileLogSource) BlockNumber(ctx context.Context) (uint64, error) {
+	if s.head != nil {
+		return *s.head, nil
+	}
+	f, err := os.Open(s.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	next := newLogReader(s.path, f)
+	var head uint64
+	for {
+		l, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if l.log.BlockNumber > head {
+			head = l.log.BlockNumber
+		}
+	}
+	s.head = &head
+	return head, nil
+}
+
+func (s *FileLogSource) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	from, to := filterRange(q)
+	// 只能向后读, 回退时重新打开
+	if s.file == nil || (s.lastTo != 0 && from <= s.lastTo) {
+		err := s.open()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var logs []types.Log
+	s.timestamps = map[uint64]uint64{}
+	for {
+		if s.peek == nil {
+			l, err := s.next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed read %s: %w", s.path, err)
+			}
+			s.peek = l
+		}
+		log := s.peek.log
+		if log.BlockNumber > to {
+			break
+		}
+		if log.BlockNumber >= from && matchFilter(log, q) {
+			logs = append(logs, *log)
+			if s.peek.timestamp != nil {
+				s.timestamps[log.BlockNumber] = *s.peek.timestamp
+			}
+		}
+		s.peek = nil
+	}
+	s.lastTo = to
+	return logs, nil
+}
+
+// BlockTimestamps 只返回上一次 FilterLogs 读到的 logs 所在区块的时间戳
+func (s *FileLogSource) BlockTimestamps(ctx context.Context, blockNumbers []uint64) (map[uint64]uint64, error) {
+	timestamps := map[uint64]uint64{}
+	for _, blockNumber := range blockNumbers {
+		if ts, ok := s.timestamps[blockNumber]; ok {
+			timestamps[blockNumber] = ts
+		}
+	}
+	return timestamps, nil
+}
+
+// types.Log 自带的 rlp 编码只包含 address, topics, data
+type rlpLog struct {
+	Address     common.Address
+	Topics      []common.Hash
+	Data        []byte
+	BlockNumber uint64
+	TxHash      common.Hash
+	TxIndex     uint
+	BlockHash   common.Hash
+	Index       uint
+	Removed     bool
+	// 旧文件没有时间戳
+	BlockTimestamp uint64 `rlp:"optional"`
+}
+
+func newRlpLog(log *types.Log) rlpLog {
+	return rlpLog{
+		Address:     log.Address,
+		Topics:      log.Topics,
+		Data:        log.Data,
+		BlockNumber: log.BlockNumber,
+		TxHash:      log.TxHash,
+		TxIndex:     log.TxIndex,
+		BlockHash:   log.BlockHash,
+		Index:       log.Index,
+		Removed:     log.Removed,
+	}
+}
+
+func (l *rlpLog) toLog() *types.Log {
+	return &types.Log{
+		Address:     l.Address,
+		Topics:      l.Topics,
+		Data:        l.Data,
+		BlockNumber: l.BlockNumber,
+		TxHash:      l.TxHash,
+		TxIndex:     l.TxIndex,
+		BlockHash:   l.BlockHash,
+		Index:       l.Index,
+		Removed:     l.Removed,
+	}
+}
+
+// WriteLogFile 把 logs 和所在区块的时间戳写入文件, 格式由后缀决定, 可以用 NewFileLogSource 读取
+func WriteLogFile(path string, logs []types.Log, timestamps map[uint64]uint64) error {
+	if !strings.HasSuffix(path, ".jsonl") && !strings.HasSuffix(path, ".rlp") {
+		return ErrUnknownLogFileFormat
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, log := range logs {
+		ts, hasTs := timestamps[log.BlockNumber]
+		if strings.HasSuffix(path, ".rlp") {
+			l := newRlpLog(&log)
+			l.BlockTimestamp = ts
+			err = rlp.Encode(w, &l)
+		} else {
+			err = writeJsonLog(w, &log, ts, hasTs)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func writeJsonLog(w io.Writer, log *types.Log, ts uint64, hasTs bool) error {
+	bs, err := json.Marshal(log)
+	if err != nil {
+		return err
+	}
+	if hasTs {
+		extra, err := json.Marshal(jsonLogExtra{BlockTimestamp: (*hexutil.Uint64)(&ts)})
+		if err != nil {
+			return err
+		}
+		// 合并两个 json 对象
+		bs = append(append(bs[:len(bs)-1], ','), extra[1:]...)
+	}
+	_, err = w.Write(append(bs, '\n'))
+	return err
+}
+
+// 未指定区块时表示全部区块
+func filterRange(q ethereum.FilterQuery) (uint64, uint64) {
+	var from uint64
+	to := ^uint64(0)
+	if q.BlockHash != nil {
+		return from, to
+	}
+	if q.FromBlock != nil && q.FromBlock.Sign() > 0 {
+		from = q.FromBlock.Uint64()
+	}
+	if q.ToBlock != nil && q.ToBlock.Sign() >= 0 {
+		to = q.ToBlock.Uint64()
+	}
+	return from, to
+}
+
+// 与节点 eth_getLogs 的过滤规则一致
+func matchFilter(log *types.Log, q ethereum.FilterQuery) bool {
+	if q.BlockHash != nil && log.BlockHash != *q.BlockHash {
+		return false
+	}
+	if len(q.Addresses) > 0 {
+		found := false
+		for _, addr := range q.Addresses {
+			if log.Address == addr {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(q.Topics) > len(log.Topics) {
+		return false
+	}
+	for i, sub := range q.Topics {
+		if len(sub) == 0 {
+			continue
+		}
+		found := false
+		for _, topic := range sub {
+			if log.Topics[i] == topic {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
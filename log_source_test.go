@@ -0,0 +1,137 @@
+package uniswap_v3_simulator
+
+import (
+	"context"
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/daoleno/uniswapv3-sdk/utils"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testFactory = common.HexToAddress("0x1F98431c8aD98523631AE4a59f267346ea31F984")
+	testPool    = common.HexToAddress("0x0000000000000000000000000000000000000001")
+	testOwner   = common.HexToAddress("0x00000000000000000000000000000000000000aa")
+)
+
+func int2Hash(v int64) common.Hash {
+	return common.BytesToHash(math.U256Bytes(big.NewInt(v)))
+}
+
+func testPoolCreatedLog(blockNumber uint64) types.Log {
+	data := append(int2Hash(60).Bytes(), common.BytesToHash(testPool.Bytes()).Bytes()...)
+	return types.Log{
+		Address:     testFactory,
+		Topics:      []common.Hash{TOPIC_POOL_CREATED, common.BytesToHash(common.HexToAddress("0x10").Bytes()), common.BytesToHash(common.HexToAddress("0x20").Bytes()), int2Hash(3000)},
+		Data:        data,
+		BlockNumber: blockNumber,
+	}
+}
+
+func testInitializeLog(blockNumber uint64) types.Log {
+	data := append(common.BigToHash(utils.EncodeSqrtRatioX96(big.NewInt(1), big.NewInt(1))).Bytes(), int2Hash(0).Bytes()...)
+	return types.Log{
+		Address:     testPool,
+		Topics:      []common.Hash{TOPIC_INITIALIZE},
+		Data:        data,
+		BlockNumber: blockNumber,
+		Index:       1,
+	}
+}
+
+func testMintLog(blockNumber uint64, tickLower, tickUpper int64, amount int64) types.Log {
+	var data []byte
+	data = append(data, common.BytesToHash(testOwner.Bytes()).Bytes()...)
+	data = append(data, int2Hash(amount).Bytes()...)
+	data = append(data, int2Hash(0).Bytes()...)
+	data = append(data, int2Hash(0).Bytes()...)
+	return types.Log{
+		Address:     testPool,
+		Topics:      []common.Hash{TOPIC_MINT, common.BytesToHash(testOwner.Bytes()), int2Hash(tickLower), int2Hash(tickUpper)},
+		Data:        data,
+		BlockNumber: blockNumber,
+		Index:       2,
+	}
+}
+
+// 内存中的 logs, 每个区块都有时间戳
+func newTestLogSource(logs ...types.Log) *MemoryLogSource {
+	source := NewMemoryLogSource(logs)
+	for _, log := range logs {
+		source.Timestamps[log.BlockNumber] = 1600000000 + log.BlockNumber*12
+	}
+	return source
+}
+
+func TestFileLogSource(t *testing.T) {
+	logs := []types.Log{testPoolCreatedLog(100), testInitializeLog(101), testMintLog(105, -600, 600, 1000000), testMintLog(110, -60, 60, 1000)}
+	timestamps := map[uint64]uint64{100: 1000, 101: 1012, 105: 1060, 110: 1120}
+	for _, name := range []string{"logs.jsonl", "logs.rlp"} {
+		path := filepath.Join(t.TempDir(), name)
+		assert.NoError(t, WriteLogFile(path, logs, timestamps))
+		source, err := NewFileLogSource(path)
+		assert.NoError(t, err)
+
+		head, err := source.BlockNumber(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(110), head)
+
+		got, err := source.FilterLogs(context.Background(), ethereum.FilterQuery{FromBlock: big.NewInt(0), ToBlock: big.NewInt(101)})
+		assert.NoError(t, err)
+		assert.Equal(t, logs[:2], got)
+		ts, err := source.BlockTimestamps(context.Background(), []uint64{100, 101, 105})
+		assert.NoError(t, err)
+		assert.Equal(t, map[uint64]uint64{100: 1000, 101: 1012}, ts)
+		got, err = source.FilterLogs(context.Background(), ethereum.FilterQuery{FromBlock: big.NewInt(102), ToBlock: big.NewInt(200), Topics: [][]common.Hash{{TOPIC_MINT}}})
+		assert.NoError(t, err)
+		assert.Equal(t, logs[2:], got)
+		// 回退重新读取
+		got, err = source.FilterLogs(context.Background(), ethereum.FilterQuery{FromBlock: big.NewInt(101), ToBlock: big.NewInt(105), Addresses: []common.Address{testPool}})
+		assert.NoError(t, err)
+		assert.Equal(t, logs[1:3], got)
+		assert.NoError(t, source.Close())
+	}
+	_, err := NewFileLogSource("logs.txt")
+	assert.ErrorIs(t, err, ErrUnknownLogFileFormat)
+
+	// 没有时间戳的文件无法同步
+	for _, name := range []string{"logs.jsonl", "logs.rlp"} {
+		path := filepath.Join(t.TempDir(), name)
+		assert.NoError(t, WriteLogFile(path, logs, nil))
+		source, err := NewFileLogSource(path)
+		assert.NoError(t, err)
+		got, err := source.FilterLogs(context.Background(), ethereum.FilterQuery{})
+		assert.NoError(t, err)
+		assert.Equal(t, logs, got)
+		pm := openTestSimulator(t, filepath.Join(t.TempDir(), "simulator.db"), source)
+		pm.startBlock = 99
+		_, err = pm.SyncTo(0, 10)
+		assert.ErrorIs(t, err, ErrNoBlockTimestamp)
+	}
+}
+
+func TestSimulator_SyncFromMemoryLogSource(t *testing.T) {
+	source := newTestLogSource(testMintLog(105, -600, 600, 1000000), testInitializeLog(101), testPoolCreatedLog(100))
+	pm := openTestSimulator(t, filepath.Join(t.TempDir(), "simulator.db"), source)
+	pm.startBlock = 99
+
+	synced, err := pm.SyncTo(0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(105), synced)
+	pool, ok := pm.Pools[testPool]
+	assert.True(t, ok)
+	assert.Equal(t, FeeAmount(3000), pool.Fee)
+	assert.Equal(t, 60, pool.TickSpacing)
+	assert.Equal(t, "1000000", pool.Liquidity.String())
+	assert.Equal(t, uint64(105), pool.CurrentBlockNum)
+	assert.Equal(t, uint64(1600000000+105*12), pool.CurrentBlockTimestamp)
+
+	_, err = openTestSimulator(t, filepath.Join(t.TempDir(), "simulator.db"), nil).SyncTo(0, 10)
+	assert.ErrorIs(t, err, ErrNoLogSource)
+}
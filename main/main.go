@@ -3,10 +3,18 @@ package main
 import uniswap_v3_simulator "github.com/CoinSummer/uniswap-v3-simulator"
 
 func main() {
-	smt := uniswap_v3_simulator.NewPoolManager("simulator.db", "https://eth-hk1.csnodes.com/v1/973eeba6738a7d8c3bd54f91adcbea89", 12369620)
+	smt, err := uniswap_v3_simulator.NewPoolManager("simulator.db", "https://eth-hk1.csnodes.com/v1/973eeba6738a7d8c3bd54f91adcbea89", 12369620)
+	if err != nil {
+		panic(err)
+	}
 
-	//err := smt.Init(10000)
-	_, err := smt.SyncTo(16381994, 10000)
+	// 本地缓存 logs, 重建数据库时不需要重新请求节点
+	err = smt.EnableLogCache("simulator.logs")
+	if err != nil {
+		panic(err)
+	}
+	//err = smt.Init(10000)
+	_, err = smt.SyncTo(16381994, 10000)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	uniswap_v3_simulator "github.com/CoinSummer/uniswap-v3-simulator"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+)
+
+// 从链上记录测试使用的数据, 例如
+// go run ./main/record -rpc https://... wraps pool,owner,tickLower,tickUpper,block
+// go run ./main/record -rpc https://... swaps pool,fromBlock,toBlock
+func main() {
+	rpcUrl := flag.String("rpc", "", "ethereum rpc url")
+	out := flag.String("out", "", "output file, default testdata file of the kind")
+	flag.Parse()
+	if *rpcUrl == "" || flag.NArg() < 2 {
+		fmt.Fprintln(os.Stderr, "usage: record -rpc url wraps pool,owner,tickLower,tickUpper,block ...")
+		fmt.Fprintln(os.Stderr, "       record -rpc url swaps pool,fromBlock,toBlock")
+		os.Exit(2)
+	}
+	dir, err := os.MkdirTemp("", "record")
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	smt, err := uniswap_v3_simulator.NewPoolManager(filepath.Join(dir, "simulator.db"), *rpcUrl, 0)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	caller, err := uniswap_v3_simulator.NewRpcLogSource(*rpcUrl)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	switch flag.Arg(0) {
+	case "wraps":
+		file := *out
+		if file == "" {
+			file = "testdata/onchain_wraps.json"
+		}
+		for _, spec := range flag.Args()[1:] {
+			err = recordWrapCase(smt, caller, file, spec)
+			if err != nil {
+				logrus.Fatalf("failed record %s: %s", spec, err)
+			}
+		}
+	case "swaps":
+		prefix := *out
+		if prefix == "" {
+			prefix = "testdata/mainnet_swaps"
+		}
+		err = recordSwaps(smt, caller, prefix, flag.Arg(1))
+		if err != nil {
+			logrus.Fatalf("failed record %s: %s", flag.Arg(1), err)
+		}
+	default:
+		logrus.Fatalf("unknown kind %s", flag.Arg(0))
+	}
+}
+
+// 与 fixed_math_test.go 中的 onChainWrapCase 相同
+type wrapCase struct {
+	Pool                 string                         `json:"pool"`
+	BlockNum             uint64                         `json:"blockNum"`
+	Owner                string                         `json:"owner"`
+	TickLower            int                            `json:"tickLower"`
+	TickUpper            int                            `json:"tickUpper"`
+	TickCurrent          int                            `json:"tickCurrent"`
+	FeeGrowthGlobal0X128 decimal.Decimal                `json:"feeGrowthGlobal0X128"`
+	FeeGrowthGlobal1X128 decimal.Decimal                `json:"feeGrowthGlobal1X128"`
+	Lower                *uniswap_v3_simulator.Tick     `json:"lower"`
+	Upper                *uniswap_v3_simulator.Tick     `json:"upper"`
+	Position             *uniswap_v3_simulator.Position `json:"position"`
+}
+
+// 记录 position 和两个边界 tick, 追加到 file. position 最后一次更新之后 pool 没有 swap 时才能用于测试
+func recordWrapCase(smt *uniswap_v3_simulator.Simulator, caller *uniswap_v3_simulator.RpcLogSource, file, spec string) error {
+	parts := strings.Split(spec, ",")
+	if len(parts) != 5 {
+		return fmt.Errorf("expect pool,owner,tickLower,tickUpper,block")
+	}
+	tickLower, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return err
+	}
+	tickUpper, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return err
+	}
+	blockNum, err := strconv.ParseUint(parts[4], 10, 64)
+	if err != nil {
+		return err
+	}
+	pool, err := smt.LoadPoolFromChain(common.HexToAddress(parts[0]), blockNum)
+	if err != nil {
+		return err
+	}
+	position, err := pool.LoadPosition(caller, blockNum, parts[1], tickLower, tickUpper)
+	if err != nil {
+		return err
+	}
+	var cases []*wrapCase
+	if bs, err := os.ReadFile(file); err == nil {
+		err = json.Unmarshal(bs, &cases)
+		if err != nil {
+			return err
+		}
+	}
+	cases = append(cases, &wrapCase{
+		Pool:                 pool.PoolAddress,
+		BlockNum:             blockNum,
+		Owner:                parts[1],
+		TickLower:            tickLower,
+		TickUpper:            tickUpper,
+		TickCurrent:          pool.TickCurrent,
+		FeeGrowthGlobal0X128: pool.FeeGrowthGlobal0X128,
+		FeeGrowthGlobal1X128: pool.FeeGrowthGlobal1X128,
+		Lower:                pool.TickManager.Ticks[tickLower],
+		Upper:                pool.TickManager.Ticks[tickUpper],
+		Position:             position,
+	})
+	bs, err := json.MarshalIndent(cases, "", "  ")
+	if err != nil {
+		return err
+	}
+	logrus.Infof("record wrap case %s, %d cases", spec, len(cases))
+	return os.WriteFile(file, bs, 0644)
+}
+
+// 记录 pool 在 fromBlock 的状态和 (fromBlock, toBlock] 的 Swap logs, 写入 prefix.export 和 prefix.json.
+// 只记录到第一个修改 liquidity 或 fee 的 log 之前, 之后的 swap 只依赖 pool 的状态和之前的 swap
+func recordSwaps(smt *uniswap_v3_simulator.Simulator, caller *uniswap_v3_simulator.RpcLogSource, prefix, spec string) error {
+	parts := strings.Split(spec, ",")
+	if len(parts) != 3 {
+		return fmt.Errorf("expect pool,fromBlock,toBlock")
+	}
+	address := common.HexToAddress(parts[0])
+	fromBlock, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return err
+	}
+	toBlock, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return err
+	}
+	pool, err := smt.LoadPoolFromChain(address, fromBlock)
+	if err != nil {
+		return err
+	}
+	logs, err := caller.FilterLogs(context.Background(), ethereum.FilterQuery{
+		FromBlock: new(big.Int).SetUint64(fromBlock + 1),
+		ToBlock:   new(big.Int).SetUint64(toBlock),
+		Addresses: []common.Address{address},
+	})
+	if err != nil {
+		return err
+	}
+	var swaps []types.Log
+	for _, log := range logs {
+		if len(log.Topics) == 0 {
+			continue
+		}
+		topic0 := log.Topics[0]
+		if topic0 == uniswap_v3_simulator.TOPIC_MINT || topic0 == uniswap_v3_simulator.TOPIC_BURN ||
+			topic0 == uniswap_v3_simulator.TOPIC_FLASH || topic0 == uniswap_v3_simulator.TOPIC_SET_FEE_PROTOCOL {
+			break
+		}
+		if topic0 == uniswap_v3_simulator.TOPIC_SWAP {
+			swaps = append(swaps, log)
+		}
+	}
+	if len(swaps) == 0 {
+		return fmt.Errorf("no swap before liquidity change")
+	}
+	var buf bytes.Buffer
+	err = uniswap_v3_simulator.ExportPools(&buf, fromBlock, []*uniswap_v3_simulator.CorePool{pool})
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(prefix+".export", buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	bs, err := json.MarshalIndent(swaps, "", "  ")
+	if err != nil {
+		return err
+	}
+	logrus.Infof("record %d swaps of %s", len(swaps), address)
+	return os.WriteFile(prefix+".json", bs, 0644)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	uniswap_v3_simulator "github.com/CoinSummer/uniswap-v3-simulator"
+	"github.com/sirupsen/logrus"
+)
+
+// 比较数据库中的 pool 与链上状态, 输出 json 格式的差异报告
+func main() {
+	dbFile := flag.String("db", "simulator.db", "simulator database")
+	rpcUrl := flag.String("rpc", "", "ethereum rpc url")
+	samples := flag.Int("positions", uniswap_v3_simulator.DefaultPositionSamples, "positions sampled per pool, negative to skip")
+	interval := flag.Duration("interval", 0, "sync and verify every interval, 0 to run once")
+	blockNum := flag.Uint64("block", 0, "verify at block, 0 to use the synced block")
+	flag.Parse()
+
+	smt, err := uniswap_v3_simulator.NewPoolManager(*dbFile, *rpcUrl, 0)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	opts := uniswap_v3_simulator.VerifyOptions{PositionSamples: *samples, OnlyMismatched: true, BlockNum: *blockNum}
+	if *interval == 0 {
+		report, err := smt.VerifyPools(opts)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		fmt.Println(report.JSON())
+		if !report.OK() {
+			os.Exit(1)
+		}
+		return
+	}
+	go func() {
+		for {
+			_, err := smt.SyncBlocks(0, 10000)
+			if err != nil {
+				logrus.Errorf("sync failed: %s", err)
+			}
+			time.Sleep(*interval)
+		}
+	}()
+	err = smt.RunVerifier(context.Background(), *interval, opts, func(report *uniswap_v3_simulator.VerifyReport) {
+		fmt.Println(report.JSON())
+	})
+	if err != nil {
+		logrus.Fatal(err)
+	}
+}
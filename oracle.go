@@ -0,0 +1,272 @@
+package uniswap_v3_simulator
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// 对应合约 Oracle.sol, 最多 65535 个 observation
+type Observation struct {
+	BlockTimestamp                    uint32
+	TickCumulative                    int64 // int56
+	SecondsPerLiquidityCumulativeX128 decimal.Decimal
+	Initialized                       bool
+}
+
+func (o *Observation) Clone() *Observation {
+	return &Observation{
+		BlockTimestamp:                    o.BlockTimestamp,
+		TickCumulative:                    o.TickCumulative,
+		SecondsPerLiquidityCumulativeX128: o.SecondsPerLiquidityCumulativeX128,
+		Initialized:                       o.Initialized,
+	}
+}
+
+var (
+	ErrOracleNotInitialized = errors.New("I")
+	ErrOracleTooOld         = errors.New("OLD")
+)
+
+func transform(last *Observation, blockTimestamp uint32, tick int, liquidity decimal.Decimal) *Observation {
+	delta := blockTimestamp - last.BlockTimestamp
+	liq := liquidity.BigInt()
+	if liq.Sign() <= 0 {
+		liq = big.NewInt(1)
+	}
+	spl := new(big.Int).Lsh(big.NewInt(int64(delta)), 128)
+	spl.Div(spl, liq)
+	spl.Add(spl, last.SecondsPerLiquidityCumulativeX128.BigInt())
+	return &Observation{
+		BlockTimestamp:                    blockTimestamp,
+		TickCumulative:                    wrapInt56(last.TickCumulative + int64(tick)*int64(delta)),
+		SecondsPerLiquidityCumulativeX128: wrapUint160(spl),
+		Initialized:                       true,
+	}
+}
+
+// 比较两个可能溢出的 uint32 时间戳, time 为当前时间, a 和 b 都不晚于 time
+func lte(time, a, b uint32) bool {
+	if a <= time && b <= time {
+		return a <= b
+	}
+	aAdjusted := uint64(a)
+	if a <= time {
+		aAdjusted += 1 << 32
+	}
+	bAdjusted := uint64(b)
+	if b <= time {
+		bAdjusted += 1 << 32
+	}
+	return aAdjusted <= bAdjusted
+}
+
+type Oracle struct {
+	Observations []*Observation `json:"observations"`
+}
+
+func NewOracle() *Oracle {
+	return &Oracle{Observations: []*Observation{}}
+}
+
+func (o *Oracle) Clone() *Oracle {
+	observations := make([]*Observation, len(o.Observations))
+	for i, observation := range o.Observations {
+		observations[i] = observation.Clone()
+	}
+	return &Oracle{Observations: observations}
+}
+
+func (o *Oracle) get(index int) *Observation {
+	if index < len(o.Observations) && o.Observations[index] != nil {
+		return o.Observations[index]
+	}
+	return &Observation{SecondsPerLiquidityCumulativeX128: ZERO}
+}
+
+func (o *Oracle) set(index int, observation *Observation) {
+	for len(o.Observations) <= index {
+		o.Observations = append(o.Observations, &Observation{SecondsPerLiquidityCumulativeX128: ZERO})
+	}
+	o.Observations[index] = observation
+}
+
+func (o *Oracle) Initialize(time uint32) (uint16, uint16) {
+	o.Observations = []*Observation{{
+		BlockTimestamp:                    time,
+		TickCumulative:                    0,
+		SecondsPerLiquidityCumulativeX128: ZERO,
+		Initialized:                       true,
+	}}
+	return 1, 1
+}
+
+// Write 返回新的 observationIndex 和 observationCardinality
+func (o *Oracle) Write(index uint16, blockTimestamp uint32, tick int, liquidity decimal.Decimal, cardinality, cardinalityNext uint16) (uint16, uint16) {
+	last := o.get(int(index))
+	// 同一个区块只写一次
+	if last.BlockTimestamp == blockTimestamp {
+		return index, cardinality
+	}
+	cardinalityUpdated := cardinality
+	if cardinalityNext > cardinality && index == cardinality-1 {
+		cardinalityUpdated = cardinalityNext
+	}
+	indexUpdated := uint16((uint32(index) + 1) % uint32(cardinalityUpdated))
+	o.set(int(indexUpdated), transform(last, blockTimestamp, tick, liquidity))
+	return indexUpdated, cardinalityUpdated
+}
+
+func (o *Oracle) Grow(current, next uint16) (uint16, error) {
+	if current == 0 {
+		return 0, ErrOracleNotInitialized
+	}
+	if next <= current {
+		return current, nil
+	}
+	// 预先写入非 0 时间戳, 与合约一致
+	for i := int(current); i < int(next); i++ {
+		o.set(i, &Observation{BlockTimestamp: 1, SecondsPerLiquidityCumulativeX128: ZERO})
+	}
+	return next, nil
+}
+
+func (o *Oracle) binarySearch(time, target uint32, index, cardinality uint16) (*Observation, *Observation) {
+	l := (int(index) + 1) % int(cardinality)
+	r := l + int(cardinality) - 1
+	for {
+		i := (l + r) / 2
+		beforeOrAt := o.get(i % int(cardinality))
+		if !beforeOrAt.Initialized {
+			l = i + 1
+			continue
+		}
+		atOrAfter := o.get((i + 1) % int(cardinality))
+		targetAtOrAfter := lte(time, beforeOrAt.BlockTimestamp, target)
+		if targetAtOrAfter && lte(time, target, atOrAfter.BlockTimestamp) {
+			return beforeOrAt, atOrAfter
+		}
+		if !targetAtOrAfter {
+			r = i - 1
+		} else {
+			l = i + 1
+		}
+	}
+}
+
+func (o *Oracle) getSurroundingObservations(time, target uint32, tick int, index uint16, liquidity decimal.Decimal, cardinality uint16) (*Observation, *Observation, error) {
+	beforeOrAt := o.get(int(index))
+	if lte(time, beforeOrAt.BlockTimestamp, target) {
+		if beforeOrAt.BlockTimestamp == target {
+			return beforeOrAt, nil, nil
+		}
+		return beforeOrAt, transform(beforeOrAt, target, tick, liquidity), nil
+	}
+	beforeOrAt = o.get((int(index) + 1) % int(cardinality))
+	if !beforeOrAt.Initialized {
+		beforeOrAt = o.get(0)
+	}
+	if !lte(time, beforeOrAt.BlockTimestamp, target) {
+		return nil, nil, ErrOracleTooOld
+	}
+	beforeOrAt, atOrAfter := o.binarySearch(time, target, index, cardinality)
+	return beforeOrAt, atOrAfter, nil
+}
+
+func (o *Oracle) ObserveSingle(time, secondsAgo uint32, tick int, index uint16, liquidity decimal.Decimal, cardinality uint16) (int64, decimal.Decimal, error) {
+	if cardinality == 0 {
+		return 0, ZERO, ErrOracleNotInitialized
+	}
+	if secondsAgo == 0 {
+		last := o.get(int(index))
+		if last.BlockTimestamp != time {
+			last = transform(last, time, tick, liquidity)
+		}
+		return last.TickCumulative, last.SecondsPerLiquidityCumulativeX128, nil
+	}
+	target := time - secondsAgo
+	beforeOrAt, atOrAfter, err := o.getSurroundingObservations(time, target, tick, index, liquidity, cardinality)
+	if err != nil {
+		return 0, ZERO, err
+	}
+	if target == beforeOrAt.BlockTimestamp {
+		return beforeOrAt.TickCumulative, beforeOrAt.SecondsPerLiquidityCumulativeX128, nil
+	}
+	if target == atOrAfter.BlockTimestamp {
+		return atOrAfter.TickCumulative, atOrAfter.SecondsPerLiquidityCumulativeX128, nil
+	}
+	// 在两个 observation 之间插值
+	observationTimeDelta := int64(atOrAfter.BlockTimestamp - beforeOrAt.BlockTimestamp)
+	targetDelta := int64(target - beforeOrAt.BlockTimestamp)
+	tickCumulative := wrapInt56(beforeOrAt.TickCumulative + (wrapInt56(atOrAfter.TickCumulative-beforeOrAt.TickCumulative)/observationTimeDelta)*targetDelta)
+
+	splDelta := new(big.Int).Sub(atOrAfter.SecondsPerLiquidityCumulativeX128.BigInt(), beforeOrAt.SecondsPerLiquidityCumulativeX128.BigInt())
+	splDelta.Mod(splDelta, two160)
+	splDelta.Mul(splDelta, big.NewInt(targetDelta))
+	splDelta.Div(splDelta, big.NewInt(observationTimeDelta))
+	splDelta.Mod(splDelta, two160)
+	spl := splDelta.Add(splDelta, beforeOrAt.SecondsPerLiquidityCumulativeX128.BigInt())
+	return tickCumulative, wrapUint160(spl), nil
+}
+
+func (o *Oracle) Observe(time uint32, secondsAgos []uint32, tick int, index uint16, liquidity decimal.Decimal, cardinality uint16) ([]int64, []decimal.Decimal, error) {
+	if cardinality == 0 {
+		return nil, nil, ErrOracleNotInitialized
+	}
+	tickCumulatives := make([]int64, len(secondsAgos))
+	secondsPerLiquidityCumulativeX128s := make([]decimal.Decimal, len(secondsAgos))
+	for i, secondsAgo := range secondsAgos {
+		tickCumulative, spl, err := o.ObserveSingle(time, secondsAgo, tick, index, liquidity, cardinality)
+		if err != nil {
+			return nil, nil, err
+		}
+		tickCumulatives[i] = tickCumulative
+		secondsPerLiquidityCumulativeX128s[i] = spl
+	}
+	return tickCumulatives, secondsPerLiquidityCumulativeX128s, nil
+}
+
+func (nc *Oracle) GormDataType() string {
+	return "LONGTEXT"
+}
+
+// postgres 没有 LONGTEXT
+func (nc *Oracle) GormDBDataType(db *gorm.DB, field *schema.Field) string {
+	if db.Dialector.Name() == "postgres" {
+		return "TEXT"
+	}
+	return nc.GormDataType()
+}
+
+func (j *Oracle) Scan(value interface{}) error {
+	var err error
+	switch v := value.(type) {
+	case []byte:
+		{
+			err = json.Unmarshal(v, j)
+		}
+	case string:
+		{
+			err = json.Unmarshal([]byte(v), j)
+		}
+	case nil:
+		return nil
+	default:
+		err = errors.New(fmt.Sprint("Failed to unmarshal Oracle value:", value))
+	}
+	return err
+}
+
+func (j *Oracle) Value() (driver.Value, error) {
+	bs, err := json.Marshal(j)
+	if err != nil {
+		return nil, err
+	}
+	return string(bs), nil
+}
@@ -0,0 +1,74 @@
+package uniswap_v3_simulator
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOracle_Lte(t *testing.T) {
+	assert.True(t, lte(100, 10, 20))
+	assert.False(t, lte(100, 20, 10))
+	// b 在 time 之后, 说明 a 已经溢出回绕
+	assert.True(t, lte(5, 4294967290, 3))
+	assert.False(t, lte(5, 3, 4294967290))
+}
+
+func TestOracle_WriteAndObserve(t *testing.T) {
+	oracle := NewOracle()
+	cardinality, cardinalityNext := oracle.Initialize(100)
+	assert.Equal(t, uint16(1), cardinality)
+
+	cardinalityNext, err := oracle.Grow(cardinalityNext, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(3), cardinalityNext)
+
+	liquidity := decimal.NewFromInt(10)
+	index, cardinality := oracle.Write(0, 110, 5, liquidity, cardinality, cardinalityNext)
+	assert.Equal(t, uint16(1), index)
+	assert.Equal(t, uint16(3), cardinality)
+	// 同一个区块不重复写入
+	index, cardinality = oracle.Write(index, 110, 7, liquidity, cardinality, cardinalityNext)
+	assert.Equal(t, uint16(1), index)
+
+	tickCumulative, _, err := oracle.ObserveSingle(120, 0, 5, index, liquidity, cardinality)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), tickCumulative)
+
+	// 100 ~ 110 之间插值
+	tickCumulative, spl, err := oracle.ObserveSingle(120, 15, 5, index, liquidity, cardinality)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(25), tickCumulative)
+	expected := new(big.Int).Lsh(big.NewInt(5), 128)
+	assert.Equal(t, expected.Div(expected, big.NewInt(10)).String(), spl.String())
+
+	_, _, err = oracle.ObserveSingle(120, 30, 5, index, liquidity, cardinality)
+	assert.ErrorIs(t, err, ErrOracleTooOld)
+
+	_, _, err = NewOracle().Observe(120, []uint32{0}, 0, 0, liquidity, 0)
+	assert.ErrorIs(t, err, ErrOracleNotInitialized)
+}
+
+func TestCorePool_SnapshotCumulativesInside(t *testing.T) {
+	pool := newTestPool(t)
+	pool.CurrentBlockTimestamp = 10
+
+	tickCumulatives, spls, err := pool.Observe([]uint32{10, 0})
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{0, 0}, tickCumulatives)
+	expected := new(big.Int).Lsh(big.NewInt(10), 128)
+	expected.Div(expected, big.NewInt(1000000))
+	assert.True(t, spls[0].IsZero())
+	assert.Equal(t, expected.String(), spls[1].String())
+
+	tickCumulativeInside, splInside, secondsInside, err := pool.SnapshotCumulativesInside(-600, 600)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), tickCumulativeInside)
+	assert.Equal(t, expected.String(), splInside.String())
+	assert.Equal(t, uint32(10), secondsInside)
+
+	_, _, _, err = pool.SnapshotCumulativesInside(-1200, 600)
+	assert.Error(t, err)
+}
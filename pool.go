@@ -3,9 +3,8 @@ package uniswap_v3_simulator
 import (
 	"errors"
 	"fmt"
-	"github.com/daoleno/uniswapv3-sdk/constants"
-	"github.com/daoleno/uniswapv3-sdk/utils"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
 	"github.com/shopspring/decimal"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
@@ -39,24 +38,36 @@ func NewPoolConfig(
 // core pool
 type CorePool struct {
 	gorm.Model
-	PoolAddress          string `gorm:"index"`
-	HasCreated           bool   // has created in db, Flush will set to true
-	Token0               string
-	Token1               string
-	Fee                  FeeAmount
-	TickSpacing          int
-	MaxLiquidityPerTick  decimal.Decimal
-	CurrentBlockNum      uint64 `gorm:"index"`
-	DeployBlockNum       uint64 `gorm:"index"`
-	Token0Balance        decimal.Decimal
-	Token1Balance        decimal.Decimal
-	SqrtPriceX96         decimal.Decimal
-	Liquidity            decimal.Decimal
-	TickCurrent          int
-	FeeGrowthGlobal0X128 decimal.Decimal
-	FeeGrowthGlobal1X128 decimal.Decimal
-	TickManager          *TickManager
-	PositionManager      *PositionManager
+	PoolAddress         string `gorm:"index"`
+	HasCreated          bool   // has created in db, Flush will set to true
+	Token0              string
+	Token1              string
+	Fee                 FeeAmount
+	TickSpacing         int
+	MaxLiquidityPerTick decimal.Decimal
+	CurrentBlockNum     uint64 `gorm:"index"`
+	// 当前处理的事件所在区块的时间戳, oracle 使用
+	CurrentBlockTimestamp uint64
+	DeployBlockNum        uint64 `gorm:"index"`
+	BootstrapBlockNum     uint64 // 从链上加载时的区块, 之前的 logs 不再应用
+	Token0Balance         decimal.Decimal
+	Token1Balance         decimal.Decimal
+	SqrtPriceX96          decimal.Decimal
+	Liquidity             decimal.Decimal
+	TickCurrent           int
+	FeeGrowthGlobal0X128  decimal.Decimal
+	FeeGrowthGlobal1X128  decimal.Decimal
+	FeeProtocol           uint8 // slot0.feeProtocol, 低4位为token0, 高4位为token1
+	ProtocolFeesToken0    decimal.Decimal
+	ProtocolFeesToken1    decimal.Decimal
+	// oracle, 对应 slot0 中的 observationIndex, observationCardinality, observationCardinalityNext
+	ObservationIndex           uint16
+	ObservationCardinality     uint16
+	ObservationCardinalityNext uint16
+	Observations               *Oracle
+	// 保存在 pool_ticks, pool_positions 表
+	TickManager     *TickManager     `gorm:"-"`
+	PositionManager *PositionManager `gorm:"-"`
 }
 
 func (p *CorePool) Clone() *CorePool {
@@ -70,6 +81,7 @@ func (p *CorePool) Clone() *CorePool {
 		MaxLiquidityPerTick:  p.MaxLiquidityPerTick,
 		CurrentBlockNum:      p.CurrentBlockNum,
 		DeployBlockNum:       p.DeployBlockNum,
+		BootstrapBlockNum:    p.BootstrapBlockNum,
 		Token0Balance:        p.Token0Balance,
 		Token1Balance:        p.Token1Balance,
 		SqrtPriceX96:         p.SqrtPriceX96,
@@ -77,8 +89,19 @@ func (p *CorePool) Clone() *CorePool {
 		TickCurrent:          p.TickCurrent,
 		FeeGrowthGlobal0X128: p.FeeGrowthGlobal0X128,
 		FeeGrowthGlobal1X128: p.FeeGrowthGlobal1X128,
+		FeeProtocol:          p.FeeProtocol,
+		ProtocolFeesToken0:   p.ProtocolFeesToken0,
+		ProtocolFeesToken1:   p.ProtocolFeesToken1,
 		TickManager:          p.TickManager.Clone(),
 		PositionManager:      p.PositionManager.Clone(),
+
+		CurrentBlockTimestamp:      p.CurrentBlockTimestamp,
+		ObservationIndex:           p.ObservationIndex,
+		ObservationCardinality:     p.ObservationCardinality,
+		ObservationCardinalityNext: p.ObservationCardinalityNext,
+	}
+	if p.Observations != nil {
+		newPool.Observations = p.Observations.Clone()
 	}
 	return newPool
 }
@@ -98,6 +121,9 @@ func NewCorePoolFromConfig(addr string, config PoolConfig) *CorePool {
 		TickCurrent:          0,
 		FeeGrowthGlobal0X128: ZERO,
 		FeeGrowthGlobal1X128: ZERO,
+		ProtocolFeesToken0:   ZERO,
+		ProtocolFeesToken1:   ZERO,
+		Observations:         NewOracle(),
 		TickManager:          NewTickManager(),
 		PositionManager:      NewPositionManager(),
 	}
@@ -105,7 +131,7 @@ func NewCorePoolFromConfig(addr string, config PoolConfig) *CorePool {
 
 func (p *CorePool) Initialize(sqrtPriceX96 decimal.Decimal) error {
 	if !p.SqrtPriceX96.IsZero() {
-		return errors.New("Already initialized!")
+		return ErrAlreadyInitialized
 	}
 	var err error
 	p.TickCurrent, err = GetTickAtSqrtRatio(sqrtPriceX96)
@@ -113,40 +139,124 @@ func (p *CorePool) Initialize(sqrtPriceX96 decimal.Decimal) error {
 		return err
 	}
 	p.SqrtPriceX96 = sqrtPriceX96
+	p.ObservationIndex = 0
+	p.ObservationCardinality, p.ObservationCardinalityNext = p.ensureOracle().Initialize(p.blockTimestamp())
 	return nil
 }
 
-// 从链上同步数据， 并保存snapshot到数据库(覆盖上一个snapshot)
-// 从数据库加载snapshot， 然后检查和最新区块的差距, 并同步到最新区块
-// 如果数据库中没有snapshot，则从initialize开始同步所有event
-func (p *CorePool) Load() error {
-	if p.DeployBlockNum == 0 {
-		// todo etherscan api 获取 部署blockNum
+func (p *CorePool) blockTimestamp() uint32 {
+	return uint32(p.CurrentBlockTimestamp)
+}
+
+// 旧数据没有 oracle, 从当前区块开始记录
+func (p *CorePool) ensureOracle() *Oracle {
+	if p.Observations == nil {
+		p.Observations = NewOracle()
 	}
+	if p.ObservationCardinality == 0 {
+		p.ObservationIndex = 0
+		p.ObservationCardinality, p.ObservationCardinalityNext = p.Observations.Initialize(p.blockTimestamp())
+	}
+	return p.Observations
+}
+
+func (p *CorePool) IncreaseObservationCardinalityNext(observationCardinalityNext uint16) error {
+	next, err := p.ensureOracle().Grow(p.ObservationCardinalityNext, observationCardinalityNext)
+	if err != nil {
+		return err
+	}
+	p.ObservationCardinalityNext = next
 	return nil
 }
 
+// Observe 以当前区块时间为准, 返回每个 secondsAgo 对应的 tickCumulative 和 secondsPerLiquidityCumulativeX128
+func (p *CorePool) Observe(secondsAgos []uint32) ([]int64, []decimal.Decimal, error) {
+	return p.ObserveAt(p.blockTimestamp(), secondsAgos)
+}
+
+// ObserveAt 与 Observe 相同, 但以 time 作为当前时间, time 不能早于最新的 observation
+func (p *CorePool) ObserveAt(time uint32, secondsAgos []uint32) ([]int64, []decimal.Decimal, error) {
+	if p.Observations == nil {
+		return nil, nil, ErrOracleNotInitialized
+	}
+	return p.Observations.Observe(time, secondsAgos, p.TickCurrent, p.ObservationIndex, p.Liquidity, p.ObservationCardinality)
+}
+
+// SnapshotCumulativesInside 返回 tick 区间内的 tickCumulative, secondsPerLiquidityX128 和 seconds 快照
+func (p *CorePool) SnapshotCumulativesInside(tickLower, tickUpper int) (int64, decimal.Decimal, uint32, error) {
+	err := p.checkTicks(tickLower, tickUpper)
+	if err != nil {
+		return 0, ZERO, 0, err
+	}
+	lower, ok := p.TickManager.Ticks[tickLower]
+	if !ok || !lower.Initialized() {
+		return 0, ZERO, 0, fmt.Errorf("%w: tickLower %d", ErrTickNotInitialized, tickLower)
+	}
+	upper, ok := p.TickManager.Ticks[tickUpper]
+	if !ok || !upper.Initialized() {
+		return 0, ZERO, 0, fmt.Errorf("%w: tickUpper %d", ErrTickNotInitialized, tickUpper)
+	}
+	lowerSpl := lower.SecondsPerLiquidityOutsideX128.BigInt()
+	upperSpl := upper.SecondsPerLiquidityOutsideX128.BigInt()
+	if p.TickCurrent < tickLower {
+		return wrapInt56(lower.TickCumulativeOutside - upper.TickCumulativeOutside),
+			wrapUint160(lowerSpl.Sub(lowerSpl, upperSpl)),
+			lower.SecondsOutside - upper.SecondsOutside,
+			nil
+	} else if p.TickCurrent < tickUpper {
+		if p.Observations == nil {
+			return 0, ZERO, 0, ErrOracleNotInitialized
+		}
+		time := p.blockTimestamp()
+		tickCumulative, spl, err := p.Observations.ObserveSingle(time, 0, p.TickCurrent, p.ObservationIndex, p.Liquidity, p.ObservationCardinality)
+		if err != nil {
+			return 0, ZERO, 0, err
+		}
+		splInside := spl.BigInt()
+		splInside.Sub(splInside, lowerSpl).Sub(splInside, upperSpl)
+		return wrapInt56(tickCumulative - lower.TickCumulativeOutside - upper.TickCumulativeOutside),
+			wrapUint160(splInside),
+			time - lower.SecondsOutside - upper.SecondsOutside,
+			nil
+	} else {
+		return wrapInt56(upper.TickCumulativeOutside - lower.TickCumulativeOutside),
+			wrapUint160(upperSpl.Sub(upperSpl, lowerSpl)),
+			upper.SecondsOutside - lower.SecondsOutside,
+			nil
+	}
+}
+
 func (p *CorePool) Mint(recipient string, tickLower, tickUpper int, amount decimal.Decimal) (decimal.Decimal, decimal.Decimal, error) {
 	if !amount.GreaterThan(ZERO) {
-		return ZERO, ZERO, errors.New("Mint amount should greater than 0")
+		return ZERO, ZERO, fmt.Errorf("%w: %s", ErrInvalidMintAmount, amount)
 	}
 
-	_, amount0, amount1, err := p.modifyPosition(recipient, tickLower, tickUpper, amount)
+	// int256(amount).toInt128()
+	liquidityDelta, err := ToInt128(amount)
+	if err != nil {
+		return ZERO, ZERO, err
+	}
+	_, amount0, amount1, err := p.modifyPosition(recipient, tickLower, tickUpper, liquidityDelta)
 	if err != nil {
 		return ZERO, ZERO, err
 	}
 	return amount0, amount1, nil
 }
 func (p *CorePool) Burn(owner string, tickLower, tickUpper int, amount decimal.Decimal) (decimal.Decimal, decimal.Decimal, error) {
-	position, amount0, amount1, err := p.modifyPosition(owner, tickLower, tickUpper, amount.Neg())
+	// -int256(amount).toInt128()
+	liquidityDelta, err := ToInt128(amount)
+	if err != nil {
+		return ZERO, ZERO, err
+	}
+	position, amount0, amount1, err := p.modifyPosition(owner, tickLower, tickUpper, liquidityDelta.Neg())
 	if err != nil {
 		return ZERO, ZERO, err
 	}
 	amount0 = amount0.Neg()
 	amount1 = amount1.Neg()
 	if amount0.IsPositive() || amount1.IsPositive() {
-		newTokensOwed0 := position.TokensOwed0.Add(amount0)
-		newTokensOwed1 := position.TokensOwed1.Add(amount1)
+		newTokensOwed0 := AddUint128(position.TokensOwed0, amount0)
+		newTokensOwed1 := AddUint128(position.TokensOwed1, amount1)
 		position.UpdateBurn(newTokensOwed0, newTokensOwed1)
 	}
 	return amount0, amount1, nil
@@ -160,77 +270,199 @@ func (p *CorePool) Collect(recipient string, tickLower, tickUpper int, amount0Re
 	return p.PositionManager.CollectPosition(recipient, tickLower, tickUpper, amount0Req, amount1Req)
 }
 
+var ErrCollectMismatch = errors.New("collect amount mismatch")
+
+// HandleCollectEvent 执行 Collect 事件, 并校验链上实际 collect 的数量和模拟的 tokensOwed 是否一致
+func (p *CorePool) HandleCollectEvent(collect *UniV3CollectEvent) error {
+	owed := p.PositionManager.GetPositionReadonly(collect.Owner, collect.TickLower, collect.TickUpper)
+	amount0, amount1, err := p.Collect(collect.Owner, collect.TickLower, collect.TickUpper, collect.Amount0, collect.Amount1)
+	if err != nil {
+		return err
+	}
+	if !amount0.Equal(collect.Amount0) || !amount1.Equal(collect.Amount1) {
+		return fmt.Errorf("%w, owner: %s ticks: [%d, %d] collected: %s/%s simulated tokensOwed: %s/%s",
+			ErrCollectMismatch, collect.Owner, collect.TickLower, collect.TickUpper, collect.Amount0, collect.Amount1, owed.TokensOwed0, owed.TokensOwed1)
+	}
+	return nil
+}
+
+// Flash 对应合约 flash 的手续费记账, paid0/paid1 为闪电贷实际支付的手续费
+func (p *CorePool) Flash(paid0, paid1 decimal.Decimal) error {
+	if !p.Liquidity.IsPositive() {
+		return ErrNoLiquidity
+	}
+	if paid0.IsPositive() {
+		fees0 := protocolFeeOf(paid0, p.FeeProtocol0())
+		p.ProtocolFeesToken0 = AddUint128(p.ProtocolFeesToken0, fees0)
+		p.FeeGrowthGlobal0X128 = AddUint256(p.FeeGrowthGlobal0X128, paid0.Sub(fees0).Mul(Q128).Div(p.Liquidity).RoundDown(0))
+	}
+	if paid1.IsPositive() {
+		fees1 := protocolFeeOf(paid1, p.FeeProtocol1())
+		p.ProtocolFeesToken1 = AddUint128(p.ProtocolFeesToken1, fees1)
+		p.FeeGrowthGlobal1X128 = AddUint256(p.FeeGrowthGlobal1X128, paid1.Sub(fees1).Mul(Q128).Div(p.Liquidity).RoundDown(0))
+	}
+	return nil
+}
+
+// 协议手续费为 feeAmount / feeProtocol, feeProtocol 为 0 表示未开启
+func protocolFeeOf(feeAmount decimal.Decimal, feeProtocol uint8) decimal.Decimal {
+	if feeProtocol == 0 {
+		return ZERO
+	}
+	return feeAmount.Div(decimal.NewFromInt(int64(feeProtocol))).RoundDown(0)
+}
+
+func (p *CorePool) FeeProtocol0() uint8 {
+	return p.FeeProtocol % 16
+}
+
+func (p *CorePool) FeeProtocol1() uint8 {
+	return p.FeeProtocol >> 4
+}
+
+// ProtocolFees 与合约 protocolFees() 返回值对应
+func (p *CorePool) ProtocolFees() (decimal.Decimal, decimal.Decimal) {
+	return p.ProtocolFeesToken0, p.ProtocolFeesToken1
+}
+
+func (p *CorePool) SetFeeProtocol(feeProtocol0, feeProtocol1 uint8) error {
+	if !(feeProtocol0 == 0 || (feeProtocol0 >= 4 && feeProtocol0 <= 10)) ||
+		!(feeProtocol1 == 0 || (feeProtocol1 >= 4 && feeProtocol1 <= 10)) {
+		return fmt.Errorf("invalid fee protocol %d %d", feeProtocol0, feeProtocol1)
+	}
+	p.FeeProtocol = feeProtocol0 + (feeProtocol1 << 4)
+	return nil
+}
+
+func (p *CorePool) CollectProtocol(amount0Requested, amount1Requested decimal.Decimal) (decimal.Decimal, decimal.Decimal, error) {
+	if amount0Requested.IsNegative() || amount1Requested.IsNegative() {
+		return ZERO, ZERO, fmt.Errorf("%w: %s %s", ErrNegativeAmountRequest, amount0Requested, amount1Requested)
+	}
+	amount0 := decimal.Min(amount0Requested, p.ProtocolFeesToken0)
+	amount1 := decimal.Min(amount1Requested, p.ProtocolFeesToken1)
+	if amount0.IsPositive() {
+		// 合约保留 1 wei 以节省 gas
+		if amount0.Equal(p.ProtocolFeesToken0) {
+			amount0 = amount0.Sub(ONE)
+		}
+		p.ProtocolFeesToken0 = p.ProtocolFeesToken0.Sub(amount0)
+	}
+	if amount1.IsPositive() {
+		if amount1.Equal(p.ProtocolFeesToken1) {
+			amount1 = amount1.Sub(ONE)
+		}
+		p.ProtocolFeesToken1 = p.ProtocolFeesToken1.Sub(amount1)
+	}
+	return amount0, amount1, nil
+}
+
+// swap 循环的状态使用 256 位定宽整数, amountSpecifiedRemaining 和 amountCalculated 为 int256 补码
 type swapState struct {
-	amountSpecifiedRemaining decimal.Decimal
-	amountCalculated         decimal.Decimal
-	sqrtPriceX96             decimal.Decimal
+	amountSpecifiedRemaining uint256.Int
+	amountCalculated         uint256.Int
+	sqrtPriceX96             uint256.Int
 	tick                     int
-	liquidity                decimal.Decimal
-	feeGrowthGlobalX128      decimal.Decimal
+	liquidity                uint256.Int
+	feeGrowthGlobalX128      uint256.Int
+	protocolFee              uint256.Int
 }
 type StepComputations struct {
-	sqrtPriceStartX96 decimal.Decimal
+	sqrtPriceStartX96 uint256.Int
 	tickNext          int
 	initialized       bool
-	sqrtPriceNextX96  decimal.Decimal
-	amountIn          decimal.Decimal
-	amountOut         decimal.Decimal
-	feeAmount         decimal.Decimal
+	sqrtPriceNextX96  uint256.Int
+	amountIn          uint256.Int
+	amountOut         uint256.Int
+	feeAmount         uint256.Int
 }
 
 func (p *CorePool) HandleSwap(zeroForOne bool, amountSpecified decimal.Decimal, optionalSqrtPriceLimitX96 *decimal.Decimal, isStatic bool) (decimal.Decimal, decimal.Decimal, decimal.Decimal, error) {
-	var sqrtPriceLimitX96 decimal.Decimal
+	amount0, amount1, sqrtPriceX96, _, err := p.handleSwap(zeroForOne, amountSpecified, optionalSqrtPriceLimitX96, isStatic)
+	return amount0, amount1, sqrtPriceX96, err
+}
+
+// swap 穿过的 tick, static 时只读取 liquidityNet, 不记录到 dirty
+func (p *CorePool) getSwapTick(index int, isStatic bool) (*Tick, error) {
+	if isStatic {
+		return p.TickManager.GetTickReadonly(index)
+	}
+	return p.TickManager.GetTickAndInitIfAbsent(index)
+}
+
+// 同 HandleSwap, 同时返回穿过的已初始化 tick 数
+func (p *CorePool) handleSwap(zeroForOne bool, amountSpecified decimal.Decimal, optionalSqrtPriceLimitX96 *decimal.Decimal, isStatic bool) (decimal.Decimal, decimal.Decimal, decimal.Decimal, uint32, error) {
+	var sqrtPriceLimitX96 uint256.Int
 	if optionalSqrtPriceLimitX96 == nil {
 		if zeroForOne {
-			sqrtPriceLimitX96 = MIN_SQRT_RATIO.Add(ONE)
+			sqrtPriceLimitX96.AddUint64(u256MinSqrtRatio, 1)
 		} else {
-			sqrtPriceLimitX96 = MAX_SQRT_RATIO.Sub(ONE)
+			sqrtPriceLimitX96.SubUint64(u256MaxSqrtRatio, 1)
 		}
-	} else {
-		sqrtPriceLimitX96 = *optionalSqrtPriceLimitX96
+	} else if !u256FromDecimal(&sqrtPriceLimitX96, *optionalSqrtPriceLimitX96) && optionalSqrtPriceLimitX96.IsPositive() {
+		// 超过 uint256 的限价按最大值处理, 负数按 0 处理, 返回与合约相同的错误
+		sqrtPriceLimitX96.Set(u256MaxUint256)
 	}
 
+	state := swapState{tick: p.TickCurrent}
+	if !u256FromDecimal(&state.sqrtPriceX96, p.SqrtPriceX96) || !u256FromDecimal(&state.liquidity, p.Liquidity) {
+		return ZERO, ZERO, ZERO, 0, OVERFLOW
+	}
 	if zeroForOne {
-		if !sqrtPriceLimitX96.GreaterThan(MIN_SQRT_RATIO) {
-			return ZERO, ZERO, ZERO, errors.New("RATIO_MIN")
+		if !sqrtPriceLimitX96.Gt(u256MinSqrtRatio) {
+			return ZERO, ZERO, ZERO, 0, ErrRatioMin
 		}
-		if !sqrtPriceLimitX96.LessThan(p.SqrtPriceX96) {
-			return ZERO, ZERO, ZERO, errors.New("RATIO_CURRENT")
+		if !sqrtPriceLimitX96.Lt(&state.sqrtPriceX96) {
+			return ZERO, ZERO, ZERO, 0, ErrRatioCurrent
 		}
 	} else {
-		if !sqrtPriceLimitX96.LessThan(MAX_SQRT_RATIO) {
-			return ZERO, ZERO, ZERO, errors.New("RATIO_MAX")
+		if !sqrtPriceLimitX96.Lt(u256MaxSqrtRatio) {
+			return ZERO, ZERO, ZERO, 0, ErrRatioMax
 		}
-		if !sqrtPriceLimitX96.GreaterThan(p.SqrtPriceX96) {
-			return ZERO, ZERO, ZERO, errors.New("RATIO_CURRENT")
+		if !sqrtPriceLimitX96.Gt(&state.sqrtPriceX96) {
+			return ZERO, ZERO, ZERO, 0, ErrRatioCurrent
 		}
 	}
 
-	exactInput := amountSpecified.GreaterThanOrEqual(ZERO)
-	state := swapState{
-		amountSpecifiedRemaining: amountSpecified,
-		amountCalculated:         ZERO,
-		sqrtPriceX96:             p.SqrtPriceX96,
-		tick:                     p.TickCurrent,
-		liquidity:                p.Liquidity,
+	var amountSpecifiedX uint256.Int
+	if !i256FromDecimal(&amountSpecifiedX, amountSpecified) {
+		return ZERO, ZERO, ZERO, 0, OVERFLOW
 	}
-
+	state.amountSpecifiedRemaining.Set(&amountSpecifiedX)
+	exactInput := amountSpecified.GreaterThanOrEqual(ZERO)
+	liquidityStart := p.Liquidity
+	tickStart := p.TickCurrent
+	// 第一次穿过已初始化的 tick 时才计算最新的 observation
+	computedLatestObservation := false
+	var tickCumulative int64
+	secondsPerLiquidityCumulativeX128 := ZERO
+
+	var feeGrowthGlobalX128 decimal.Decimal
+	var feeProtocol uint8
 	if zeroForOne {
-		state.feeGrowthGlobalX128 = p.FeeGrowthGlobal0X128
+		feeGrowthGlobalX128 = p.FeeGrowthGlobal0X128
+		feeProtocol = p.FeeProtocol0()
 	} else {
-		state.feeGrowthGlobalX128 = p.FeeGrowthGlobal1X128
+		feeGrowthGlobalX128 = p.FeeGrowthGlobal1X128
+		feeProtocol = p.FeeProtocol1()
 	}
+	if !u256FromDecimal(&state.feeGrowthGlobalX128, feeGrowthGlobalX128) {
+		return ZERO, ZERO, ZERO, 0, OVERFLOW
+	}
+	var feeProtocolX uint256.Int
+	feeProtocolX.SetUint64(uint64(feeProtocol))
+	feePips := uint64(p.Fee)
+
+	var step StepComputations
+	var initializedTicksCrossed uint32
+	var sqrtRatioTargetX96 *uint256.Int
+	var sqrtPriceX96, delta, liquidityNetX uint256.Int
 	// 达到限价或者兑换完成
-	for !(state.amountSpecifiedRemaining.Equal(ZERO) || state.sqrtPriceX96.Equal(sqrtPriceLimitX96)) {
-		step := StepComputations{
-			sqrtPriceStartX96: ZERO, tickNext: 0, initialized: false, sqrtPriceNextX96: ZERO, amountIn: ZERO, amountOut: ZERO, feeAmount: ZERO}
-		step.sqrtPriceStartX96 = state.sqrtPriceX96
-		//fmt.Println("tick params", state.tick, p.TickSpacing, zeroForOne)
+	for !(state.amountSpecifiedRemaining.IsZero() || state.sqrtPriceX96.Eq(&sqrtPriceLimitX96)) {
+		step.sqrtPriceStartX96.Set(&state.sqrtPriceX96)
 		tickNext, initialized, err := p.TickManager.GetNextInitializedTick(state.tick, p.TickSpacing, zeroForOne)
 		if err != nil {
-			return ZERO, ZERO, ZERO, err
+			return ZERO, ZERO, ZERO, 0, err
 		}
-		//fmt.Println("next tick:", tickNext)
 
 		step.tickNext = tickNext
 		step.initialized = initialized
@@ -239,105 +471,124 @@ func (p *CorePool) HandleSwap(zeroForOne bool, amountSpecified decimal.Decimal,
 		} else if step.tickNext > MAX_TICK {
 			step.tickNext = MAX_TICK
 		}
-		sqrtPriceNextX96bi, err := utils.GetSqrtRatioAtTick(step.tickNext)
-		if err != nil {
-			return ZERO, ZERO, ZERO, err
+		if err := u256GetSqrtRatioAtTick(&step.sqrtPriceNextX96, step.tickNext); err != nil {
+			return ZERO, ZERO, ZERO, 0, err
 		}
-		step.sqrtPriceNextX96 = decimal.NewFromBigInt(sqrtPriceNextX96bi, 0)
-		var sqrtRatioTargetX96 decimal.Decimal
 		if zeroForOne {
-			if step.sqrtPriceNextX96.LessThan(sqrtPriceLimitX96) {
-				sqrtRatioTargetX96 = sqrtPriceLimitX96
+			if step.sqrtPriceNextX96.Lt(&sqrtPriceLimitX96) {
+				sqrtRatioTargetX96 = &sqrtPriceLimitX96
 			} else {
-				sqrtRatioTargetX96 = step.sqrtPriceNextX96
+				sqrtRatioTargetX96 = &step.sqrtPriceNextX96
 			}
 		} else {
-			if step.sqrtPriceNextX96.GreaterThan(sqrtPriceLimitX96) {
-				sqrtRatioTargetX96 = sqrtPriceLimitX96
+			if step.sqrtPriceNextX96.Gt(&sqrtPriceLimitX96) {
+				sqrtRatioTargetX96 = &sqrtPriceLimitX96
 			} else {
-				sqrtRatioTargetX96 = step.sqrtPriceNextX96
+				sqrtRatioTargetX96 = &step.sqrtPriceNextX96
 			}
 		}
-		_sqrtPriceX96, _amountIn, _amountOut, _feeAmount, err := utils.ComputeSwapStep(state.sqrtPriceX96.BigInt(), sqrtRatioTargetX96.BigInt(), state.liquidity.BigInt(), state.amountSpecifiedRemaining.BigInt(), constants.FeeAmount(p.Fee))
-		if err != nil {
-			return ZERO, ZERO, ZERO, err
+		if err := u256ComputeSwapStep(&sqrtPriceX96, &step.amountIn, &step.amountOut, &step.feeAmount, &state.sqrtPriceX96, sqrtRatioTargetX96, &state.liquidity, &state.amountSpecifiedRemaining, feePips); err != nil {
+			return ZERO, ZERO, ZERO, 0, err
 		}
+		state.sqrtPriceX96.Set(&sqrtPriceX96)
 
-		state.sqrtPriceX96 = decimal.NewFromBigInt(_sqrtPriceX96, 0)
-		step.amountIn = decimal.NewFromBigInt(_amountIn, 0)
-		step.amountOut = decimal.NewFromBigInt(_amountOut, 0)
-		step.feeAmount = decimal.NewFromBigInt(_feeAmount, 0)
-
+		delta.Add(&step.amountIn, &step.feeAmount)
 		if exactInput {
-			state.amountSpecifiedRemaining = state.amountSpecifiedRemaining.Sub(step.amountIn.Add(step.feeAmount))
-			state.amountCalculated = state.amountCalculated.Sub(step.amountOut)
+			state.amountSpecifiedRemaining.Sub(&state.amountSpecifiedRemaining, &delta)
+			state.amountCalculated.Sub(&state.amountCalculated, &step.amountOut)
 		} else {
-			state.amountSpecifiedRemaining = state.amountSpecifiedRemaining.Add(step.amountOut)
-			state.amountCalculated = state.amountCalculated.Add(step.amountIn.Add(step.feeAmount))
+			state.amountSpecifiedRemaining.Add(&state.amountSpecifiedRemaining, &step.amountOut)
+			state.amountCalculated.Add(&state.amountCalculated, &delta)
+		}
+		if feeProtocol > 0 {
+			delta.Div(&step.feeAmount, &feeProtocolX)
+			step.feeAmount.Sub(&step.feeAmount, &delta)
+			// protocolFee 为 uint128
+			state.protocolFee.Add(&state.protocolFee, &delta)
+			state.protocolFee.And(&state.protocolFee, u256MaxUint128)
 		}
-		if state.liquidity.IsPositive() {
-			state.feeGrowthGlobalX128 = state.feeGrowthGlobalX128.Add(step.feeAmount.Mul(Q128).Div(state.liquidity).RoundDown(0))
+		if !state.liquidity.IsZero() {
+			if err := u256MulDiv(&delta, &step.feeAmount, u256Q128, &state.liquidity); err != nil {
+				return ZERO, ZERO, ZERO, 0, err
+			}
+			// fee growth 溢出回绕
+			state.feeGrowthGlobalX128.Add(&state.feeGrowthGlobalX128, &delta)
 		}
-		if state.sqrtPriceX96.Equal(step.sqrtPriceNextX96) {
+		if state.sqrtPriceX96.Eq(&step.sqrtPriceNextX96) {
 			if step.initialized {
-				nextTick, err := p.TickManager.GetTickAndInitIfAbsent(step.tickNext)
+				initializedTicksCrossed++
+				nextTick, err := p.getSwapTick(step.tickNext, isStatic)
 				if err != nil {
-					return ZERO, ZERO, ZERO, err
+					return ZERO, ZERO, ZERO, 0, err
 				}
 				var liquidityNet decimal.Decimal
 				if isStatic {
 					liquidityNet = nextTick.LiquidityNet
 				} else {
+					if !computedLatestObservation {
+						tickCumulative, secondsPerLiquidityCumulativeX128, err = p.ensureOracle().ObserveSingle(p.blockTimestamp(), 0, tickStart, p.ObservationIndex, liquidityStart, p.ObservationCardinality)
+						if err != nil {
+							return ZERO, ZERO, ZERO, 0, err
+						}
+						computedLatestObservation = true
+					}
 					if zeroForOne {
-						liquidityNet = nextTick.Cross(state.feeGrowthGlobalX128, p.FeeGrowthGlobal1X128)
+						liquidityNet = nextTick.Cross(decimalFromU256(&state.feeGrowthGlobalX128), p.FeeGrowthGlobal1X128, secondsPerLiquidityCumulativeX128, tickCumulative, p.blockTimestamp())
 					} else {
-						liquidityNet = nextTick.Cross(p.FeeGrowthGlobal0X128, state.feeGrowthGlobalX128)
+						liquidityNet = nextTick.Cross(p.FeeGrowthGlobal0X128, decimalFromU256(&state.feeGrowthGlobalX128), secondsPerLiquidityCumulativeX128, tickCumulative, p.blockTimestamp())
 					}
 				}
+				if !i256FromDecimal(&liquidityNetX, liquidityNet) {
+					return ZERO, ZERO, ZERO, 0, OVERFLOW
+				}
 				if zeroForOne {
-					liquidityNet = liquidityNet.Neg()
+					liquidityNetX.Neg(&liquidityNetX)
 				}
-				state.liquidity, err = AddDelta(state.liquidity, liquidityNet)
-				if err != nil {
-					return ZERO, ZERO, ZERO, err
+				if err := u256AddDelta(&state.liquidity, &state.liquidity, &liquidityNetX); err != nil {
+					return ZERO, ZERO, ZERO, 0, err
 				}
-
 			}
 			if zeroForOne {
 				state.tick = step.tickNext - 1
 			} else {
 				state.tick = step.tickNext
 			}
-		} else if !state.sqrtPriceX96.Equal(step.sqrtPriceStartX96) {
-			state.tick, err = GetTickAtSqrtRatio(state.sqrtPriceX96)
+		} else if !state.sqrtPriceX96.Eq(&step.sqrtPriceStartX96) {
+			state.tick, err = u256GetTickAtSqrtRatio(&state.sqrtPriceX96)
 			if err != nil {
-				return ZERO, ZERO, ZERO, err
+				return ZERO, ZERO, ZERO, 0, err
 			}
 		}
 	}
+	sqrtPriceX96Result := decimalFromU256(&state.sqrtPriceX96)
 	if !isStatic {
-		p.SqrtPriceX96 = state.sqrtPriceX96
+		p.SqrtPriceX96 = sqrtPriceX96Result
 		if state.tick != p.TickCurrent {
+			p.ObservationIndex, p.ObservationCardinality = p.ensureOracle().Write(p.ObservationIndex, p.blockTimestamp(), tickStart, liquidityStart, p.ObservationCardinality, p.ObservationCardinalityNext)
 			p.TickCurrent = state.tick
 		}
-		if !state.liquidity.Equal(p.Liquidity) {
-			p.Liquidity = state.liquidity
+		liquidity := decimalFromU256(&state.liquidity)
+		if !liquidity.Equal(p.Liquidity) {
+			p.Liquidity = liquidity
 		}
 		if zeroForOne {
-			p.FeeGrowthGlobal0X128 = state.feeGrowthGlobalX128
+			p.FeeGrowthGlobal0X128 = decimalFromU256(&state.feeGrowthGlobalX128)
+			p.ProtocolFeesToken0 = AddUint128(p.ProtocolFeesToken0, decimalFromU256(&state.protocolFee))
 		} else {
-			p.FeeGrowthGlobal1X128 = state.feeGrowthGlobalX128
+			p.FeeGrowthGlobal1X128 = decimalFromU256(&state.feeGrowthGlobalX128)
+			p.ProtocolFeesToken1 = AddUint128(p.ProtocolFeesToken1, decimalFromU256(&state.protocolFee))
 		}
 	}
+	delta.Sub(&amountSpecifiedX, &state.amountSpecifiedRemaining)
 	var amount0, amount1 decimal.Decimal
 	if zeroForOne == exactInput {
-		amount0 = amountSpecified.Sub(state.amountSpecifiedRemaining)
-		amount1 = state.amountCalculated
+		amount0 = decimalFromI256(&delta)
+		amount1 = decimalFromI256(&state.amountCalculated)
 	} else {
-		amount0 = state.amountCalculated                              // -1
-		amount1 = amountSpecified.Sub(state.amountSpecifiedRemaining) // -2
+		amount0 = decimalFromI256(&state.amountCalculated)
+		amount1 = decimalFromI256(&delta)
 	}
-	return amount0, amount1, state.sqrtPriceX96, nil
+	return amount0, amount1, sqrtPriceX96Result, initializedTicksCrossed, nil
 }
 
 type SwapSolution struct {
@@ -349,16 +600,11 @@ func (p *CorePool) tryToDryRun(param *UniV3SwapEvent, amountSpec decimal.Decimal
 	var zeroForOne = param.Amount0.IsPositive()
 	amount0, amount1, priceX96, err := p.HandleSwap(zeroForOne, amountSpec, sqrtPriceLimitX96, true)
 	if err != nil {
-		logrus.Error(err)
+		// 候选输入失败是正常情况, 所有候选都失败时由调用方记录
+		logrus.Debugf("dry run swap candidate failed, pool: %s, amount: %s, %s", p.PoolAddress, amountSpec, err)
 		return false
 	}
-	result := amount0.Equal(param.Amount0) && amount1.Equal(param.Amount1) && priceX96.Equal(param.SqrtPriceX96)
-	if param.RawEvent.Address == common.HexToAddress("0xCba27C8e7115b4Eb50Aa14999BC0866674a96eCB") {
-		fmt.Println(amount0, param.Amount0)
-		fmt.Println(amount1, param.Amount1)
-		fmt.Println(sqrtPriceLimitX96, param.SqrtPriceX96)
-	}
-	return result
+	return amount0.Equal(param.Amount0) && amount1.Equal(param.Amount1) && priceX96.Equal(param.SqrtPriceX96)
 }
 
 func incTowardsInfinity(d decimal.Decimal) decimal.Decimal {
@@ -408,20 +654,20 @@ func (p *CorePool) ResolveInputFromSwapResultEvent(param *UniV3SwapEvent) (decim
 		}
 	}
 
-	err := fmt.Errorf("failed find swap solution %s %s", param.RawEvent.TxHash, param.RawEvent.Address)
+	err := fmt.Errorf("%w %s %s", ErrSwapUnresolvable, param.RawEvent.TxHash, param.RawEvent.Address)
 	logrus.Error(err)
 	return ZERO, nil, err
 }
 
 func (p *CorePool) checkTicks(tickLower, tickUpper int) error {
 	if !(tickLower < tickUpper) {
-		return errors.New("tickLower should lower than tickUpper")
+		return ErrTicksMisordered
 	}
 	if !(tickLower >= MIN_TICK) {
-		return errors.New("tickLower should NOT lower than MIN_TICK")
+		return ErrTickLowerTooLow
 	}
 	if !(tickUpper <= MAX_TICK) {
-		return errors.New("tickUpper should NOT greater than MAX_TICK")
+		return ErrTickUpperTooHigh
 	}
 	return nil
 }
@@ -437,7 +683,7 @@ func (p *CorePool) modifyPosition(owner string, tickLower, tickUpper int, liquid
 	if liquidityDelta.IsNegative() {
 		negatedLiquidityDelta := liquidityDelta.Neg()
 		if !positionView.Liquidity.GreaterThanOrEqual(negatedLiquidityDelta) {
-			return nil, ZERO, ZERO, errors.New("Liquidity Underflow")
+			return nil, ZERO, ZERO, ErrLiquiditySub
 		}
 	}
 	position, err := p.updatePosition(owner, tickLower, tickUpper, liquidityDelta)
@@ -475,6 +721,7 @@ func (p *CorePool) modifyPosition(owner string, tickLower, tickUpper int, liquid
 			if err != nil {
 				return nil, ZERO, ZERO, err
 			}
+			p.ObservationIndex, p.ObservationCardinality = p.ensureOracle().Write(p.ObservationIndex, p.blockTimestamp(), p.TickCurrent, p.Liquidity, p.ObservationCardinality, p.ObservationCardinalityNext)
 			p.Liquidity, err = AddDelta(p.Liquidity, liquidityDelta)
 			if err != nil {
 				return nil, ZERO, ZERO, err
@@ -502,11 +749,16 @@ func (p *CorePool) updatePosition(owner string, lower int, upper int, delta deci
 	flippedLower := false
 	flippedUpper := false
 	if !delta.IsZero() {
+		time := p.blockTimestamp()
+		tickCumulative, secondsPerLiquidityCumulativeX128, err := p.ensureOracle().ObserveSingle(time, 0, p.TickCurrent, p.ObservationIndex, p.Liquidity, p.ObservationCardinality)
+		if err != nil {
+			return nil, err
+		}
 		tick, err := p.TickManager.GetTickAndInitIfAbsent(lower)
 		if err != nil {
 			return nil, err
 		}
-		flippedLower, err = tick.Update(delta, p.TickCurrent, p.FeeGrowthGlobal0X128, p.FeeGrowthGlobal1X128, false, p.MaxLiquidityPerTick)
+		flippedLower, err = tick.Update(delta, p.TickCurrent, p.FeeGrowthGlobal0X128, p.FeeGrowthGlobal1X128, secondsPerLiquidityCumulativeX128, tickCumulative, time, false, p.MaxLiquidityPerTick)
 		if err != nil {
 			return nil, err
 		}
@@ -515,7 +767,7 @@ func (p *CorePool) updatePosition(owner string, lower int, upper int, delta deci
 		if err != nil {
 			return nil, err
 		}
-		flippedUpper, err = tick.Update(delta, p.TickCurrent, p.FeeGrowthGlobal0X128, p.FeeGrowthGlobal1X128, true, p.MaxLiquidityPerTick)
+		flippedUpper, err = tick.Update(delta, p.TickCurrent, p.FeeGrowthGlobal0X128, p.FeeGrowthGlobal1X128, secondsPerLiquidityCumulativeX128, tickCumulative, time, true, p.MaxLiquidityPerTick)
 		if err != nil {
 			return nil, err
 		}
@@ -530,10 +782,14 @@ func (p *CorePool) updatePosition(owner string, lower int, upper int, delta deci
 	}
 	if delta.IsNegative() {
 		if flippedLower {
-			p.TickManager.Clear(lower)
+			if err := p.TickManager.Clear(lower); err != nil {
+				return nil, err
+			}
 		}
 		if flippedUpper {
-			p.TickManager.Clear(upper)
+			if err := p.TickManager.Clear(upper); err != nil {
+				return nil, err
+			}
 		}
 	}
 	return position, nil
@@ -541,22 +797,40 @@ func (p *CorePool) updatePosition(owner string, lower int, upper int, delta deci
 
 func (p *CorePool) Flush(db *gorm.DB) error {
 	if p.HasCreated {
-		return db.Model(p).Updates(map[string]interface{}{
-			"current_block_num":       p.CurrentBlockNum,
-			"token0_balance":          p.Token0Balance,
-			"token1_balance":          p.Token1Balance,
-			"sqrt_price_x96":          p.SqrtPriceX96,
-			"liquidity":               p.Liquidity,
-			"tick_current":            p.TickCurrent,
-			"fee_growth_global0_x128": p.FeeGrowthGlobal0X128,
-			"fee_growth_global1_x128": p.FeeGrowthGlobal1X128,
-			"tick_manager":            p.TickManager,
-			"position_manager":        p.PositionManager,
+		err := db.Model(p).Updates(map[string]interface{}{
+			"current_block_num":            p.CurrentBlockNum,
+			"bootstrap_block_num":          p.BootstrapBlockNum,
+			"current_block_timestamp":      p.CurrentBlockTimestamp,
+			"token0_balance":               p.Token0Balance,
+			"token1_balance":               p.Token1Balance,
+			"sqrt_price_x96":               p.SqrtPriceX96,
+			"liquidity":                    p.Liquidity,
+			"tick_current":                 p.TickCurrent,
+			"fee_growth_global0_x128":      p.FeeGrowthGlobal0X128,
+			"fee_growth_global1_x128":      p.FeeGrowthGlobal1X128,
+			"fee_protocol":                 p.FeeProtocol,
+			"protocol_fees_token0":         p.ProtocolFeesToken0,
+			"protocol_fees_token1":         p.ProtocolFeesToken1,
+			"observation_index":            p.ObservationIndex,
+			"observation_cardinality":      p.ObservationCardinality,
+			"observation_cardinality_next": p.ObservationCardinalityNext,
+			"observations":                 p.Observations,
 		}).Error
+		if err != nil {
+			return err
+		}
 	} else {
 		p.HasCreated = true
-		return db.Create(p).Error
+		err := db.Create(p).Error
+		if err != nil {
+			return err
+		}
+	}
+	err := p.flushTicks(db)
+	if err != nil {
+		return err
 	}
+	return p.flushPositions(db)
 }
 
 type ActionType string
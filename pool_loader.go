@@ -0,0 +1,378 @@
+package uniswap_v3_simulator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	MULTICALL3_ADDRESS = common.HexToAddress("0xcA11bde05977b3631167028862bE2a173976CA11")
+
+	multicall3ABI = `[{"inputs":[{"components":[{"internalType":"address","name":"target","type":"address"},{"internalType":"bool","name":"allowFailure","type":"bool"},{"internalType":"bytes","name":"callData","type":"bytes"}],"internalType":"struct Multicall3.Call3[]","name":"calls","type":"tuple[]"}],"name":"aggregate3","outputs":[{"components":[{"internalType":"bool","name":"success","type":"bool"},{"internalType":"bytes","name":"returnData","type":"bytes"}],"internalType":"struct Multicall3.Result[]","name":"returnData","type":"tuple[]"}],"stateMutability":"payable","type":"function"}]`
+
+	ErrNoContractCaller = errors.New("no contract caller")
+)
+
+// 每次 multicall 最多的调用数
+const multicallBatchSize = 500
+
+type multicallCall struct {
+	Target       common.Address
+	AllowFailure bool
+	CallData     []byte
+}
+
+type multicallResult struct {
+	Success    bool
+	ReturnData []byte
+}
+
+type batchCall struct {
+	Method string
+	Args   []interface{}
+}
+
+// 在指定区块批量调用同一个 pool 的 view 方法, 通过 Multicall3 合并请求, Multicall3 未部署时逐个调用
+type poolBatchCaller struct {
+	ctx       context.Context
+	caller    bind.ContractCaller
+	pool      common.Address
+	block     *big.Int
+	poolAbi   *abi.ABI
+	multicall abi.ABI
+	// Multicall3 不可用时为 true
+	direct bool
+}
+
+func newPoolBatchCaller(ctx context.Context, caller bind.ContractCaller, pool common.Address, blockNum uint64) (*poolBatchCaller, error) {
+	poolAbi, err := UniswapV3SimulatorMetaData.GetAbi()
+	if err != nil {
+		return nil, err
+	}
+	multicall, err := abi.JSON(strings.NewReader(multicall3ABI))
+	if err != nil {
+		return nil, err
+	}
+	return &poolBatchCaller{
+		ctx:       ctx,
+		caller:    caller,
+		pool:      pool,
+		block:     new(big.Int).SetUint64(blockNum),
+		poolAbi:   poolAbi,
+		multicall: multicall,
+	}, nil
+}
+
+func (b *poolBatchCaller) Call(calls []batchCall) ([][]interface{}, error) {
+	results := make([][]interface{}, 0, len(calls))
+	for i := 0; i < len(calls); i += multicallBatchSize {
+		end := i + multicallBatchSize
+		if end > len(calls) {
+			end = len(calls)
+		}
+		outs, err := b.call(calls[i:end])
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, outs...)
+	}
+	return results, nil
+}
+
+func (b *poolBatchCaller) call(calls []batchCall) ([][]interface{}, error) {
+	packed := make([]multicallCall, len(calls))
+	for i, c := range calls {
+		data, err := b.poolAbi.Pack(c.Method, c.Args...)
+		if err != nil {
+			return nil, err
+		}
+		packed[i] = multicallCall{Target: b.pool, CallData: data}
+	}
+	var returnData [][]byte
+	if !b.direct {
+		input, err := b.multicall.Pack("aggregate3", packed)
+		if err != nil {
+			return nil, err
+		}
+		output, err := b.caller.CallContract(b.ctx, ethereum.CallMsg{To: &MULTICALL3_ADDRESS, Data: input}, b.block)
+		if err != nil {
+			return nil, err
+		}
+		if len(output) == 0 {
+			// 区块早于 Multicall3 部署
+			logrus.Infof("multicall3 not available at block %s, fallback to direct calls", b.block)
+			b.direct = true
+		} else {
+			out, err := b.multicall.Unpack("aggregate3", output)
+			if err != nil {
+				return nil, err
+			}
+			results := *abi.ConvertType(out[0], new([]multicallResult)).(*[]multicallResult)
+			for _, result := range results {
+				returnData = append(returnData, result.ReturnData)
+			}
+		}
+	}
+	if b.direct {
+		for _, c := range packed {
+			output, err := b.caller.CallContract(b.ctx, ethereum.CallMsg{To: &b.pool, Data: c.CallData}, b.block)
+			if err != nil {
+				return nil, err
+			}
+			returnData = append(returnData, output)
+		}
+	}
+	if len(returnData) != len(calls) {
+		return nil, fmt.Errorf("multicall returned %d results, expect %d", len(returnData), len(calls))
+	}
+	outs := make([][]interface{}, len(calls))
+	for i, data := range returnData {
+		out, err := b.poolAbi.Unpack(calls[i].Method, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed unpack %s: %w", calls[i].Method, err)
+		}
+		outs[i] = out
+	}
+	return outs, nil
+}
+
+func bigToDecimal(v interface{}) decimal.Decimal {
+	return decimal.NewFromBigInt(*abi.ConvertType(v, new(*big.Int)).(**big.Int), 0)
+}
+
+func bigToInt64(v interface{}) int64 {
+	return (*abi.ConvertType(v, new(*big.Int)).(**big.Int)).Int64()
+}
+
+// 向负无穷取整, 与合约中 compress 一致
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// Load 从链上读取 blockNum 结束时的 pool 状态, 包括 slot0, liquidity, feeGrowthGlobal, tickBitmap 中所有已初始化的 tick 和 observations.
+// position 无法从链上枚举, 由 Simulator 在第一次使用时按需读取
+func (p *CorePool) Load(caller bind.ContractCaller, blockNum uint64) error {
+	if caller == nil {
+		return ErrNoContractCaller
+	}
+	b, err := newPoolBatchCaller(context.Background(), caller, common.HexToAddress(p.PoolAddress), blockNum)
+	if err != nil {
+		return err
+	}
+	outs, err := b.Call([]batchCall{
+		{Method: "slot0"},
+		{Method: "liquidity"},
+		{Method: "feeGrowthGlobal0X128"},
+		{Method: "feeGrowthGlobal1X128"},
+		{Method: "protocolFees"},
+		{Method: "maxLiquidityPerTick"},
+		{Method: "token0"},
+		{Method: "token1"},
+		{Method: "fee"},
+		{Method: "tickSpacing"},
+	})
+	if err != nil {
+		return err
+	}
+	slot0, liquidity, feeGrowth0, feeGrowth1, protocolFees := outs[0], outs[1], outs[2], outs[3], outs[4]
+	if bigToDecimal(slot0[0]).IsZero() {
+		return fmt.Errorf("pool %s not initialized at block %d", p.PoolAddress, blockNum)
+	}
+	p.SqrtPriceX96 = bigToDecimal(slot0[0])
+	p.TickCurrent = int(bigToInt64(slot0[1]))
+	p.ObservationIndex = *abi.ConvertType(slot0[2], new(uint16)).(*uint16)
+	p.ObservationCardinality = *abi.ConvertType(slot0[3], new(uint16)).(*uint16)
+	p.ObservationCardinalityNext = *abi.ConvertType(slot0[4], new(uint16)).(*uint16)
+	p.FeeProtocol = *abi.ConvertType(slot0[5], new(uint8)).(*uint8)
+	p.Liquidity = bigToDecimal(liquidity[0])
+	p.FeeGrowthGlobal0X128 = bigToDecimal(feeGrowth0[0])
+	p.FeeGrowthGlobal1X128 = bigToDecimal(feeGrowth1[0])
+	p.ProtocolFeesToken0 = bigToDecimal(protocolFees[0])
+	p.ProtocolFeesToken1 = bigToDecimal(protocolFees[1])
+	p.MaxLiquidityPerTick = bigToDecimal(outs[5][0])
+	p.Token0 = (*abi.ConvertType(outs[6][0], new(common.Address)).(*common.Address)).String()
+	p.Token1 = (*abi.ConvertType(outs[7][0], new(common.Address)).(*common.Address)).String()
+	p.Fee = FeeAmount(bigToInt64(outs[8][0]))
+	p.TickSpacing = int(bigToInt64(outs[9][0]))
+
+	// tickBitmap 中所有 word
+	minWord := floorDiv(MIN_TICK, p.TickSpacing) >> 8
+	maxWord := floorDiv(MAX_TICK, p.TickSpacing) >> 8
+	var wordCalls []batchCall
+	for word := minWord; word <= maxWord; word++ {
+		wordCalls = append(wordCalls, batchCall{Method: "tickBitmap", Args: []interface{}{int16(word)}})
+	}
+	words, err := b.Call(wordCalls)
+	if err != nil {
+		return err
+	}
+	var tickCalls []batchCall
+	for i, out := range words {
+		bitmap := *abi.ConvertType(out[0], new(*big.Int)).(**big.Int)
+		for bit := 0; bit < 256; bit++ {
+			if bitmap.Bit(bit) == 0 {
+				continue
+			}
+			tick := ((minWord+i)<<8 + bit) * p.TickSpacing
+			tickCalls = append(tickCalls, batchCall{Method: "ticks", Args: []interface{}{big.NewInt(int64(tick))}})
+		}
+	}
+	ticks, err := b.Call(tickCalls)
+	if err != nil {
+		return err
+	}
+	tickManager := NewTickManager()
+	for i, out := range ticks {
+		index := int((tickCalls[i].Args[0].(*big.Int)).Int64())
+		tickManager.Ticks[index] = &Tick{
+			TickIndex:                      index,
+			LiquidityGross:                 bigToDecimal(out[0]),
+			LiquidityNet:                   bigToDecimal(out[1]),
+			FeeGrowthOutside0X128:          bigToDecimal(out[2]),
+			FeeGrowthOutside1X128:          bigToDecimal(out[3]),
+			TickCumulativeOutside:          bigToInt64(out[4]),
+			SecondsPerLiquidityOutsideX128: bigToDecimal(out[5]),
+			SecondsOutside:                 *abi.ConvertType(out[6], new(uint32)).(*uint32),
+		}
+	}
+	p.TickManager = tickManager
+
+	// observations, 包括已经 grow 但还没有写入的
+	var observationCalls []batchCall
+	for i := 0; i < int(p.ObservationCardinalityNext); i++ {
+		observationCalls = append(observationCalls, batchCall{Method: "observations", Args: []interface{}{big.NewInt(int64(i))}})
+	}
+	observations, err := b.Call(observationCalls)
+	if err != nil {
+		return err
+	}
+	oracle := NewOracle()
+	for _, out := range observations {
+		oracle.Observations = append(oracle.Observations, &Observation{
+			BlockTimestamp:                    *abi.ConvertType(out[0], new(uint32)).(*uint32),
+			TickCumulative:                    bigToInt64(out[1]),
+			SecondsPerLiquidityCumulativeX128: bigToDecimal(out[2]),
+			Initialized:                       *abi.ConvertType(out[3], new(bool)).(*bool),
+		})
+	}
+	p.Observations = oracle
+	p.PositionManager = NewPositionManager()
+	p.CurrentBlockNum = blockNum
+	p.BootstrapBlockNum = blockNum
+	return nil
+}
+
+// 合约中 position 的 key: keccak256(abi.encodePacked(owner, tickLower, tickUpper))
+func chainPositionKey(owner string, tickLower, tickUpper int) [32]byte {
+	packed := make([]byte, 0, 26)
+	packed = append(packed, common.HexToAddress(owner).Bytes()...)
+	for _, tick := range []int{tickLower, tickUpper} {
+		v := uint32(int32(tick))
+		packed = append(packed, byte(v>>16), byte(v>>8), byte(v))
+	}
+	return crypto.Keccak256Hash(packed)
+}
+
+// LoadPosition 从链上读取 blockNum 结束时的 position
+func (p *CorePool) LoadPosition(caller bind.ContractCaller, blockNum uint64, owner string, tickLower, tickUpper int) (*Position, error) {
+	if caller == nil {
+		return nil, ErrNoContractCaller
+	}
+	client, err := NewUniswapV3SimulatorCaller(common.HexToAddress(p.PoolAddress), caller)
+	if err != nil {
+		return nil, err
+	}
+	position, err := client.Positions(&bind.CallOpts{BlockNumber: new(big.Int).SetUint64(blockNum)}, chainPositionKey(owner, tickLower, tickUpper))
+	if err != nil {
+		return nil, err
+	}
+	return &Position{
+		Liquidity:                decimal.NewFromBigInt(position.Liquidity, 0),
+		FeeGrowthInside0LastX128: decimal.NewFromBigInt(position.FeeGrowthInside0LastX128, 0),
+		FeeGrowthInside1LastX128: decimal.NewFromBigInt(position.FeeGrowthInside1LastX128, 0),
+		TokensOwed0:              decimal.NewFromBigInt(position.TokensOwed0, 0),
+		TokensOwed1:              decimal.NewFromBigInt(position.TokensOwed1, 0),
+	}, nil
+}
+
+// LoadPoolFromChain 从链上读取 pool 在 blockNum 结束时的状态, 不需要从 Initialize 开始回放.
+// 之后同步时只应用 blockNum 之后的 logs
+func (pm *Simulator) LoadPoolFromChain(address common.Address, blockNum uint64) (*CorePool, error) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	return pm.loadPoolFromChain(address, blockNum, false)
+}
+
+// replace 为 true 时覆盖已有的 pool, 保留数据库主键
+func (pm *Simulator) loadPoolFromChain(address common.Address, blockNum uint64, replace bool) (*CorePool, error) {
+	if pm.caller == nil {
+		return nil, ErrNoContractCaller
+	}
+	current, exist := pm.Pools[address]
+	if exist && !replace {
+		return nil, fmt.Errorf("%w %s", ErrPoolExists, address)
+	}
+	config, err := pm.poolConfig(address)
+	if err != nil {
+		return nil, err
+	}
+	pool := NewCorePoolFromConfig(address.String(), *config)
+	err = pool.Load(pm.caller, blockNum)
+	if err != nil {
+		return nil, err
+	}
+	if headers, ok := asHeaderSource(pm.source); ok {
+		header, err := headers.HeaderByNumber(pm.ctx, new(big.Int).SetUint64(blockNum))
+		if err != nil {
+			return nil, err
+		}
+		pool.CurrentBlockTimestamp = header.Time
+	}
+	logrus.Infof("load pool from chain: %s, block: %d, ticks: %d", address, blockNum, len(pool.TickManager.Ticks))
+	if exist {
+		pool.DeployBlockNum = current.DeployBlockNum
+		model, created := current.Model, current.HasCreated
+		*current = *pool
+		current.Model = model
+		current.HasCreated = created
+		pool = current
+	}
+	pm.Pools[address] = pool
+	pm.dirtyPools[pool.PoolAddress] = pool
+	return pool, nil
+}
+
+// 从链上加载的 pool 没有 position, 第一次修改前读取上一个区块结束时的状态.
+// 加载之后 position 的所有变化都来自 logs, 所以上一个区块的状态就是加载时的状态
+func (pm *Simulator) ensurePosition(pool *CorePool, owner string, tickLower, tickUpper int, blockNum uint64) error {
+	if pool.BootstrapBlockNum == 0 {
+		return nil
+	}
+	key := GetPositionKey(owner, tickLower, tickUpper)
+	if _, ok := pool.PositionManager.Positions[key]; ok {
+		return nil
+	}
+	position, err := pool.LoadPosition(pm.caller, blockNum-1, owner, tickLower, tickUpper)
+	if err != nil {
+		return err
+	}
+	if !position.IsEmpty() {
+		pool.PositionManager.Set(key, position)
+	}
+	return nil
+}
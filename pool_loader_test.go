@@ -0,0 +1,161 @@
+package uniswap_v3_simulator
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/daoleno/uniswapv3-sdk/utils"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// 模拟链上的 pool 和 Multicall3
+type mockPoolCaller struct {
+	t           *testing.T
+	poolAbi     *abi.ABI
+	multicall   abi.ABI
+	noMulticall bool
+	calls       int
+}
+
+func newMockPoolCaller(t *testing.T) *mockPoolCaller {
+	poolAbi, err := UniswapV3SimulatorMetaData.GetAbi()
+	assert.NoError(t, err)
+	multicall, err := abi.JSON(strings.NewReader(multicall3ABI))
+	assert.NoError(t, err)
+	return &mockPoolCaller{t: t, poolAbi: poolAbi, multicall: multicall}
+}
+
+func (m *mockPoolCaller) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	return []byte{1}, nil
+}
+
+func (m *mockPoolCaller) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	m.calls += 1
+	if *call.To == MULTICALL3_ADDRESS {
+		if m.noMulticall {
+			return nil, nil
+		}
+		args, err := m.multicall.Methods["aggregate3"].Inputs.Unpack(call.Data[4:])
+		assert.NoError(m.t, err)
+		calls := *abi.ConvertType(args[0], new([]multicallCall)).(*[]multicallCall)
+		results := make([]multicallResult, len(calls))
+		for i, c := range calls {
+			results[i] = multicallResult{Success: true, ReturnData: m.poolCall(c.CallData)}
+		}
+		return m.multicall.Methods["aggregate3"].Outputs.Pack(results)
+	}
+	return m.poolCall(call.Data), nil
+}
+
+func (m *mockPoolCaller) poolCall(data []byte) []byte {
+	method, err := m.poolAbi.MethodById(data[:4])
+	assert.NoError(m.t, err)
+	args, err := method.Inputs.Unpack(data[4:])
+	assert.NoError(m.t, err)
+	var out []interface{}
+	switch method.Name {
+	case "slot0":
+		out = []interface{}{utils.EncodeSqrtRatioX96(big.NewInt(1), big.NewInt(1)), big.NewInt(0), uint16(0), uint16(1), uint16(2), uint8(0x44), true}
+	case "liquidity":
+		out = []interface{}{big.NewInt(1000000)}
+	case "feeGrowthGlobal0X128", "feeGrowthGlobal1X128", "maxLiquidityPerTick":
+		out = []interface{}{big.NewInt(7)}
+	case "protocolFees":
+		out = []interface{}{big.NewInt(3), big.NewInt(4)}
+	case "token0":
+		out = []interface{}{common.HexToAddress("0x10")}
+	case "token1":
+		out = []interface{}{common.HexToAddress("0x20")}
+	case "fee":
+		out = []interface{}{big.NewInt(3000)}
+	case "tickSpacing":
+		out = []interface{}{big.NewInt(60)}
+	case "tickBitmap":
+		bitmap := new(big.Int)
+		switch args[0].(int16) {
+		case -1:
+			// -600 / 60 = -10, word -1, bit 246
+			bitmap.SetBit(bitmap, 246, 1)
+		case 0:
+			bitmap.SetBit(bitmap, 10, 1)
+		}
+		out = []interface{}{bitmap}
+	case "ticks":
+		net := big.NewInt(1000000)
+		if args[0].(*big.Int).Sign() > 0 {
+			net.Neg(net)
+		}
+		out = []interface{}{big.NewInt(1000000), net, big.NewInt(1), big.NewInt(2), big.NewInt(-5), big.NewInt(6), uint32(8), true}
+	case "observations":
+		out = []interface{}{uint32(100), big.NewInt(0), big.NewInt(0), args[0].(*big.Int).Sign() == 0}
+	case "positions":
+		liquidity := new(big.Int)
+		if args[0].([32]byte) == chainPositionKey(testOwner.Hex(), -600, 600) {
+			liquidity.SetInt64(1000000)
+		}
+		out = []interface{}{liquidity, big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0)}
+	default:
+		m.t.Fatalf("unexpected call %s", method.Name)
+	}
+	bs, err := method.Outputs.Pack(out...)
+	assert.NoError(m.t, err)
+	return bs
+}
+
+func testBurnLog(blockNumber uint64, tickLower, tickUpper int64, amount int64) types.Log {
+	var data []byte
+	data = append(data, int2Hash(amount).Bytes()...)
+	data = append(data, int2Hash(0).Bytes()...)
+	data = append(data, int2Hash(0).Bytes()...)
+	return types.Log{
+		Address:     testPool,
+		Topics:      []common.Hash{TOPIC_BURN, common.BytesToHash(testOwner.Bytes()), int2Hash(tickLower), int2Hash(tickUpper)},
+		Data:        data,
+		BlockNumber: blockNumber,
+		Index:       3,
+	}
+}
+
+func TestSimulator_LoadPoolFromChain(t *testing.T) {
+	for _, noMulticall := range []bool{false, true} {
+		pm := newTestSimulator(t)
+		caller := newMockPoolCaller(t)
+		caller.noMulticall = noMulticall
+		pm.caller = caller
+		pm.BurnID = TOPIC_BURN
+		assert.NoError(t, pm.HandleLogs([]types.Log{testPoolCreatedLog(1)}))
+
+		pool, err := pm.LoadPoolFromChain(testPool, 100)
+		assert.NoError(t, err)
+		assert.Equal(t, FeeAmount(3000), pool.Fee)
+		assert.Equal(t, "1000000", pool.Liquidity.String())
+		assert.Equal(t, uint8(0x44), pool.FeeProtocol)
+		assert.Equal(t, "4", pool.ProtocolFeesToken1.String())
+		assert.Equal(t, uint16(2), pool.ObservationCardinalityNext)
+		assert.Len(t, pool.Observations.Observations, 2)
+		assert.Equal(t, uint64(100), pool.BootstrapBlockNum)
+		assert.Len(t, pool.TickManager.GetSortedTicks(), 2)
+		assert.Equal(t, -600, pool.TickManager.GetSortedTicks()[0].TickIndex)
+		assert.Equal(t, "-1000000", pool.TickManager.Ticks[600].LiquidityNet.String())
+		assert.Equal(t, int64(-5), pool.TickManager.Ticks[600].TickCumulativeOutside)
+
+		_, err = pm.LoadPoolFromChain(testPool, 100)
+		assert.Error(t, err)
+
+		// 100 之前的 logs 已经包含在链上状态中
+		err = pm.HandleLogs([]types.Log{testBurnLog(100, -600, 600, 1000000)})
+		assert.NoError(t, err)
+		assert.Equal(t, "1000000", pool.Liquidity.String())
+		// position 从链上读取
+		err = pm.HandleLogs([]types.Log{testBurnLog(101, -600, 600, 1000000)})
+		assert.NoError(t, err)
+		assert.True(t, pool.Liquidity.IsZero())
+		assert.NoError(t, pm.FlushPools())
+	}
+}
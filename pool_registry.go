@@ -0,0 +1,98 @@
+package uniswap_v3_simulator
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	RegistrySourceEvent = "event" // factory PoolCreated 事件
+	RegistrySourceRpc   = "rpc"   // 没有 PoolCreated 事件时从链上读取
+)
+
+// RegisteredPool pool 注册表, 记录 factory 创建的 pool 配置, 初始化 pool 时不需要再请求节点
+type RegisteredPool struct {
+	gorm.Model
+	PoolAddress string `gorm:"uniqueIndex"`
+	Token0      string
+	Token1      string
+	Fee         FeeAmount
+	TickSpacing int64
+	BlockNum    uint64 `gorm:"index"` // PoolCreated 所在区块, rpc 读取时为 0
+	TxHash      string
+	Source      string
+}
+
+func (r *RegisteredPool) Config() *PoolConfig {
+	return NewPoolConfig(r.TickSpacing, common.HexToAddress(r.Token0), common.HexToAddress(r.Token1), r.Fee)
+}
+
+// 从数据库加载注册表
+func (pm *Simulator) loadRegistry() error {
+	registered, err := pm.store.LoadRegistry()
+	if err != nil {
+		return err
+	}
+	for _, r := range registered {
+		pm.poolConfigs[common.HexToAddress(r.PoolAddress)] = r.Config()
+	}
+	logrus.Infof("load pool registry: %d pools", len(registered))
+	return nil
+}
+
+// 注册 pool 配置, FlushPools 时写入数据库. 已经注册过时返回 false
+func (pm *Simulator) registerPool(address common.Address, config *PoolConfig, blockNum uint64, txHash common.Hash, source string) bool {
+	if _, ok := pm.poolConfigs[address]; ok {
+		return false
+	}
+	pm.poolConfigs[address] = config
+	r := &RegisteredPool{
+		PoolAddress: address.String(),
+		Token0:      config.Token0.String(),
+		Token1:      config.Token1.String(),
+		Fee:         config.Fee,
+		TickSpacing: config.TickSpacing,
+		BlockNum:    blockNum,
+		Source:      source,
+	}
+	if txHash != (common.Hash{}) {
+		r.TxHash = txHash.String()
+	}
+	pm.newRegistered = append(pm.newRegistered, r)
+	return true
+}
+
+// 撤销注册, 已经写入数据库的记录在 FlushPools 时删除
+func (pm *Simulator) unregisterPool(address common.Address) {
+	delete(pm.poolConfigs, address)
+	for i, r := range pm.newRegistered {
+		if r.PoolAddress == address.String() {
+			pm.newRegistered = append(pm.newRegistered[:i], pm.newRegistered[i+1:]...)
+			return
+		}
+	}
+	pm.removedRegistered = append(pm.removedRegistered, address.String())
+}
+
+func (pm *Simulator) flushRegistry(tx StoreTx) error {
+	if len(pm.removedRegistered) > 0 {
+		err := tx.DeleteRegistered(pm.removedRegistered)
+		if err != nil {
+			return err
+		}
+	}
+	if len(pm.newRegistered) == 0 {
+		return nil
+	}
+	// pool 地址由 CREATE2 决定, 重组后重新注册的配置相同, 忽略已存在的记录
+	return tx.SaveRegistered(pm.newRegistered)
+}
+
+// RegisteredPool 返回注册表中的 pool 配置
+func (pm *Simulator) RegisteredPool(address common.Address) (*PoolConfig, bool) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	config, ok := pm.poolConfigs[address]
+	return config, ok
+}
@@ -0,0 +1,39 @@
+package uniswap_v3_simulator
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulator_PoolRegistry(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "simulator.db")
+	pm := openTestSimulator(t, dbFile, nil)
+	pm.caller = newMockPoolCaller(t)
+	assert.NoError(t, pm.HandleLogs([]types.Log{testPoolCreatedLog(100), testPoolCreatedLog(100)}))
+	// 没有 PoolCreated 事件的 pool 从链上读取后也会注册
+	genuine := ComputePoolAddress(UNISWAP_V3_FACTORY, POOL_INIT_CODE_HASH, common.HexToAddress("0x10"), common.HexToAddress("0x20"), FeeAmount(3000))
+	_, err := pm.poolConfig(genuine)
+	assert.NoError(t, err)
+	assert.NoError(t, pm.FlushPools())
+
+	var registered []*RegisteredPool
+	assert.NoError(t, testDB(pm).Order("id").Find(&registered).Error)
+	assert.Len(t, registered, 2)
+	assert.Equal(t, RegistrySourceEvent, registered[0].Source)
+	assert.Equal(t, uint64(100), registered[0].BlockNum)
+	assert.Equal(t, RegistrySourceRpc, registered[1].Source)
+
+	// 重新打开后不需要请求节点就可以初始化 pool
+	pm = openTestSimulator(t, dbFile, nil)
+	config, ok := pm.RegisteredPool(testPool)
+	assert.True(t, ok)
+	assert.Equal(t, int64(60), config.TickSpacing)
+	assert.Equal(t, FeeAmount(3000), config.Fee)
+	assert.NoError(t, pm.HandleLogs([]types.Log{testInitializeLog(101)}))
+	assert.Contains(t, pm.Pools, testPool)
+	assert.NoError(t, pm.FlushPools())
+}
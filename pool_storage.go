@@ -0,0 +1,299 @@
+package uniswap_v3_simulator
+
+import (
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const storageBatchSize = 500
+
+// PoolTick pool 中已初始化的 tick, 每个 tick 一行
+type PoolTick struct {
+	ID                             uint   `gorm:"primarykey"`
+	PoolAddress                    string `gorm:"uniqueIndex:idx_pool_tick"`
+	TickIndex                      int    `gorm:"uniqueIndex:idx_pool_tick"`
+	LiquidityGross                 decimal.Decimal
+	LiquidityNet                   decimal.Decimal
+	FeeGrowthOutside0X128          decimal.Decimal
+	FeeGrowthOutside1X128          decimal.Decimal
+	TickCumulativeOutside          int64
+	SecondsPerLiquidityOutsideX128 decimal.Decimal
+	SecondsOutside                 uint32
+}
+
+func newPoolTick(address string, tick *Tick) *PoolTick {
+	return &PoolTick{
+		PoolAddress:                    address,
+		TickIndex:                      tick.TickIndex,
+		LiquidityGross:                 tick.LiquidityGross,
+		LiquidityNet:                   tick.LiquidityNet,
+		FeeGrowthOutside0X128:          tick.FeeGrowthOutside0X128,
+		FeeGrowthOutside1X128:          tick.FeeGrowthOutside1X128,
+		TickCumulativeOutside:          tick.TickCumulativeOutside,
+		SecondsPerLiquidityOutsideX128: tick.SecondsPerLiquidityOutsideX128,
+		SecondsOutside:                 tick.SecondsOutside,
+	}
+}
+
+func (r *PoolTick) Tick() *Tick {
+	return &Tick{
+		TickIndex:                      r.TickIndex,
+		LiquidityGross:                 r.LiquidityGross,
+		LiquidityNet:                   r.LiquidityNet,
+		FeeGrowthOutside0X128:          r.FeeGrowthOutside0X128,
+		FeeGrowthOutside1X128:          r.FeeGrowthOutside1X128,
+		TickCumulativeOutside:          r.TickCumulativeOutside,
+		SecondsPerLiquidityOutsideX128: r.SecondsPerLiquidityOutsideX128,
+		SecondsOutside:                 r.SecondsOutside,
+	}
+}
+
+// PoolPosition pool 中的 position, 每个 (owner, tickLower, tickUpper) 一行
+type PoolPosition struct {
+	ID                       uint   `gorm:"primarykey"`
+	PoolAddress              string `gorm:"uniqueIndex:idx_pool_position"`
+	Owner                    string `gorm:"uniqueIndex:idx_pool_position;index"`
+	TickLower                int    `gorm:"uniqueIndex:idx_pool_position"`
+	TickUpper                int    `gorm:"uniqueIndex:idx_pool_position"`
+	Liquidity                decimal.Decimal
+	FeeGrowthInside0LastX128 decimal.Decimal
+	FeeGrowthInside1LastX128 decimal.Decimal
+	TokensOwed0              decimal.Decimal
+	TokensOwed1              decimal.Decimal
+}
+
+func newPoolPosition(address, owner string, tickLower, tickUpper int, position *Position) *PoolPosition {
+	return &PoolPosition{
+		PoolAddress:              address,
+		Owner:                    owner,
+		TickLower:                tickLower,
+		TickUpper:                tickUpper,
+		Liquidity:                position.Liquidity,
+		FeeGrowthInside0LastX128: position.FeeGrowthInside0LastX128,
+		FeeGrowthInside1LastX128: position.FeeGrowthInside1LastX128,
+		TokensOwed0:              position.TokensOwed0,
+		TokensOwed1:              position.TokensOwed1,
+	}
+}
+
+func (r *PoolPosition) Key() string {
+	return GetPositionKey(r.Owner, r.TickLower, r.TickUpper)
+}
+
+func (r *PoolPosition) Position() *Position {
+	return &Position{
+		Liquidity:                r.Liquidity,
+		FeeGrowthInside0LastX128: r.FeeGrowthInside0LastX128,
+		FeeGrowthInside1LastX128: r.FeeGrowthInside1LastX128,
+		TokensOwed0:              r.TokensOwed0,
+		TokensOwed1:              r.TokensOwed1,
+	}
+}
+
+// 写入 dirty 的 tick, dirty 为 nil 时删除 pool 所有的 tick 后重新写入. dirty 在事务提交后由 clearDirty 清除
+func (p *CorePool) flushTicks(tx *gorm.DB) error {
+	tm := p.TickManager
+	var rows []*PoolTick
+	if tm.dirty == nil {
+		err := tx.Where("pool_address = ?", p.PoolAddress).Delete(&PoolTick{}).Error
+		if err != nil {
+			return err
+		}
+		for _, tick := range tm.Ticks {
+			rows = append(rows, newPoolTick(p.PoolAddress, tick))
+		}
+	} else {
+		var cleared []int
+		for index := range tm.dirty {
+			if tick, ok := tm.Ticks[index]; ok {
+				rows = append(rows, newPoolTick(p.PoolAddress, tick))
+			} else {
+				cleared = append(cleared, index)
+			}
+		}
+		if len(cleared) > 0 {
+			err := tx.Where("pool_address = ? AND tick_index IN ?", p.PoolAddress, cleared).Delete(&PoolTick{}).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(rows) > 0 {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "pool_address"}, {Name: "tick_index"}},
+			UpdateAll: true,
+		}).CreateInBatches(rows, storageBatchSize).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 写入 dirty 的 position, dirty 为 nil 时删除 pool 所有的 position 后重新写入
+func (p *CorePool) flushPositions(tx *gorm.DB) error {
+	pm := p.PositionManager
+	var rows []*PoolPosition
+	var keys []string
+	if pm.dirty == nil {
+		err := tx.Where("pool_address = ?", p.PoolAddress).Delete(&PoolPosition{}).Error
+		if err != nil {
+			return err
+		}
+		for key := range pm.Positions {
+			keys = append(keys, key)
+		}
+	} else {
+		for key := range pm.dirty {
+			keys = append(keys, key)
+		}
+	}
+	var removed [][]interface{}
+	for _, key := range keys {
+		owner, tickLower, tickUpper, ok := parsePositionKey(key)
+		if !ok {
+			logrus.Warnf("invalid position key %s in pool %s", key, p.PoolAddress)
+			continue
+		}
+		position, ok := pm.Positions[key]
+		if !ok {
+			removed = append(removed, []interface{}{owner, tickLower, tickUpper})
+			continue
+		}
+		rows = append(rows, newPoolPosition(p.PoolAddress, owner, tickLower, tickUpper, position))
+	}
+	// 按 (owner, tick_lower, tick_upper) 分批删除
+	for start := 0; start < len(removed); start += storageBatchSize {
+		end := start + storageBatchSize
+		if end > len(removed) {
+			end = len(removed)
+		}
+		err := tx.Where("pool_address = ? AND (owner, tick_lower, tick_upper) IN ?", p.PoolAddress, removed[start:end]).Delete(&PoolPosition{}).Error
+		if err != nil {
+			return err
+		}
+	}
+	if len(rows) > 0 {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "pool_address"}, {Name: "owner"}, {Name: "tick_lower"}, {Name: "tick_upper"}},
+			UpdateAll: true,
+		}).CreateInBatches(rows, storageBatchSize).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 事务提交后调用, 回滚时保留 dirty, 下次 flush 重新写入
+func (p *CorePool) clearDirty() {
+	p.TickManager.dirty = map[int]bool{}
+	p.PositionManager.dirty = map[string]bool{}
+}
+
+// 删除 pool 时调用
+func deletePoolState(tx *gorm.DB, address string) error {
+	err := tx.Where("pool_address = ?", address).Delete(&PoolTick{}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Where("pool_address = ?", address).Delete(&PoolPosition{}).Error
+}
+
+// 从 pool_ticks, pool_positions 表加载 pools 的 tick 和 position
+func loadPoolState(db *gorm.DB, pools []*CorePool) error {
+	byAddress := make(map[string]*CorePool, len(pools))
+	for _, pool := range pools {
+		pool.TickManager = NewTickManager()
+		pool.PositionManager = NewPositionManager()
+		byAddress[pool.PoolAddress] = pool
+	}
+	var ticks []*PoolTick
+	err := db.FindInBatches(&ticks, 10000, func(tx *gorm.DB, batch int) error {
+		for _, row := range ticks {
+			if pool, ok := byAddress[row.PoolAddress]; ok {
+				pool.TickManager.Ticks[row.TickIndex] = row.Tick()
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return err
+	}
+	var positions []*PoolPosition
+	err = db.FindInBatches(&positions, 10000, func(tx *gorm.DB, batch int) error {
+		for _, row := range positions {
+			if pool, ok := byAddress[row.PoolAddress]; ok {
+				pool.PositionManager.Positions[row.Key()] = row.Position()
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return err
+	}
+	// 和数据库一致, 之后只写入修改的部分
+	for _, pool := range pools {
+		pool.TickManager.dirty = map[int]bool{}
+		pool.PositionManager.dirty = map[string]bool{}
+	}
+	return nil
+}
+
+// 旧版本的 core_pools 表中 tick_manager, position_manager 为 json 格式的 LONGTEXT, 迁移到 pool_ticks, pool_positions 表后删除
+func migrateLegacyPoolState(db *gorm.DB) error {
+	migrator := db.Migrator()
+	if !migrator.HasColumn(&CorePool{}, "tick_manager") {
+		return nil
+	}
+	var legacy []struct {
+		ID              uint
+		PoolAddress     string
+		TickManager     *TickManager
+		PositionManager *PositionManager
+	}
+	migrated := 0
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return tx.Table("core_pools").Select("id, pool_address, tick_manager, position_manager").FindInBatches(&legacy, 100, func(batch *gorm.DB, n int) error {
+			for _, row := range legacy {
+				pool := &CorePool{PoolAddress: row.PoolAddress, TickManager: row.TickManager, PositionManager: row.PositionManager}
+				if pool.TickManager == nil {
+					pool.TickManager = NewTickManager()
+				}
+				if pool.PositionManager == nil {
+					pool.PositionManager = NewPositionManager()
+				}
+				// dirty 为 nil, 全部写入
+				pool.TickManager.dirty = nil
+				pool.PositionManager.dirty = nil
+				err := pool.flushTicks(tx)
+				if err != nil {
+					return err
+				}
+				err = pool.flushPositions(tx)
+				if err != nil {
+					return err
+				}
+				migrated += 1
+			}
+			return nil
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+	logrus.Infof("migrate legacy pool state: %d pools", migrated)
+	// sqlite migrator 重建表时匹配不到最后一列, 直接 DROP COLUMN
+	for _, column := range []string{"tick_manager", "position_manager"} {
+		if !migrator.HasColumn(&CorePool{}, column) {
+			continue
+		}
+		err = db.Exec("ALTER TABLE ? DROP COLUMN ?", clause.Table{Name: "core_pools"}, clause.Column{Name: column}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package uniswap_v3_simulator
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/glebarez/sqlite"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func assertPoolStateEqual(t *testing.T, expected, actual *CorePool) {
+	e, err := json.Marshal(expected.TickManager)
+	assert.NoError(t, err)
+	a, err := json.Marshal(actual.TickManager)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(e), string(a))
+	e, err = json.Marshal(expected.PositionManager)
+	assert.NoError(t, err)
+	a, err = json.Marshal(actual.PositionManager)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(e), string(a))
+}
+
+func countRows(t *testing.T, db *gorm.DB, model interface{}) int64 {
+	var count int64
+	assert.NoError(t, db.Model(model).Where("pool_address = ?", testPool.String()).Count(&count).Error)
+	return count
+}
+
+func TestSimulator_PoolStorage(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "simulator.db")
+	pm := openTestSimulator(t, dbFile, nil)
+	assert.NoError(t, pm.HandleLogs([]types.Log{
+		testPoolCreatedLog(100),
+		testInitializeLog(101),
+		testMintLog(102, -600, 600, 1000000),
+		testMintLog(102, -60, 60, 1000),
+	}))
+	assert.NoError(t, pm.FlushPools())
+	assert.False(t, testDB(pm).Migrator().HasColumn(&CorePool{}, "tick_manager"))
+	assert.Equal(t, int64(4), countRows(t, testDB(pm), &PoolTick{}))
+	assert.Equal(t, int64(2), countRows(t, testDB(pm), &PoolPosition{}))
+	pool := pm.Pools[testPool]
+	assert.Empty(t, pool.TickManager.dirty)
+	assert.Empty(t, pool.PositionManager.dirty)
+
+	// 只写入修改的 tick 和 position, 清除的 tick 删除
+	assert.NoError(t, pm.HandleLogs([]types.Log{testBurnLog(103, -60, 60, 1000)}))
+	assert.Equal(t, map[int]bool{-60: true, 60: true}, pool.TickManager.dirty)
+	assert.Len(t, pool.PositionManager.dirty, 1)
+	assert.NoError(t, pm.FlushPools())
+	assert.Equal(t, int64(2), countRows(t, testDB(pm), &PoolTick{}))
+	assert.Equal(t, int64(2), countRows(t, testDB(pm), &PoolPosition{}))
+
+	var positions []*PoolPosition
+	assert.NoError(t, testDB(pm).Where("owner = ?", strings.ToLower(testOwner.Hex())).Order("tick_lower").Find(&positions).Error)
+	assert.Len(t, positions, 2)
+	assert.Equal(t, "1000000", positions[0].Liquidity.String())
+	assert.True(t, positions[1].Liquidity.IsZero())
+
+	reopened := openTestSimulator(t, dbFile, nil)
+	assertPoolStateEqual(t, pool, reopened.Pools[testPool])
+	assert.Len(t, reopened.Pools[testPool].TickManager.GetSortedTicks(), 2)
+
+	// 删除的 position 在一条语句中删除, 其他 position 保留
+	for key := range pool.PositionManager.Positions {
+		delete(pool.PositionManager.Positions, key)
+		pool.PositionManager.dirty[key] = true
+	}
+	pool.PositionManager.dirty[GetPositionKey(strings.ToLower(testOwner.Hex()), -6, 6)] = true
+	pm.dirtyPools[pool.PoolAddress] = pool
+	assert.NoError(t, pm.FlushPools())
+	assert.Equal(t, int64(0), countRows(t, testDB(pm), &PoolPosition{}))
+}
+
+func TestMigrateLegacyPoolState(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "simulator.db")
+	pm := openTestSimulator(t, dbFile, nil)
+	assert.NoError(t, pm.HandleLogs([]types.Log{
+		testPoolCreatedLog(100),
+		testInitializeLog(101),
+		testMintLog(102, -600, 600, 1000000),
+		testMintLog(102, -60, 60, 1000),
+	}))
+	assert.NoError(t, pm.FlushPools())
+	pool := pm.Pools[testPool]
+	assert.NoError(t, pm.Close())
+
+	// 旧版本的表结构, tick 和 position 保存在 core_pools 中
+	db, err := gorm.Open(sqlite.Open(dbFile), &gorm.Config{})
+	assert.NoError(t, err)
+	assert.NoError(t, db.Exec("ALTER TABLE core_pools ADD COLUMN tick_manager LONGTEXT").Error)
+	assert.NoError(t, db.Exec("ALTER TABLE core_pools ADD COLUMN position_manager LONGTEXT").Error)
+	assert.NoError(t, db.Table("core_pools").Where("pool_address = ?", testPool.String()).Updates(map[string]interface{}{
+		"tick_manager":     pool.TickManager,
+		"position_manager": pool.PositionManager,
+	}).Error)
+	assert.NoError(t, db.Exec("DELETE FROM pool_ticks").Error)
+	assert.NoError(t, db.Exec("DELETE FROM pool_positions").Error)
+	sqlDB, err := db.DB()
+	assert.NoError(t, err)
+	assert.NoError(t, sqlDB.Close())
+
+	pm = openTestSimulator(t, dbFile, nil)
+	assert.False(t, testDB(pm).Migrator().HasColumn(&CorePool{}, "tick_manager"))
+	assert.False(t, testDB(pm).Migrator().HasColumn(&CorePool{}, "position_manager"))
+	assert.Equal(t, int64(4), countRows(t, testDB(pm), &PoolTick{}))
+	assert.Equal(t, int64(2), countRows(t, testDB(pm), &PoolPosition{}))
+	assertPoolStateEqual(t, pool, pm.Pools[testPool])
+	assert.Equal(t, "1001000", pm.Pools[testPool].Liquidity.String())
+}
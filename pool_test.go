@@ -6,6 +6,8 @@ import (
 
 	"github.com/daoleno/uniswapv3-sdk/constants"
 	"github.com/daoleno/uniswapv3-sdk/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -224,3 +226,86 @@ func TestCorePool_computeSwapStep_HandlesIntermediateInsufficientLiquidityInOneF
 	assert.Equal(t, amountIn.String(), "1")
 	assert.Equal(t, feeAmount.String(), "1")
 }
+
+func newTestPool(t *testing.T) *CorePool {
+	pool := NewCorePoolFromConfig("0x0000000000000000000000000000000000000001", *NewPoolConfig(60, common.Address{}, common.Address{}, FeeAmount(3000)))
+	err := pool.Initialize(decimal.NewFromBigInt(utils.EncodeSqrtRatioX96(big.NewInt(1), big.NewInt(1)), 0))
+	assert.NoError(t, err)
+	_, _, err = pool.Mint("0xowner", -600, 600, decimal.NewFromInt(1000000))
+	assert.NoError(t, err)
+	return pool
+}
+
+func TestCorePool_Flash(t *testing.T) {
+	pool := newTestPool(t)
+	err := pool.Flash(decimal.NewFromInt(1000), ZERO)
+	assert.NoError(t, err)
+	// 1000 * 2^128 / 1000000
+	assert.Equal(t, "340282366920938463463374607431768211", pool.FeeGrowthGlobal0X128.String())
+	assert.True(t, pool.FeeGrowthGlobal1X128.IsZero())
+
+	empty := NewCorePoolFromConfig("0x0000000000000000000000000000000000000002", *NewPoolConfig(60, common.Address{}, common.Address{}, FeeAmount(3000)))
+	assert.Error(t, empty.Flash(ONE, ONE))
+}
+
+func TestCorePool_HandleCollectEvent(t *testing.T) {
+	pool := newTestPool(t)
+	amount0, amount1, err := pool.Burn("0xowner", -600, 600, decimal.NewFromInt(1000000))
+	assert.NoError(t, err)
+
+	collect := &UniV3CollectEvent{Owner: "0xowner", TickLower: -600, TickUpper: 600, Amount0: amount0, Amount1: amount1}
+	assert.NoError(t, pool.HandleCollectEvent(collect))
+	// fully collected position with zero liquidity is removed
+	assert.Empty(t, pool.PositionManager.Positions)
+
+	err = pool.HandleCollectEvent(collect)
+	assert.ErrorIs(t, err, ErrCollectMismatch)
+}
+
+func TestCorePool_ProtocolFees(t *testing.T) {
+	pool := newTestPool(t)
+	assert.Error(t, pool.SetFeeProtocol(3, 0))
+	assert.NoError(t, pool.SetFeeProtocol(4, 5))
+	assert.Equal(t, uint8(4), pool.FeeProtocol0())
+	assert.Equal(t, uint8(5), pool.FeeProtocol1())
+
+	assert.NoError(t, pool.Flash(decimal.NewFromInt(1000), decimal.NewFromInt(1000)))
+	fees0, fees1 := pool.ProtocolFees()
+	assert.Equal(t, "250", fees0.String())
+	assert.Equal(t, "200", fees1.String())
+	// (1000 - 250) * 2^128 / 1000000
+	assert.Equal(t, "255211775190703847597530955573826158", pool.FeeGrowthGlobal0X128.String())
+
+	_, _, _, err := pool.HandleSwap(true, decimal.NewFromInt(10000), nil, false)
+	assert.NoError(t, err)
+	fees0, _ = pool.ProtocolFees()
+	// swap fee 30 = 10000 * 0.3%, protocol takes 30 / 4 = 7
+	assert.Equal(t, "257", fees0.String())
+
+	// collecting everything leaves 1 wei in the pool
+	amount0, amount1, err := pool.CollectProtocol(decimal.NewFromInt(1000), decimal.NewFromInt(100))
+	assert.NoError(t, err)
+	assert.Equal(t, "256", amount0.String())
+	assert.Equal(t, "100", amount1.String())
+	fees0, fees1 = pool.ProtocolFees()
+	assert.Equal(t, "1", fees0.String())
+	assert.Equal(t, "100", fees1.String())
+}
+
+// 参数错误返回 sentinel, 可以用 errors.Is 判断
+func TestCorePool_SentinelErrors(t *testing.T) {
+	pool := newTestPool(t)
+	_, _, err := pool.Mint("0xowner", -600, 600, ZERO)
+	assert.ErrorIs(t, err, ErrInvalidMintAmount)
+	_, _, err = pool.CollectProtocol(ONE.Neg(), ZERO)
+	assert.ErrorIs(t, err, ErrNegativeAmountRequest)
+	_, _, err = pool.PositionManager.CollectPosition("0xowner", -600, 600, ZERO, ONE.Neg())
+	assert.ErrorIs(t, err, ErrNegativeAmountRequest)
+	_, _, _, err = pool.SnapshotCumulativesInside(-120, 600)
+	assert.ErrorIs(t, err, ErrTickNotInitialized)
+	_, _, _, err = pool.SnapshotCumulativesInside(-600, 120)
+	assert.ErrorIs(t, err, ErrTickNotInitialized)
+	_, _, err = pool.TickManager.getFeeGrowthInside(-120, 600, 0, ZERO, ZERO)
+	assert.ErrorIs(t, err, ErrInvalidTick)
+	assert.ErrorIs(t, err, INVALID_TICK)
+}
@@ -43,7 +43,7 @@ func (p *Position) Update(
 	var err error
 	if liquidityDelta.IsZero() {
 		if p.Liquidity.LessThanOrEqual(ZERO) {
-			return errors.New("NP")
+			return ErrNoPosition
 		}
 		liquidityNext = p.Liquidity
 	} else {
@@ -52,8 +52,9 @@ func (p *Position) Update(
 			return err
 		}
 	}
-	tokensOwed0 := feeGrowthInside0X128.Sub(p.FeeGrowthInside0LastX128).Mul(p.Liquidity).Div(Q128).RoundDown(0)
-	tokensOwed1 := feeGrowthInside1X128.Sub(p.FeeGrowthInside1LastX128).Mul(p.Liquidity).Div(Q128).RoundDown(0)
+	// feeGrowthInside 回绕后可能小于上次的值, 差值按 uint256 计算, 结果截断为 uint128
+	tokensOwed0 := WrapUint128(SubUint256(feeGrowthInside0X128, p.FeeGrowthInside0LastX128).Mul(p.Liquidity).Div(Q128).RoundDown(0))
+	tokensOwed1 := WrapUint128(SubUint256(feeGrowthInside1X128, p.FeeGrowthInside1LastX128).Mul(p.Liquidity).Div(Q128).RoundDown(0))
 	if !liquidityDelta.IsZero() {
 		p.Liquidity = liquidityNext
 	}
@@ -61,8 +62,9 @@ func (p *Position) Update(
 	p.FeeGrowthInside1LastX128 = feeGrowthInside1X128
 
 	if tokensOwed0.GreaterThan(ZERO) || tokensOwed1.GreaterThan(ZERO) {
-		p.TokensOwed0 = p.TokensOwed0.Add(tokensOwed0)
-		p.TokensOwed1 = p.TokensOwed1.Add(tokensOwed1)
+		// 合约中允许溢出, 需要在超过 uint128 之前 collect
+		p.TokensOwed0 = AddUint128(p.TokensOwed0, tokensOwed0)
+		p.TokensOwed1 = AddUint128(p.TokensOwed1, tokensOwed1)
 	}
 	return nil
 }
@@ -83,6 +85,8 @@ func GetPositionKey(owner string, tickLower int, tickUpper int) string {
 
 type PositionManager struct {
 	Positions map[string]*Position
+	// 上次写入数据库之后修改过的 position, nil 表示需要全部重新写入
+	dirty map[string]bool
 }
 
 func NewPositionManager() *PositionManager {
@@ -102,12 +106,22 @@ func (pm *PositionManager) Clone() *PositionManager {
 }
 func (pm *PositionManager) Set(key string, position *Position) {
 	pm.Positions[key] = position
+	pm.markDirty(key)
 }
 func (pm *PositionManager) Clear(key string) {
 	delete(pm.Positions, key)
+	pm.markDirty(key)
+}
+
+// 返回的 position 可能被修改, 记录到 dirty
+func (pm *PositionManager) markDirty(key string) {
+	if pm.dirty != nil {
+		pm.dirty[key] = true
+	}
 }
 func (pm *PositionManager) GetPositionAndInitIfAbsent(key string) *Position {
 	if v, ok := pm.Positions[key]; ok {
+		pm.markDirty(key)
 		return v
 	}
 	newP := NewPosition()
@@ -124,10 +138,11 @@ func (pm *PositionManager) GetPositionReadonly(owner string, tickLower int, tick
 }
 func (pm *PositionManager) CollectPosition(owner string, tickLower int, tickUpper int, amount0Requested, amount1Requested decimal.Decimal) (decimal.Decimal, decimal.Decimal, error) {
 	if amount0Requested.LessThan(ZERO) || amount1Requested.LessThan(ZERO) {
-		return ZERO, ZERO, errors.New("amounts requested should be positive")
+		return ZERO, ZERO, fmt.Errorf("%w: %s %s", ErrNegativeAmountRequest, amount0Requested, amount1Requested)
 	}
 	key := GetPositionKey(owner, tickLower, tickUpper)
 	if v, ok := pm.Positions[key]; ok {
+		pm.markDirty(key)
 		positionToCollect := v
 		var amount0 decimal.Decimal
 		if amount0Requested.GreaterThan(positionToCollect.TokensOwed0) {
@@ -0,0 +1,168 @@
+package uniswap_v3_simulator
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	QuarantineSwapUnresolvable = "swap_unresolvable" // 无法从 swap 事件还原输入
+	QuarantineManual           = "manual"
+)
+
+// QuarantinedPool 隔离的 pool, 之后的 logs 不再处理, 直到清除或从链上重新同步
+type QuarantinedPool struct {
+	gorm.Model
+	PoolAddress string `gorm:"uniqueIndex"`
+	// 第一次失败的 log
+	TxHash   string
+	BlockNum uint64
+	LogIndex uint
+	Reason   string
+	Error    string
+}
+
+func (pm *Simulator) loadQuarantine() error {
+	quarantined, err := pm.store.LoadQuarantine()
+	if err != nil {
+		return err
+	}
+	for _, q := range quarantined {
+		pm.quarantined[common.HexToAddress(q.PoolAddress)] = q
+	}
+	if len(quarantined) > 0 {
+		logrus.Warnf("load quarantined pools: %d", len(quarantined))
+	}
+	return nil
+}
+
+// 隔离 pool, FlushPools 时写入数据库, 与 pool 状态在同一个事务中
+func (pm *Simulator) quarantine(address common.Address, log *types.Log, reason string, cause error) {
+	if _, ok := pm.quarantined[address]; ok {
+		return
+	}
+	q := &QuarantinedPool{
+		PoolAddress: address.String(),
+		Reason:      reason,
+	}
+	if log != nil {
+		q.TxHash = log.TxHash.String()
+		q.BlockNum = log.BlockNumber
+		q.LogIndex = log.Index
+	}
+	if cause != nil {
+		q.Error = cause.Error()
+	}
+	pm.quarantined[address] = q
+	if log != nil {
+		if entry := pm.unconfirmedEntry(log.BlockNumber, log.BlockHash); entry != nil {
+			entry.quarantined = append(entry.quarantined, address)
+		}
+	}
+	logrus.Warnf("quarantine pool: %s, reason: %s, tx: %s, %s, current quarantined pools: %d", address, reason, q.TxHash, q.Error, len(pm.quarantined))
+}
+
+func (pm *Simulator) flushQuarantine(tx StoreTx) error {
+	for _, q := range pm.quarantined {
+		if q.ID != 0 {
+			continue
+		}
+		err := tx.SaveQuarantined(q)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pm *Simulator) isQuarantined(address common.Address) bool {
+	_, ok := pm.quarantined[address]
+	return ok
+}
+
+// IsQuarantined pool 是否被隔离
+func (pm *Simulator) IsQuarantined(address common.Address) bool {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	return pm.isQuarantined(address)
+}
+
+// Quarantine 手动隔离 pool
+func (pm *Simulator) Quarantine(address common.Address, reason string) error {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	if reason == "" {
+		reason = QuarantineManual
+	}
+	pm.quarantine(address, nil, reason, nil)
+	return pm.FlushPools()
+}
+
+// QuarantinedPools 所有被隔离的 pool, 按隔离的区块排序
+func (pm *Simulator) QuarantinedPools() []*QuarantinedPool {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	list := make([]*QuarantinedPool, 0, len(pm.quarantined))
+	for _, q := range pm.quarantined {
+		list = append(list, q)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].BlockNum != list[j].BlockNum {
+			return list[i].BlockNum < list[j].BlockNum
+		}
+		return list[i].PoolAddress < list[j].PoolAddress
+	})
+	return list
+}
+
+func (pm *Simulator) clearQuarantine(address common.Address) error {
+	q, ok := pm.quarantined[address]
+	if !ok {
+		return fmt.Errorf("pool not quarantined %s", address)
+	}
+	if q.ID != 0 {
+		err := pm.store.Update(func(tx StoreTx) error {
+			return tx.DeleteQuarantined(q)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	delete(pm.quarantined, address)
+	logrus.Infof("clear quarantined pool: %s", address)
+	return nil
+}
+
+// ClearQuarantine 解除隔离, 之后的 logs 继续应用到隔离前的状态上, 隔离期间跳过的 logs 不会重新处理
+func (pm *Simulator) ClearQuarantine(address common.Address) error {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	return pm.clearQuarantine(address)
+}
+
+// ResyncQuarantined 从链上重新加载隔离的 pool 在已同步区块的状态, 然后解除隔离
+func (pm *Simulator) ResyncQuarantined(address common.Address) (*CorePool, error) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	if !pm.isQuarantined(address) {
+		return nil, fmt.Errorf("pool not quarantined %s", address)
+	}
+	blockNum, err := pm.MaxSyncedBlockNum()
+	if err != nil {
+		return nil, err
+	}
+	pool, err := pm.loadPoolFromChain(address, blockNum, true)
+	if err != nil {
+		return nil, err
+	}
+	err = pm.clearQuarantine(address)
+	if err != nil {
+		return nil, err
+	}
+	return pool, pm.FlushPools()
+}
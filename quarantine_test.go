@@ -0,0 +1,83 @@
+package uniswap_v3_simulator
+
+import (
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/daoleno/uniswapv3-sdk/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSwapLog(blockNumber uint64, amount0, amount1 int64, liquidity int64) types.Log {
+	var data []byte
+	data = append(data, int2Hash(amount0).Bytes()...)
+	data = append(data, int2Hash(amount1).Bytes()...)
+	data = append(data, common.BigToHash(utils.EncodeSqrtRatioX96(big.NewInt(1), big.NewInt(1))).Bytes()...)
+	data = append(data, int2Hash(liquidity).Bytes()...)
+	data = append(data, int2Hash(0).Bytes()...)
+	return types.Log{
+		Address:     testPool,
+		Topics:      []common.Hash{TOPIC_SWAP, common.BytesToHash(testOwner.Bytes()), common.BytesToHash(testOwner.Bytes())},
+		Data:        data,
+		BlockNumber: blockNumber,
+		TxHash:      common.HexToHash("0x5a"),
+		Index:       4,
+	}
+}
+
+func TestSimulator_Quarantine(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "simulator.db")
+	pm := openTestSimulator(t, dbFile, nil)
+	err := pm.HandleLogs([]types.Log{testPoolCreatedLog(100), testInitializeLog(101), testMintLog(102, -600, 600, 1000000)})
+	assert.NoError(t, err)
+	pool := pm.Pools[testPool]
+
+	// 两个方向都为正的 swap 无法还原, pool 被隔离, 之后的 logs 被忽略
+	err = pm.HandleLogs([]types.Log{testSwapLog(103, 5, 5, 1000000), testMintLog(104, -600, 600, 1000)})
+	assert.NoError(t, err)
+	assert.True(t, pm.IsQuarantined(testPool))
+	assert.Equal(t, "1000000", pool.Liquidity.String())
+	assert.NoError(t, pm.FlushPools())
+
+	// 重启后仍然隔离
+	pm = openTestSimulator(t, dbFile, nil)
+	list := pm.QuarantinedPools()
+	assert.Len(t, list, 1)
+	assert.Equal(t, testPool.String(), list[0].PoolAddress)
+	assert.Equal(t, uint64(103), list[0].BlockNum)
+	assert.Equal(t, uint(4), list[0].LogIndex)
+	assert.Equal(t, common.HexToHash("0x5a").String(), list[0].TxHash)
+	assert.Equal(t, QuarantineSwapUnresolvable, list[0].Reason)
+	assert.NotEmpty(t, list[0].Error)
+
+	// fork 同样忽略隔离的 pool
+	fork := NewSimulatorSnapshot(pm)
+	assert.NoError(t, fork.HandleLogs([]types.Log{testMintLog(105, -600, 600, 1000)}))
+	assert.Empty(t, fork.Pools)
+
+	// 从链上重新同步后解除隔离
+	_, err = pm.ResyncQuarantined(testPool)
+	assert.ErrorIs(t, err, ErrNoContractCaller)
+	pm.caller = newMockPoolCaller(t)
+	pool, err = pm.ResyncQuarantined(testPool)
+	assert.NoError(t, err)
+	assert.False(t, pm.IsQuarantined(testPool))
+	assert.Equal(t, uint64(102), pool.BootstrapBlockNum)
+	assert.Equal(t, uint64(101), pool.DeployBlockNum)
+	assert.Len(t, pool.TickManager.Ticks, 2)
+
+	pm = openTestSimulator(t, dbFile, nil)
+	assert.Empty(t, pm.QuarantinedPools())
+	assert.Equal(t, uint64(102), pm.Pools[testPool].BootstrapBlockNum)
+
+	// 手动隔离和解除
+	assert.NoError(t, pm.Quarantine(testPool, ""))
+	assert.Equal(t, QuarantineManual, pm.QuarantinedPools()[0].Reason)
+	assert.NoError(t, pm.ClearQuarantine(testPool))
+	assert.Error(t, pm.ClearQuarantine(testPool))
+	pm = openTestSimulator(t, dbFile, nil)
+	assert.Empty(t, pm.QuarantinedPools())
+}
@@ -0,0 +1,246 @@
+package uniswap_v3_simulator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/shopspring/decimal"
+)
+
+// gas 估算与 Uniswap routing 的 v3 gas 模型相同: 基础消耗, 每个 hop 的消耗和每个穿过的已初始化 tick 的消耗
+const (
+	QuoteGasBase               = 2000
+	QuoteGasPerHop             = 80000
+	QuoteGasPerInitializedTick = 31000
+)
+
+const (
+	pathAddrSize = 20
+	pathFeeSize  = 3
+	pathHopSize  = pathAddrSize + pathFeeSize
+)
+
+var (
+	ErrInvalidPath          = errors.New("invalid swap path")
+	ErrInvalidQuoteAmount   = errors.New("quote amount must be positive")
+	ErrPoolQuarantined      = errors.New("pool quarantined")
+	ErrQuoteOutputNotFilled = errors.New("insufficient liquidity for exact output")
+)
+
+// QuoterPools Quoter 读取 pool 的接口, Simulator 和 SimulatorFork 都实现
+type QuoterPools interface {
+	GetPool(addr common.Address) (*CorePool, error)
+	IsQuarantined(addr common.Address) bool
+}
+
+// Quoter 与 Uniswap 的 QuoterV2 相同, 每个 hop 都是 static 的 swap, 不修改 pool
+type Quoter struct {
+	pools        QuoterPools
+	factory      common.Address
+	initCodeHash common.Hash
+}
+
+type QuoteExactInputSingleParams struct {
+	TokenIn           common.Address
+	TokenOut          common.Address
+	AmountIn          decimal.Decimal
+	Fee               FeeAmount
+	SqrtPriceLimitX96 *decimal.Decimal // nil 表示没有限价
+}
+
+type QuoteExactOutputSingleParams struct {
+	TokenIn           common.Address
+	TokenOut          common.Address
+	Amount            decimal.Decimal
+	Fee               FeeAmount
+	SqrtPriceLimitX96 *decimal.Decimal // nil 表示没有限价, 此时必须输出全部数量
+}
+
+type QuoteResult struct {
+	AmountIn                decimal.Decimal
+	AmountOut               decimal.Decimal
+	SqrtPriceX96After       decimal.Decimal
+	InitializedTicksCrossed uint32
+	GasEstimate             uint64
+}
+
+// PathQuoteResult 的列表按 path 中 pool 的顺序
+type PathQuoteResult struct {
+	AmountIn                    decimal.Decimal
+	AmountOut                   decimal.Decimal
+	SqrtPriceX96AfterList       []decimal.Decimal
+	InitializedTicksCrossedList []uint32
+	GasEstimate                 uint64
+}
+
+func NewQuoter(pools QuoterPools, factory common.Address, initCodeHash common.Hash) *Quoter {
+	return &Quoter{pools: pools, factory: factory, initCodeHash: initCodeHash}
+}
+
+// GetPool 返回 pool 当前状态的复制, quote 时不访问 simulator 中的 pool, 可以与 SyncBlocks 并发
+func (pm *Simulator) GetPool(addr common.Address) (*CorePool, error) {
+	return pm.ForkPool(addr)
+}
+
+// Quoter 使用 simulator 当前的 pool 和 factory
+func (pm *Simulator) Quoter() *Quoter {
+	return NewQuoter(pm, pm.factory, pm.initCodeHash)
+}
+
+// Quoter 使用 fork 中的 pool
+func (s *SimulatorFork) Quoter() *Quoter {
+	return NewQuoter(s, s.simulator.factory, s.simulator.initCodeHash)
+}
+
+// EncodePath 与 Uniswap 的 path 编码相同: token0 fee0 token1 fee1 token2 ..., fee 为 3 字节
+func EncodePath(tokens []common.Address, fees []FeeAmount) ([]byte, error) {
+	if len(tokens) < 2 || len(tokens) != len(fees)+1 {
+		return nil, fmt.Errorf("%w: %d tokens, %d fees", ErrInvalidPath, len(tokens), len(fees))
+	}
+	path := make([]byte, 0, pathAddrSize+len(fees)*pathHopSize)
+	for i, fee := range fees {
+		path = append(path, tokens[i].Bytes()...)
+		path = append(path, byte(fee>>16), byte(fee>>8), byte(fee))
+	}
+	return append(path, tokens[len(tokens)-1].Bytes()...), nil
+}
+
+func DecodePath(path []byte) ([]common.Address, []FeeAmount, error) {
+	if len(path) < pathAddrSize+pathHopSize || (len(path)-pathAddrSize)%pathHopSize != 0 {
+		return nil, nil, fmt.Errorf("%w: length %d", ErrInvalidPath, len(path))
+	}
+	hops := (len(path) - pathAddrSize) / pathHopSize
+	tokens := make([]common.Address, 0, hops+1)
+	fees := make([]FeeAmount, 0, hops)
+	for i := 0; i < hops; i++ {
+		offset := i * pathHopSize
+		tokens = append(tokens, common.BytesToAddress(path[offset:offset+pathAddrSize]))
+		fee := path[offset+pathAddrSize : offset+pathHopSize]
+		fees = append(fees, FeeAmount(int(fee[0])<<16|int(fee[1])<<8|int(fee[2])))
+	}
+	tokens = append(tokens, common.BytesToAddress(path[len(path)-pathAddrSize:]))
+	return tokens, fees, nil
+}
+
+func (q *Quoter) getPool(tokenA, tokenB common.Address, fee FeeAmount) (*CorePool, error) {
+	token0, token1 := tokenA, tokenB
+	if bytes.Compare(token0.Bytes(), token1.Bytes()) > 0 {
+		token0, token1 = token1, token0
+	}
+	addr := ComputePoolAddress(q.factory, q.initCodeHash, token0, token1, fee)
+	if q.pools.IsQuarantined(addr) {
+		return nil, fmt.Errorf("%w %s", ErrPoolQuarantined, addr)
+	}
+	return q.pools.GetPool(addr)
+}
+
+// 单个 pool 的 static swap, amountSpecified 为正数表示 exact input, 负数表示 exact output
+func (q *Quoter) quoteSingle(tokenIn, tokenOut common.Address, fee FeeAmount, amountSpecified decimal.Decimal, sqrtPriceLimitX96 *decimal.Decimal) (*QuoteResult, error) {
+	pool, err := q.getPool(tokenIn, tokenOut, fee)
+	if err != nil {
+		return nil, err
+	}
+	zeroForOne := bytes.Compare(tokenIn.Bytes(), tokenOut.Bytes()) < 0
+	amount0, amount1, sqrtPriceX96After, ticksCrossed, err := pool.handleSwap(zeroForOne, amountSpecified, sqrtPriceLimitX96, true)
+	if err != nil {
+		return nil, err
+	}
+	result := &QuoteResult{
+		SqrtPriceX96After:       sqrtPriceX96After,
+		InitializedTicksCrossed: ticksCrossed,
+		GasEstimate:             QuoteGasPerHop + QuoteGasPerInitializedTick*uint64(ticksCrossed),
+	}
+	if zeroForOne {
+		result.AmountIn, result.AmountOut = amount0, amount1.Neg()
+	} else {
+		result.AmountIn, result.AmountOut = amount1, amount0.Neg()
+	}
+	return result, nil
+}
+
+// QuoteExactInputSingle 输入 AmountIn 时单个 pool 的输出
+func (q *Quoter) QuoteExactInputSingle(params QuoteExactInputSingleParams) (*QuoteResult, error) {
+	if !params.AmountIn.IsPositive() {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidQuoteAmount, params.AmountIn)
+	}
+	result, err := q.quoteSingle(params.TokenIn, params.TokenOut, params.Fee, params.AmountIn, params.SqrtPriceLimitX96)
+	if err != nil {
+		return nil, err
+	}
+	result.GasEstimate += QuoteGasBase
+	return result, nil
+}
+
+// QuoteExactOutputSingle 输出 Amount 时单个 pool 需要的输入
+func (q *Quoter) QuoteExactOutputSingle(params QuoteExactOutputSingleParams) (*QuoteResult, error) {
+	result, err := q.quoteExactOutputSingle(params.TokenIn, params.TokenOut, params.Fee, params.Amount, params.SqrtPriceLimitX96)
+	if err != nil {
+		return nil, err
+	}
+	result.GasEstimate += QuoteGasBase
+	return result, nil
+}
+
+func (q *Quoter) quoteExactOutputSingle(tokenIn, tokenOut common.Address, fee FeeAmount, amount decimal.Decimal, sqrtPriceLimitX96 *decimal.Decimal) (*QuoteResult, error) {
+	if !amount.IsPositive() {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidQuoteAmount, amount)
+	}
+	result, err := q.quoteSingle(tokenIn, tokenOut, fee, amount.Neg(), sqrtPriceLimitX96)
+	if err != nil {
+		return nil, err
+	}
+	// 与 QuoterV2 相同, 没有限价时 pool 的 liquidity 必须足够输出全部数量
+	if sqrtPriceLimitX96 == nil && !result.AmountOut.Equal(amount) {
+		return nil, fmt.Errorf("%w: %s %s, requested %s, received %s", ErrQuoteOutputNotFilled, tokenIn, tokenOut, amount, result.AmountOut)
+	}
+	return result, nil
+}
+
+// QuoteExactInput 沿 path 依次兑换, 每个 hop 的输入为上一个 hop 的输出
+func (q *Quoter) QuoteExactInput(path []byte, amountIn decimal.Decimal) (*PathQuoteResult, error) {
+	tokens, fees, err := DecodePath(path)
+	if err != nil {
+		return nil, err
+	}
+	if !amountIn.IsPositive() {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidQuoteAmount, amountIn)
+	}
+	result := &PathQuoteResult{AmountIn: amountIn, GasEstimate: QuoteGasBase}
+	amount := amountIn
+	for i, fee := range fees {
+		hop, err := q.quoteSingle(tokens[i], tokens[i+1], fee, amount, nil)
+		if err != nil {
+			return nil, err
+		}
+		amount = hop.AmountOut
+		result.SqrtPriceX96AfterList = append(result.SqrtPriceX96AfterList, hop.SqrtPriceX96After)
+		result.InitializedTicksCrossedList = append(result.InitializedTicksCrossedList, hop.InitializedTicksCrossed)
+		result.GasEstimate += hop.GasEstimate
+	}
+	result.AmountOut = amount
+	return result, nil
+}
+
+// QuoteExactOutput 与 QuoterV2 相同, path 为倒序: 第一个 token 为输出, 最后一个为输入
+func (q *Quoter) QuoteExactOutput(path []byte, amountOut decimal.Decimal) (*PathQuoteResult, error) {
+	tokens, fees, err := DecodePath(path)
+	if err != nil {
+		return nil, err
+	}
+	result := &PathQuoteResult{AmountOut: amountOut, GasEstimate: QuoteGasBase}
+	amount := amountOut
+	for i, fee := range fees {
+		hop, err := q.quoteExactOutputSingle(tokens[i+1], tokens[i], fee, amount, nil)
+		if err != nil {
+			return nil, err
+		}
+		amount = hop.AmountIn
+		result.SqrtPriceX96AfterList = append(result.SqrtPriceX96AfterList, hop.SqrtPriceX96After)
+		result.InitializedTicksCrossedList = append(result.InitializedTicksCrossedList, hop.InitializedTicksCrossed)
+		result.GasEstimate += hop.GasEstimate
+	}
+	result.AmountIn = amount
+	return result, nil
+}
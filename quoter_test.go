@@ -0,0 +1,154 @@
+package uniswap_v3_simulator
+
+import (
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/daoleno/uniswapv3-sdk/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	testTokenA = common.HexToAddress("0x10")
+	testTokenB = common.HexToAddress("0x20")
+	testTokenC = common.HexToAddress("0x30")
+)
+
+func addTestQuotePool(t *testing.T, pm *Simulator, token0, token1 common.Address, fee FeeAmount, tickSpacing int64) *CorePool {
+	addr := ComputePoolAddress(pm.factory, pm.initCodeHash, token0, token1, fee)
+	pool := NewCorePoolFromConfig(addr.String(), *NewPoolConfig(tickSpacing, token0, token1, fee))
+	assert.NoError(t, pool.Initialize(decimal.NewFromBigInt(utils.EncodeSqrtRatioX96(big.NewInt(1), big.NewInt(1)), 0)))
+	_, _, err := pool.Mint(testOwner.String(), -6000, 6000, decimal.NewFromInt(1e18))
+	assert.NoError(t, err)
+	_, _, err = pool.Mint(testOwner.String(), -120, 120, decimal.NewFromInt(1e18))
+	assert.NoError(t, err)
+	pm.Pools[addr] = pool
+	return pool
+}
+
+func TestQuoter_Single(t *testing.T) {
+	pm := openTestSimulator(t, filepath.Join(t.TempDir(), "simulator.db"), nil)
+	pool := addTestQuotePool(t, pm, testTokenA, testTokenB, 3000, 60)
+	price := pool.SqrtPriceX96
+	quoter := pm.Quoter()
+	// quote 不修改 simulator 中的 pool, 包括 dirty 和 bitmap
+	pool.TickManager.dirty = map[int]bool{}
+	pool.TickManager.bitmap = nil
+
+	// A -> B 为 zeroForOne, 穿过 -120
+	amountIn := decimal.NewFromInt(2e16)
+	result, err := quoter.QuoteExactInputSingle(QuoteExactInputSingleParams{TokenIn: testTokenA, TokenOut: testTokenB, AmountIn: amountIn, Fee: 3000})
+	assert.NoError(t, err)
+	assert.Nil(t, pool.TickManager.bitmap)
+	amount0, amount1, sqrtPriceX96, err := pool.HandleSwap(true, amountIn, nil, true)
+	assert.NoError(t, err)
+	assert.Equal(t, amount0.String(), result.AmountIn.String())
+	assert.Equal(t, amount1.Neg().String(), result.AmountOut.String())
+	assert.Equal(t, sqrtPriceX96.String(), result.SqrtPriceX96After.String())
+	assert.Equal(t, uint32(1), result.InitializedTicksCrossed)
+	assert.Equal(t, uint64(QuoteGasBase+QuoteGasPerHop+QuoteGasPerInitializedTick), result.GasEstimate)
+	assert.Equal(t, price.String(), pool.SqrtPriceX96.String())
+	assert.Empty(t, pool.TickManager.dirty)
+
+	// B -> A 不穿过 tick
+	result, err = quoter.QuoteExactInputSingle(QuoteExactInputSingleParams{TokenIn: testTokenB, TokenOut: testTokenA, AmountIn: decimal.NewFromInt(1e9), Fee: 3000})
+	assert.NoError(t, err)
+	assert.True(t, result.SqrtPriceX96After.GreaterThan(price))
+	assert.Equal(t, uint32(0), result.InitializedTicksCrossed)
+	assert.Equal(t, uint64(QuoteGasBase+QuoteGasPerHop), result.GasEstimate)
+
+	// exact output 需要的输入再 exact input 得到相同的输出
+	amountOut := decimal.NewFromInt(1e16)
+	result, err = quoter.QuoteExactOutputSingle(QuoteExactOutputSingleParams{TokenIn: testTokenB, TokenOut: testTokenA, Amount: amountOut, Fee: 3000})
+	assert.NoError(t, err)
+	assert.Equal(t, amountOut.String(), result.AmountOut.String())
+	reverse, err := quoter.QuoteExactInputSingle(QuoteExactInputSingleParams{TokenIn: testTokenB, TokenOut: testTokenA, AmountIn: result.AmountIn, Fee: 3000})
+	assert.NoError(t, err)
+	assert.Equal(t, amountOut.String(), reverse.AmountOut.String())
+
+	// liquidity 不足时没有限价的 exact output 失败, 有限价时返回部分输出
+	_, err = quoter.QuoteExactOutputSingle(QuoteExactOutputSingleParams{TokenIn: testTokenB, TokenOut: testTokenA, Amount: decimal.NewFromInt(1e18), Fee: 3000})
+	assert.ErrorIs(t, err, ErrQuoteOutputNotFilled)
+	limit, err := GetSqrtRatioAtTick(600)
+	assert.NoError(t, err)
+	result, err = quoter.QuoteExactOutputSingle(QuoteExactOutputSingleParams{TokenIn: testTokenB, TokenOut: testTokenA, Amount: decimal.NewFromInt(1e18), Fee: 3000, SqrtPriceLimitX96: &limit})
+	assert.NoError(t, err)
+	assert.Equal(t, limit.String(), result.SqrtPriceX96After.String())
+	assert.True(t, result.AmountOut.LessThan(decimal.NewFromInt(1e18)))
+
+	_, err = quoter.QuoteExactInputSingle(QuoteExactInputSingleParams{TokenIn: testTokenA, TokenOut: testTokenB, AmountIn: ZERO, Fee: 3000})
+	assert.ErrorIs(t, err, ErrInvalidQuoteAmount)
+	_, err = quoter.QuoteExactInputSingle(QuoteExactInputSingleParams{TokenIn: testTokenA, TokenOut: testTokenB, AmountIn: ONE, Fee: 500})
+	assert.ErrorIs(t, err, ErrPoolNotExists)
+	assert.NoError(t, pm.Quarantine(common.HexToAddress(pool.PoolAddress), ""))
+	_, err = quoter.QuoteExactInputSingle(QuoteExactInputSingleParams{TokenIn: testTokenA, TokenOut: testTokenB, AmountIn: ONE, Fee: 3000})
+	assert.ErrorIs(t, err, ErrPoolQuarantined)
+}
+
+func TestQuoter_Path(t *testing.T) {
+	tokens := []common.Address{testTokenA, testTokenB, testTokenC}
+	fees := []FeeAmount{3000, 500}
+	path, err := EncodePath(tokens, fees)
+	assert.NoError(t, err)
+	assert.Len(t, path, 66)
+	decodedTokens, decodedFees, err := DecodePath(path)
+	assert.NoError(t, err)
+	assert.Equal(t, tokens, decodedTokens)
+	assert.Equal(t, fees, decodedFees)
+	_, _, err = DecodePath(path[:65])
+	assert.ErrorIs(t, err, ErrInvalidPath)
+	_, err = EncodePath(tokens, fees[:1])
+	assert.ErrorIs(t, err, ErrInvalidPath)
+
+	pm := openTestSimulator(t, filepath.Join(t.TempDir(), "simulator.db"), nil)
+	addTestQuotePool(t, pm, testTokenA, testTokenB, 3000, 60)
+	addTestQuotePool(t, pm, testTokenB, testTokenC, 500, 10)
+	quoter := pm.Quoter()
+
+	// 每个 hop 的输入为上一个 hop 的输出
+	amountIn := decimal.NewFromInt(2e16)
+	result, err := quoter.QuoteExactInput(path, amountIn)
+	assert.NoError(t, err)
+	first, err := quoter.QuoteExactInputSingle(QuoteExactInputSingleParams{TokenIn: testTokenA, TokenOut: testTokenB, AmountIn: amountIn, Fee: 3000})
+	assert.NoError(t, err)
+	second, err := quoter.QuoteExactInputSingle(QuoteExactInputSingleParams{TokenIn: testTokenB, TokenOut: testTokenC, AmountIn: first.AmountOut, Fee: 500})
+	assert.NoError(t, err)
+	assert.Equal(t, amountIn.String(), result.AmountIn.String())
+	assert.Equal(t, second.AmountOut.String(), result.AmountOut.String())
+	assert.Equal(t, []string{first.SqrtPriceX96After.String(), second.SqrtPriceX96After.String()}, []string{result.SqrtPriceX96AfterList[0].String(), result.SqrtPriceX96AfterList[1].String()})
+	assert.Equal(t, []uint32{first.InitializedTicksCrossed, second.InitializedTicksCrossed}, result.InitializedTicksCrossedList)
+	assert.Equal(t, first.GasEstimate+second.GasEstimate-QuoteGasBase, result.GasEstimate)
+
+	// exact output 的 path 为倒序, 列表按 path 的顺序
+	reversed, err := EncodePath([]common.Address{testTokenC, testTokenB, testTokenA}, []FeeAmount{500, 3000})
+	assert.NoError(t, err)
+	amountOut := decimal.NewFromInt(1e16)
+	result, err = quoter.QuoteExactOutput(reversed, amountOut)
+	assert.NoError(t, err)
+	last, err := quoter.QuoteExactOutputSingle(QuoteExactOutputSingleParams{TokenIn: testTokenB, TokenOut: testTokenC, Amount: amountOut, Fee: 500})
+	assert.NoError(t, err)
+	assert.Equal(t, last.SqrtPriceX96After.String(), result.SqrtPriceX96AfterList[0].String())
+	exactIn, err := quoter.QuoteExactInput(path, result.AmountIn)
+	assert.NoError(t, err)
+	assert.True(t, exactIn.AmountOut.GreaterThanOrEqual(amountOut))
+	_, err = quoter.QuoteExactOutput(reversed, decimal.NewFromInt(1e18).Mul(decimal.NewFromInt(10)))
+	assert.ErrorIs(t, err, ErrQuoteOutputNotFilled)
+
+	// fork 中的 pool 与 simulator 独立
+	fork := NewSimulatorSnapshot(pm)
+	forkResult, err := fork.Quoter().QuoteExactInput(path, amountIn)
+	assert.NoError(t, err)
+	assert.Equal(t, second.AmountOut.String(), forkResult.AmountOut.String())
+	assert.Len(t, fork.Pools, 2)
+	for addr, pool := range fork.Pools {
+		_, _, _, err := pool.HandleSwap(true, amountIn, nil, false)
+		assert.NoError(t, err)
+		assert.NotEqual(t, pool.SqrtPriceX96.String(), pm.Pools[addr].SqrtPriceX96.String())
+	}
+	forkResult, err = fork.Quoter().QuoteExactInput(path, amountIn)
+	assert.NoError(t, err)
+	assert.NotEqual(t, second.AmountOut.String(), forkResult.AmountOut.String())
+}
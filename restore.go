@@ -0,0 +1,150 @@
+package uniswap_v3_simulator
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrInconsistentState = errors.New("pool state inconsistent with block")
+	ErrInvalidSnapshot   = errors.New("invalid snapshot file")
+	ErrDBExists          = errors.New("db file already exists")
+)
+
+// SyncState 已同步到的区块, 与 pool 状态在同一个事务中写入. 没有 log 的区块不会体现在 pool 的 CurrentBlockNum 中
+type SyncState struct {
+	ID        uint `gorm:"primarykey"`
+	BlockNum  uint64
+	UpdatedAt time.Time
+}
+
+const syncStateID = 1
+
+func (pm *Simulator) loadSyncState() error {
+	blockNum, err := pm.store.SyncState()
+	if err != nil {
+		return err
+	}
+	pm.currentBlock = blockNum
+	return nil
+}
+
+// 检查 pool 的状态都不晚于 blockNum, 返回第一个不一致的 pool
+func checkPoolsAt(pools map[common.Address]*CorePool, blockNum uint64) error {
+	addresses := make([]common.Address, 0, len(pools))
+	for address := range pools {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return strings.Compare(addresses[i].Hex(), addresses[j].Hex()) < 0
+	})
+	for _, address := range addresses {
+		pool := pools[address]
+		switch {
+		case pool.CurrentBlockNum > blockNum:
+			return fmt.Errorf("%w %d: pool %s at block %d", ErrInconsistentState, blockNum, address, pool.CurrentBlockNum)
+		case pool.BootstrapBlockNum > blockNum:
+			return fmt.Errorf("%w %d: pool %s loaded from chain at block %d", ErrInconsistentState, blockNum, address, pool.BootstrapBlockNum)
+		case pool.DeployBlockNum > blockNum:
+			return fmt.Errorf("%w %d: pool %s deployed at block %d", ErrInconsistentState, blockNum, address, pool.DeployBlockNum)
+		case pool.SqrtPriceX96.IsZero():
+			return fmt.Errorf("%w %d: pool %s not initialized", ErrInconsistentState, blockNum, address)
+		}
+	}
+	return nil
+}
+
+// SnapshotBlockNum 从文件名 xxx.snapshot-N 得到快照的区块
+func SnapshotBlockNum(path string) (uint64, error) {
+	name := filepath.Base(path)
+	i := strings.LastIndex(name, ".snapshot-")
+	if i < 0 {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidSnapshot, path)
+	}
+	blockNum, err := strconv.ParseUint(name[i+len(".snapshot-"):], 10, 64)
+	if err != nil || blockNum == 0 {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidSnapshot, path)
+	}
+	return blockNum, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// NewSimulatorFromSnapshot 把 SyncBlocks 以前写入的 snapshot 文件复制到 dbFile, 检查所有 pool 都不晚于快照的区块,
+// 从快照的区块之后继续同步. dbFile 不能已经存在
+func NewSimulatorFromSnapshot(snapshotFile, dbFile string, source LogSource) (*Simulator, error) {
+	blockNum, err := SnapshotBlockNum(snapshotFile)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dbFile); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrDBExists, dbFile)
+	}
+	err = copyFile(snapshotFile, dbFile)
+	if err != nil {
+		return nil, err
+	}
+	pm, err := NewSimulatorWithSource(dbFile, source, 0)
+	if err == nil {
+		err = pm.restoreSnapshot(blockNum)
+		if err != nil {
+			pm.Close()
+		}
+	}
+	if err != nil {
+		os.Remove(dbFile)
+		return nil, err
+	}
+	return pm, nil
+}
+
+func (pm *Simulator) restoreSnapshot(blockNum uint64) error {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	err := checkPoolsAt(pm.Pools, blockNum)
+	if err != nil {
+		return err
+	}
+	synced, err := pm.MaxSyncedBlockNum()
+	if err != nil {
+		return err
+	}
+	if synced > blockNum {
+		return fmt.Errorf("%w %d: synced to %d", ErrInconsistentState, blockNum, synced)
+	}
+	pm.currentBlock = blockNum
+	pm.journal = nil
+	pm.journalBase = blockNum
+	err = pm.deleteCheckpointsAfter(blockNum)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("restore snapshot: %d, pools: %d", blockNum, len(pm.Pools))
+	return pm.FlushPools()
+}
@@ -0,0 +1,78 @@
+package uniswap_v3_simulator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulator_SyncState(t *testing.T) {
+	source := newTestLogSource(
+		testPoolCreatedLog(100),
+		testInitializeLog(101),
+		testMintLog(105, -600, 600, 1000000),
+	)
+	dbFile := filepath.Join(t.TempDir(), "simulator.db")
+	pm := openTestSimulator(t, dbFile, source)
+	pm.startBlock = 99
+	_, err := pm.SyncTo(300, 10)
+	assert.NoError(t, err)
+	assert.NoError(t, pm.FlushPools())
+	assert.NoError(t, pm.Close())
+
+	// 105 之后没有 log, 重启后仍然从 301 开始同步
+	pm = openTestSimulator(t, dbFile, source)
+	assert.Equal(t, uint64(300), pm.CurrentBlock())
+	synced, err := pm.MaxSyncedBlockNum()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(300), synced)
+}
+
+func TestNewSimulatorFromSnapshot(t *testing.T) {
+	source := newTestLogSource(
+		testPoolCreatedLog(100),
+		testInitializeLog(101),
+		testMintLog(105, -600, 600, 1000000),
+		testMintLog(200, -600, 600, 5),
+	)
+	dir := t.TempDir()
+	dbFile := filepath.Join(dir, "simulator.db")
+	pm := openTestSimulator(t, dbFile, source)
+	pm.startBlock = 99
+	pm.SetCheckpointInterval(0)
+	_, err := pm.SyncTo(150, 10)
+	assert.NoError(t, err)
+	assert.NoError(t, pm.FlushPools())
+	// 以前的 snapshot 文件没有同步位置
+	assert.NoError(t, testDB(pm).Migrator().DropTable(&SyncState{}))
+	assert.NoError(t, pm.Close())
+	snapshot := filepath.Join(dir, "simulator.db.snapshot-150")
+	assert.NoError(t, os.Rename(dbFile, snapshot))
+
+	_, err = SnapshotBlockNum(filepath.Join(dir, "simulator.db"))
+	assert.ErrorIs(t, err, ErrInvalidSnapshot)
+	_, err = NewSimulatorFromSnapshot(snapshot, snapshot, source)
+	assert.ErrorIs(t, err, ErrDBExists)
+
+	// pool 在 105 修改过, 不可能是 103 的快照
+	early := filepath.Join(dir, "simulator.db.snapshot-103")
+	bs, err := os.ReadFile(snapshot)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(early, bs, 0644))
+	restored := filepath.Join(dir, "restored.db")
+	_, err = NewSimulatorFromSnapshot(early, restored, source)
+	assert.ErrorIs(t, err, ErrInconsistentState)
+	_, err = os.Stat(restored)
+	assert.True(t, os.IsNotExist(err))
+
+	pm, err = NewSimulatorFromSnapshot(snapshot, restored, source)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(150), pm.CurrentBlock())
+	assert.Equal(t, "1000000", pm.Pools[testPool].Liquidity.String())
+	_, err = pm.SyncTo(0, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, "1000005", pm.Pools[testPool].Liquidity.String())
+	assert.Equal(t, uint64(200), pm.CurrentBlock())
+}
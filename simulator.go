@@ -1,119 +1,205 @@
 package uniswap_v3_simulator
 
+//go:generate abigen --abi univ3.json --pkg uniswap_v3_simulator --type UniswapV3Simulator --out v3.go
+
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
-	"github.com/glebarez/sqlite"
 	"github.com/sirupsen/logrus"
-	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
-	"log"
 	"math/big"
-	"os"
 	"strings"
 	"sync"
-	"time"
 )
 
 var (
-	ABI              = `[{"inputs":[],"stateMutability":"nonpayable","type":"constructor"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"address","name":"owner","type":"address"},{"indexed":true,"internalType":"int24","name":"tickLower","type":"int24"},{"indexed":true,"internalType":"int24","name":"tickUpper","type":"int24"},{"indexed":false,"internalType":"uint128","name":"amount","type":"uint128"},{"indexed":false,"internalType":"uint256","name":"amount0","type":"uint256"},{"indexed":false,"internalType":"uint256","name":"amount1","type":"uint256"}],"name":"Burn","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"address","name":"owner","type":"address"},{"indexed":false,"internalType":"address","name":"recipient","type":"address"},{"indexed":true,"internalType":"int24","name":"tickLower","type":"int24"},{"indexed":true,"internalType":"int24","name":"tickUpper","type":"int24"},{"indexed":false,"internalType":"uint128","name":"amount0","type":"uint128"},{"indexed":false,"internalType":"uint128","name":"amount1","type":"uint128"}],"name":"Collect","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"address","name":"sender","type":"address"},{"indexed":true,"internalType":"address","name":"recipient","type":"address"},{"indexed":false,"internalType":"uint128","name":"amount0","type":"uint128"},{"indexed":false,"internalType":"uint128","name":"amount1","type":"uint128"}],"name":"CollectProtocol","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"address","name":"sender","type":"address"},{"indexed":true,"internalType":"address","name":"recipient","type":"address"},{"indexed":false,"internalType":"uint256","name":"amount0","type":"uint256"},{"indexed":false,"internalType":"uint256","name":"amount1","type":"uint256"},{"indexed":false,"internalType":"uint256","name":"paid0","type":"uint256"},{"indexed":false,"internalType":"uint256","name":"paid1","type":"uint256"}],"name":"Flash","type":"event"},{"anonymous":false,"inputs":[{"indexed":false,"internalType":"uint16","name":"observationCardinalityNextOld","type":"uint16"},{"indexed":false,"internalType":"uint16","name":"observationCardinalityNextNew","type":"uint16"}],"name":"IncreaseObservationCardinalityNext","type":"event"},{"anonymous":false,"inputs":[{"indexed":false,"internalType":"uint160","name":"sqrtPriceX96","type":"uint160"},{"indexed":false,"internalType":"int24","name":"tick","type":"int24"}],"name":"Initialize","type":"event"},{"anonymous":false,"inputs":[{"indexed":false,"internalType":"address","name":"sender","type":"address"},{"indexed":true,"internalType":"address","name":"owner","type":"address"},{"indexed":true,"internalType":"int24","name":"tickLower","type":"int24"},{"indexed":true,"internalType":"int24","name":"tickUpper","type":"int24"},{"indexed":false,"internalType":"uint128","name":"amount","type":"uint128"},{"indexed":false,"internalType":"uint256","name":"amount0","type":"uint256"},{"indexed":false,"internalType":"uint256","name":"amount1","type":"uint256"}],"name":"Mint","type":"event"},{"anonymous":false,"inputs":[{"indexed":false,"internalType":"uint8","name":"feeProtocol0Old","type":"uint8"},{"indexed":false,"internalType":"uint8","name":"feeProtocol1Old","type":"uint8"},{"indexed":false,"internalType":"uint8","name":"feeProtocol0New","type":"uint8"},{"indexed":false,"internalType":"uint8","name":"feeProtocol1New","type":"uint8"}],"name":"SetFeeProtocol","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"address","name":"sender","type":"address"},{"indexed":true,"internalType":"address","name":"recipient","type":"address"},{"indexed":false,"internalType":"int256","name":"amount0","type":"int256"},{"indexed":false,"internalType":"int256","name":"amount1","type":"int256"},{"indexed":false,"internalType":"uint160","name":"sqrtPriceX96","type":"uint160"},{"indexed":false,"internalType":"uint128","name":"Liquidity","type":"uint128"},{"indexed":false,"internalType":"int24","name":"tick","type":"int24"}],"name":"Swap","type":"event"},{"inputs":[{"internalType":"int24","name":"tickLower","type":"int24"},{"internalType":"int24","name":"tickUpper","type":"int24"},{"internalType":"uint128","name":"amount","type":"uint128"}],"name":"burn","outputs":[{"internalType":"uint256","name":"amount0","type":"uint256"},{"internalType":"uint256","name":"amount1","type":"uint256"}],"stateMutability":"nonpayable","type":"function"},{"inputs":[{"internalType":"address","name":"recipient","type":"address"},{"internalType":"int24","name":"tickLower","type":"int24"},{"internalType":"int24","name":"tickUpper","type":"int24"},{"internalType":"uint128","name":"amount0Requested","type":"uint128"},{"internalType":"uint128","name":"amount1Requested","type":"uint128"}],"name":"collect","outputs":[{"internalType":"uint128","name":"amount0","type":"uint128"},{"internalType":"uint128","name":"amount1","type":"uint128"}],"stateMutability":"nonpayable","type":"function"},{"inputs":[{"internalType":"address","name":"recipient","type":"address"},{"internalType":"uint128","name":"amount0Requested","type":"uint128"},{"internalType":"uint128","name":"amount1Requested","type":"uint128"}],"name":"collectProtocol","outputs":[{"internalType":"uint128","name":"amount0","type":"uint128"},{"internalType":"uint128","name":"amount1","type":"uint128"}],"stateMutability":"nonpayable","type":"function"},{"inputs":[],"name":"factory","outputs":[{"internalType":"address","name":"","type":"address"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"fee","outputs":[{"internalType":"uint24","name":"","type":"uint24"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"feeGrowthGlobal0X128","outputs":[{"internalType":"uint256","name":"","type":"uint256"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"feeGrowthGlobal1X128","outputs":[{"internalType":"uint256","name":"","type":"uint256"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"address","name":"recipient","type":"address"},{"internalType":"uint256","name":"amount0","type":"uint256"},{"internalType":"uint256","name":"amount1","type":"uint256"},{"internalType":"bytes","name":"data","type":"bytes"}],"name":"flash","outputs":[],"stateMutability":"nonpayable","type":"function"},{"inputs":[{"internalType":"uint16","name":"observationCardinalityNext","type":"uint16"}],"name":"increaseObservationCardinalityNext","outputs":[],"stateMutability":"nonpayable","type":"function"},{"inputs":[{"internalType":"uint160","name":"sqrtPriceX96","type":"uint160"}],"name":"initialize","outputs":[],"stateMutability":"nonpayable","type":"function"},{"inputs":[],"name":"Liquidity","outputs":[{"internalType":"uint128","name":"","type":"uint128"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"maxLiquidityPerTick","outputs":[{"internalType":"uint128","name":"","type":"uint128"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"address","name":"recipient","type":"address"},{"internalType":"int24","name":"tickLower","type":"int24"},{"internalType":"int24","name":"tickUpper","type":"int24"},{"internalType":"uint128","name":"amount","type":"uint128"},{"internalType":"bytes","name":"data","type":"bytes"}],"name":"mint","outputs":[{"internalType":"uint256","name":"amount0","type":"uint256"},{"internalType":"uint256","name":"amount1","type":"uint256"}],"stateMutability":"nonpayable","type":"function"},{"inputs":[{"internalType":"uint256","name":"","type":"uint256"}],"name":"observations","outputs":[{"internalType":"uint32","name":"blockTimestamp","type":"uint32"},{"internalType":"int56","name":"tickCumulative","type":"int56"},{"internalType":"uint160","name":"secondsPerLiquidityCumulativeX128","type":"uint160"},{"internalType":"bool","name":"initialized","type":"bool"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"uint32[]","name":"secondsAgos","type":"uint32[]"}],"name":"observe","outputs":[{"internalType":"int56[]","name":"tickCumulatives","type":"int56[]"},{"internalType":"uint160[]","name":"secondsPerLiquidityCumulativeX128s","type":"uint160[]"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"bytes32","name":"","type":"bytes32"}],"name":"Positions","outputs":[{"internalType":"uint128","name":"Liquidity","type":"uint128"},{"internalType":"uint256","name":"FeeGrowthInside0LastX128","type":"uint256"},{"internalType":"uint256","name":"FeeGrowthInside1LastX128","type":"uint256"},{"internalType":"uint128","name":"TokensOwed0","type":"uint128"},{"internalType":"uint128","name":"TokensOwed1","type":"uint128"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"protocolFees","outputs":[{"internalType":"uint128","name":"token0","type":"uint128"},{"internalType":"uint128","name":"token1","type":"uint128"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"uint8","name":"feeProtocol0","type":"uint8"},{"internalType":"uint8","name":"feeProtocol1","type":"uint8"}],"name":"setFeeProtocol","outputs":[],"stateMutability":"nonpayable","type":"function"},{"inputs":[],"name":"slot0","outputs":[{"internalType":"uint160","name":"sqrtPriceX96","type":"uint160"},{"internalType":"int24","name":"tick","type":"int24"},{"internalType":"uint16","name":"observationIndex","type":"uint16"},{"internalType":"uint16","name":"observationCardinality","type":"uint16"},{"internalType":"uint16","name":"observationCardinalityNext","type":"uint16"},{"internalType":"uint8","name":"feeProtocol","type":"uint8"},{"internalType":"bool","name":"unlocked","type":"bool"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"int24","name":"tickLower","type":"int24"},{"internalType":"int24","name":"tickUpper","type":"int24"}],"name":"snapshotCumulativesInside","outputs":[{"internalType":"int56","name":"tickCumulativeInside","type":"int56"},{"internalType":"uint160","name":"secondsPerLiquidityInsideX128","type":"uint160"},{"internalType":"uint32","name":"secondsInside","type":"uint32"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"address","name":"recipient","type":"address"},{"internalType":"bool","name":"zeroForOne","type":"bool"},{"internalType":"int256","name":"amountSpecified","type":"int256"},{"internalType":"uint160","name":"sqrtPriceLimitX96","type":"uint160"},{"internalType":"bytes","name":"data","type":"bytes"}],"name":"swap","outputs":[{"internalType":"int256","name":"amount0","type":"int256"},{"internalType":"int256","name":"amount1","type":"int256"}],"stateMutability":"nonpayable","type":"function"},{"inputs":[{"internalType":"int16","name":"","type":"int16"}],"name":"tickBitmap","outputs":[{"internalType":"uint256","name":"","type":"uint256"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"tickSpacing","outputs":[{"internalType":"int24","name":"","type":"int24"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"int24","name":"","type":"int24"}],"name":"Ticks","outputs":[{"internalType":"uint128","name":"liquidityGross","type":"uint128"},{"internalType":"int128","name":"liquidityNet","type":"int128"},{"internalType":"uint256","name":"feeGrowthOutside0X128","type":"uint256"},{"internalType":"uint256","name":"feeGrowthOutside1X128","type":"uint256"},{"internalType":"int56","name":"tickCumulativeOutside","type":"int56"},{"internalType":"uint160","name":"secondsPerLiquidityOutsideX128","type":"uint160"},{"internalType":"uint32","name":"secondsOutside","type":"uint32"},{"internalType":"bool","name":"initialized","type":"bool"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"token0","outputs":[{"internalType":"address","name":"","type":"address"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"token1","outputs":[{"internalType":"address","name":"","type":"address"}],"stateMutability":"view","type":"function"}]`
+	ABI              = `[{"inputs":[],"stateMutability":"nonpayable","type":"constructor"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"address","name":"owner","type":"address"},{"indexed":true,"internalType":"int24","name":"tickLower","type":"int24"},{"indexed":true,"internalType":"int24","name":"tickUpper","type":"int24"},{"indexed":false,"internalType":"uint128","name":"amount","type":"uint128"},{"indexed":false,"internalType":"uint256","name":"amount0","type":"uint256"},{"indexed":false,"internalType":"uint256","name":"amount1","type":"uint256"}],"name":"Burn","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"address","name":"owner","type":"address"},{"indexed":false,"internalType":"address","name":"recipient","type":"address"},{"indexed":true,"internalType":"int24","name":"tickLower","type":"int24"},{"indexed":true,"internalType":"int24","name":"tickUpper","type":"int24"},{"indexed":false,"internalType":"uint128","name":"amount0","type":"uint128"},{"indexed":false,"internalType":"uint128","name":"amount1","type":"uint128"}],"name":"Collect","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"address","name":"sender","type":"address"},{"indexed":true,"internalType":"address","name":"recipient","type":"address"},{"indexed":false,"internalType":"uint128","name":"amount0","type":"uint128"},{"indexed":false,"internalType":"uint128","name":"amount1","type":"uint128"}],"name":"CollectProtocol","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"address","name":"sender","type":"address"},{"indexed":true,"internalType":"address","name":"recipient","type":"address"},{"indexed":false,"internalType":"uint256","name":"amount0","type":"uint256"},{"indexed":false,"internalType":"uint256","name":"amount1","type":"uint256"},{"indexed":false,"internalType":"uint256","name":"paid0","type":"uint256"},{"indexed":false,"internalType":"uint256","name":"paid1","type":"uint256"}],"name":"Flash","type":"event"},{"anonymous":false,"inputs":[{"indexed":false,"internalType":"uint16","name":"observationCardinalityNextOld","type":"uint16"},{"indexed":false,"internalType":"uint16","name":"observationCardinalityNextNew","type":"uint16"}],"name":"IncreaseObservationCardinalityNext","type":"event"},{"anonymous":false,"inputs":[{"indexed":false,"internalType":"uint160","name":"sqrtPriceX96","type":"uint160"},{"indexed":false,"internalType":"int24","name":"tick","type":"int24"}],"name":"Initialize","type":"event"},{"anonymous":false,"inputs":[{"indexed":false,"internalType":"address","name":"sender","type":"address"},{"indexed":true,"internalType":"address","name":"owner","type":"address"},{"indexed":true,"internalType":"int24","name":"tickLower","type":"int24"},{"indexed":true,"internalType":"int24","name":"tickUpper","type":"int24"},{"indexed":false,"internalType":"uint128","name":"amount","type":"uint128"},{"indexed":false,"internalType":"uint256","name":"amount0","type":"uint256"},{"indexed":false,"internalType":"uint256","name":"amount1","type":"uint256"}],"name":"Mint","type":"event"},{"anonymous":false,"inputs":[{"indexed":false,"internalType":"uint8","name":"feeProtocol0Old","type":"uint8"},{"indexed":false,"internalType":"uint8","name":"feeProtocol1Old","type":"uint8"},{"indexed":false,"internalType":"uint8","name":"feeProtocol0New","type":"uint8"},{"indexed":false,"internalType":"uint8","name":"feeProtocol1New","type":"uint8"}],"name":"SetFeeProtocol","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"internalType":"address","name":"sender","type":"address"},{"indexed":true,"internalType":"address","name":"recipient","type":"address"},{"indexed":false,"internalType":"int256","name":"amount0","type":"int256"},{"indexed":false,"internalType":"int256","name":"amount1","type":"int256"},{"indexed":false,"internalType":"uint160","name":"sqrtPriceX96","type":"uint160"},{"indexed":false,"internalType":"uint128","name":"liquidity","type":"uint128"},{"indexed":false,"internalType":"int24","name":"tick","type":"int24"}],"name":"Swap","type":"event"},{"inputs":[{"internalType":"int24","name":"tickLower","type":"int24"},{"internalType":"int24","name":"tickUpper","type":"int24"},{"internalType":"uint128","name":"amount","type":"uint128"}],"name":"burn","outputs":[{"internalType":"uint256","name":"amount0","type":"uint256"},{"internalType":"uint256","name":"amount1","type":"uint256"}],"stateMutability":"nonpayable","type":"function"},{"inputs":[{"internalType":"address","name":"recipient","type":"address"},{"internalType":"int24","name":"tickLower","type":"int24"},{"internalType":"int24","name":"tickUpper","type":"int24"},{"internalType":"uint128","name":"amount0Requested","type":"uint128"},{"internalType":"uint128","name":"amount1Requested","type":"uint128"}],"name":"collect","outputs":[{"internalType":"uint128","name":"amount0","type":"uint128"},{"internalType":"uint128","name":"amount1","type":"uint128"}],"stateMutability":"nonpayable","type":"function"},{"inputs":[{"internalType":"address","name":"recipient","type":"address"},{"internalType":"uint128","name":"amount0Requested","type":"uint128"},{"internalType":"uint128","name":"amount1Requested","type":"uint128"}],"name":"collectProtocol","outputs":[{"internalType":"uint128","name":"amount0","type":"uint128"},{"internalType":"uint128","name":"amount1","type":"uint128"}],"stateMutability":"nonpayable","type":"function"},{"inputs":[],"name":"factory","outputs":[{"internalType":"address","name":"","type":"address"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"fee","outputs":[{"internalType":"uint24","name":"","type":"uint24"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"feeGrowthGlobal0X128","outputs":[{"internalType":"uint256","name":"","type":"uint256"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"feeGrowthGlobal1X128","outputs":[{"internalType":"uint256","name":"","type":"uint256"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"address","name":"recipient","type":"address"},{"internalType":"uint256","name":"amount0","type":"uint256"},{"internalType":"uint256","name":"amount1","type":"uint256"},{"internalType":"bytes","name":"data","type":"bytes"}],"name":"flash","outputs":[],"stateMutability":"nonpayable","type":"function"},{"inputs":[{"internalType":"uint16","name":"observationCardinalityNext","type":"uint16"}],"name":"increaseObservationCardinalityNext","outputs":[],"stateMutability":"nonpayable","type":"function"},{"inputs":[{"internalType":"uint160","name":"sqrtPriceX96","type":"uint160"}],"name":"initialize","outputs":[],"stateMutability":"nonpayable","type":"function"},{"inputs":[],"name":"liquidity","outputs":[{"internalType":"uint128","name":"","type":"uint128"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"maxLiquidityPerTick","outputs":[{"internalType":"uint128","name":"","type":"uint128"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"address","name":"recipient","type":"address"},{"internalType":"int24","name":"tickLower","type":"int24"},{"internalType":"int24","name":"tickUpper","type":"int24"},{"internalType":"uint128","name":"amount","type":"uint128"},{"internalType":"bytes","name":"data","type":"bytes"}],"name":"mint","outputs":[{"internalType":"uint256","name":"amount0","type":"uint256"},{"internalType":"uint256","name":"amount1","type":"uint256"}],"stateMutability":"nonpayable","type":"function"},{"inputs":[{"internalType":"uint256","name":"","type":"uint256"}],"name":"observations","outputs":[{"internalType":"uint32","name":"blockTimestamp","type":"uint32"},{"internalType":"int56","name":"tickCumulative","type":"int56"},{"internalType":"uint160","name":"secondsPerLiquidityCumulativeX128","type":"uint160"},{"internalType":"bool","name":"initialized","type":"bool"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"uint32[]","name":"secondsAgos","type":"uint32[]"}],"name":"observe","outputs":[{"internalType":"int56[]","name":"tickCumulatives","type":"int56[]"},{"internalType":"uint160[]","name":"secondsPerLiquidityCumulativeX128s","type":"uint160[]"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"bytes32","name":"","type":"bytes32"}],"name":"positions","outputs":[{"internalType":"uint128","name":"liquidity","type":"uint128"},{"internalType":"uint256","name":"feeGrowthInside0LastX128","type":"uint256"},{"internalType":"uint256","name":"feeGrowthInside1LastX128","type":"uint256"},{"internalType":"uint128","name":"tokensOwed0","type":"uint128"},{"internalType":"uint128","name":"tokensOwed1","type":"uint128"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"protocolFees","outputs":[{"internalType":"uint128","name":"token0","type":"uint128"},{"internalType":"uint128","name":"token1","type":"uint128"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"uint8","name":"feeProtocol0","type":"uint8"},{"internalType":"uint8","name":"feeProtocol1","type":"uint8"}],"name":"setFeeProtocol","outputs":[],"stateMutability":"nonpayable","type":"function"},{"inputs":[],"name":"slot0","outputs":[{"internalType":"uint160","name":"sqrtPriceX96","type":"uint160"},{"internalType":"int24","name":"tick","type":"int24"},{"internalType":"uint16","name":"observationIndex","type":"uint16"},{"internalType":"uint16","name":"observationCardinality","type":"uint16"},{"internalType":"uint16","name":"observationCardinalityNext","type":"uint16"},{"internalType":"uint8","name":"feeProtocol","type":"uint8"},{"internalType":"bool","name":"unlocked","type":"bool"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"int24","name":"tickLower","type":"int24"},{"internalType":"int24","name":"tickUpper","type":"int24"}],"name":"snapshotCumulativesInside","outputs":[{"internalType":"int56","name":"tickCumulativeInside","type":"int56"},{"internalType":"uint160","name":"secondsPerLiquidityInsideX128","type":"uint160"},{"internalType":"uint32","name":"secondsInside","type":"uint32"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"address","name":"recipient","type":"address"},{"internalType":"bool","name":"zeroForOne","type":"bool"},{"internalType":"int256","name":"amountSpecified","type":"int256"},{"internalType":"uint160","name":"sqrtPriceLimitX96","type":"uint160"},{"internalType":"bytes","name":"data","type":"bytes"}],"name":"swap","outputs":[{"internalType":"int256","name":"amount0","type":"int256"},{"internalType":"int256","name":"amount1","type":"int256"}],"stateMutability":"nonpayable","type":"function"},{"inputs":[{"internalType":"int16","name":"","type":"int16"}],"name":"tickBitmap","outputs":[{"internalType":"uint256","name":"","type":"uint256"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"tickSpacing","outputs":[{"internalType":"int24","name":"","type":"int24"}],"stateMutability":"view","type":"function"},{"inputs":[{"internalType":"int24","name":"","type":"int24"}],"name":"ticks","outputs":[{"internalType":"uint128","name":"liquidityGross","type":"uint128"},{"internalType":"int128","name":"liquidityNet","type":"int128"},{"internalType":"uint256","name":"feeGrowthOutside0X128","type":"uint256"},{"internalType":"uint256","name":"feeGrowthOutside1X128","type":"uint256"},{"internalType":"int56","name":"tickCumulativeOutside","type":"int56"},{"internalType":"uint160","name":"secondsPerLiquidityOutsideX128","type":"uint160"},{"internalType":"uint32","name":"secondsOutside","type":"uint32"},{"internalType":"bool","name":"initialized","type":"bool"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"token0","outputs":[{"internalType":"address","name":"","type":"address"}],"stateMutability":"view","type":"function"},{"inputs":[],"name":"token1","outputs":[{"internalType":"address","name":"","type":"address"}],"stateMutability":"view","type":"function"}]`
 	TOPIC_INITIALIZE = common.HexToHash("0x98636036cb66a9c19a37435efc1e90142190214e8abeb821bdba3f2990dd4c95")
 	TOPIC_BURN       = common.HexToHash("0x0c396cd989a39f4459b5fa1aed6a9a8dcdbc45908acfd67e028cd568da98982c")
 	TOPIC_SWAP       = common.HexToHash("0xc42079f94a6350d7e6235f29174924f928cc2ac818eb64fed8004e115fbcca67")
 	TOPIC_MINT       = common.HexToHash("0x7a53080ba414158be7ec69b987b5fb7d07dee101fe85488f0853ae16239d0bde")
-)
+	TOPIC_FLASH      = common.HexToHash("0xbdbdb71d7860376ba52b25a5028beea23581364a40522f6bcfb86bb1f2dca633")
+	TOPIC_COLLECT    = common.HexToHash("0x70935338e69775456a85ddef226c395fb668b63fa0115f5f20610b388e6ca9c0")
 
-var (
-	skipAddress = []common.Address{common.HexToAddress("0xAE085446Dd8e7545072dFf82429A866b75AD776d"), common.HexToAddress("0xa87998484c19d68807debdc280e18424d55743a9"), common.HexToAddress("0xcba27c8e7115b4eb50aa14999bc0866674a96ecb"), common.HexToAddress("0x979f63b8279376ef8205fb536b16080cd1d45058")}
+	TOPIC_SET_FEE_PROTOCOL = common.HexToHash("0x973d8d92bb299f4af6ce49b52a8adb85ae46b9f214c4c4fc06ac77401237b133")
+	TOPIC_COLLECT_PROTOCOL = common.HexToHash("0x596b573906218d3411850b26a6b437d6c4522fdb43d2d2386263f86d50b8b151")
+
+	TOPIC_INCREASE_CARDINALITY = common.HexToHash("0xac49e518f90a358f652e4400164f05a5d8f7e35e7747279bc3a93dbf584e125a")
+
+	// factory
+	TOPIC_POOL_CREATED = common.HexToHash("0x783cca1c0412dd0d695e784568c96da2e9c22ff989357a2e8b1d9b2b4e6b7118")
 )
 
 type Simulator struct {
-	lock         sync.Mutex
-	startBlock   uint64 // 起始区块
-	currentBlock uint64 // 当前同步到
-	Pools        map[common.Address]*CorePool
-	dirtyPools   map[string]*CorePool
-	Abi          abi.ABI
-	InitializeID common.Hash
-	MintID       common.Hash
-	BurnID       common.Hash
-	SwapID       common.Hash
-	rpc          *ethclient.Client
-	db           *gorm.DB
-	dbfile       string
-	ctx          context.Context
+	lock                  sync.Mutex
+	startBlock            uint64 // 起始区块
+	currentBlock          uint64 // 当前同步到
+	Pools                 map[common.Address]*CorePool
+	dirtyPools            map[string]*CorePool
+	removedPools          []*CorePool // 重组回滚时删除的 pool
+	confirmations         uint64      // 确认深度, 0 表示不处理重组
+	head                  uint64      // 已知的链头
+	journalBase           uint64      // 开始记录 journal 之前已同步的区块
+	journal               []*journalEntry
+	Abi                   abi.ABI
+	InitializeID          common.Hash
+	MintID                common.Hash
+	BurnID                common.Hash
+	SwapID                common.Hash
+	FlashID               common.Hash
+	CollectID             common.Hash
+	SetFeeProtocolID      common.Hash
+	CollectProtocolID     common.Hash
+	IncreaseCardinalityID common.Hash
+	blockTimestamps       map[uint64]uint64 // 区块时间戳缓存, oracle 使用
+	tsLock                sync.Mutex
+	source                LogSource
+	caller                bind.ContractCaller            // 读取 pool 配置, 离线时为 nil
+	poolConfigs           map[common.Address]*PoolConfig // pool 注册表, 来自 factory PoolCreated 事件
+	newRegistered         []*RegisteredPool              // 还没有写入数据库的注册记录
+	removedRegistered     []string                       // 回滚时撤销的注册记录, 需要从数据库删除
+	factory               common.Address                 // 只接受该 factory 创建的 pool
+	initCodeHash          common.Hash
+	quarantined           map[common.Address]*QuarantinedPool // 隔离的 pool, 之后的 logs 忽略
+	errorPolicy           int32                               // ErrorPolicy, 原子读写, 持有 lock 时也可以读取
+	swapMode              SwapMode                            // 执行 Swap 事件的方式
+	errCounter            errorCounter
+	checkpointInterval    uint64 // 保存 checkpoint 的间隔区块数
+	checkpointRetention   CheckpointRetention
+	lastCheckpoint        uint64          // 最后一个 checkpoint 的区块
+	checkpointSeq         uint64          // 最后一个 checkpoint 的序号
+	checkpointPools       map[string]bool // 上一个 checkpoint 之后修改过的 pool
+	store                 Store
+	ctx                   context.Context
 }
 
-func NewPoolManager(dbFile string, rpcUrl string, startBlock uint64) *Simulator {
-	db, err := gorm.Open(sqlite.Open(dbFile), &gorm.Config{
-		Logger: logger.New(
-			log.New(os.Stdout, "\r\n", log.LstdFlags), // io writer
-			logger.Config{
-				SlowThreshold:             100 * time.Second, // Slow SQL threshold
-				LogLevel:                  logger.Error,      // Log level
-				IgnoreRecordNotFoundError: true,              // Ignore ErrRecordNotFound error for sugaredLogger
-				Colorful:                  true,              // Disable color
-			},
-		),
-	})
-	rpc, err := ethclient.Dial(rpcUrl)
+func NewPoolManager(dbFile string, rpcUrl string, startBlock uint64) (*Simulator, error) {
+	source, err := NewRpcLogSource(rpcUrl)
+	if err != nil {
+		return nil, fmt.Errorf("failed dial rpc %s: %w", rpcUrl, err)
+	}
+	return NewSimulatorWithSource(dbFile, source, startBlock)
+}
+
+// NewSimulatorWithSource 使用指定的 LogSource 同步, 可以离线回放文件或内存中的 logs.
+// source 实现 bind.ContractCaller 时, 从链上读取 pool 配置, 否则只能使用 PoolCreated 事件中的配置
+func NewSimulatorWithSource(dbFile string, source LogSource, startBlock uint64) (*Simulator, error) {
+	store, err := NewSQLiteStore(dbFile)
 	if err != nil {
-		logrus.Fatal(err)
+		return nil, err
 	}
+	return NewSimulatorWithStore(store, source, startBlock)
+}
+
+// NewSimulatorWithStore 使用指定的 Store 保存状态, 启动时从 Store 加载
+func NewSimulatorWithStore(store Store, source LogSource, startBlock uint64) (*Simulator, error) {
 	pm := &Simulator{
-		startBlock: startBlock,
-		Pools:      map[common.Address]*CorePool{},
-		dirtyPools: map[string]*CorePool{},
-		rpc:        rpc,
-		db:         db,
-		dbfile:     dbFile,
-		ctx:        context.Background(),
+		startBlock:         startBlock,
+		Pools:              map[common.Address]*CorePool{},
+		dirtyPools:         map[string]*CorePool{},
+		blockTimestamps:    map[uint64]uint64{},
+		source:             source,
+		poolConfigs:        map[common.Address]*PoolConfig{},
+		quarantined:        map[common.Address]*QuarantinedPool{},
+		checkpointInterval: DefaultCheckpointInterval,
+		checkpointPools:    map[string]bool{},
+		factory:            UNISWAP_V3_FACTORY,
+		initCodeHash:       POOL_INIT_CODE_HASH,
+		store:              store,
+		ctx:                context.Background(),
 	}
 	a, err := abi.JSON(strings.NewReader(ABI))
 	if err != nil {
-		logrus.Fatal(err)
+		return nil, err
+	}
+	if caller, ok := asContractCaller(source); ok {
+		pm.caller = caller
 	}
 	pm.Abi = a
 	pm.InitializeID = a.Events["Initialize"].ID
 	pm.MintID = a.Events["Mint"].ID
 	pm.BurnID = a.Events["Burn"].ID
 	pm.SwapID = a.Events["Swap"].ID
+	pm.FlashID = a.Events["Flash"].ID
+	pm.CollectID = a.Events["Collect"].ID
+	pm.SetFeeProtocolID = a.Events["SetFeeProtocol"].ID
+	pm.CollectProtocolID = a.Events["CollectProtocol"].ID
+	pm.IncreaseCardinalityID = a.Events["IncreaseObservationCardinalityNext"].ID
 
-	err = db.AutoMigrate(&CorePool{})
+	err = pm.loadRegistry()
 	if err != nil {
-		logrus.Fatal(err)
+		return nil, err
+	}
+	err = pm.loadQuarantine()
+	if err != nil {
+		return nil, err
+	}
+	err = pm.loadCheckpoints()
+	if err != nil {
+		return nil, err
+	}
+	err = pm.loadSyncState()
+	if err != nil {
+		return nil, err
 	}
 
-	var currentPool []*CorePool
-	err = db.Find(&currentPool).Error
+	currentPool, err := pm.store.LoadPools()
 	if err != nil {
-		logrus.Fatal(err)
+		return nil, err
 	}
 	for _, pool := range currentPool {
 		pm.Pools[common.HexToAddress(pool.PoolAddress)] = pool
 	}
-	return pm
+	return pm, nil
 }
 
 func (pm *Simulator) CurrentBlock() uint64 {
 	return pm.currentBlock
 }
 
-func (pm *Simulator) NewPool(log *types.Log) (*CorePool, error) {
-	initialze, err := parseUniv3InitializeEvent(log)
+// Close 关闭数据库, 未 flush 的修改会丢失
+func (pm *Simulator) Close() error {
+	return pm.store.Close()
+}
+
+var ErrPoolConfigUnavailable = errors.New("pool config unavailable")
+
+// 从 PoolCreated 事件或链上读取 pool 配置, 链上读取的配置需要和 CREATE2 地址一致
+func (pm *Simulator) poolConfig(address common.Address) (*PoolConfig, error) {
+	if config, ok := pm.poolConfigs[address]; ok {
+		return config, nil
+	}
+	config, err := fetchPoolConfig(pm.caller, pm.factory, pm.initCodeHash, address)
 	if err != nil {
 		return nil, err
 	}
+	pm.registerPool(address, config, 0, common.Hash{}, RegistrySourceRpc)
+	return config, nil
+}
 
-	logrus.Infof("initialize pool: %s,  tx: %s, price: %s", log.Address, log.TxHash, initialze.SqrtPriceX96)
-	price := initialze.SqrtPriceX96
-	client, err := NewUniswapV3SimulatorCaller(log.Address, pm.rpc)
+// fork 读取 pool 配置: 在锁内查询注册表, 链上读取时不持有锁, 也不注册, 注册表只由同步修改
+func (pm *Simulator) lookupPoolConfig(address common.Address) (*PoolConfig, error) {
+	pm.lock.Lock()
+	config, ok := pm.poolConfigs[address]
+	factory, initCodeHash := pm.factory, pm.initCodeHash
+	pm.lock.Unlock()
+	if ok {
+		return config, nil
+	}
+	return fetchPoolConfig(pm.caller, factory, initCodeHash, address)
+}
+
+// 从链上读取 pool 配置, 不修改 simulator 的状态
+func fetchPoolConfig(caller bind.ContractCaller, factory common.Address, initCodeHash common.Hash, address common.Address) (*PoolConfig, error) {
+	if caller == nil {
+		return nil, fmt.Errorf("%w: %s", ErrPoolConfigUnavailable, address)
+	}
+	client, err := NewUniswapV3SimulatorCaller(address, caller)
 	if err != nil {
 		return nil, err
 	}
@@ -133,13 +219,37 @@ func (pm *Simulator) NewPool(log *types.Log) (*CorePool, error) {
 	if err != nil {
 		return nil, err
 	}
-
-	pool := NewCorePoolFromConfig(log.Address.String(), *NewPoolConfig(
+	config := NewPoolConfig(
 		tickSpacing.Int64(),
 		token0,
 		token1,
 		FeeAmount(fee.Int64()),
-	))
+	)
+	err = checkFactoryPool(factory, initCodeHash, address, config)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (pm *Simulator) NewPool(log *types.Log) (*CorePool, error) {
+	config, err := pm.poolConfig(log.Address)
+	if err != nil {
+		return nil, err
+	}
+	return pm.initializePool(log, config)
+}
+
+func (pm *Simulator) initializePool(log *types.Log, config *PoolConfig) (*CorePool, error) {
+	initialze, err := parseUniv3InitializeEvent(log)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Infof("initialize pool: %s,  tx: %s, price: %s", log.Address, log.TxHash, initialze.SqrtPriceX96)
+	price := initialze.SqrtPriceX96
+	pool := NewCorePoolFromConfig(log.Address.String(), *config)
+	pool.CurrentBlockTimestamp = pm.BlockTimestamp(log.BlockNumber)
 	err = pool.Initialize(price)
 	if err != nil {
 		return nil, err
@@ -147,37 +257,123 @@ func (pm *Simulator) NewPool(log *types.Log) (*CorePool, error) {
 	return pool, nil
 }
 
+// BlockTimestamp 返回缓存中的区块时间戳, 需要先调用 LoadBlockTimestamps
+func (pm *Simulator) BlockTimestamp(blockNumber uint64) uint64 {
+	pm.tsLock.Lock()
+	defer pm.tsLock.Unlock()
+	return pm.blockTimestamps[blockNumber]
+}
+
+// LoadBlockTimestamps 批量获取 logs 所在区块的时间戳, oracle 依赖时间戳, source 无法提供时返回 ErrNoBlockTimestamp.
+// 没有 source 时 (直接调用 HandleLogs) 时间戳为 0
+func (pm *Simulator) LoadBlockTimestamps(logs []types.Log) error {
+	pm.tsLock.Lock()
+	defer pm.tsLock.Unlock()
+	var missing []uint64
+	seen := map[uint64]bool{}
+	for _, log := range logs {
+		if log.Removed {
+			continue
+		}
+		if _, ok := pm.blockTimestamps[log.BlockNumber]; ok || seen[log.BlockNumber] {
+			continue
+		}
+		seen[log.BlockNumber] = true
+		missing = append(missing, log.BlockNumber)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if pm.source == nil {
+		for _, blockNumber := range missing {
+			pm.blockTimestamps[blockNumber] = 0
+		}
+		return nil
+	}
+	timestamps, err := fetchBlockTimestamps(pm.ctx, pm.source, missing)
+	if err != nil {
+		return err
+	}
+	for _, blockNumber := range missing {
+		ts, ok := timestamps[blockNumber]
+		if !ok {
+			return fmt.Errorf("%w: block %d", ErrNoBlockTimestamp, blockNumber)
+		}
+		pm.blockTimestamps[blockNumber] = ts
+	}
+	return nil
+}
+
 func (pm *Simulator) HandleLogs(logs []types.Log) error {
+	err := pm.LoadBlockTimestamps(logs)
+	if err != nil {
+		return err
+	}
 	// 有变更的pool
 	for _, log := range logs {
-		skip := false
-		for _, address := range skipAddress {
-			if log.Address == address {
-				skip = true
+		if log.Removed {
+			// 链重组, 回滚到该区块之前, 之后的 canonical logs 会重新应用
+			if log.BlockNumber == 0 {
+				return ErrReorgTooDeep
 			}
+			err := pm.rollbackTo(log.BlockNumber - 1)
+			if err != nil {
+				return err
+			}
+			continue
 		}
-
-		if skip {
+		if pm.isQuarantined(log.Address) {
+			pm.errCounter.ignore()
 			continue
 		}
-
 		if len(log.Topics) == 0 {
 			return nil
 		}
 		topic0 := log.Topics[0]
+		if topic0 == TOPIC_POOL_CREATED {
+			if log.Address != pm.factory {
+				continue
+			}
+			created, err := parseUniv3PoolCreatedEvent(&log)
+			if err != nil {
+				logrus.Warnf("failed parse pool created event, tx: %s  factory: %s", log.TxHash, log.Address)
+				continue
+			}
+			if pm.registerPool(created.Pool, NewPoolConfig(int64(created.TickSpacing), created.Token0, created.Token1, created.Fee), log.BlockNumber, log.TxHash, RegistrySourceEvent) {
+				if entry := pm.unconfirmedEntry(log.BlockNumber, log.BlockHash); entry != nil {
+					entry.registered = append(entry.registered, created.Pool)
+				}
+			}
+			continue
+		}
+		// 从链上加载的 pool 已经包含之前的 logs
+		if pool, ok := pm.Pools[log.Address]; ok && log.BlockNumber <= pool.BootstrapBlockNum {
+			continue
+		}
+		pm.journalPool(&log)
 		if topic0 == pm.InitializeID {
-			if _, exist := pm.Pools[log.Address]; exist {
-				return fmt.Errorf("pool exists %s", log.Address)
+			if pool, exist := pm.Pools[log.Address]; exist {
+				if err := duplicateInitialize(pm.ErrorPolicy(), &log, pool); err != nil {
+					return err
+				}
+				continue
 			}
-			pool, err := pm.NewPool(&log)
+			config, err := pm.poolConfig(log.Address)
 			if err != nil {
 				logrus.Warnf("failed initialize pool: %s", err)
-				// reverted 就是不规范合约， 忽略
-				if strings.Contains(err.Error(), "reverted") {
+				// reverted 或者不是 factory 部署的就是不规范合约， 忽略
+				if isNotPoolError(err) {
 					continue
-				} else {
-					logrus.Fatal(err)
 				}
+				// 读取配置失败和 log 无关, 返回给调用方重试
+				return newPoolError(&log, err)
+			}
+			pool, err := pm.initializePool(&log, config)
+			if err != nil {
+				if err := pm.logError(&log, nil, err); err != nil {
+					return err
+				}
+				continue
 			}
 			pool.DeployBlockNum = log.BlockNumber
 			pool.CurrentBlockNum = log.BlockNumber
@@ -188,17 +384,27 @@ func (pm *Simulator) HandleLogs(logs []types.Log) error {
 				//logrus.Warnf("mint before initialize, tx: %s, pool: %s", log.TxHash, log.Address)
 				continue
 			} else {
+				pool.CurrentBlockTimestamp = pm.BlockTimestamp(log.BlockNumber)
 				mint, err := parseUniv3MintEvent(&log)
 				if err != nil {
-					logrus.Warnf("failed parse mint event, tx: %s  pool: %s", log.TxHash, log.Address)
+					if err := pm.logError(&log, pool, newParseError(err)); err != nil {
+						return err
+					}
 					continue
 				}
 				//s, _ := json.Marshal(mint)
 				//logrus.Infof("mint: %s %s %s", log.Address, log.TxHash, string(s))
+				err = pm.ensurePosition(pool, mint.Owner, mint.TickLower, mint.TickUpper, log.BlockNumber)
+				if err != nil {
+					logrus.Errorf("failed load position, %s tx: %s  pool: %s", err, log.TxHash, log.Address)
+					return newPoolError(&log, err)
+				}
 				_, _, err = pool.Mint(mint.Owner, mint.TickLower, mint.TickUpper, mint.Amount)
 				if err != nil {
-					logrus.Errorf("failed execute mint event, %s tx: %s  pool: %s", err, log.TxHash, log.Address)
-					return err
+					if err := pm.logError(&log, pool, err); err != nil {
+						return err
+					}
+					continue
 				}
 				pool.CurrentBlockNum = log.BlockNumber
 				pm.dirtyPools[pool.PoolAddress] = pool
@@ -208,17 +414,27 @@ func (pm *Simulator) HandleLogs(logs []types.Log) error {
 				//logrus.Warnf("burn before initialize, tx: %s, pool: %s", log.TxHash, log.Address)
 				continue
 			} else {
+				pool.CurrentBlockTimestamp = pm.BlockTimestamp(log.BlockNumber)
 				burn, err := parseUniv3BurnEvent(&log)
 				if err != nil {
-					logrus.Warnf("failed parse burn event, tx: %s  pool: %s err: %s", log.TxHash, log.Address, err)
+					if err := pm.logError(&log, pool, newParseError(err)); err != nil {
+						return err
+					}
 					continue
 				}
 				//s, _ := json.Marshal(burn)
 				//logrus.Infof("burn: %s %s %s", log.Address, log.TxHash, string(s))
+				err = pm.ensurePosition(pool, burn.Owner, burn.TickLower, burn.TickUpper, log.BlockNumber)
+				if err != nil {
+					logrus.Errorf("failed load position, %s tx: %s  pool: %s", err, log.TxHash, log.Address)
+					return newPoolError(&log, err)
+				}
 				_, _, err = pool.Burn(burn.Owner, burn.TickLower, burn.TickUpper, burn.Amount)
 				if err != nil {
-					logrus.Errorf("failed execute burn event, %s tx: %s  pool: %s", err, log.TxHash, log.Address)
-					return err
+					if err := pm.logError(&log, pool, err); err != nil {
+						return err
+					}
+					continue
 				}
 				pool.CurrentBlockNum = log.BlockNumber
 				pm.dirtyPools[pool.PoolAddress] = pool
@@ -228,24 +444,139 @@ func (pm *Simulator) HandleLogs(logs []types.Log) error {
 				//logrus.Warnf("swap before initialize, tx: %s, pool: %s", log.TxHash, log.Address)
 				continue
 			} else {
+				pool.CurrentBlockTimestamp = pm.BlockTimestamp(log.BlockNumber)
 				swap, err := parseUniv3SwapEvent(&log)
 				if err != nil {
-					logrus.Warnf("failed parse swap event, tx: %s  pool: %s", log.TxHash, log.Address)
+					if err := pm.logError(&log, pool, newParseError(err)); err != nil {
+						return err
+					}
 					continue
 				}
 				//s, _ := json.Marshal(swap)
 				//logrus.Infof("swap: %s %s %s", log.Address, log.TxHash, string(s))
-				amountSpecified, sqrtPriceX96, err := pool.ResolveInputFromSwapResultEvent(swap)
+				if err := applySwap(pool, swap, pm.swapMode); err != nil {
+					logrus.Errorf("failed apply swap event, tx: %s  pool: %s, %s", log.TxHash, log.Address, err)
+					if err := pm.logError(&log, pool, err); err != nil {
+						return err
+					}
+					continue
+				}
+				pool.CurrentBlockNum = log.BlockNumber
+				pm.dirtyPools[pool.PoolAddress] = pool
+			}
+		} else if topic0 == pm.CollectID {
+			if pool, ok := pm.Pools[log.Address]; !ok {
+				continue
+			} else {
+				pool.CurrentBlockTimestamp = pm.BlockTimestamp(log.BlockNumber)
+				collect, err := parseUniv3CollectEvent(&log)
 				if err != nil {
-					skipAddress = append(skipAddress, log.Address)
-					logrus.Errorf("failed resolve swap param from event, tx: %s  pool: %s, %s", log.TxHash, log.Address, err)
-					logrus.Infof("new skipped pool: %s, current skipped pools: %s", log.Address, skipAddress)
+					if err := pm.logError(&log, pool, newParseError(err)); err != nil {
+						return err
+					}
 					continue
 				}
-
-				_, _, _, err = pool.HandleSwap(swap.Amount0.IsPositive(), amountSpecified, sqrtPriceX96, false)
+				err = pm.ensurePosition(pool, collect.Owner, collect.TickLower, collect.TickUpper, log.BlockNumber)
+				if err != nil {
+					logrus.Errorf("failed load position, %s tx: %s  pool: %s", err, log.TxHash, log.Address)
+					return newPoolError(&log, err)
+				}
+				err = pool.HandleCollectEvent(collect)
+				if errors.Is(err, ErrCollectMismatch) {
+					logrus.Warnf("%s tx: %s  pool: %s", err, log.TxHash, log.Address)
+				} else if err != nil {
+					if err := pm.logError(&log, pool, err); err != nil {
+						return err
+					}
+					continue
+				}
+				pool.CurrentBlockNum = log.BlockNumber
+				pm.dirtyPools[pool.PoolAddress] = pool
+			}
+		} else if topic0 == pm.SetFeeProtocolID {
+			if pool, ok := pm.Pools[log.Address]; !ok {
+				continue
+			} else {
+				pool.CurrentBlockTimestamp = pm.BlockTimestamp(log.BlockNumber)
+				setFeeProtocol, err := parseUniv3SetFeeProtocolEvent(&log)
 				if err != nil {
-					logrus.Fatalf("failed execute swap event, %s tx: %s  pool: %s", err, log.TxHash, log.Address)
+					if err := pm.logError(&log, pool, newParseError(err)); err != nil {
+						return err
+					}
+					continue
+				}
+				err = pool.SetFeeProtocol(setFeeProtocol.FeeProtocol0New, setFeeProtocol.FeeProtocol1New)
+				if err != nil {
+					if err := pm.logError(&log, pool, err); err != nil {
+						return err
+					}
+					continue
+				}
+				pool.CurrentBlockNum = log.BlockNumber
+				pm.dirtyPools[pool.PoolAddress] = pool
+			}
+		} else if topic0 == pm.CollectProtocolID {
+			if pool, ok := pm.Pools[log.Address]; !ok {
+				continue
+			} else {
+				pool.CurrentBlockTimestamp = pm.BlockTimestamp(log.BlockNumber)
+				collectProtocol, err := parseUniv3CollectProtocolEvent(&log)
+				if err != nil {
+					if err := pm.logError(&log, pool, newParseError(err)); err != nil {
+						return err
+					}
+					continue
+				}
+				_, _, err = pool.CollectProtocol(collectProtocol.Amount0, collectProtocol.Amount1)
+				if err != nil {
+					if err := pm.logError(&log, pool, err); err != nil {
+						return err
+					}
+					continue
+				}
+				pool.CurrentBlockNum = log.BlockNumber
+				pm.dirtyPools[pool.PoolAddress] = pool
+			}
+		} else if topic0 == pm.IncreaseCardinalityID {
+			if pool, ok := pm.Pools[log.Address]; !ok {
+				continue
+			} else {
+				pool.CurrentBlockTimestamp = pm.BlockTimestamp(log.BlockNumber)
+				increase, err := parseUniv3IncreaseObservationCardinalityNextEvent(&log)
+				if err != nil {
+					if err := pm.logError(&log, pool, newParseError(err)); err != nil {
+						return err
+					}
+					continue
+				}
+				err = pool.IncreaseObservationCardinalityNext(increase.ObservationCardinalityNextNew)
+				if err != nil {
+					if err := pm.logError(&log, pool, err); err != nil {
+						return err
+					}
+					continue
+				}
+				pool.CurrentBlockNum = log.BlockNumber
+				pm.dirtyPools[pool.PoolAddress] = pool
+			}
+		} else if topic0 == pm.FlashID {
+			if pool, ok := pm.Pools[log.Address]; !ok {
+				continue
+			} else {
+				pool.CurrentBlockTimestamp = pm.BlockTimestamp(log.BlockNumber)
+				flash, err := parseUniv3FlashEvent(&log)
+				if err != nil {
+					if err := pm.logError(&log, pool, newParseError(err)); err != nil {
+						return err
+					}
+					continue
+				}
+				err = pool.Flash(flash.Paid0, flash.Paid1)
+				if err != nil {
+					if err := pm.logError(&log, pool, err); err != nil {
+						return err
+					}
+					continue
 				}
 				pool.CurrentBlockNum = log.BlockNumber
 				pm.dirtyPools[pool.PoolAddress] = pool
@@ -256,26 +587,53 @@ func (pm *Simulator) HandleLogs(logs []types.Log) error {
 }
 
 func (pm *Simulator) MaxSyncedBlockNum() (uint64, error) {
-	var lastBlock *uint64
-	err := pm.db.Model(&CorePool{}).Select("max(current_block_num) as last_block").Scan(&lastBlock).Error
+	// 从链上加载后还没有同步过的 pool 不算
+	lastBlock, err := pm.store.MaxPoolBlockNum()
 	if err != nil {
 		return 0, err
 	}
-	if lastBlock == nil {
-		return 0, nil
-	}
-	if *lastBlock > pm.currentBlock {
-		return *lastBlock, nil
+	if lastBlock > pm.currentBlock {
+		return lastBlock, nil
 	} else {
 		return pm.currentBlock, nil
 	}
 }
 
 func (pm *Simulator) FlushPools() error {
+	// 事务回滚时需要重新插入
+	var created []*CorePool
+	for _, pool := range pm.dirtyPools {
+		if !pool.HasCreated {
+			created = append(created, pool)
+		}
+	}
 	// pool变更落地
-	err := pm.db.Transaction(func(tx *gorm.DB) error {
+	err := pm.store.Update(func(tx StoreTx) error {
+		err := pm.flushRegistry(tx)
+		if err != nil {
+			logrus.Errorf("failed flush pool registry %s", err)
+			return err
+		}
+		err = pm.flushQuarantine(tx)
+		if err != nil {
+			logrus.Errorf("failed flush quarantined pools %s", err)
+			return err
+		}
+		err = tx.SaveSyncState(pm.currentBlock)
+		if err != nil {
+			logrus.Errorf("failed flush sync state %s", err)
+			return err
+		}
+		for _, pool := range pm.removedPools {
+			err := tx.DeletePool(pool)
+			if err != nil {
+				logrus.Errorf("failed delete pool %s", err)
+				return err
+			}
+			logrus.Infof("delete pool: %s", pool.PoolAddress)
+		}
 		for _, pool := range pm.dirtyPools {
-			err := pool.Flush(tx)
+			err := tx.SavePool(pool)
 			if err != nil {
 				logrus.Errorf("failed flush pool %s", err)
 				return err
@@ -286,9 +644,20 @@ func (pm *Simulator) FlushPools() error {
 	})
 	if err != nil {
 		logrus.Warnf("failed save snapshot %s", err)
+		for _, pool := range created {
+			pool.HasCreated = false
+			pool.ID = 0
+		}
 		return err
 	} else {
+		pm.markCheckpointPools()
+		for _, pool := range pm.dirtyPools {
+			pool.clearDirty()
+		}
 		pm.dirtyPools = map[string]*CorePool{}
+		pm.removedPools = nil
+		pm.newRegistered = nil
+		pm.removedRegistered = nil
 		return nil
 	}
 }
@@ -298,6 +667,9 @@ func (pm *Simulator) SyncBlocks(to uint64, step uint64) (uint64, error) {
 	// 从数据库获取start, max(currentBlock)
 	pm.lock.Lock()
 	defer pm.lock.Unlock()
+	if pm.source == nil {
+		return 0, ErrNoLogSource
+	}
 	lastBlock, err := pm.MaxSyncedBlockNum()
 	if err != nil {
 		return 0, err
@@ -308,13 +680,20 @@ func (pm *Simulator) SyncBlocks(to uint64, step uint64) (uint64, error) {
 	}
 	start := lastBlock + 1
 	var end uint64
-	if to == 0 {
-		latest, err := pm.rpc.BlockNumber(pm.ctx)
+	if to == 0 || pm.confirmations > 0 {
+		latest, err := pm.source.BlockNumber(pm.ctx)
 		if err != nil {
 			return 0, err
 		}
 		end = latest
-	} else {
+		if latest > pm.head {
+			pm.head = latest
+		}
+		if pm.journalBase == 0 {
+			pm.journalBase = lastBlock
+		}
+	}
+	if to != 0 {
 		end = to
 	}
 
@@ -325,6 +704,10 @@ func (pm *Simulator) SyncBlocks(to uint64, step uint64) (uint64, error) {
 		if start > end {
 			return end, nil
 		}
+		start, err = pm.checkReorg(start)
+		if err != nil {
+			return 0, err
+		}
 		flushStep += 1
 		var minEnd uint64
 		if start+step > end {
@@ -333,10 +716,10 @@ func (pm *Simulator) SyncBlocks(to uint64, step uint64) (uint64, error) {
 			minEnd = start + step
 		}
 		logrus.Infof("sync blocks: %d - %d", start, minEnd)
-		logs, err := pm.rpc.FilterLogs(pm.ctx, ethereum.FilterQuery{
+		logs, err := pm.source.FilterLogs(pm.ctx, ethereum.FilterQuery{
 			FromBlock: big.NewInt(int64(start)),
 			ToBlock:   big.NewInt(int64(minEnd)),
-			Topics:    [][]common.Hash{{pm.InitializeID, pm.MintID, pm.BurnID, pm.SwapID}},
+			Topics:    [][]common.Hash{{pm.InitializeID, pm.MintID, pm.BurnID, pm.SwapID, pm.FlashID, pm.CollectID, pm.SetFeeProtocolID, pm.CollectProtocolID, pm.IncreaseCardinalityID, TOPIC_POOL_CREATED}},
 			//Addresses: []common.Address{common.HexToAddress("0xCba27C8e7115b4Eb50Aa14999BC0866674a96eCB")},
 		})
 		if err != nil {
@@ -346,23 +729,32 @@ func (pm *Simulator) SyncBlocks(to uint64, step uint64) (uint64, error) {
 		if err != nil {
 			return 0, err
 		}
+		// 未确认区块记录 hash, 下一轮检查 parent hash
+		if headers, ok := asHeaderSource(pm.source); ok && pm.confirmations > 0 && minEnd+pm.confirmations > pm.head {
+			header, err := headers.HeaderByNumber(pm.ctx, big.NewInt(int64(minEnd)))
+			if err != nil {
+				return 0, err
+			}
+			pm.journalHeader(header)
+		}
+		// flush 时同步位置与 pool 状态一起保存
+		pm.currentBlock = minEnd
 		// 每10w block flush一次
 		if flushStep%10 == 0 {
 			err = pm.FlushPools()
 			if err != nil {
 				return 0, err
 			}
-			bytesRead, err := os.ReadFile(pm.dbfile)
-			if err != nil {
-				logrus.Errorf("failed read db file %s", err)
-			}
-			err = os.WriteFile(fmt.Sprintf("%s.snapshot-%d", pm.dbfile, minEnd), bytesRead, 0755)
-			if err != nil {
-				logrus.Errorf("failed write snapshot file %s", err)
-			}
+		}
+		err = pm.maybeCheckpoint(minEnd)
+		if err != nil {
+			return 0, err
 		}
 		start = minEnd + 1
-		pm.currentBlock = minEnd
+		pm.tsLock.Lock()
+		pm.blockTimestamps = map[uint64]uint64{}
+		pm.tsLock.Unlock()
+		pm.pruneJournal()
 	}
 
 }
@@ -384,14 +776,13 @@ func (pm *Simulator) Init(step uint64) error {
 	return nil
 }
 
+// ForkPool 复制 pool 的当前状态, 历史区块的状态使用 PoolAt
 func (pm *Simulator) ForkPool(poolAddress common.Address) (*CorePool, error) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
 	if pool, ok := pm.Pools[poolAddress]; !ok {
-		return nil, fmt.Errorf("pool not exists %s", poolAddress)
+		return nil, fmt.Errorf("%w %s", ErrPoolNotExists, poolAddress)
 	} else {
-		//currentBlockNum := pm.CurrentBlock()
-		//if currentBlockNum != blockNum {
-		//	return nil, fmt.Errorf("fork pool at %d , but current synced block is %d", blockNum, currentBlockNum)
-		//}
 		fork := pool.Clone()
 		return fork, nil
 	}
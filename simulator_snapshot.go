@@ -2,6 +2,9 @@ package uniswap_v3_simulator
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/sirupsen/logrus"
@@ -9,19 +12,27 @@ import (
 
 // 分叉而不影响原数据
 type SimulatorFork struct {
-	Pools     map[common.Address]*CorePool
-	simulator *Simulator
+	Pools       map[common.Address]*CorePool
+	simulator   *Simulator
+	quarantined map[common.Address]*QuarantinedPool // fork 中隔离的 pool, 不写入数据库
+	errCounter  errorCounter
+	history     bool                           // 回放历史状态, 不使用 simulator 当前的状态和隔离
+	poolConfigs map[common.Address]*PoolConfig // 回放历史状态时初始化 pool 使用的配置
 }
 
 func NewSimulatorSnapshot(s *Simulator) *SimulatorFork {
 	return &SimulatorFork{
-		Pools:     map[common.Address]*CorePool{},
-		simulator: s,
+		Pools:       map[common.Address]*CorePool{},
+		simulator:   s,
+		quarantined: map[common.Address]*QuarantinedPool{},
 	}
 }
 
 func (s *SimulatorFork) GetPool(addr common.Address) (*CorePool, error) {
 	if _, ok := s.Pools[addr]; !ok {
+		if s.history {
+			return nil, fmt.Errorf("%w %s", ErrPoolNotExists, addr)
+		}
 		// fork
 		forkedPool, err := s.simulator.ForkPool(addr)
 		if err != nil {
@@ -32,9 +43,42 @@ func (s *SimulatorFork) GetPool(addr common.Address) (*CorePool, error) {
 	return s.Pools[addr], nil
 }
 
+// 回放历史状态时只使用 fork 的配置, 不访问 simulator 的注册表.
+// fork 当前状态时只读注册表, 链上读取的配置不注册到 simulator
+func (s *SimulatorFork) poolConfig(address common.Address) (*PoolConfig, error) {
+	if !s.history {
+		return s.simulator.lookupPoolConfig(address)
+	}
+	config, ok := s.poolConfigs[address]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrPoolConfigUnavailable, address)
+	}
+	return config, nil
+}
+
+// IsQuarantined pool 在 simulator 或 fork 中被隔离
+func (s *SimulatorFork) IsQuarantined(addr common.Address) bool {
+	if _, ok := s.quarantined[addr]; ok {
+		return true
+	}
+	if s.history {
+		return false
+	}
+	return s.simulator.IsQuarantined(addr)
+}
+
 func (s *SimulatorFork) HandleLogs(logs []types.Log) error {
+	err := s.simulator.LoadBlockTimestamps(logs)
+	if err != nil {
+		return err
+	}
 	for _, log := range logs {
-		if log.Address == skipAddress[0] || log.Address == skipAddress[1] || log.Address == skipAddress[2] {
+		// fork 不记录 journal, 被重组移除的 log 直接忽略
+		if log.Removed {
+			continue
+		}
+		if s.IsQuarantined(log.Address) {
+			s.errCounter.ignore()
 			continue
 		}
 		if len(log.Topics) == 0 {
@@ -42,14 +86,26 @@ func (s *SimulatorFork) HandleLogs(logs []types.Log) error {
 		}
 		topic0 := log.Topics[0]
 		if topic0 == s.simulator.InitializeID {
-			pool, err := s.simulator.NewPool(&log)
+			if pool, err := s.GetPool(log.Address); err == nil {
+				if err := duplicateInitialize(s.simulator.ErrorPolicy(), &log, pool); err != nil {
+					return err
+				}
+				continue
+			}
+			config, err := s.poolConfig(log.Address)
 			if err != nil {
 				logrus.Error(err)
-				if err.Error() == "execution reverted" {
+				if isNotPoolError(err) {
 					continue
-				} else {
-					logrus.Fatal(err)
 				}
+				return newPoolError(&log, err)
+			}
+			pool, err := s.simulator.initializePool(&log, config)
+			if err != nil {
+				if err := s.logError(&log, nil, err); err != nil {
+					return err
+				}
+				continue
 			}
 			pool.DeployBlockNum = log.BlockNumber
 			pool.CurrentBlockNum = log.BlockNumber
@@ -57,58 +113,164 @@ func (s *SimulatorFork) HandleLogs(logs []types.Log) error {
 		} else {
 			var pool *CorePool
 			var err error
-			if topic0 == s.simulator.MintID || topic0 == s.simulator.BurnID || topic0 == s.simulator.SwapID {
+			if topic0 == s.simulator.MintID || topic0 == s.simulator.BurnID || topic0 == s.simulator.SwapID || topic0 == s.simulator.FlashID || topic0 == s.simulator.CollectID ||
+				topic0 == s.simulator.SetFeeProtocolID || topic0 == s.simulator.CollectProtocolID ||
+				topic0 == s.simulator.IncreaseCardinalityID {
 				pool, err = s.GetPool(log.Address)
 				if err != nil {
-					return err
+					return newPoolError(&log, err)
 				}
 			} else {
 				continue
 			}
+			pool.CurrentBlockTimestamp = s.simulator.BlockTimestamp(log.BlockNumber)
 
 			if topic0 == s.simulator.MintID {
 				mint, err := parseUniv3MintEvent(&log)
 				if err != nil {
-					logrus.Warnf("failed parse mint event, tx: %s  pool: %s", log.TxHash, log.Address)
+					if err := s.logError(&log, pool, newParseError(err)); err != nil {
+						return err
+					}
 					continue
 				}
+				err = s.simulator.ensurePosition(pool, mint.Owner, mint.TickLower, mint.TickUpper, log.BlockNumber)
+				if err != nil {
+					logrus.Errorf("failed load position, %s tx: %s  pool: %s", err, log.TxHash, log.Address)
+					return newPoolError(&log, err)
+				}
 				_, _, err = pool.Mint(mint.Owner, mint.TickLower, mint.TickUpper, mint.Amount)
 				if err != nil {
-					logrus.Errorf("failed execute mint event, %s tx: %s  pool: %s", err, log.TxHash, log.Address)
-					return err
+					if err := s.logError(&log, pool, err); err != nil {
+						return err
+					}
+					continue
 				}
 				pool.CurrentBlockNum = log.BlockNumber
 			} else if topic0 == s.simulator.BurnID {
 				burn, err := parseUniv3BurnEvent(&log)
 				if err != nil {
-					logrus.Warnf("failed parse burn event, tx: %s  pool: %s err: %s", log.TxHash, log.Address, err)
+					if err := s.logError(&log, pool, newParseError(err)); err != nil {
+						return err
+					}
 					continue
 				}
 				//s, _ := json.Marshal(burn)
 				//logrus.Infof("burn: %s %s %s", log.Address, log.TxHash, string(s))
+				err = s.simulator.ensurePosition(pool, burn.Owner, burn.TickLower, burn.TickUpper, log.BlockNumber)
+				if err != nil {
+					logrus.Errorf("failed load position, %s tx: %s  pool: %s", err, log.TxHash, log.Address)
+					return newPoolError(&log, err)
+				}
 				_, _, err = pool.Burn(burn.Owner, burn.TickLower, burn.TickUpper, burn.Amount)
 				if err != nil {
-					logrus.Errorf("failed execute burn event, %s tx: %s  pool: %s", err, log.TxHash, log.Address)
-					return err
+					if err := s.logError(&log, pool, err); err != nil {
+						return err
+					}
+					continue
 				}
 				pool.CurrentBlockNum = log.BlockNumber
 			} else if topic0 == s.simulator.SwapID {
 				swap, err := parseUniv3SwapEvent(&log)
 				if err != nil {
-					logrus.Warnf("failed parse swap event, tx: %s  pool: %s", log.TxHash, log.Address)
+					if err := s.logError(&log, pool, newParseError(err)); err != nil {
+						return err
+					}
+					continue
+				}
+				if err := applySwap(pool, swap, s.simulator.swapMode); err != nil {
+					bs, _ := json.Marshal(swap)
+					logrus.Infof("swap: %s %s %s", log.Address, log.TxHash, string(bs))
+					if err := s.logError(&log, pool, err); err != nil {
+						return err
+					}
+					continue
+				}
+				pool.CurrentBlockNum = log.BlockNumber
+			} else if topic0 == s.simulator.CollectID {
+				collect, err := parseUniv3CollectEvent(&log)
+				if err != nil {
+					if err := s.logError(&log, pool, newParseError(err)); err != nil {
+						return err
+					}
 					continue
 				}
-				amountSpecified, sqrtPriceX96, err := pool.ResolveInputFromSwapResultEvent(swap)
+				err = s.simulator.ensurePosition(pool, collect.Owner, collect.TickLower, collect.TickUpper, log.BlockNumber)
 				if err != nil {
-					s, _ := json.Marshal(swap)
-					logrus.Infof("swap: %s %s %s", log.Address, log.TxHash, string(s))
-					return err
+					logrus.Errorf("failed load position, %s tx: %s  pool: %s", err, log.TxHash, log.Address)
+					return newPoolError(&log, err)
 				}
-
-				_, _, _, err = pool.HandleSwap(swap.Amount0.IsPositive(), amountSpecified, sqrtPriceX96, false)
+				err = pool.HandleCollectEvent(collect)
+				if errors.Is(err, ErrCollectMismatch) {
+					logrus.Warnf("%s tx: %s  pool: %s", err, log.TxHash, log.Address)
+				} else if err != nil {
+					if err := s.logError(&log, pool, err); err != nil {
+						return err
+					}
+					continue
+				}
+				pool.CurrentBlockNum = log.BlockNumber
+			} else if topic0 == s.simulator.SetFeeProtocolID {
+				setFeeProtocol, err := parseUniv3SetFeeProtocolEvent(&log)
 				if err != nil {
-					logrus.Errorf("failed execute swap event, %s tx: %s  pool: %s", err, log.TxHash, log.Address)
-					return err
+					if err := s.logError(&log, pool, newParseError(err)); err != nil {
+						return err
+					}
+					continue
+				}
+				err = pool.SetFeeProtocol(setFeeProtocol.FeeProtocol0New, setFeeProtocol.FeeProtocol1New)
+				if err != nil {
+					if err := s.logError(&log, pool, err); err != nil {
+						return err
+					}
+					continue
+				}
+				pool.CurrentBlockNum = log.BlockNumber
+			} else if topic0 == s.simulator.CollectProtocolID {
+				collectProtocol, err := parseUniv3CollectProtocolEvent(&log)
+				if err != nil {
+					if err := s.logError(&log, pool, newParseError(err)); err != nil {
+						return err
+					}
+					continue
+				}
+				_, _, err = pool.CollectProtocol(collectProtocol.Amount0, collectProtocol.Amount1)
+				if err != nil {
+					if err := s.logError(&log, pool, err); err != nil {
+						return err
+					}
+					continue
+				}
+				pool.CurrentBlockNum = log.BlockNumber
+			} else if topic0 == s.simulator.IncreaseCardinalityID {
+				increase, err := parseUniv3IncreaseObservationCardinalityNextEvent(&log)
+				if err != nil {
+					if err := s.logError(&log, pool, newParseError(err)); err != nil {
+						return err
+					}
+					continue
+				}
+				err = pool.IncreaseObservationCardinalityNext(increase.ObservationCardinalityNextNew)
+				if err != nil {
+					if err := s.logError(&log, pool, err); err != nil {
+						return err
+					}
+					continue
+				}
+				pool.CurrentBlockNum = log.BlockNumber
+			} else if topic0 == s.simulator.FlashID {
+				flash, err := parseUniv3FlashEvent(&log)
+				if err != nil {
+					if err := s.logError(&log, pool, newParseError(err)); err != nil {
+						return err
+					}
+					continue
+				}
+				err = pool.Flash(flash.Paid0, flash.Paid1)
+				if err != nil {
+					if err := s.logError(&log, pool, err); err != nil {
+						return err
+					}
+					continue
 				}
 				pool.CurrentBlockNum = log.BlockNumber
 			}
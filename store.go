@@ -0,0 +1,278 @@
+package uniswap_v3_simulator
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+// Store 持久化 pool 状态, pool 注册表, 隔离记录, checkpoint 和同步位置. 所有写入在 Update 的事务中完成
+type Store interface {
+	// LoadPools 加载所有 pool, 包括 tick 和 position
+	LoadPools() ([]*CorePool, error)
+	LoadRegistry() ([]*RegisteredPool, error)
+	LoadQuarantine() ([]*QuarantinedPool, error)
+	// SyncState 已同步到的区块, 没有保存过时为 0
+	SyncState() (uint64, error)
+	// MaxPoolBlockNum pool 最后修改的区块, 从链上加载后还没有同步过的 pool 不算
+	MaxPoolBlockNum() (uint64, error)
+
+	// Checkpoints 按区块排序
+	Checkpoints() ([]*Checkpoint, error)
+	// FindCheckpoint blockNum 的 checkpoint, 不存在时返回 nil
+	FindCheckpoint(blockNum uint64) (*Checkpoint, error)
+	// LastCheckpoint 不存在时返回 nil
+	LastCheckpoint() (*Checkpoint, error)
+	// PoolCheckpointAt pool 不晚于 blockNum 的最后一个 checkpoint, 不存在时返回 nil
+	PoolCheckpointAt(address string, blockNum uint64) (*PoolCheckpoint, error)
+	// PoolCheckpointsAt 每个 pool 不晚于 blockNum 的最后一个 checkpoint
+	PoolCheckpointsAt(blockNum uint64) ([]*PoolCheckpoint, error)
+
+	Update(fn func(tx StoreTx) error) error
+	Close() error
+}
+
+// StoreTx Update 中的写操作, fn 返回错误时全部回滚
+type StoreTx interface {
+	// SavePool 新的 pool 写入后设置 HasCreated, tick 和 position 只写入 dirty 的部分
+	SavePool(pool *CorePool) error
+	DeletePool(pool *CorePool) error
+	// SaveRegistered 已存在的 pool 忽略
+	SaveRegistered(pools []*RegisteredPool) error
+	DeleteRegistered(addresses []string) error
+	// SaveQuarantined 写入后 ID 不为 0
+	SaveQuarantined(q *QuarantinedPool) error
+	DeleteQuarantined(q *QuarantinedPool) error
+	SaveSyncState(blockNum uint64) error
+	SaveCheckpoint(checkpoint *Checkpoint, pools []*PoolCheckpoint) error
+	// PruneCheckpoint 删除 blockNum 的 checkpoint, 其中的 pool 状态如果在 next 之前没有更新, 移到 next
+	PruneCheckpoint(blockNum, next uint64) error
+	// DeleteCheckpointsAfter 删除 blockNum 之后的 checkpoint, 返回其中保存过状态的 pool
+	DeleteCheckpointsAfter(blockNum uint64) ([]string, error)
+}
+
+// GormStore 使用 gorm 的关系数据库, 支持 sqlite 和 postgres
+type GormStore struct {
+	db *gorm.DB
+}
+
+func gormConfig() *gorm.Config {
+	return &gorm.Config{
+		Logger: logger.New(
+			log.New(os.Stdout, "\r\n", log.LstdFlags), // io writer
+			logger.Config{
+				SlowThreshold:             100 * time.Second, // Slow SQL threshold
+				LogLevel:                  logger.Error,      // Log level
+				IgnoreRecordNotFoundError: true,              // Ignore ErrRecordNotFound error for sugaredLogger
+				Colorful:                  true,              // Disable color
+			},
+		),
+	}
+}
+
+func NewSQLiteStore(dbFile string) (*GormStore, error) {
+	db, err := gorm.Open(sqlite.Open(dbFile), gormConfig())
+	if err != nil {
+		return nil, err
+	}
+	return NewGormStore(db)
+}
+
+// NewPostgresStore dsn 例如 "host=localhost user=postgres password=postgres dbname=simulator port=5432"
+func NewPostgresStore(dsn string) (*GormStore, error) {
+	db, err := gorm.Open(postgres.Open(dsn), gormConfig())
+	if err != nil {
+		return nil, err
+	}
+	return NewGormStore(db)
+}
+
+// NewGormStore 创建或迁移表结构
+func NewGormStore(db *gorm.DB) (*GormStore, error) {
+	err := db.AutoMigrate(&CorePool{}, &PoolTick{}, &PoolPosition{}, &RegisteredPool{}, &QuarantinedPool{}, &Checkpoint{}, &PoolCheckpoint{}, &SyncState{})
+	if err != nil {
+		return nil, err
+	}
+	err = migrateLegacyPoolState(db)
+	if err != nil {
+		return nil, err
+	}
+	return &GormStore{db: db}, nil
+}
+
+// DB 用于直接查询 tick, position 等表
+func (s *GormStore) DB() *gorm.DB {
+	return s.db
+}
+
+func (s *GormStore) LoadPools() ([]*CorePool, error) {
+	var pools []*CorePool
+	err := s.db.Find(&pools).Error
+	if err != nil {
+		return nil, err
+	}
+	err = loadPoolState(s.db, pools)
+	if err != nil {
+		return nil, err
+	}
+	return pools, nil
+}
+
+func (s *GormStore) LoadRegistry() ([]*RegisteredPool, error) {
+	var registered []*RegisteredPool
+	err := s.db.Find(&registered).Error
+	return registered, err
+}
+
+func (s *GormStore) LoadQuarantine() ([]*QuarantinedPool, error) {
+	var quarantined []*QuarantinedPool
+	err := s.db.Find(&quarantined).Error
+	return quarantined, err
+}
+
+func (s *GormStore) SyncState() (uint64, error) {
+	var state SyncState
+	err := s.db.Where("id = ?", syncStateID).Limit(1).Find(&state).Error
+	return state.BlockNum, err
+}
+
+func (s *GormStore) MaxPoolBlockNum() (uint64, error) {
+	var lastBlock *uint64
+	err := s.db.Model(&CorePool{}).Where("bootstrap_block_num = 0 OR current_block_num > bootstrap_block_num").Select("max(current_block_num) as last_block").Scan(&lastBlock).Error
+	if err != nil || lastBlock == nil {
+		return 0, err
+	}
+	return *lastBlock, nil
+}
+
+func (s *GormStore) Checkpoints() ([]*Checkpoint, error) {
+	var checkpoints []*Checkpoint
+	err := s.db.Order("block_num").Find(&checkpoints).Error
+	return checkpoints, err
+}
+
+func (s *GormStore) FindCheckpoint(blockNum uint64) (*Checkpoint, error) {
+	var checkpoint Checkpoint
+	err := s.db.Where("block_num = ?", blockNum).Limit(1).Find(&checkpoint).Error
+	if err != nil || checkpoint.ID == 0 {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+func (s *GormStore) LastCheckpoint() (*Checkpoint, error) {
+	var checkpoint Checkpoint
+	err := s.db.Order("block_num desc").Limit(1).Find(&checkpoint).Error
+	if err != nil || checkpoint.ID == 0 {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+func (s *GormStore) PoolCheckpointAt(address string, blockNum uint64) (*PoolCheckpoint, error) {
+	var checkpoint PoolCheckpoint
+	err := s.db.Where("pool_address = ? AND block_num <= ?", address, blockNum).Order("block_num desc").Limit(1).Find(&checkpoint).Error
+	if err != nil || checkpoint.ID == 0 {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+func (s *GormStore) PoolCheckpointsAt(blockNum uint64) ([]*PoolCheckpoint, error) {
+	latest := s.db.Model(&PoolCheckpoint{}).Select("pool_address, max(block_num) as block_num").Where("block_num <= ?", blockNum).Group("pool_address")
+	var rows []*PoolCheckpoint
+	err := s.db.Joins("JOIN (?) AS latest ON latest.pool_address = pool_checkpoints.pool_address AND latest.block_num = pool_checkpoints.block_num", latest).Find(&rows).Error
+	return rows, err
+}
+
+func (s *GormStore) Update(fn func(tx StoreTx) error) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		return fn(&gormTx{db: tx})
+	})
+}
+
+func (s *GormStore) Close() error {
+	db, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+type gormTx struct {
+	db *gorm.DB
+}
+
+func (tx *gormTx) SavePool(pool *CorePool) error {
+	return pool.Flush(tx.db)
+}
+
+func (tx *gormTx) DeletePool(pool *CorePool) error {
+	err := tx.db.Unscoped().Delete(pool).Error
+	if err != nil {
+		return err
+	}
+	return deletePoolState(tx.db, pool.PoolAddress)
+}
+
+func (tx *gormTx) SaveRegistered(pools []*RegisteredPool) error {
+	return tx.db.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(pools, storageBatchSize).Error
+}
+
+func (tx *gormTx) DeleteRegistered(addresses []string) error {
+	return tx.db.Unscoped().Where("pool_address IN ?", addresses).Delete(&RegisteredPool{}).Error
+}
+
+func (tx *gormTx) SaveQuarantined(q *QuarantinedPool) error {
+	return tx.db.Create(q).Error
+}
+
+func (tx *gormTx) DeleteQuarantined(q *QuarantinedPool) error {
+	return tx.db.Unscoped().Delete(q).Error
+}
+
+func (tx *gormTx) SaveSyncState(blockNum uint64) error {
+	return tx.db.Save(&SyncState{ID: syncStateID, BlockNum: blockNum}).Error
+}
+
+func (tx *gormTx) SaveCheckpoint(checkpoint *Checkpoint, pools []*PoolCheckpoint) error {
+	if len(pools) > 0 {
+		err := tx.db.CreateInBatches(pools, storageBatchSize).Error
+		if err != nil {
+			return err
+		}
+	}
+	return tx.db.Create(checkpoint).Error
+}
+
+func (tx *gormTx) PruneCheckpoint(blockNum, next uint64) error {
+	updated := tx.db.Model(&PoolCheckpoint{}).Select("pool_address").Where("block_num > ? AND block_num <= ?", blockNum, next)
+	err := tx.db.Where("block_num = ? AND pool_address IN (?)", blockNum, updated).Delete(&PoolCheckpoint{}).Error
+	if err != nil {
+		return err
+	}
+	err = tx.db.Model(&PoolCheckpoint{}).Where("block_num = ?", blockNum).Update("block_num", next).Error
+	if err != nil {
+		return err
+	}
+	return tx.db.Where("block_num = ?", blockNum).Delete(&Checkpoint{}).Error
+}
+
+func (tx *gormTx) DeleteCheckpointsAfter(blockNum uint64) ([]string, error) {
+	var addresses []string
+	err := tx.db.Model(&PoolCheckpoint{}).Where("block_num > ?", blockNum).Distinct().Pluck("pool_address", &addresses).Error
+	if err != nil {
+		return nil, err
+	}
+	err = tx.db.Where("block_num > ?", blockNum).Delete(&PoolCheckpoint{}).Error
+	if err != nil {
+		return nil, err
+	}
+	return addresses, tx.db.Where("block_num > ?", blockNum).Delete(&Checkpoint{}).Error
+}
@@ -0,0 +1,600 @@
+package uniswap_v3_simulator
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// leveldb 中的 key, 值为 json
+//
+//	pool/<address>                         pool, 不包括 tick 和 position
+//	tick/<address>/<tick>                  Tick
+//	position/<address>/<position key>      Position
+//	registry/<address>                     RegisteredPool
+//	quarantine/<address>                   QuarantinedPool
+//	sync                                   同步到的区块
+//	seq/<name>                             自增 ID
+//	checkpoint/<block>                     Checkpoint
+//	poolcheckpoint/<address>/<block>       PoolCheckpoint.State
+//	checkpointpool/<block>/<address>       空, checkpoint 中的 pool
+//
+// 区块号格式化为 20 位十进制, 按字节序即按区块排序
+const (
+	levelPoolPrefix           = "pool/"
+	levelTickPrefix           = "tick/"
+	levelPositionPrefix       = "position/"
+	levelRegistryPrefix       = "registry/"
+	levelQuarantinePrefix     = "quarantine/"
+	levelSyncKey              = "sync"
+	levelSeqPrefix            = "seq/"
+	levelCheckpointPrefix     = "checkpoint/"
+	levelPoolCheckpointPrefix = "poolcheckpoint/"
+	levelCheckpointPoolPrefix = "checkpointpool/"
+)
+
+func levelBlockKey(blockNum uint64) string {
+	return fmt.Sprintf("%020d", blockNum)
+}
+
+// LevelDBStore 嵌入式 kv 存储, 不需要数据库服务
+type LevelDBStore struct {
+	db *leveldb.DB
+}
+
+func NewLevelDBStore(path string) (*LevelDBStore, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &LevelDBStore{db: db}, nil
+}
+
+// leveldb.DB 和 leveldb.Transaction 共有的读操作
+type levelReader interface {
+	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+	NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator
+}
+
+// 读取 key 并解析到 v, key 不存在时返回 false
+func levelGet(r levelReader, key string, v interface{}) (bool, error) {
+	data, err := r.Get([]byte(key), nil)
+	if err == leveldb.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// 按顺序遍历 [start, limit) 的 key, limit 为空时遍历 start 前缀
+func levelScan(r levelReader, start, limit string, fn func(key string, value []byte) error) error {
+	var slice *util.Range
+	if limit == "" {
+		slice = util.BytesPrefix([]byte(start))
+	} else {
+		slice = &util.Range{Start: []byte(start), Limit: []byte(limit)}
+	}
+	iter := r.NewIterator(slice, nil)
+	defer iter.Release()
+	for iter.Next() {
+		err := fn(string(iter.Key()), iter.Value())
+		if err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+func (s *LevelDBStore) LoadPools() ([]*CorePool, error) {
+	var pools []*CorePool
+	byAddress := map[string]*CorePool{}
+	err := levelScan(s.db, levelPoolPrefix, "", func(key string, value []byte) error {
+		pool := &CorePool{}
+		err := json.Unmarshal(value, pool)
+		if err != nil {
+			return err
+		}
+		pool.HasCreated = true
+		pool.TickManager = NewTickManager()
+		pool.PositionManager = NewPositionManager()
+		pools = append(pools, pool)
+		byAddress[pool.PoolAddress] = pool
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = levelScan(s.db, levelTickPrefix, "", func(key string, value []byte) error {
+		pool, ok := byAddress[strings.Split(strings.TrimPrefix(key, levelTickPrefix), "/")[0]]
+		if !ok {
+			return nil
+		}
+		tick := &Tick{}
+		err := json.Unmarshal(value, tick)
+		if err != nil {
+			return err
+		}
+		pool.TickManager.Ticks[tick.TickIndex] = tick
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = levelScan(s.db, levelPositionPrefix, "", func(key string, value []byte) error {
+		parts := strings.SplitN(strings.TrimPrefix(key, levelPositionPrefix), "/", 2)
+		pool, ok := byAddress[parts[0]]
+		if !ok || len(parts) != 2 {
+			return nil
+		}
+		position := &Position{}
+		err := json.Unmarshal(value, position)
+		if err != nil {
+			return err
+		}
+		pool.PositionManager.Positions[parts[1]] = position
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, pool := range pools {
+		pool.TickManager.dirty = map[int]bool{}
+		pool.PositionManager.dirty = map[string]bool{}
+	}
+	return pools, nil
+}
+
+func (s *LevelDBStore) LoadRegistry() ([]*RegisteredPool, error) {
+	var registered []*RegisteredPool
+	err := levelScan(s.db, levelRegistryPrefix, "", func(key string, value []byte) error {
+		r := &RegisteredPool{}
+		registered = append(registered, r)
+		return json.Unmarshal(value, r)
+	})
+	return registered, err
+}
+
+func (s *LevelDBStore) LoadQuarantine() ([]*QuarantinedPool, error) {
+	var quarantined []*QuarantinedPool
+	err := levelScan(s.db, levelQuarantinePrefix, "", func(key string, value []byte) error {
+		q := &QuarantinedPool{}
+		quarantined = append(quarantined, q)
+		return json.Unmarshal(value, q)
+	})
+	return quarantined, err
+}
+
+func (s *LevelDBStore) SyncState() (uint64, error) {
+	var blockNum uint64
+	_, err := levelGet(s.db, levelSyncKey, &blockNum)
+	return blockNum, err
+}
+
+func (s *LevelDBStore) MaxPoolBlockNum() (uint64, error) {
+	var lastBlock uint64
+	err := levelScan(s.db, levelPoolPrefix, "", func(key string, value []byte) error {
+		pool := &CorePool{}
+		err := json.Unmarshal(value, pool)
+		if err != nil {
+			return err
+		}
+		if (pool.BootstrapBlockNum == 0 || pool.CurrentBlockNum > pool.BootstrapBlockNum) && pool.CurrentBlockNum > lastBlock {
+			lastBlock = pool.CurrentBlockNum
+		}
+		return nil
+	})
+	return lastBlock, err
+}
+
+func (s *LevelDBStore) Checkpoints() ([]*Checkpoint, error) {
+	var checkpoints []*Checkpoint
+	err := levelScan(s.db, levelCheckpointPrefix, "", func(key string, value []byte) error {
+		checkpoint := &Checkpoint{}
+		checkpoints = append(checkpoints, checkpoint)
+		return json.Unmarshal(value, checkpoint)
+	})
+	return checkpoints, err
+}
+
+func (s *LevelDBStore) FindCheckpoint(blockNum uint64) (*Checkpoint, error) {
+	checkpoint := &Checkpoint{}
+	ok, err := levelGet(s.db, levelCheckpointPrefix+levelBlockKey(blockNum), checkpoint)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return checkpoint, nil
+}
+
+func (s *LevelDBStore) LastCheckpoint() (*Checkpoint, error) {
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(levelCheckpointPrefix)), nil)
+	defer iter.Release()
+	if !iter.Last() {
+		return nil, iter.Error()
+	}
+	checkpoint := &Checkpoint{}
+	return checkpoint, json.Unmarshal(iter.Value(), checkpoint)
+}
+
+func (s *LevelDBStore) PoolCheckpointAt(address string, blockNum uint64) (*PoolCheckpoint, error) {
+	prefix := levelPoolCheckpointPrefix + address + "/"
+	iter := s.db.NewIterator(&util.Range{Start: []byte(prefix), Limit: []byte(prefix + levelBlockKey(blockNum+1))}, nil)
+	defer iter.Release()
+	if !iter.Last() {
+		return nil, iter.Error()
+	}
+	return levelPoolCheckpoint(string(iter.Key()), iter.Value())
+}
+
+func (s *LevelDBStore) PoolCheckpointsAt(blockNum uint64) ([]*PoolCheckpoint, error) {
+	// key 按 pool, 区块排序, 每个 pool 取最后一个不晚于 blockNum 的
+	var rows []*PoolCheckpoint
+	err := levelScan(s.db, levelPoolCheckpointPrefix, "", func(key string, value []byte) error {
+		row, err := levelPoolCheckpoint(key, value)
+		if err != nil {
+			return err
+		}
+		if row.BlockNum > blockNum {
+			return nil
+		}
+		if len(rows) > 0 && rows[len(rows)-1].PoolAddress == row.PoolAddress {
+			rows[len(rows)-1] = row
+		} else {
+			rows = append(rows, row)
+		}
+		return nil
+	})
+	return rows, err
+}
+
+func levelPoolCheckpoint(key string, value []byte) (*PoolCheckpoint, error) {
+	parts := strings.Split(strings.TrimPrefix(key, levelPoolCheckpointPrefix), "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid pool checkpoint key %s", key)
+	}
+	blockNum, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	state := make([]byte, len(value))
+	copy(state, value)
+	return &PoolCheckpoint{PoolAddress: parts[0], BlockNum: blockNum, State: state}, nil
+}
+
+func (s *LevelDBStore) Update(fn func(tx StoreTx) error) error {
+	tr, err := s.db.OpenTransaction()
+	if err != nil {
+		return err
+	}
+	err = fn(&levelTx{tr: tr})
+	if err != nil {
+		tr.Discard()
+		return err
+	}
+	return tr.Commit()
+}
+
+func (s *LevelDBStore) Close() error {
+	return s.db.Close()
+}
+
+// 事务中的读取包括未提交的写入
+type levelTx struct {
+	tr *leveldb.Transaction
+}
+
+func (tx *levelTx) put(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.tr.Put([]byte(key), data, nil)
+}
+
+func (tx *levelTx) delete(key string) error {
+	return tx.tr.Delete([]byte(key), nil)
+}
+
+// 删除 [start, limit) 的 key, limit 为空时删除 start 前缀
+func (tx *levelTx) deleteRange(start, limit string) error {
+	var keys []string
+	err := levelScan(tx.tr, start, limit, func(key string, value []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = tx.delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *levelTx) nextID(name string) (uint, error) {
+	var id uint64
+	key := []byte(levelSeqPrefix + name)
+	data, err := tx.tr.Get(key, nil)
+	if err == nil && len(data) == 8 {
+		id = binary.BigEndian.Uint64(data)
+	} else if err != nil && err != leveldb.ErrNotFound {
+		return 0, err
+	}
+	id += 1
+	data = make([]byte, 8)
+	binary.BigEndian.PutUint64(data, id)
+	return uint(id), tx.tr.Put(key, data, nil)
+}
+
+func (tx *levelTx) SavePool(pool *CorePool) error {
+	if !pool.HasCreated {
+		id, err := tx.nextID("pool")
+		if err != nil {
+			return err
+		}
+		pool.ID = id
+		pool.HasCreated = true
+	}
+	header := *pool
+	header.TickManager = nil
+	header.PositionManager = nil
+	err := tx.put(levelPoolPrefix+pool.PoolAddress, &header)
+	if err != nil {
+		return err
+	}
+	err = tx.saveTicks(pool)
+	if err != nil {
+		return err
+	}
+	return tx.savePositions(pool)
+}
+
+// 和 flushTicks 相同, dirty 为 nil 时删除 pool 所有的 tick 后重新写入
+func (tx *levelTx) saveTicks(pool *CorePool) error {
+	tm := pool.TickManager
+	prefix := levelTickPrefix + pool.PoolAddress + "/"
+	indexes := make([]int, 0, len(tm.dirty))
+	if tm.dirty == nil {
+		err := tx.deleteRange(prefix, "")
+		if err != nil {
+			return err
+		}
+		for index := range tm.Ticks {
+			indexes = append(indexes, index)
+		}
+	} else {
+		for index := range tm.dirty {
+			indexes = append(indexes, index)
+		}
+	}
+	for _, index := range indexes {
+		key := prefix + strconv.Itoa(index)
+		var err error
+		if tick, ok := tm.Ticks[index]; ok {
+			err = tx.put(key, tick)
+		} else {
+			err = tx.delete(key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *levelTx) savePositions(pool *CorePool) error {
+	pm := pool.PositionManager
+	prefix := levelPositionPrefix + pool.PoolAddress + "/"
+	keys := make([]string, 0, len(pm.dirty))
+	if pm.dirty == nil {
+		err := tx.deleteRange(prefix, "")
+		if err != nil {
+			return err
+		}
+		for key := range pm.Positions {
+			keys = append(keys, key)
+		}
+	} else {
+		for key := range pm.dirty {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		var err error
+		if position, ok := pm.Positions[key]; ok {
+			err = tx.put(prefix+key, position)
+		} else {
+			err = tx.delete(prefix + key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *levelTx) DeletePool(pool *CorePool) error {
+	err := tx.delete(levelPoolPrefix + pool.PoolAddress)
+	if err != nil {
+		return err
+	}
+	err = tx.deleteRange(levelTickPrefix+pool.PoolAddress+"/", "")
+	if err != nil {
+		return err
+	}
+	return tx.deleteRange(levelPositionPrefix+pool.PoolAddress+"/", "")
+}
+
+func (tx *levelTx) SaveRegistered(pools []*RegisteredPool) error {
+	for _, r := range pools {
+		key := levelRegistryPrefix + r.PoolAddress
+		ok, err := tx.tr.Has([]byte(key), nil)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		if r.ID == 0 {
+			r.ID, err = tx.nextID("registry")
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.put(key, r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *levelTx) DeleteRegistered(addresses []string) error {
+	for _, address := range addresses {
+		err := tx.delete(levelRegistryPrefix + address)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *levelTx) SaveQuarantined(q *QuarantinedPool) error {
+	if q.ID == 0 {
+		id, err := tx.nextID("quarantine")
+		if err != nil {
+			return err
+		}
+		q.ID = id
+	}
+	return tx.put(levelQuarantinePrefix+q.PoolAddress, q)
+}
+
+func (tx *levelTx) DeleteQuarantined(q *QuarantinedPool) error {
+	return tx.delete(levelQuarantinePrefix + q.PoolAddress)
+}
+
+func (tx *levelTx) SaveSyncState(blockNum uint64) error {
+	return tx.put(levelSyncKey, blockNum)
+}
+
+func (tx *levelTx) SaveCheckpoint(checkpoint *Checkpoint, pools []*PoolCheckpoint) error {
+	block := levelBlockKey(checkpoint.BlockNum)
+	for _, row := range pools {
+		err := tx.tr.Put([]byte(levelPoolCheckpointPrefix+row.PoolAddress+"/"+levelBlockKey(row.BlockNum)), row.State, nil)
+		if err != nil {
+			return err
+		}
+		err = tx.tr.Put([]byte(levelCheckpointPoolPrefix+levelBlockKey(row.BlockNum)+"/"+row.PoolAddress), nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+	if checkpoint.ID == 0 {
+		id, err := tx.nextID("checkpoint")
+		if err != nil {
+			return err
+		}
+		checkpoint.ID = id
+	}
+	return tx.put(levelCheckpointPrefix+block, checkpoint)
+}
+
+// 返回 checkpoint 中的 pool
+func (tx *levelTx) checkpointPools(blockNum uint64) ([]string, error) {
+	var addresses []string
+	prefix := levelCheckpointPoolPrefix + levelBlockKey(blockNum) + "/"
+	err := levelScan(tx.tr, prefix, "", func(key string, value []byte) error {
+		addresses = append(addresses, strings.TrimPrefix(key, prefix))
+		return nil
+	})
+	return addresses, err
+}
+
+func (tx *levelTx) PruneCheckpoint(blockNum, next uint64) error {
+	addresses, err := tx.checkpointPools(blockNum)
+	if err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		prefix := levelPoolCheckpointPrefix + address + "/"
+		key := prefix + levelBlockKey(blockNum)
+		updated := false
+		err = levelScan(tx.tr, prefix+levelBlockKey(blockNum+1), prefix+levelBlockKey(next+1), func(key string, value []byte) error {
+			updated = true
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if !updated {
+			state, err := tx.tr.Get([]byte(key), nil)
+			if err != nil {
+				return err
+			}
+			err = tx.tr.Put([]byte(prefix+levelBlockKey(next)), state, nil)
+			if err != nil {
+				return err
+			}
+			err = tx.tr.Put([]byte(levelCheckpointPoolPrefix+levelBlockKey(next)+"/"+address), nil, nil)
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.deleteRange(levelCheckpointPoolPrefix+levelBlockKey(blockNum)+"/", "")
+	if err != nil {
+		return err
+	}
+	return tx.delete(levelCheckpointPrefix + levelBlockKey(blockNum))
+}
+
+func (tx *levelTx) DeleteCheckpointsAfter(blockNum uint64) ([]string, error) {
+	start := levelBlockKey(blockNum + 1)
+	limit := levelCheckpointPoolPrefix + "~"
+	var keys []string
+	seen := map[string]bool{}
+	var addresses []string
+	err := levelScan(tx.tr, levelCheckpointPoolPrefix+start, limit, func(key string, value []byte) error {
+		keys = append(keys, key)
+		parts := strings.Split(strings.TrimPrefix(key, levelCheckpointPoolPrefix), "/")
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid checkpoint pool key %s", key)
+		}
+		keys = append(keys, levelPoolCheckpointPrefix+parts[1]+"/"+parts[0])
+		if !seen[parts[1]] {
+			seen[parts[1]] = true
+			addresses = append(addresses, parts[1])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		err = tx.delete(key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tx.deleteRange(levelCheckpointPrefix+start, levelCheckpointPrefix+"~")
+	if err != nil {
+		return nil, err
+	}
+	return addresses, nil
+}
@@ -0,0 +1,184 @@
+package uniswap_v3_simulator
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// 每个 Store 运行相同的同步, checkpoint, 恢复和重启流程
+func testStore(t *testing.T, open func() Store) {
+	source := newTestLogSource(
+		testPoolCreatedLog(100),
+		testInitializeLog(101),
+		testMintLog(105, -600, 600, 1000000),
+		testMintLog(125, -60, 60, 1000),
+		testBurnLog(145, -60, 60, 1000),
+		testMintLog(165, -600, 600, 1),
+	)
+	pm, err := NewSimulatorWithStore(open(), source, 99)
+	assert.NoError(t, err)
+	pm.SetCheckpointInterval(10)
+	pm.SetCheckpointRetention(CheckpointRetention{KeepLast: 3})
+	_, err = pm.SyncTo(179, 9)
+	assert.NoError(t, err)
+
+	checkpoints, err := pm.Checkpoints()
+	assert.NoError(t, err)
+	assert.Len(t, checkpoints, 3)
+	assert.Equal(t, uint64(159), checkpoints[0].BlockNum)
+	assert.Equal(t, uint64(179), checkpoints[2].BlockNum)
+	for block, liquidity := range map[uint64]string{
+		130: "1001000", // 从 Initialize 回放, 之前的 checkpoint 已删除
+		159: "1000000", // 145 的状态移到 159
+		170: "1000001",
+	} {
+		pool, err := pm.PoolAt(testPool, block)
+		assert.NoError(t, err)
+		assert.Equal(t, liquidity, pool.Liquidity.String(), "block %d", block)
+	}
+	expected := pm.Pools[testPool].Clone()
+	assert.NoError(t, pm.Close())
+
+	// 重启后从 Store 加载
+	pm, err = NewSimulatorWithStore(open(), source, 99)
+	assert.NoError(t, err)
+	pool := pm.Pools[testPool]
+	assert.NotNil(t, pool)
+	assert.Equal(t, "1000001", pool.Liquidity.String())
+	assertPoolStateEqual(t, expected, pool)
+	assert.Len(t, pool.TickManager.GetSortedTicks(), 2)
+	assert.Contains(t, pm.poolConfigs, testPool)
+	synced, err := pm.MaxSyncedBlockNum()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(179), synced)
+
+	assert.NoError(t, pm.RestoreCheckpoint(159))
+	assert.Equal(t, "1000000", pm.Pools[testPool].Liquidity.String())
+	checkpoints, err = pm.Checkpoints()
+	assert.NoError(t, err)
+	assert.Len(t, checkpoints, 1)
+
+	// 重新同步得到相同的状态
+	_, err = pm.SyncTo(179, 9)
+	assert.NoError(t, err)
+	assertPoolStateEqual(t, expected, pm.Pools[testPool])
+	assert.Equal(t, "1000001", pm.Pools[testPool].Liquidity.String())
+	assert.NoError(t, pm.Close())
+}
+
+func TestSQLiteStore(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "simulator.db")
+	testStore(t, func() Store {
+		store, err := NewSQLiteStore(dbFile)
+		assert.NoError(t, err)
+		return store
+	})
+	dbFile = filepath.Join(t.TempDir(), "retry.db")
+	testStoreFlushRetry(t, func() Store {
+		store, err := NewSQLiteStore(dbFile)
+		assert.NoError(t, err)
+		return store
+	})
+}
+
+func TestLevelDBStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "simulator")
+	testStore(t, func() Store {
+		store, err := NewLevelDBStore(dir)
+		assert.NoError(t, err)
+		return store
+	})
+	dir = filepath.Join(t.TempDir(), "retry")
+	testStoreFlushRetry(t, func() Store {
+		store, err := NewLevelDBStore(dir)
+		assert.NoError(t, err)
+		return store
+	})
+}
+
+// SIMULATOR_POSTGRES_DSN 为空时跳过, 例如
+// SIMULATOR_POSTGRES_DSN="host=localhost user=postgres password=postgres dbname=simulator_test port=5432" go test -run TestPostgresStore
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv("SIMULATOR_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("SIMULATOR_POSTGRES_DSN not set")
+	}
+	db, err := gorm.Open(postgres.Open(dsn), gormConfig())
+	assert.NoError(t, err)
+	assert.NoError(t, db.Migrator().DropTable(&CorePool{}, &PoolTick{}, &PoolPosition{}, &RegisteredPool{}, &QuarantinedPool{}, &Checkpoint{}, &PoolCheckpoint{}, &SyncState{}))
+	sqlDB, err := db.DB()
+	assert.NoError(t, err)
+	assert.NoError(t, sqlDB.Close())
+	testStore(t, func() Store {
+		store, err := NewPostgresStore(dsn)
+		assert.NoError(t, err)
+		return store
+	})
+}
+
+var errTestSavePool = errors.New("test save pool")
+
+// SavePool 写入 failPool 时失败, 整个事务回滚
+type failingStore struct {
+	Store
+	failPool string
+}
+
+type failingTx struct {
+	StoreTx
+	failPool string
+}
+
+func (s *failingStore) Update(fn func(tx StoreTx) error) error {
+	return s.Store.Update(func(tx StoreTx) error {
+		return fn(&failingTx{StoreTx: tx, failPool: s.failPool})
+	})
+}
+
+func (tx *failingTx) SavePool(pool *CorePool) error {
+	if pool.PoolAddress == tx.failPool {
+		return errTestSavePool
+	}
+	return tx.StoreTx.SavePool(pool)
+}
+
+// 事务回滚后 dirty 的 tick 和 position 保留, 下次 flush 重新写入
+func testStoreFlushRetry(t *testing.T, open func() Store) {
+	store := &failingStore{Store: open()}
+	pm, err := NewSimulatorWithStore(store, nil, 0)
+	assert.NoError(t, err)
+	first := addTestQuotePool(t, pm, testTokenA, testTokenB, 3000, 60)
+	second := addTestQuotePool(t, pm, testTokenB, testTokenC, 500, 10)
+	pm.dirtyPools[first.PoolAddress] = first
+	pm.dirtyPools[second.PoolAddress] = second
+	assert.NoError(t, pm.FlushPools())
+
+	for _, pool := range []*CorePool{first, second} {
+		_, _, err = pool.Mint(testOwner.String(), -1200, 1200, decimal.NewFromInt(1000))
+		assert.NoError(t, err)
+		pm.dirtyPools[pool.PoolAddress] = pool
+	}
+	store.failPool = second.PoolAddress
+	assert.ErrorIs(t, pm.FlushPools(), errTestSavePool)
+	store.failPool = ""
+	assert.NoError(t, pm.FlushPools())
+	expected := []*CorePool{first.Clone(), second.Clone()}
+	assert.NoError(t, pm.Close())
+
+	pm, err = NewSimulatorWithStore(open(), nil, 0)
+	assert.NoError(t, err)
+	for _, pool := range expected {
+		loaded := pm.Pools[common.HexToAddress(pool.PoolAddress)]
+		assert.Len(t, loaded.TickManager.GetSortedTicks(), 6)
+		assertPoolStateEqual(t, pool, loaded)
+	}
+	assert.NoError(t, pm.Close())
+}
@@ -0,0 +1,272 @@
+package uniswap_v3_simulator
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/holiman/uint256"
+)
+
+// SwapMode 执行 Swap 事件的方式
+type SwapMode int
+
+const (
+	// SwapModeResolve 只从 event 反推 amountSpecified 和 sqrtPriceLimitX96, 反推失败时按 ErrorPolicy 处理
+	SwapModeResolve SwapMode = iota
+	// SwapModeResolveOrEvent 先从 event 反推输入执行 swap, 反推失败时按 event 的结果执行
+	SwapModeResolveOrEvent
+	// SwapModeEvent 不反推输入, 直接把价格移动到 event 的 sqrtPriceX96, 手续费按 event 的数量计算
+	SwapModeEvent
+)
+
+var (
+	ErrSwapEventMismatch     = errors.New("swap event inconsistent with pool")
+	ErrSwapLiquidityMismatch = errors.New("swap event liquidity mismatch")
+)
+
+func (m SwapMode) String() string {
+	switch m {
+	case SwapModeResolve:
+		return "resolve"
+	case SwapModeResolveOrEvent:
+		return "resolve-or-event"
+	case SwapModeEvent:
+		return "event"
+	}
+	return fmt.Sprintf("SwapMode(%d)", int(m))
+}
+
+func ParseSwapMode(s string) (SwapMode, error) {
+	for _, m := range []SwapMode{SwapModeResolve, SwapModeResolveOrEvent, SwapModeEvent} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown swap mode %s", s)
+}
+
+// SetSwapMode 设置执行 Swap 事件的方式, 默认 SwapModeResolve, 按 event 执行的方式需要显式开启
+func (pm *Simulator) SetSwapMode(mode SwapMode) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.swapMode = mode
+}
+
+func (pm *Simulator) SwapMode() SwapMode {
+	return pm.swapMode
+}
+
+// 按 mode 执行 Swap 事件
+func applySwap(pool *CorePool, swap *UniV3SwapEvent, mode SwapMode) error {
+	if mode == SwapModeEvent {
+		return pool.ApplySwapEvent(swap)
+	}
+	amountSpecified, sqrtPriceX96, err := pool.ResolveInputFromSwapResultEvent(swap)
+	if err != nil {
+		if mode == SwapModeResolve {
+			return err
+		}
+		if eventErr := pool.ApplySwapEvent(swap); eventErr != nil {
+			return fmt.Errorf("%w, apply event: %s", err, eventErr)
+		}
+		return nil
+	}
+	_, _, _, err = pool.HandleSwap(swap.Amount0.IsPositive(), amountSpecified, sqrtPriceX96, false)
+	return err
+}
+
+// ApplySwapEvent 不反推 swap 的输入, 从当前价格走到 event 的 sqrtPriceX96, 依次穿过已初始化的 tick.
+// 除最后一步外每一步的手续费与合约相同, 最后一步的手续费为 event 的输入数量剩下的部分.
+// 结束时的 liquidity 必须与 event 的 Liquidity 相同, 否则返回 ErrSwapLiquidityMismatch, pool 不变
+func (p *CorePool) ApplySwapEvent(swap *UniV3SwapEvent) error {
+	if err := p.applySwapEvent(swap, true); err != nil {
+		return err
+	}
+	return p.applySwapEvent(swap, false)
+}
+
+func (p *CorePool) applySwapEvent(swap *UniV3SwapEvent, isStatic bool) error {
+	var sqrtPriceTargetX96, liquidityTarget uint256.Int
+	if !u256FromDecimal(&sqrtPriceTargetX96, swap.SqrtPriceX96) || !u256FromDecimal(&liquidityTarget, swap.Liquidity) {
+		return OVERFLOW
+	}
+	if sqrtPriceTargetX96.Lt(u256MinSqrtRatio) || !sqrtPriceTargetX96.Lt(u256MaxSqrtRatio) {
+		return ErrInvalidSqrtRatio
+	}
+
+	state := swapState{tick: p.TickCurrent}
+	if !u256FromDecimal(&state.sqrtPriceX96, p.SqrtPriceX96) || !u256FromDecimal(&state.liquidity, p.Liquidity) {
+		return OVERFLOW
+	}
+	// 价格下降为 zeroForOne, 价格不变时按输入的 token 判断
+	var zeroForOne bool
+	switch state.sqrtPriceX96.Cmp(&sqrtPriceTargetX96) {
+	case 1:
+		zeroForOne = true
+	case 0:
+		zeroForOne = swap.Amount0.IsPositive()
+	}
+	amountIn, amountOut := swap.Amount1, swap.Amount0
+	if zeroForOne {
+		amountIn, amountOut = swap.Amount0, swap.Amount1
+	}
+	if amountOut.IsPositive() {
+		return fmt.Errorf("%w: amount0 %s amount1 %s", ErrSwapEventMismatch, swap.Amount0, swap.Amount1)
+	}
+	// 剩余的输入, 包括手续费
+	var amountRemaining uint256.Int
+	if !u256FromDecimal(&amountRemaining, amountIn) {
+		return fmt.Errorf("%w: amount0 %s amount1 %s", ErrSwapEventMismatch, swap.Amount0, swap.Amount1)
+	}
+
+	liquidityStart := p.Liquidity
+	tickStart := p.TickCurrent
+	computedLatestObservation := false
+	var tickCumulative int64
+	secondsPerLiquidityCumulativeX128 := ZERO
+
+	var feeProtocol uint8
+	if zeroForOne {
+		feeProtocol = p.FeeProtocol0()
+		if !u256FromDecimal(&state.feeGrowthGlobalX128, p.FeeGrowthGlobal0X128) {
+			return OVERFLOW
+		}
+	} else {
+		feeProtocol = p.FeeProtocol1()
+		if !u256FromDecimal(&state.feeGrowthGlobalX128, p.FeeGrowthGlobal1X128) {
+			return OVERFLOW
+		}
+	}
+	var feeProtocolX, feePipsX, feeComplement uint256.Int
+	feeProtocolX.SetUint64(uint64(feeProtocol))
+	feePipsX.SetUint64(uint64(p.Fee))
+	feeComplement.SetUint64(1000000 - uint64(p.Fee))
+
+	var step StepComputations
+	var sqrtRatioTargetX96 *uint256.Int
+	var delta, liquidityNetX uint256.Int
+	for last := false; !last; {
+		step.sqrtPriceStartX96.Set(&state.sqrtPriceX96)
+		tickNext, initialized, err := p.TickManager.GetNextInitializedTick(state.tick, p.TickSpacing, zeroForOne)
+		if err != nil {
+			return err
+		}
+		step.tickNext = tickNext
+		step.initialized = initialized
+		if step.tickNext < MIN_TICK {
+			step.tickNext = MIN_TICK
+		} else if step.tickNext > MAX_TICK {
+			step.tickNext = MAX_TICK
+		}
+		if err := u256GetSqrtRatioAtTick(&step.sqrtPriceNextX96, step.tickNext); err != nil {
+			return err
+		}
+		// 下一个 tick 超过 event 的价格时为最后一步
+		sqrtRatioTargetX96 = &step.sqrtPriceNextX96
+		if zeroForOne && !step.sqrtPriceNextX96.Gt(&sqrtPriceTargetX96) || !zeroForOne && !step.sqrtPriceNextX96.Lt(&sqrtPriceTargetX96) {
+			sqrtRatioTargetX96 = &sqrtPriceTargetX96
+			last = true
+		}
+
+		if zeroForOne {
+			err = u256GetAmount0Delta(&step.amountIn, sqrtRatioTargetX96, &state.sqrtPriceX96, &state.liquidity, true)
+		} else {
+			err = u256GetAmount1Delta(&step.amountIn, &state.sqrtPriceX96, sqrtRatioTargetX96, &state.liquidity, true)
+		}
+		if err != nil {
+			return err
+		}
+		if amountRemaining.Lt(&step.amountIn) {
+			return fmt.Errorf("%w: amount in %s less than price movement", ErrSwapEventMismatch, amountIn)
+		}
+		amountRemaining.Sub(&amountRemaining, &step.amountIn)
+		if last {
+			step.feeAmount.Set(&amountRemaining)
+		} else {
+			if err := u256MulDivRoundingUp(&step.feeAmount, &step.amountIn, &feePipsX, &feeComplement); err != nil {
+				return err
+			}
+			if amountRemaining.Lt(&step.feeAmount) {
+				return fmt.Errorf("%w: amount in %s less than price movement", ErrSwapEventMismatch, amountIn)
+			}
+			amountRemaining.Sub(&amountRemaining, &step.feeAmount)
+		}
+		state.sqrtPriceX96.Set(sqrtRatioTargetX96)
+
+		if feeProtocol > 0 {
+			delta.Div(&step.feeAmount, &feeProtocolX)
+			step.feeAmount.Sub(&step.feeAmount, &delta)
+			state.protocolFee.Add(&state.protocolFee, &delta)
+			state.protocolFee.And(&state.protocolFee, u256MaxUint128)
+		}
+		if !state.liquidity.IsZero() {
+			if err := u256MulDiv(&delta, &step.feeAmount, u256Q128, &state.liquidity); err != nil {
+				return err
+			}
+			state.feeGrowthGlobalX128.Add(&state.feeGrowthGlobalX128, &delta)
+		}
+		if state.sqrtPriceX96.Eq(&step.sqrtPriceNextX96) {
+			if step.initialized {
+				nextTick, err := p.getSwapTick(step.tickNext, isStatic)
+				if err != nil {
+					return err
+				}
+				liquidityNet := nextTick.LiquidityNet
+				if !isStatic {
+					if !computedLatestObservation {
+						tickCumulative, secondsPerLiquidityCumulativeX128, err = p.ensureOracle().ObserveSingle(p.blockTimestamp(), 0, tickStart, p.ObservationIndex, liquidityStart, p.ObservationCardinality)
+						if err != nil {
+							return err
+						}
+						computedLatestObservation = true
+					}
+					if zeroForOne {
+						liquidityNet = nextTick.Cross(decimalFromU256(&state.feeGrowthGlobalX128), p.FeeGrowthGlobal1X128, secondsPerLiquidityCumulativeX128, tickCumulative, p.blockTimestamp())
+					} else {
+						liquidityNet = nextTick.Cross(p.FeeGrowthGlobal0X128, decimalFromU256(&state.feeGrowthGlobalX128), secondsPerLiquidityCumulativeX128, tickCumulative, p.blockTimestamp())
+					}
+				}
+				if !i256FromDecimal(&liquidityNetX, liquidityNet) {
+					return OVERFLOW
+				}
+				if zeroForOne {
+					liquidityNetX.Neg(&liquidityNetX)
+				}
+				if err := u256AddDelta(&state.liquidity, &state.liquidity, &liquidityNetX); err != nil {
+					return err
+				}
+			}
+			if zeroForOne {
+				state.tick = step.tickNext - 1
+			} else {
+				state.tick = step.tickNext
+			}
+		} else if !state.sqrtPriceX96.Eq(&step.sqrtPriceStartX96) {
+			state.tick, err = u256GetTickAtSqrtRatio(&state.sqrtPriceX96)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if !state.liquidity.Eq(&liquidityTarget) {
+		return fmt.Errorf("%w: event %s, simulated %s", ErrSwapLiquidityMismatch, swap.Liquidity, decimalFromU256(&state.liquidity))
+	}
+	if isStatic {
+		return nil
+	}
+
+	p.SqrtPriceX96 = decimalFromU256(&state.sqrtPriceX96)
+	if state.tick != p.TickCurrent {
+		p.ObservationIndex, p.ObservationCardinality = p.ensureOracle().Write(p.ObservationIndex, p.blockTimestamp(), tickStart, liquidityStart, p.ObservationCardinality, p.ObservationCardinalityNext)
+		p.TickCurrent = state.tick
+	}
+	p.Liquidity = decimalFromU256(&state.liquidity)
+	if zeroForOne {
+		p.FeeGrowthGlobal0X128 = decimalFromU256(&state.feeGrowthGlobalX128)
+		p.ProtocolFeesToken0 = AddUint128(p.ProtocolFeesToken0, decimalFromU256(&state.protocolFee))
+	} else {
+		p.FeeGrowthGlobal1X128 = decimalFromU256(&state.feeGrowthGlobalX128)
+		p.ProtocolFeesToken1 = AddUint128(p.ProtocolFeesToken1, decimalFromU256(&state.protocolFee))
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package uniswap_v3_simulator
+
+import (
+	"math/big"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCorePool_ApplySwapEvent(t *testing.T) {
+	pool, swaps, events := testSwapSequence(t, 200)
+	expected, actual := pool.Clone(), pool.Clone()
+	for i, swap := range swaps {
+		_, _, _, err := expected.HandleSwap(swap.zeroForOne, swap.amountSpecified, swap.sqrtPriceLimitX96, false)
+		assert.NoError(t, err)
+		assert.NoError(t, actual.ApplySwapEvent(events[i]), "swap %d", i)
+		assertSwapStateEqual(t, expected, actual)
+	}
+	assertPoolStateEqual(t, expected, actual)
+
+	// liquidity 与 event 不同时不修改 pool
+	event := *events[0]
+	event.SqrtPriceX96 = actual.SqrtPriceX96.Sub(decimal.NewFromInt(1e15))
+	event.Amount0 = decimal.NewFromInt(1e18)
+	event.Amount1 = ONE.Neg()
+	event.Liquidity = actual.Liquidity.Add(ONE)
+	assert.ErrorIs(t, actual.ApplySwapEvent(&event), ErrSwapLiquidityMismatch)
+	assertPoolStateEqual(t, expected, actual)
+
+	// 输入不够移动价格
+	event.Liquidity = actual.Liquidity
+	event.Amount0 = ONE
+	assert.ErrorIs(t, actual.ApplySwapEvent(&event), ErrSwapEventMismatch)
+	// 两个方向都为正
+	event.SqrtPriceX96 = actual.SqrtPriceX96
+	event.Amount0, event.Amount1 = ONE, ONE
+	assert.ErrorIs(t, actual.ApplySwapEvent(&event), ErrSwapEventMismatch)
+	assertPoolStateEqual(t, expected, actual)
+}
+
+func TestCorePool_ApplySwapEventExtraInput(t *testing.T) {
+	pool, swaps, events := testSwapSequence(t, 20)
+	expected := pool.Clone()
+	for i, swap := range swaps[:len(swaps)-1] {
+		_, _, _, err := expected.HandleSwap(swap.zeroForOne, swap.amountSpecified, swap.sqrtPriceLimitX96, false)
+		assert.NoError(t, err)
+		assert.NoError(t, pool.ApplySwapEvent(events[i]))
+	}
+
+	// 输入比合约计算的多, 无法反推输入, 多出的部分作为手续费
+	event := *events[len(events)-1]
+	swap := swaps[len(swaps)-1]
+	extra := decimal.NewFromInt(1e9)
+	if swap.zeroForOne {
+		event.Amount0 = event.Amount0.Add(extra)
+	} else {
+		event.Amount1 = event.Amount1.Add(extra)
+	}
+	_, _, err := pool.ResolveInputFromSwapResultEvent(&event)
+	assert.ErrorIs(t, err, ErrSwapUnresolvable)
+
+	_, _, _, err = expected.HandleSwap(swap.zeroForOne, swap.amountSpecified, swap.sqrtPriceLimitX96, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pool.ApplySwapEvent(&event))
+	assert.Equal(t, expected.SqrtPriceX96.String(), pool.SqrtPriceX96.String())
+	assert.Equal(t, expected.TickCurrent, pool.TickCurrent)
+	assert.Equal(t, expected.Liquidity.String(), pool.Liquidity.String())
+	if swap.zeroForOne {
+		assert.True(t, pool.FeeGrowthGlobal0X128.GreaterThan(expected.FeeGrowthGlobal0X128))
+		assert.True(t, pool.ProtocolFeesToken0.GreaterThan(expected.ProtocolFeesToken0))
+	} else {
+		assert.True(t, pool.FeeGrowthGlobal1X128.GreaterThan(expected.FeeGrowthGlobal1X128))
+		assert.True(t, pool.ProtocolFeesToken1.GreaterThan(expected.ProtocolFeesToken1))
+	}
+}
+
+func TestSimulator_SwapMode(t *testing.T) {
+	mode, err := ParseSwapMode("event")
+	assert.NoError(t, err)
+	assert.Equal(t, SwapModeEvent, mode)
+	_, err = ParseSwapMode("guess")
+	assert.Error(t, err)
+
+	// 价格不变, 输入全部作为手续费, 反推不出输入
+	logs := []types.Log{testPoolCreatedLog(100), testInitializeLog(101), testMintLog(102, -600, 600, 1000000), testSwapLog(103, 5, 0, 1000000)}
+	pm := openTestSimulator(t, filepath.Join(t.TempDir(), "simulator.db"), nil)
+	assert.Equal(t, SwapModeResolve, pm.SwapMode())
+	assert.NoError(t, pm.HandleLogs(logs))
+	assert.True(t, pm.IsQuarantined(testPool))
+
+	pm = openTestSimulator(t, filepath.Join(t.TempDir(), "simulator.db"), nil)
+	pm.SetSwapMode(SwapModeResolveOrEvent)
+	assert.NoError(t, pm.HandleLogs(logs))
+	assert.False(t, pm.IsQuarantined(testPool))
+	pool := pm.Pools[testPool]
+	feeGrowth := new(big.Int).Div(new(big.Int).Lsh(big.NewInt(5), 128), big.NewInt(1000000))
+	assert.Equal(t, feeGrowth.String(), pool.FeeGrowthGlobal0X128.String())
+	assert.Equal(t, uint64(103), pool.CurrentBlockNum)
+
+	// fork 使用 simulator 的 mode
+	fork := NewSimulatorSnapshot(pm)
+	assert.NoError(t, fork.HandleLogs([]types.Log{testSwapLog(104, 5, 0, 1000000)}))
+	assert.Equal(t, new(big.Int).Mul(feeGrowth, big.NewInt(2)).String(), fork.Pools[testPool].FeeGrowthGlobal0X128.String())
+
+	// liquidity 与 event 不同时按 ErrorPolicy 处理
+	pm.SetSwapMode(SwapModeEvent)
+	assert.NoError(t, pm.HandleLogs([]types.Log{testSwapLog(105, 5, 0, 999)}))
+	assert.True(t, pm.IsQuarantined(testPool))
+	assert.Equal(t, QuarantineExecutionFailed, pm.QuarantinedPools()[0].Reason)
+}
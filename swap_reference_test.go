@@ -0,0 +1,543 @@
+package uniswap_v3_simulator
+
+import (
+	"encoding/json"
+	"math/big"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/daoleno/uniswapv3-sdk/constants"
+	"github.com/daoleno/uniswapv3-sdk/utils"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/holiman/uint256"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+// 之前基于 decimal 和 SDK big.Int 的 HandleSwap, 作为 256 位整数实现的对照和 benchmark 的基准
+type referenceSwapState struct {
+	amountSpecifiedRemaining decimal.Decimal
+	amountCalculated         decimal.Decimal
+	sqrtPriceX96             decimal.Decimal
+	tick                     int
+	liquidity                decimal.Decimal
+	feeGrowthGlobalX128      decimal.Decimal
+	protocolFee              decimal.Decimal
+}
+type referenceStepComputations struct {
+	sqrtPriceStartX96 decimal.Decimal
+	tickNext          int
+	initialized       bool
+	sqrtPriceNextX96  decimal.Decimal
+	amountIn          decimal.Decimal
+	amountOut         decimal.Decimal
+	feeAmount         decimal.Decimal
+}
+
+func (p *CorePool) handleSwapReference(zeroForOne bool, amountSpecified decimal.Decimal, optionalSqrtPriceLimitX96 *decimal.Decimal, isStatic bool) (decimal.Decimal, decimal.Decimal, decimal.Decimal, error) {
+	var sqrtPriceLimitX96 decimal.Decimal
+	if optionalSqrtPriceLimitX96 == nil {
+		if zeroForOne {
+			sqrtPriceLimitX96 = MIN_SQRT_RATIO.Add(ONE)
+		} else {
+			sqrtPriceLimitX96 = MAX_SQRT_RATIO.Sub(ONE)
+		}
+	} else {
+		sqrtPriceLimitX96 = *optionalSqrtPriceLimitX96
+	}
+
+	if zeroForOne {
+		if !sqrtPriceLimitX96.GreaterThan(MIN_SQRT_RATIO) {
+			return ZERO, ZERO, ZERO, ErrRatioMin
+		}
+		if !sqrtPriceLimitX96.LessThan(p.SqrtPriceX96) {
+			return ZERO, ZERO, ZERO, ErrRatioCurrent
+		}
+	} else {
+		if !sqrtPriceLimitX96.LessThan(MAX_SQRT_RATIO) {
+			return ZERO, ZERO, ZERO, ErrRatioMax
+		}
+		if !sqrtPriceLimitX96.GreaterThan(p.SqrtPriceX96) {
+			return ZERO, ZERO, ZERO, ErrRatioCurrent
+		}
+	}
+
+	exactInput := amountSpecified.GreaterThanOrEqual(ZERO)
+	liquidityStart := p.Liquidity
+	tickStart := p.TickCurrent
+	// 第一次穿过已初始化的 tick 时才计算最新的 observation
+	computedLatestObservation := false
+	var tickCumulative int64
+	secondsPerLiquidityCumulativeX128 := ZERO
+	state := referenceSwapState{
+		amountSpecifiedRemaining: amountSpecified,
+		amountCalculated:         ZERO,
+		sqrtPriceX96:             p.SqrtPriceX96,
+		tick:                     p.TickCurrent,
+		liquidity:                p.Liquidity,
+		protocolFee:              ZERO,
+	}
+
+	var feeProtocol uint8
+	if zeroForOne {
+		state.feeGrowthGlobalX128 = p.FeeGrowthGlobal0X128
+		feeProtocol = p.FeeProtocol0()
+	} else {
+		state.feeGrowthGlobalX128 = p.FeeGrowthGlobal1X128
+		feeProtocol = p.FeeProtocol1()
+	}
+	// 达到限价或者兑换完成
+	for !(state.amountSpecifiedRemaining.Equal(ZERO) || state.sqrtPriceX96.Equal(sqrtPriceLimitX96)) {
+		step := referenceStepComputations{
+			sqrtPriceStartX96: ZERO, tickNext: 0, initialized: false, sqrtPriceNextX96: ZERO, amountIn: ZERO, amountOut: ZERO, feeAmount: ZERO}
+		step.sqrtPriceStartX96 = state.sqrtPriceX96
+		tickNext, initialized, err := p.TickManager.GetNextInitializedTick(state.tick, p.TickSpacing, zeroForOne)
+		if err != nil {
+			return ZERO, ZERO, ZERO, err
+		}
+
+		step.tickNext = tickNext
+		step.initialized = initialized
+		if step.tickNext < MIN_TICK {
+			step.tickNext = MIN_TICK
+		} else if step.tickNext > MAX_TICK {
+			step.tickNext = MAX_TICK
+		}
+		sqrtPriceNextX96bi, err := utils.GetSqrtRatioAtTick(step.tickNext)
+		if err != nil {
+			return ZERO, ZERO, ZERO, err
+		}
+		step.sqrtPriceNextX96 = decimal.NewFromBigInt(sqrtPriceNextX96bi, 0)
+		var sqrtRatioTargetX96 decimal.Decimal
+		if zeroForOne {
+			if step.sqrtPriceNextX96.LessThan(sqrtPriceLimitX96) {
+				sqrtRatioTargetX96 = sqrtPriceLimitX96
+			} else {
+				sqrtRatioTargetX96 = step.sqrtPriceNextX96
+			}
+		} else {
+			if step.sqrtPriceNextX96.GreaterThan(sqrtPriceLimitX96) {
+				sqrtRatioTargetX96 = sqrtPriceLimitX96
+			} else {
+				sqrtRatioTargetX96 = step.sqrtPriceNextX96
+			}
+		}
+		_sqrtPriceX96, _amountIn, _amountOut, _feeAmount, err := utils.ComputeSwapStep(state.sqrtPriceX96.BigInt(), sqrtRatioTargetX96.BigInt(), state.liquidity.BigInt(), state.amountSpecifiedRemaining.BigInt(), constants.FeeAmount(p.Fee))
+		if err != nil {
+			return ZERO, ZERO, ZERO, err
+		}
+
+		state.sqrtPriceX96 = decimal.NewFromBigInt(_sqrtPriceX96, 0)
+		step.amountIn = decimal.NewFromBigInt(_amountIn, 0)
+		step.amountOut = decimal.NewFromBigInt(_amountOut, 0)
+		step.feeAmount = decimal.NewFromBigInt(_feeAmount, 0)
+
+		if exactInput {
+			state.amountSpecifiedRemaining = state.amountSpecifiedRemaining.Sub(step.amountIn.Add(step.feeAmount))
+			state.amountCalculated = state.amountCalculated.Sub(step.amountOut)
+		} else {
+			state.amountSpecifiedRemaining = state.amountSpecifiedRemaining.Add(step.amountOut)
+			state.amountCalculated = state.amountCalculated.Add(step.amountIn.Add(step.feeAmount))
+		}
+		if feeProtocol > 0 {
+			delta := protocolFeeOf(step.feeAmount, feeProtocol)
+			step.feeAmount = step.feeAmount.Sub(delta)
+			state.protocolFee = AddUint128(state.protocolFee, delta)
+		}
+		if state.liquidity.IsPositive() {
+			state.feeGrowthGlobalX128 = AddUint256(state.feeGrowthGlobalX128, step.feeAmount.Mul(Q128).Div(state.liquidity).RoundDown(0))
+		}
+		if state.sqrtPriceX96.Equal(step.sqrtPriceNextX96) {
+			if step.initialized {
+				nextTick, err := p.TickManager.GetTickAndInitIfAbsent(step.tickNext)
+				if err != nil {
+					return ZERO, ZERO, ZERO, err
+				}
+				var liquidityNet decimal.Decimal
+				if isStatic {
+					liquidityNet = nextTick.LiquidityNet
+				} else {
+					if !computedLatestObservation {
+						tickCumulative, secondsPerLiquidityCumulativeX128, err = p.ensureOracle().ObserveSingle(p.blockTimestamp(), 0, tickStart, p.ObservationIndex, liquidityStart, p.ObservationCardinality)
+						if err != nil {
+							return ZERO, ZERO, ZERO, err
+						}
+						computedLatestObservation = true
+					}
+					if zeroForOne {
+						liquidityNet = nextTick.Cross(state.feeGrowthGlobalX128, p.FeeGrowthGlobal1X128, secondsPerLiquidityCumulativeX128, tickCumulative, p.blockTimestamp())
+					} else {
+						liquidityNet = nextTick.Cross(p.FeeGrowthGlobal0X128, state.feeGrowthGlobalX128, secondsPerLiquidityCumulativeX128, tickCumulative, p.blockTimestamp())
+					}
+				}
+				if zeroForOne {
+					liquidityNet = liquidityNet.Neg()
+				}
+				state.liquidity, err = AddDelta(state.liquidity, liquidityNet)
+				if err != nil {
+					return ZERO, ZERO, ZERO, err
+				}
+
+			}
+			if zeroForOne {
+				state.tick = step.tickNext - 1
+			} else {
+				state.tick = step.tickNext
+			}
+		} else if !state.sqrtPriceX96.Equal(step.sqrtPriceStartX96) {
+			state.tick, err = GetTickAtSqrtRatio(state.sqrtPriceX96)
+			if err != nil {
+				return ZERO, ZERO, ZERO, err
+			}
+		}
+	}
+	if !isStatic {
+		p.SqrtPriceX96 = state.sqrtPriceX96
+		if state.tick != p.TickCurrent {
+			p.ObservationIndex, p.ObservationCardinality = p.ensureOracle().Write(p.ObservationIndex, p.blockTimestamp(), tickStart, liquidityStart, p.ObservationCardinality, p.ObservationCardinalityNext)
+			p.TickCurrent = state.tick
+		}
+		if !state.liquidity.Equal(p.Liquidity) {
+			p.Liquidity = state.liquidity
+		}
+		if zeroForOne {
+			p.FeeGrowthGlobal0X128 = state.feeGrowthGlobalX128
+			p.ProtocolFeesToken0 = AddUint128(p.ProtocolFeesToken0, state.protocolFee)
+		} else {
+			p.FeeGrowthGlobal1X128 = state.feeGrowthGlobalX128
+			p.ProtocolFeesToken1 = AddUint128(p.ProtocolFeesToken1, state.protocolFee)
+		}
+	}
+	var amount0, amount1 decimal.Decimal
+	if zeroForOne == exactInput {
+		amount0 = amountSpecified.Sub(state.amountSpecifiedRemaining)
+		amount1 = state.amountCalculated
+	} else {
+		amount0 = state.amountCalculated
+		amount1 = amountSpecified.Sub(state.amountSpecifiedRemaining)
+	}
+	return amount0, amount1, state.sqrtPriceX96, nil
+}
+
+type testSwap struct {
+	zeroForOne        bool
+	amountSpecified   decimal.Decimal
+	sqrtPriceLimitX96 *decimal.Decimal
+}
+
+// 固定种子生成的 pool 和 swap 序列. 在 decimal 实现上依次执行, 记录成功的 swap 对应的 event
+func testSwapSequence(t testing.TB, n int) (*CorePool, []testSwap, []*UniV3SwapEvent) {
+	rnd := rand.New(rand.NewSource(1))
+	pool := NewCorePoolFromConfig(testPool.String(), *NewPoolConfig(60, common.Address{}, common.Address{}, FeeAmount(3000)))
+	assert.NoError(t, pool.Initialize(decimal.NewFromBigInt(utils.EncodeSqrtRatioX96(big.NewInt(1), big.NewInt(1)), 0)))
+	assert.NoError(t, pool.SetFeeProtocol(4, 5))
+	for i := 0; i < 40; i++ {
+		lower := (rnd.Intn(200) - 100) * 60
+		upper := lower + (rnd.Intn(100)+1)*60
+		_, _, err := pool.Mint(testOwner.String(), lower, upper, decimal.NewFromInt(rnd.Int63n(1e18)+1e15))
+		assert.NoError(t, err)
+	}
+
+	recorded := pool.Clone()
+	var swaps []testSwap
+	var events []*UniV3SwapEvent
+	for len(swaps) < n {
+		swap := testSwap{zeroForOne: rnd.Intn(2) == 0, amountSpecified: decimal.NewFromInt(rnd.Int63n(1e17) + 1)}
+		if rnd.Intn(2) == 0 {
+			swap.amountSpecified = swap.amountSpecified.Neg()
+		}
+		if rnd.Intn(4) == 0 {
+			offset := (rnd.Intn(20) + 1) * 60
+			if swap.zeroForOne {
+				offset = -offset
+			}
+			limit, err := GetSqrtRatioAtTick(recorded.TickCurrent + offset)
+			assert.NoError(t, err)
+			swap.sqrtPriceLimitX96 = &limit
+		}
+		amount0, amount1, sqrtPriceX96, err := recorded.handleSwapReference(swap.zeroForOne, swap.amountSpecified, swap.sqrtPriceLimitX96, false)
+		if err != nil {
+			continue
+		}
+		swaps = append(swaps, swap)
+		events = append(events, &UniV3SwapEvent{
+			RawEvent:     &types.Log{Address: testPool},
+			Amount0:      amount0,
+			Amount1:      amount1,
+			SqrtPriceX96: sqrtPriceX96,
+			Liquidity:    recorded.Liquidity,
+		})
+	}
+	return pool, swaps, events
+}
+
+func assertSwapStateEqual(t *testing.T, expected, actual *CorePool) {
+	assert.Equal(t, expected.SqrtPriceX96.String(), actual.SqrtPriceX96.String())
+	assert.Equal(t, expected.TickCurrent, actual.TickCurrent)
+	assert.Equal(t, expected.Liquidity.String(), actual.Liquidity.String())
+	assert.Equal(t, expected.FeeGrowthGlobal0X128.String(), actual.FeeGrowthGlobal0X128.String())
+	assert.Equal(t, expected.FeeGrowthGlobal1X128.String(), actual.FeeGrowthGlobal1X128.String())
+	assert.Equal(t, expected.ProtocolFeesToken0.String(), actual.ProtocolFeesToken0.String())
+	assert.Equal(t, expected.ProtocolFeesToken1.String(), actual.ProtocolFeesToken1.String())
+	assert.Equal(t, expected.ObservationIndex, actual.ObservationIndex)
+}
+
+func TestCorePool_HandleSwapMatchesReference(t *testing.T) {
+	pool, swaps, _ := testSwapSequence(t, 200)
+	expected, actual := pool.Clone(), pool.Clone()
+	crossed := 0
+	for _, swap := range swaps {
+		// static 的 dry run 不修改状态
+		amount0, amount1, sqrtPriceX96, err := actual.HandleSwap(swap.zeroForOne, swap.amountSpecified, swap.sqrtPriceLimitX96, true)
+		assert.NoError(t, err)
+
+		tickBefore := expected.TickCurrent
+		expected0, expected1, expectedPrice, err := expected.handleSwapReference(swap.zeroForOne, swap.amountSpecified, swap.sqrtPriceLimitX96, false)
+		assert.NoError(t, err)
+		assert.Equal(t, expected0.String(), amount0.String())
+		assert.Equal(t, expected1.String(), amount1.String())
+		assert.Equal(t, expectedPrice.String(), sqrtPriceX96.String())
+
+		amount0, amount1, sqrtPriceX96, err = actual.HandleSwap(swap.zeroForOne, swap.amountSpecified, swap.sqrtPriceLimitX96, false)
+		assert.NoError(t, err)
+		assert.Equal(t, expected0.String(), amount0.String())
+		assert.Equal(t, expected1.String(), amount1.String())
+		assert.Equal(t, expectedPrice.String(), sqrtPriceX96.String())
+		assertSwapStateEqual(t, expected, actual)
+		if expected.TickCurrent/60 != tickBefore/60 {
+			crossed++
+		}
+	}
+	assertPoolStateEqual(t, expected, actual)
+	// 序列需要覆盖穿过 tick 的情况
+	assert.Greater(t, crossed, len(swaps)/2)
+
+	// 与合约相同的限价检查
+	_, _, _, err := actual.HandleSwap(true, ONE, &MIN_SQRT_RATIO, true)
+	assert.ErrorIs(t, err, ErrRatioMin)
+	_, _, _, err = actual.HandleSwap(false, ONE, &MAX_SQRT_RATIO, true)
+	assert.ErrorIs(t, err, ErrRatioMax)
+	_, _, _, err = actual.HandleSwap(true, ONE, &actual.SqrtPriceX96, true)
+	assert.ErrorIs(t, err, ErrRatioCurrent)
+	negative := ONE.Neg()
+	_, _, _, err = actual.HandleSwap(false, ONE, &negative, true)
+	assert.ErrorIs(t, err, ErrRatioCurrent)
+}
+
+func TestCorePool_ResolveInputFromSwapResultEvent(t *testing.T) {
+	pool, _, events := testSwapSequence(t, 100)
+	for i, event := range events {
+		amountSpecified, sqrtPriceLimitX96, err := pool.ResolveInputFromSwapResultEvent(event)
+		if !assert.NoError(t, err, "swap %d", i) {
+			return
+		}
+		_, _, _, err = pool.HandleSwap(event.Amount0.IsPositive(), amountSpecified, sqrtPriceLimitX96, false)
+		assert.NoError(t, err)
+		assert.Equal(t, event.SqrtPriceX96.String(), pool.SqrtPriceX96.String())
+		assert.Equal(t, event.Liquidity.String(), pool.Liquidity.String())
+	}
+}
+
+type swapFunc func(p *CorePool, zeroForOne bool, amountSpecified decimal.Decimal, sqrtPriceLimitX96 *decimal.Decimal, isStatic bool) (decimal.Decimal, decimal.Decimal, decimal.Decimal, error)
+
+// go test -run ^$ -bench Swap -benchmem
+// 对比 256 位整数和之前 decimal 实现回放同一个 swap 序列的耗时
+func benchmarkSwapSequence(b *testing.B, isStatic bool, handleSwap swapFunc) {
+	pool, swaps, _ := testSwapSequence(b, 200)
+	runSwapSequence(b, pool, swaps, isStatic, handleSwap)
+}
+
+func runSwapSequence(b *testing.B, pool *CorePool, swaps []testSwap, isStatic bool, handleSwap swapFunc) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		p := pool.Clone()
+		b.StartTimer()
+		for _, swap := range swaps {
+			if _, _, _, err := handleSwap(p, swap.zeroForOne, swap.amountSpecified, swap.sqrtPriceLimitX96, isStatic); err != nil && !isStatic {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkHandleSwap(b *testing.B) {
+	benchmarkSwapSequence(b, false, (*CorePool).HandleSwap)
+}
+
+func BenchmarkHandleSwapReference(b *testing.B) {
+	benchmarkSwapSequence(b, false, (*CorePool).handleSwapReference)
+}
+
+// ResolveInputFromSwapResultEvent 的 dry run
+func BenchmarkHandleSwapStatic(b *testing.B) {
+	benchmarkSwapSequence(b, true, (*CorePool).HandleSwap)
+}
+
+func BenchmarkHandleSwapStaticReference(b *testing.B) {
+	benchmarkSwapSequence(b, true, (*CorePool).handleSwapReference)
+}
+
+func BenchmarkResolveInputFromSwapResultEvent(b *testing.B) {
+	pool, _, events := testSwapSequence(b, 200)
+	runResolveSequence(b, pool, events)
+}
+
+func runResolveSequence(b *testing.B, pool *CorePool, events []*UniV3SwapEvent) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		p := pool.Clone()
+		b.StartTimer()
+		for _, event := range events {
+			amountSpecified, sqrtPriceLimitX96, err := p.ResolveInputFromSwapResultEvent(event)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, _, _, err = p.HandleSwap(event.Amount0.IsPositive(), amountSpecified, sqrtPriceLimitX96, false); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkComputeSwapStep(b *testing.B) {
+	var sqrtRatioNextX96, amountIn, amountOut, feeAmount uint256.Int
+	current := uint256.MustFromBig(utils.EncodeSqrtRatioX96(big.NewInt(1), big.NewInt(1)))
+	target := uint256.MustFromBig(utils.EncodeSqrtRatioX96(big.NewInt(101), big.NewInt(100)))
+	liquidity := uint256.NewInt(2e18)
+	amount := uint256.NewInt(1e18)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := u256ComputeSwapStep(&sqrtRatioNextX96, &amountIn, &amountOut, &feeAmount, current, target, liquidity, amount, 600); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkComputeSwapStepReference(b *testing.B) {
+	current := utils.EncodeSqrtRatioX96(big.NewInt(1), big.NewInt(1))
+	target := utils.EncodeSqrtRatioX96(big.NewInt(101), big.NewInt(100))
+	liquidity := big.NewInt(2e18)
+	amount := big.NewInt(1e18)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, _, err := utils.ComputeSwapStep(current, target, liquidity, amount, constants.FeeAmount(600)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// 主网 pool 在 BlockNum 的状态和之后的 Swap logs, 状态为 ExportPools 的格式,
+// 由 go run ./main/record -rpc url swaps pool,fromBlock,toBlock 记录
+const (
+	mainnetSwapPoolFile = "testdata/mainnet_swaps.export"
+	mainnetSwapLogsFile = "testdata/mainnet_swaps.json"
+)
+
+// 读取记录的 pool 和 Swap logs, 从 event 反推每个 swap 的输入. 没有记录时返回 nil
+func loadMainnetSwapFixture(t testing.TB) (*CorePool, []testSwap, []*UniV3SwapEvent) {
+	f, err := os.Open(mainnetSwapPoolFile)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer f.Close()
+	export, err := ImportPools(f)
+	if !assert.NoError(t, err) || !assert.Len(t, export.Pools, 1) {
+		t.FailNow()
+	}
+	bs, err := os.ReadFile(mainnetSwapLogsFile)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var logs []types.Log
+	if !assert.NoError(t, json.Unmarshal(bs, &logs)) {
+		t.FailNow()
+	}
+
+	pool := export.Pools[0]
+	resolved := pool.Clone()
+	swaps := make([]testSwap, 0, len(logs))
+	events := make([]*UniV3SwapEvent, 0, len(logs))
+	for i := range logs {
+		event, err := parseUniv3SwapEvent(&logs[i])
+		if !assert.NoError(t, err, "swap %d", i) {
+			t.FailNow()
+		}
+		amountSpecified, sqrtPriceLimitX96, err := resolved.ResolveInputFromSwapResultEvent(event)
+		if !assert.NoError(t, err, "swap %d in %s", i, logs[i].TxHash) {
+			t.FailNow()
+		}
+		swap := testSwap{zeroForOne: event.Amount0.IsPositive(), amountSpecified: amountSpecified, sqrtPriceLimitX96: sqrtPriceLimitX96}
+		if _, _, _, err = resolved.HandleSwap(swap.zeroForOne, swap.amountSpecified, swap.sqrtPriceLimitX96, false); !assert.NoError(t, err, "swap %d", i) {
+			t.FailNow()
+		}
+		swaps = append(swaps, swap)
+		events = append(events, event)
+	}
+	return pool, swaps, events
+}
+
+// 主网的 swap 序列在 256 位整数和 decimal 实现上结果相同, 每个 swap 之后的价格和 liquidity 与 event 相同
+func TestMainnetSwapFixture(t *testing.T) {
+	pool, swaps, events := loadMainnetSwapFixture(t)
+	if pool == nil {
+		t.Skipf("%s not recorded", mainnetSwapPoolFile)
+	}
+	expected, actual := pool.Clone(), pool.Clone()
+	for i, swap := range swaps {
+		amount0, amount1, sqrtPriceX96, err := actual.HandleSwap(swap.zeroForOne, swap.amountSpecified, swap.sqrtPriceLimitX96, false)
+		assert.NoError(t, err, "swap %d", i)
+		expected0, expected1, expectedPrice, err := expected.handleSwapReference(swap.zeroForOne, swap.amountSpecified, swap.sqrtPriceLimitX96, false)
+		assert.NoError(t, err, "swap %d", i)
+		assert.Equal(t, events[i].Amount0.String(), amount0.String(), "swap %d", i)
+		assert.Equal(t, events[i].Amount1.String(), amount1.String(), "swap %d", i)
+		assert.Equal(t, events[i].SqrtPriceX96.String(), sqrtPriceX96.String(), "swap %d", i)
+		assert.Equal(t, events[i].Liquidity.String(), actual.Liquidity.String(), "swap %d", i)
+		assert.Equal(t, expected0.String(), amount0.String(), "swap %d", i)
+		assert.Equal(t, expected1.String(), amount1.String(), "swap %d", i)
+		assert.Equal(t, expectedPrice.String(), sqrtPriceX96.String(), "swap %d", i)
+		assertSwapStateEqual(t, expected, actual)
+	}
+}
+
+// go test -run ^$ -bench Mainnet -benchmem
+// 与 BenchmarkHandleSwap 相同, 使用记录的主网 swap 序列
+func benchmarkMainnetSwaps(b *testing.B, isStatic bool, handleSwap swapFunc) {
+	pool, swaps, _ := loadMainnetSwapFixture(b)
+	if pool == nil {
+		b.Skipf("%s not recorded", mainnetSwapPoolFile)
+	}
+	runSwapSequence(b, pool, swaps, isStatic, handleSwap)
+}
+
+func BenchmarkHandleSwapMainnet(b *testing.B) {
+	benchmarkMainnetSwaps(b, false, (*CorePool).HandleSwap)
+}
+
+func BenchmarkHandleSwapMainnetReference(b *testing.B) {
+	benchmarkMainnetSwaps(b, false, (*CorePool).handleSwapReference)
+}
+
+func BenchmarkHandleSwapStaticMainnet(b *testing.B) {
+	benchmarkMainnetSwaps(b, true, (*CorePool).HandleSwap)
+}
+
+func BenchmarkHandleSwapStaticMainnetReference(b *testing.B) {
+	benchmarkMainnetSwaps(b, true, (*CorePool).handleSwapReference)
+}
+
+func BenchmarkResolveInputFromSwapResultEventMainnet(b *testing.B) {
+	pool, _, events := loadMainnetSwapFixture(b)
+	if pool == nil {
+		b.Skipf("%s not recorded", mainnetSwapPoolFile)
+	}
+	runResolveSequence(b, pool, events)
+}
@@ -0,0 +1,113 @@
+package uniswap_v3_simulator
+
+import (
+	"errors"
+	"math/bits"
+
+	"github.com/holiman/uint256"
+)
+
+var ErrTickNotSpaced = errors.New("tick not a multiple of tickSpacing")
+
+// TickBitmap 与合约的 TickBitmap 相同, 以压缩后的 tick (tick / tickSpacing) 为下标,
+// 每个 word 记录 256 个 tick 是否初始化, word 的下标为 int16
+type TickBitmap struct {
+	words map[int16]*uint256.Int
+}
+
+func NewTickBitmap() *TickBitmap {
+	return &TickBitmap{words: map[int16]*uint256.Int{}}
+}
+
+func (tb *TickBitmap) Clone() *TickBitmap {
+	words := make(map[int16]*uint256.Int, len(tb.words))
+	for wordPos, word := range tb.words {
+		words[wordPos] = word.Clone()
+	}
+	return &TickBitmap{words: words}
+}
+
+// 压缩后的 tick 在 bitmap 中的位置
+func tickPosition(tick int) (int16, uint) {
+	return int16(tick >> 8), uint(tick & 0xff)
+}
+
+// 压缩, 向负无穷取整
+func compressTick(tick, tickSpacing int) int {
+	compressed := tick / tickSpacing
+	if tick < 0 && tick%tickSpacing != 0 {
+		compressed--
+	}
+	return compressed
+}
+
+// FlipTick 切换 tick 的初始化状态
+func (tb *TickBitmap) FlipTick(tick, tickSpacing int) error {
+	if tick%tickSpacing != 0 {
+		return ErrTickNotSpaced
+	}
+	wordPos, bitPos := tickPosition(tick / tickSpacing)
+	word, ok := tb.words[wordPos]
+	if !ok {
+		word = new(uint256.Int)
+		tb.words[wordPos] = word
+	}
+	var mask uint256.Int
+	mask.Lsh(u256One, bitPos)
+	word.Xor(word, &mask)
+	if word.IsZero() {
+		delete(tb.words, wordPos)
+	}
+	return nil
+}
+
+// IsInitialized tick 是否已经初始化
+func (tb *TickBitmap) IsInitialized(tick, tickSpacing int) bool {
+	if tick%tickSpacing != 0 {
+		return false
+	}
+	wordPos, bitPos := tickPosition(tick / tickSpacing)
+	word, ok := tb.words[wordPos]
+	if !ok {
+		return false
+	}
+	return word[bitPos/64]&(1<<(bitPos%64)) != 0
+}
+
+// NextInitializedTickWithinOneWord 在 tick 所在的 word 中查找下一个初始化的 tick, lte 为 true 时向左查找 (包括 tick 本身).
+// 没有找到时返回 word 的边界和 false, 与合约相同
+func (tb *TickBitmap) NextInitializedTickWithinOneWord(tick, tickSpacing int, lte bool) (int, bool) {
+	compressed := compressTick(tick, tickSpacing)
+	var masked uint256.Int
+	if lte {
+		wordPos, bitPos := tickPosition(compressed)
+		// bitPos 及右边的所有位
+		if word, ok := tb.words[wordPos]; ok {
+			masked.Lsh(word, 255-bitPos)
+		}
+		if masked.IsZero() {
+			return (compressed - int(bitPos)) * tickSpacing, false
+		}
+		msb := masked.BitLen() - 1 - int(255-bitPos)
+		return (compressed - (int(bitPos) - msb)) * tickSpacing, true
+	}
+
+	wordPos, bitPos := tickPosition(compressed + 1)
+	// bitPos 及左边的所有位
+	if word, ok := tb.words[wordPos]; ok {
+		masked.Rsh(word, bitPos)
+	}
+	if masked.IsZero() {
+		return (compressed + 1 + int(255-bitPos)) * tickSpacing, false
+	}
+	return (compressed + 1 + trailingZeros256(&masked)) * tickSpacing, true
+}
+
+func trailingZeros256(x *uint256.Int) int {
+	for i, w := range x {
+		if w != 0 {
+			return i*64 + bits.TrailingZeros64(w)
+		}
+	}
+	return 256
+}
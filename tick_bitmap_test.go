@@ -0,0 +1,162 @@
+package uniswap_v3_simulator
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+// 用例来自 https://github.com/Uniswap/v3-core/blob/main/test/TickBitmap.spec.ts
+func testTickBitmap(t *testing.T) *TickBitmap {
+	tb := NewTickBitmap()
+	for _, tick := range []int{-200, -55, -4, 70, 78, 84, 139, 240, 535} {
+		assert.NoError(t, tb.FlipTick(tick, 1))
+	}
+	return tb
+}
+
+func TestTickBitmap_FlipTick(t *testing.T) {
+	tb := NewTickBitmap()
+	assert.NoError(t, tb.FlipTick(-230, 1))
+	assert.True(t, tb.IsInitialized(-230, 1))
+	assert.False(t, tb.IsInitialized(-231, 1))
+	assert.False(t, tb.IsInitialized(-229, 1))
+	assert.False(t, tb.IsInitialized(-230+256, 1))
+	assert.False(t, tb.IsInitialized(-230-256, 1))
+	assert.NoError(t, tb.FlipTick(-230, 1))
+	assert.False(t, tb.IsInitialized(-230, 1))
+	assert.Empty(t, tb.words)
+
+	assert.ErrorIs(t, tb.FlipTick(61, 60), ErrTickNotSpaced)
+}
+
+func TestTickBitmap_NextInitializedTickWithinOneWord(t *testing.T) {
+	tb := testTickBitmap(t)
+	for _, c := range []struct {
+		tick        int
+		lte         bool
+		next        int
+		initialized bool
+	}{
+		{78, false, 84, true},
+		{-55, false, -4, true},
+		{77, false, 78, true},
+		{-56, false, -55, true},
+		{255, false, 511, false},
+		{-257, false, -200, true},
+		{508, false, 511, false},
+		{383, false, 511, false},
+		{78, true, 78, true},
+		{79, true, 78, true},
+		{258, true, 256, false},
+		{256, true, 256, false},
+		{72, true, 70, true},
+		{-257, true, -512, false},
+		{1023, true, 768, false},
+		{900, true, 768, false},
+	} {
+		next, initialized := tb.NextInitializedTickWithinOneWord(c.tick, 1, c.lte)
+		assert.Equal(t, c.next, next, "tick %d lte %v", c.tick, c.lte)
+		assert.Equal(t, c.initialized, initialized, "tick %d lte %v", c.tick, c.lte)
+	}
+
+	assert.NoError(t, tb.FlipTick(340, 1))
+	next, initialized := tb.NextInitializedTickWithinOneWord(328, 1, false)
+	assert.Equal(t, 340, next)
+	assert.True(t, initialized)
+	assert.NoError(t, tb.FlipTick(340, 1))
+	assert.NoError(t, tb.FlipTick(329, 1))
+	next, initialized = tb.NextInitializedTickWithinOneWord(456, 1, true)
+	assert.Equal(t, 329, next)
+	assert.True(t, initialized)
+}
+
+// 逐个检查 word 中的 tick, 作为 bitmap 查找的对照
+func nextInitializedTickBruteForce(ticks map[int]*Tick, tick, tickSpacing int, lte bool) (int, bool) {
+	compressed := compressTick(tick, tickSpacing)
+	if lte {
+		wordStart := compressed >> 8 << 8
+		for c := compressed; c >= wordStart; c-- {
+			if _, ok := ticks[c*tickSpacing]; ok {
+				return c * tickSpacing, true
+			}
+		}
+		return wordStart * tickSpacing, false
+	}
+	wordEnd := ((compressed+1)>>8<<8 + 255)
+	for c := compressed + 1; c <= wordEnd; c++ {
+		if _, ok := ticks[c*tickSpacing]; ok {
+			return c * tickSpacing, true
+		}
+	}
+	return wordEnd * tickSpacing, false
+}
+
+func TestTickManager_Bitmap(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	tm := NewTickManager()
+	// 第一次查找之前加入的 tick
+	for i := 0; i < 100; i++ {
+		_, err := tm.GetTickAndInitIfAbsent((rnd.Intn(4000) - 2000) * 60)
+		assert.NoError(t, err)
+	}
+	for i := 0; i < 2000; i++ {
+		switch rnd.Intn(3) {
+		case 0:
+			_, err := tm.GetTickAndInitIfAbsent((rnd.Intn(4000) - 2000) * 60)
+			assert.NoError(t, err)
+		case 1:
+			assert.NoError(t, tm.Clear((rnd.Intn(4000)-2000)*60))
+		}
+		tick := rnd.Intn(2*60*2100) - 60*2100
+		lte := rnd.Intn(2) == 0
+		next, initialized, err := tm.GetNextInitializedTick(tick, 60, lte)
+		assert.NoError(t, err)
+		expectedNext, expectedInitialized := nextInitializedTickBruteForce(tm.Ticks, tick, 60, lte)
+		assert.Equal(t, expectedNext, next, "tick %d lte %v", tick, lte)
+		assert.Equal(t, expectedInitialized, initialized, "tick %d lte %v", tick, lte)
+	}
+
+	// clone 之后互不影响
+	clone := tm.Clone()
+	for index := range tm.Ticks {
+		assert.NoError(t, tm.Clear(index))
+	}
+	next, initialized, err := tm.GetNextInitializedTick(0, 60, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, next)
+	assert.False(t, initialized)
+	for index := range clone.Ticks {
+		next, initialized, err = clone.GetNextInitializedTick(index, 60, true)
+		assert.NoError(t, err)
+		assert.Equal(t, index, next)
+		assert.True(t, initialized)
+	}
+
+	// tickSpacing 之外的 tick
+	_, err = clone.GetTickAndInitIfAbsent(61)
+	assert.ErrorIs(t, err, ErrTickNotSpaced)
+	assert.NotContains(t, clone.Ticks, 61)
+	clone.Ticks[61], err = NewTick(61)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, clone.Clear(61), ErrTickNotSpaced)
+	assert.Contains(t, clone.Ticks, 61)
+}
+
+// 没有 liquidity 的 pool 按 word 边界移动到限价, 与合约相同
+func TestCorePool_SwapWithoutTicks(t *testing.T) {
+	pool := newTestPool(t)
+	_, _, err := pool.Burn("0xowner", -600, 600, decimal.NewFromInt(1000000))
+	assert.NoError(t, err)
+	assert.Empty(t, pool.TickManager.Ticks)
+	limit, err := GetSqrtRatioAtTick(-60 * 600)
+	assert.NoError(t, err)
+	amount0, amount1, sqrtPriceX96, err := pool.HandleSwap(true, decimal.NewFromInt(1000), &limit, false)
+	assert.NoError(t, err)
+	assert.True(t, amount0.IsZero())
+	assert.True(t, amount1.IsZero())
+	assert.Equal(t, limit.String(), sqrtPriceX96.String())
+	assert.Equal(t, -60*600, pool.TickCurrent)
+}
@@ -6,39 +6,46 @@ import (
 	"errors"
 	"fmt"
 	"github.com/shopspring/decimal"
-	"math"
+	"math/big"
 	"sort"
 )
 
 type Tick struct {
-	TickIndex             int
-	LiquidityGross        decimal.Decimal
-	LiquidityNet          decimal.Decimal
-	FeeGrowthOutside0X128 decimal.Decimal
-	FeeGrowthOutside1X128 decimal.Decimal
+	TickIndex                      int
+	LiquidityGross                 decimal.Decimal
+	LiquidityNet                   decimal.Decimal
+	FeeGrowthOutside0X128          decimal.Decimal
+	FeeGrowthOutside1X128          decimal.Decimal
+	TickCumulativeOutside          int64
+	SecondsPerLiquidityOutsideX128 decimal.Decimal
+	SecondsOutside                 uint32
 }
 
 func NewTick(index int) (*Tick, error) {
-	if index > MAX_TICK || index < MIN_TICK {
-		return nil, errors.New("TICK")
+	if !isValidTick(index) {
+		return nil, ErrTickOutOfRange
 	} else {
 		return &Tick{
-			TickIndex:             index,
-			LiquidityGross:        ZERO,
-			LiquidityNet:          ZERO,
-			FeeGrowthOutside0X128: ZERO,
-			FeeGrowthOutside1X128: ZERO,
+			TickIndex:                      index,
+			LiquidityGross:                 ZERO,
+			LiquidityNet:                   ZERO,
+			FeeGrowthOutside0X128:          ZERO,
+			FeeGrowthOutside1X128:          ZERO,
+			SecondsPerLiquidityOutsideX128: ZERO,
 		}, nil
 	}
 }
 
 func (t *Tick) Clone() *Tick {
 	return &Tick{
-		TickIndex:             t.TickIndex,
-		LiquidityGross:        t.LiquidityGross,
-		LiquidityNet:          t.LiquidityNet,
-		FeeGrowthOutside0X128: t.FeeGrowthOutside0X128,
-		FeeGrowthOutside1X128: t.FeeGrowthOutside1X128,
+		TickIndex:                      t.TickIndex,
+		LiquidityGross:                 t.LiquidityGross,
+		LiquidityNet:                   t.LiquidityNet,
+		FeeGrowthOutside0X128:          t.FeeGrowthOutside0X128,
+		FeeGrowthOutside1X128:          t.FeeGrowthOutside1X128,
+		TickCumulativeOutside:          t.TickCumulativeOutside,
+		SecondsPerLiquidityOutsideX128: t.SecondsPerLiquidityOutsideX128,
+		SecondsOutside:                 t.SecondsOutside,
 	}
 }
 func (t *Tick) Initialized() bool {
@@ -50,6 +57,9 @@ func (t *Tick) Update(
 	tickCurrent int,
 	feeGrowthGlobal0X128 decimal.Decimal,
 	feeGrowthGlobal1X128 decimal.Decimal,
+	secondsPerLiquidityCumulativeX128 decimal.Decimal,
+	tickCumulative int64,
+	time uint32,
 	upper bool,
 	maxLiquidity decimal.Decimal,
 ) (bool, error) {
@@ -62,43 +72,56 @@ func (t *Tick) Update(
 		return false, err
 	}
 	if liquidityGrossAfter.GreaterThan(maxLiquidity) {
-		return false, errors.New("L0")
+		return false, ErrLiquidityOverflow
 	}
 	flipped := liquidityGrossAfter.IsZero() != liquidityGrossBefore.IsZero()
 
 	if liquidityGrossBefore.IsZero() {
+		// 按照惯例, 假设 tick 初始化之前的增长都发生在 tick 以下
 		if t.TickIndex <= tickCurrent {
 			t.FeeGrowthOutside0X128 = feeGrowthGlobal0X128
 			t.FeeGrowthOutside1X128 = feeGrowthGlobal1X128
+			t.SecondsPerLiquidityOutsideX128 = secondsPerLiquidityCumulativeX128
+			t.TickCumulativeOutside = tickCumulative
+			t.SecondsOutside = time
 		}
 	}
 	t.LiquidityGross = liquidityGrossAfter
+	var liquidityNet decimal.Decimal
 	if upper {
-		t.LiquidityNet = t.LiquidityNet.Sub(liquidityDelta)
+		liquidityNet, err = ToInt128(t.LiquidityNet.Sub(liquidityDelta))
 	} else {
-		t.LiquidityNet = t.LiquidityNet.Add(liquidityDelta)
+		liquidityNet, err = ToInt128(t.LiquidityNet.Add(liquidityDelta))
 	}
-	if t.LiquidityNet.GreaterThan(MaxInt128) {
-		return false, OVERFLOW
-	}
-	if t.LiquidityNet.LessThan(MinInt128) {
-		return false, UNDERFLOW
+	if err != nil {
+		return false, err
 	}
+	t.LiquidityNet = liquidityNet
 	return flipped, nil
 }
 
 func (t *Tick) Cross(
 	feeGrowthGlobal0X128 decimal.Decimal,
 	feeGrowthGlobal1X128 decimal.Decimal,
+	secondsPerLiquidityCumulativeX128 decimal.Decimal,
+	tickCumulative int64,
+	time uint32,
 ) decimal.Decimal {
-	t.FeeGrowthOutside0X128 = feeGrowthGlobal0X128.Sub(t.FeeGrowthOutside0X128)
-	t.FeeGrowthOutside1X128 = feeGrowthGlobal1X128.Sub(t.FeeGrowthOutside1X128)
+	t.FeeGrowthOutside0X128 = SubUint256(feeGrowthGlobal0X128, t.FeeGrowthOutside0X128)
+	t.FeeGrowthOutside1X128 = SubUint256(feeGrowthGlobal1X128, t.FeeGrowthOutside1X128)
+	t.SecondsPerLiquidityOutsideX128 = wrapUint160(new(big.Int).Sub(secondsPerLiquidityCumulativeX128.BigInt(), t.SecondsPerLiquidityOutsideX128.BigInt()))
+	t.TickCumulativeOutside = wrapInt56(tickCumulative - t.TickCumulativeOutside)
+	t.SecondsOutside = time - t.SecondsOutside
 	return t.LiquidityNet
 }
 
 type TickManager struct {
-	Ticks       map[int]*Tick `json:"ticks"`
-	SortedTicks []*Tick       `json:"-"`
+	Ticks map[int]*Tick `json:"ticks"`
+	// Ticks 对应的 tickBitmap, 第一次查找时按 tickSpacing 建立, 之后随 Ticks 的增删更新. nil 表示需要重新建立
+	bitmap      *TickBitmap
+	tickSpacing int
+	// 上次写入数据库之后修改过的 tick, nil 表示需要全部重新写入
+	dirty map[int]bool
 }
 
 func NewTickManager() *TickManager {
@@ -113,24 +136,40 @@ func (tm *TickManager) Clone() *TickManager {
 	}
 	newM := NewTickManager()
 	newM.Ticks = ticks
-	newM.SortTicks()
+	if tm.bitmap != nil {
+		newM.bitmap = tm.bitmap.Clone()
+		newM.tickSpacing = tm.tickSpacing
+	}
 	return newM
 }
 
 func (tm *TickManager) GetTickAndInitIfAbsent(index int) (*Tick, error) {
 
 	if tick, ok := tm.Ticks[index]; ok {
+		tm.markDirty(index)
 		return tick, nil
 	} else {
 		tick, err := NewTick(index)
 		if err != nil {
 			return nil, err
 		}
+		if tm.bitmap != nil {
+			if err := tm.bitmap.FlipTick(index, tm.tickSpacing); err != nil {
+				return nil, err
+			}
+		}
 		tm.Ticks[tick.TickIndex] = tick
-		tm.SortTicks()
+		tm.markDirty(index)
 		return tick, nil
 	}
 }
+
+// 返回的 tick 可能被修改, 记录到 dirty
+func (tm *TickManager) markDirty(index int) {
+	if tm.dirty != nil {
+		tm.dirty[index] = true
+	}
+}
 func (tm *TickManager) GetTickReadonly(index int) (*Tick, error) {
 	if tick, ok := tm.Ticks[index]; ok {
 		return tick.Clone(), nil
@@ -142,41 +181,15 @@ func (tm *TickManager) GetTickReadonly(index int) (*Tick, error) {
 		return tick, nil
 	}
 }
-func (tm *TickManager) nextInitializedTick(ticks []*Tick, tick int, lte bool) (*Tick, error) {
-
-	if lte {
-		if tm.isBelowSmallest(ticks, tick) {
-			return nil, errors.New("BELOW_SMALLEST")
-		}
-		if tm.isAtOrAboveLargest(ticks, tick) {
-			return ticks[len(ticks)-1], nil
-		}
-		index, err := tm.binarySearch(ticks, tick)
-		if err != nil {
-			return nil, err
-		}
-		return ticks[index], nil
-	} else {
-		if tm.isAtOrAboveLargest(ticks, tick) {
-			return nil, errors.New("AT_OR_ABOVE_LARGEST")
+func (tm *TickManager) Clear(tick int) error {
+	if _, ok := tm.Ticks[tick]; ok && tm.bitmap != nil {
+		if err := tm.bitmap.FlipTick(tick, tm.tickSpacing); err != nil {
+			return err
 		}
-		if tm.isBelowSmallest(ticks, tick) {
-			return ticks[0], nil
-		}
-		index, err := tm.binarySearch(ticks, tick)
-		if err != nil {
-			return nil, err
-		}
-		return ticks[index+1], nil
 	}
-}
-
-func (tm *TickManager) SortTicks() {
-	tm.SortedTicks = tm.GetSortedTicks()
-}
-func (tm *TickManager) Clear(tick int) {
 	delete(tm.Ticks, tick)
-	tm.SortTicks()
+	tm.markDirty(tick)
+	return nil
 }
 
 func (tm *TickManager) GetSortedTicks() []*Tick {
@@ -192,46 +205,36 @@ func (tm *TickManager) GetSortedTicks() []*Tick {
 	return result
 }
 
-func (tm *TickManager) GetNextInitializedTick(tick, tickSpacing int, lte bool) (int, bool, error) {
-	sortedTicks := tm.SortedTicks
-	if len(sortedTicks) == 0 {
-		return 0, false, fmt.Errorf("empty ticks")
+// 按 tickSpacing 建立 bitmap, tickSpacing 改变时重新建立
+func (tm *TickManager) ensureBitmap(tickSpacing int) (*TickBitmap, error) {
+	if tm.bitmap != nil && tm.tickSpacing == tickSpacing {
+		return tm.bitmap, nil
 	}
-
-	compressed := int(math.Floor(float64(tick) / float64(tickSpacing)))
-
-	if lte {
-		wordPos := compressed >> 8
-		minimum := (wordPos << 8) * tickSpacing
-		if tm.isBelowSmallest(sortedTicks, tick) {
-			return minimum, false, nil
-		}
-		nextTick, err := tm.nextInitializedTick(sortedTicks, tick, lte)
-		if err != nil {
-			return 0, false, err
-		}
-		nextInitializedTick := int(math.Max(float64(minimum), float64(nextTick.TickIndex)))
-		return nextInitializedTick, nextInitializedTick == nextTick.TickIndex, nil
-	} else {
-		wordPos := (compressed + 1) >> 8
-		maximum := (((wordPos + 1) << 8) - 1) * tickSpacing
-		if tm.isAtOrAboveLargest(sortedTicks, tick) {
-			return maximum, false, nil
-		}
-		nextTick, err := tm.nextInitializedTick(sortedTicks, tick, lte)
-		if err != nil {
-			return 0, false, err
+	bitmap := NewTickBitmap()
+	for index := range tm.Ticks {
+		if err := bitmap.FlipTick(index, tickSpacing); err != nil {
+			return nil, err
 		}
-		nextInitializedTick := int(math.Min(float64(maximum), float64(nextTick.TickIndex)))
-		return nextInitializedTick, nextInitializedTick == nextTick.TickIndex, nil
 	}
+	tm.bitmap, tm.tickSpacing = bitmap, tickSpacing
+	return bitmap, nil
+}
+
+// GetNextInitializedTick 与合约的 nextInitializedTickWithinOneWord 相同, 最多查找到 tick 所在 word 的边界
+func (tm *TickManager) GetNextInitializedTick(tick, tickSpacing int, lte bool) (int, bool, error) {
+	bitmap, err := tm.ensureBitmap(tickSpacing)
+	if err != nil {
+		return 0, false, err
+	}
+	next, initialized := bitmap.NextInitializedTickWithinOneWord(tick, tickSpacing, lte)
+	return next, initialized, nil
 }
 
 func (tm *TickManager) getFeeGrowthInside(tickLower, tickUpper, tickCurrent int, feeGrowthGlobal0X128, feeGrowthGlobal1X128 decimal.Decimal) (decimal.Decimal, decimal.Decimal, error) {
 	_, lok := tm.Ticks[tickLower]
 	_, uok := tm.Ticks[tickUpper]
 	if !lok || !uok {
-		return ZERO, ZERO, errors.New("INVALID_TICK")
+		return ZERO, ZERO, fmt.Errorf("%w: %d %d not initialized", ErrInvalidTick, tickLower, tickUpper)
 	}
 	lower, err := tm.GetTickAndInitIfAbsent(tickLower)
 	if err != nil {
@@ -248,8 +251,8 @@ func (tm *TickManager) getFeeGrowthInside(tickLower, tickUpper, tickCurrent int,
 		feeGrowthBelow0X128 = lower.FeeGrowthOutside0X128
 		feeGrowthBelow1X128 = lower.FeeGrowthOutside1X128
 	} else {
-		feeGrowthBelow0X128 = feeGrowthGlobal0X128.Sub(lower.FeeGrowthOutside0X128)
-		feeGrowthBelow1X128 = feeGrowthGlobal1X128.Sub(lower.FeeGrowthOutside1X128)
+		feeGrowthBelow0X128 = SubUint256(feeGrowthGlobal0X128, lower.FeeGrowthOutside0X128)
+		feeGrowthBelow1X128 = SubUint256(feeGrowthGlobal1X128, lower.FeeGrowthOutside1X128)
 	}
 	var feeGrowthAbove0X128 decimal.Decimal
 	var feeGrowthAbove1X128 decimal.Decimal
@@ -257,58 +260,16 @@ func (tm *TickManager) getFeeGrowthInside(tickLower, tickUpper, tickCurrent int,
 		feeGrowthAbove0X128 = upper.FeeGrowthOutside0X128
 		feeGrowthAbove1X128 = upper.FeeGrowthOutside1X128
 	} else {
-		feeGrowthAbove0X128 = feeGrowthGlobal0X128.Sub(upper.FeeGrowthOutside0X128)
-		feeGrowthAbove1X128 = feeGrowthGlobal1X128.Sub(upper.FeeGrowthOutside1X128)
+		feeGrowthAbove0X128 = SubUint256(feeGrowthGlobal0X128, upper.FeeGrowthOutside0X128)
+		feeGrowthAbove1X128 = SubUint256(feeGrowthGlobal1X128, upper.FeeGrowthOutside1X128)
 	}
 
-	result1, err := Mod256Sub(feeGrowthGlobal0X128, feeGrowthBelow0X128)
-	if err != nil {
-		return ZERO, ZERO, err
-	}
-	result1 = result1.Sub(feeGrowthAbove0X128)
-	result2, err := Mod256Sub(feeGrowthGlobal1X128, feeGrowthBelow1X128)
-	if err != nil {
-		return ZERO, ZERO, err
-	}
-	result2 = result2.Sub(feeGrowthAbove1X128)
+	// 区间外的 fee growth 可能大于 global, 结果回绕, 与合约一致
+	result1 := SubUint256(SubUint256(feeGrowthGlobal0X128, feeGrowthBelow0X128), feeGrowthAbove0X128)
+	result2 := SubUint256(SubUint256(feeGrowthGlobal1X128, feeGrowthBelow1X128), feeGrowthAbove1X128)
 	return result1, result2, nil
 }
 
-func (tm *TickManager) isAtOrAboveLargest(sortedTicks []*Tick, tick int) bool {
-	if len(sortedTicks) == 0 {
-		return false
-	}
-	return tick >= sortedTicks[len(sortedTicks)-1].TickIndex
-}
-
-func (tm *TickManager) isBelowSmallest(sortedTicks []*Tick, tick int) bool {
-	if len(sortedTicks) == 0 {
-		return false
-	}
-	return tick < sortedTicks[0].TickIndex
-}
-
-func (tm *TickManager) binarySearch(ticks []*Tick, tick int) (int, error) {
-	if tm.isBelowSmallest(ticks, tick) {
-		return 0, errors.New("tick is below smallest tick")
-	}
-
-	l := 0
-	r := len(ticks) - 1
-	i := 0
-	for {
-		i = int(math.Floor(float64(l+r) / 2))
-		if ticks[i].TickIndex <= tick && (i == len(ticks)-1 || ticks[i+1].TickIndex > tick) {
-			return i, nil
-		}
-		if ticks[i].TickIndex < tick {
-			l = i + 1
-		} else {
-			r = i - 1
-		}
-	}
-}
-
 func (nc *TickManager) GormDataType() string {
 	return "LONGTEXT"
 }
@@ -329,9 +290,8 @@ func (j *TickManager) Scan(value interface{}) error {
 	default:
 		err = errors.New(fmt.Sprint("Failed to unmarshal TickManager value:", value))
 	}
-	if err == nil {
-		j.SortTicks()
-	}
+	// Ticks 被替换, 下次查找时重新建立 bitmap
+	j.bitmap = nil
 	return err
 }
 
@@ -95,9 +95,8 @@ func mulShift(val decimal.Decimal, by *big.Int) decimal.Decimal {
 	return decimal.NewFromBigInt(tmp, 0)
 }
 
-var (
-	INVALID_TICK = errors.New("invalid tick")
-)
+// INVALID_TICK 与 ErrInvalidTick 相同, 保留之前的名字
+var INVALID_TICK = ErrInvalidTick
 
 var (
 	mulShiftBy2, _     = new(big.Int).SetString("fff97272373d413259a46990580e213a", 16)
@@ -122,7 +121,7 @@ var (
 )
 
 func GetSqrtRatioAtTick(tick int) (decimal.Decimal, error) {
-	if tick < MIN_TICK || tick > MAX_TICK {
+	if !isValidTick(tick) {
 		return ZERO, INVALID_TICK
 	}
 	var absTick = int(math.Abs(float64(tick)))
@@ -0,0 +1,456 @@
+package uniswap_v3_simulator
+
+import (
+	"math/big"
+
+	"github.com/daoleno/uniswapv3-sdk/utils"
+	"github.com/holiman/uint256"
+	"github.com/shopspring/decimal"
+)
+
+// swap 的热路径使用 256 位定宽整数, 对应合约的 FullMath, TickMath, SqrtPriceMath, SwapMath 和 LiquidityMath.
+// 结果写入第一个参数 z, 不分配内存. int256 使用补码表示, 与合约相同.
+// decimal 只在 CorePool 的字段和对外接口上使用, 见 HandleSwap
+
+var (
+	u256One          = uint256.NewInt(1)
+	u256Q96          = new(uint256.Int).Lsh(u256One, 96)
+	u256Q128         = new(uint256.Int).Lsh(u256One, 128)
+	u256MaxUint128   = new(uint256.Int).Sub(u256Q128, u256One)
+	u256MaxUint160   = new(uint256.Int).Sub(new(uint256.Int).Lsh(u256One, 160), u256One)
+	u256MinInt256    = new(uint256.Int).Lsh(u256One, 255)
+	u256MaxInt256    = new(uint256.Int).Sub(u256MinInt256, u256One)
+	u256MaxUint256   = new(uint256.Int).Not(new(uint256.Int))
+	u256MaxFee       = uint256.NewInt(1000000)
+	u256MinSqrtRatio = uint256.MustFromBig(MIN_SQRT_RATIO.BigInt())
+	u256MaxSqrtRatio = uint256.MustFromBig(MAX_SQRT_RATIO.BigInt())
+
+	u256MagicSqrt10001 = uint256.MustFromBig(magicSqrt10001)
+	u256MagicTickLow   = uint256.MustFromBig(magicTickLow)
+	u256MagicTickHigh  = uint256.MustFromBig(magicTickHigh)
+
+	// absTick 每一位对应的乘数, 第 0 位同时作为 ratio 的初始值
+	u256TickRatios = [20]*uint256.Int{
+		uint256.MustFromBig(mustBigFromHex("fffcb933bd6fad37aa2d162d1a594001")),
+		uint256.MustFromBig(mulShiftBy2),
+		uint256.MustFromBig(mulShiftBy4),
+		uint256.MustFromBig(mulShiftBy8),
+		uint256.MustFromBig(mulShiftBy10),
+		uint256.MustFromBig(mulShiftBy20),
+		uint256.MustFromBig(mulShiftBy40),
+		uint256.MustFromBig(mulShiftBy80),
+		uint256.MustFromBig(mulShiftBy100),
+		uint256.MustFromBig(mulShiftBy200),
+		uint256.MustFromBig(mulShiftBy400),
+		uint256.MustFromBig(mulShiftBy800),
+		uint256.MustFromBig(mulShiftBy1000),
+		uint256.MustFromBig(mulShiftBy2000),
+		uint256.MustFromBig(mulShiftBy4000),
+		uint256.MustFromBig(mulShiftBy8000),
+		uint256.MustFromBig(mulShiftBy10000),
+		uint256.MustFromBig(mulShiftBy20000),
+		uint256.MustFromBig(mulShiftBy40000),
+		uint256.MustFromBig(mulShiftBy80000),
+	}
+)
+
+func mustBigFromHex(s string) *big.Int {
+	v, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("invalid hex " + s)
+	}
+	return v
+}
+
+// decimal 的整数部分. exponent 为 0 时直接复制系数, BigInt 会经过字符串转换
+func decimalBigInt(d decimal.Decimal) *big.Int {
+	if d.Exponent() == 0 {
+		return d.Coefficient()
+	}
+	return d.BigInt()
+}
+
+// decimal 转为 uint256, 负数或者超过 uint256 返回 false
+func u256FromDecimal(z *uint256.Int, d decimal.Decimal) bool {
+	if d.IsNegative() {
+		z.Clear()
+		return false
+	}
+	return !z.SetFromBig(decimalBigInt(d))
+}
+
+// decimal 转为 int256 补码, 超过 int256 范围返回 false
+func i256FromDecimal(z *uint256.Int, d decimal.Decimal) bool {
+	b := decimalBigInt(d)
+	// SetFromBig 对负数取补码, 超出 int256 时符号位与原值不同
+	if z.SetFromBig(b) {
+		return false
+	}
+	return (b.Sign() < 0) == (z.Sign() < 0)
+}
+
+func decimalFromU256(x *uint256.Int) decimal.Decimal {
+	return decimal.NewFromBigInt(x.ToBig(), 0)
+}
+
+func decimalFromI256(x *uint256.Int) decimal.Decimal {
+	if x.Sign() >= 0 {
+		return decimalFromU256(x)
+	}
+	var abs uint256.Int
+	abs.Neg(x)
+	return decimal.NewFromBigInt(new(big.Int).Neg(abs.ToBig()), 0)
+}
+
+// FullMath.mulDiv, 结果超过 uint256 返回 OVERFLOW
+func u256MulDiv(z, a, b, denominator *uint256.Int) error {
+	if denominator.IsZero() {
+		return OVERFLOW
+	}
+	if _, overflow := z.MulDivOverflow(a, b, denominator); overflow {
+		return OVERFLOW
+	}
+	return nil
+}
+
+// FullMath.mulDivRoundingUp
+func u256MulDivRoundingUp(z, a, b, denominator *uint256.Int) error {
+	if denominator.IsZero() {
+		return OVERFLOW
+	}
+	var rem uint256.Int
+	rem.MulMod(a, b, denominator)
+	if err := u256MulDiv(z, a, b, denominator); err != nil {
+		return err
+	}
+	if !rem.IsZero() {
+		if z.Eq(u256MaxUint256) {
+			return OVERFLOW
+		}
+		z.AddUint64(z, 1)
+	}
+	return nil
+}
+
+// UnsafeMath.divRoundingUp, 除数为 0 时结果为 0
+func u256DivRoundingUp(z, x, y *uint256.Int) {
+	var rem uint256.Int
+	rem.Mod(x, y)
+	z.Div(x, y)
+	if !rem.IsZero() {
+		z.AddUint64(z, 1)
+	}
+}
+
+// TickMath.getSqrtRatioAtTick
+func u256GetSqrtRatioAtTick(z *uint256.Int, tick int) error {
+	if tick < MIN_TICK || tick > MAX_TICK {
+		return INVALID_TICK
+	}
+	absTick := tick
+	if absTick < 0 {
+		absTick = -absTick
+	}
+	if absTick&0x1 != 0 {
+		z.Set(u256TickRatios[0])
+	} else {
+		z.Set(u256Q128)
+	}
+	for i := 1; i < len(u256TickRatios); i++ {
+		if absTick&(1<<uint(i)) != 0 {
+			z.Mul(z, u256TickRatios[i])
+			z.Rsh(z, 128)
+		}
+	}
+	if tick > 0 {
+		z.Div(u256MaxUint256, z)
+	}
+	// Q128.128 转为 Q64.96, 有余数时向上取整
+	roundUp := z[0]&0xffffffff != 0
+	z.Rsh(z, 32)
+	if roundUp {
+		z.AddUint64(z, 1)
+	}
+	return nil
+}
+
+// TickMath.getTickAtSqrtRatio
+func u256GetTickAtSqrtRatio(sqrtPriceX96 *uint256.Int) (int, error) {
+	if sqrtPriceX96.Lt(u256MinSqrtRatio) || !sqrtPriceX96.Lt(u256MaxSqrtRatio) {
+		return 0, ErrInvalidSqrtRatio
+	}
+	var ratio, r, log2 uint256.Int
+	ratio.Lsh(sqrtPriceX96, 32)
+	msb := ratio.BitLen() - 1
+	if msb >= 128 {
+		r.Rsh(&ratio, uint(msb-127))
+	} else {
+		r.Lsh(&ratio, uint(127-msb))
+	}
+
+	// log_2 = (msb - 128) << 64, 可能为负数
+	if msb >= 128 {
+		log2.SetUint64(uint64(msb - 128))
+	} else {
+		log2.SetUint64(uint64(128 - msb))
+		log2.Neg(&log2)
+	}
+	log2.Lsh(&log2, 64)
+	for i := 0; i < 14; i++ {
+		r.Mul(&r, &r)
+		r.Rsh(&r, 127)
+		// r < 2^129, r >> 128 只能是 0 或 1
+		if r[2] != 0 {
+			log2[0] |= 1 << uint(63-i)
+			r.Rsh(&r, 1)
+		}
+	}
+
+	var logSqrt10001, tickLow, tickHigh uint256.Int
+	logSqrt10001.Mul(&log2, u256MagicSqrt10001)
+	tickLow.Sub(&logSqrt10001, u256MagicTickLow)
+	tickLow.SRsh(&tickLow, 128)
+	tickHigh.Add(&logSqrt10001, u256MagicTickHigh)
+	tickHigh.SRsh(&tickHigh, 128)
+	low, high := int(int64(tickLow[0])), int(int64(tickHigh[0]))
+	if low == high {
+		return low, nil
+	}
+	var sqrtRatio uint256.Int
+	if err := u256GetSqrtRatioAtTick(&sqrtRatio, high); err != nil {
+		return 0, err
+	}
+	if !sqrtRatio.Gt(sqrtPriceX96) {
+		return high, nil
+	}
+	return low, nil
+}
+
+// SqrtPriceMath.getNextSqrtPriceFromAmount0RoundingUp
+func u256GetNextSqrtPriceFromAmount0RoundingUp(z, sqrtPX96, liquidity, amount *uint256.Int, add bool) error {
+	if amount.IsZero() {
+		z.Set(sqrtPX96)
+		return nil
+	}
+	var numerator1, product, denominator uint256.Int
+	numerator1.Lsh(liquidity, 96)
+	if add {
+		if _, overflow := product.MulOverflow(amount, sqrtPX96); !overflow {
+			denominator.Add(&numerator1, &product)
+			if !denominator.Lt(&numerator1) {
+				return u256MulDivRoundingUp(z, &numerator1, sqrtPX96, &denominator)
+			}
+		}
+		denominator.Div(&numerator1, sqrtPX96)
+		if _, overflow := denominator.AddOverflow(&denominator, amount); overflow {
+			return OVERFLOW
+		}
+		u256DivRoundingUp(z, &numerator1, &denominator)
+		return nil
+	}
+	if _, overflow := product.MulOverflow(amount, sqrtPX96); overflow || !numerator1.Gt(&product) {
+		return utils.ErrInvariant
+	}
+	denominator.Sub(&numerator1, &product)
+	if err := u256MulDivRoundingUp(z, &numerator1, sqrtPX96, &denominator); err != nil {
+		return err
+	}
+	if z.Gt(u256MaxUint160) {
+		return OVERFLOW
+	}
+	return nil
+}
+
+// SqrtPriceMath.getNextSqrtPriceFromAmount1RoundingDown
+func u256GetNextSqrtPriceFromAmount1RoundingDown(z, sqrtPX96, liquidity, amount *uint256.Int, add bool) error {
+	var quotient uint256.Int
+	if add {
+		if !amount.Gt(u256MaxUint160) {
+			quotient.Lsh(amount, 96)
+			quotient.Div(&quotient, liquidity)
+		} else if err := u256MulDiv(&quotient, amount, u256Q96, liquidity); err != nil {
+			return err
+		}
+		z.Add(sqrtPX96, &quotient)
+		if z.Gt(u256MaxUint160) {
+			return OVERFLOW
+		}
+		return nil
+	}
+	if !amount.Gt(u256MaxUint160) {
+		var numerator uint256.Int
+		numerator.Lsh(amount, 96)
+		u256DivRoundingUp(&quotient, &numerator, liquidity)
+	} else if err := u256MulDivRoundingUp(&quotient, amount, u256Q96, liquidity); err != nil {
+		return err
+	}
+	if !sqrtPX96.Gt(&quotient) {
+		return utils.ErrInvariant
+	}
+	z.Sub(sqrtPX96, &quotient)
+	return nil
+}
+
+// SqrtPriceMath.getNextSqrtPriceFromInput
+func u256GetNextSqrtPriceFromInput(z, sqrtPX96, liquidity, amountIn *uint256.Int, zeroForOne bool) error {
+	if sqrtPX96.IsZero() {
+		return utils.ErrSqrtPriceLessThanZero
+	}
+	if liquidity.IsZero() {
+		return utils.ErrLiquidityLessThanZero
+	}
+	if zeroForOne {
+		return u256GetNextSqrtPriceFromAmount0RoundingUp(z, sqrtPX96, liquidity, amountIn, true)
+	}
+	return u256GetNextSqrtPriceFromAmount1RoundingDown(z, sqrtPX96, liquidity, amountIn, true)
+}
+
+// SqrtPriceMath.getNextSqrtPriceFromOutput
+func u256GetNextSqrtPriceFromOutput(z, sqrtPX96, liquidity, amountOut *uint256.Int, zeroForOne bool) error {
+	if sqrtPX96.IsZero() {
+		return utils.ErrSqrtPriceLessThanZero
+	}
+	if liquidity.IsZero() {
+		return utils.ErrLiquidityLessThanZero
+	}
+	if zeroForOne {
+		return u256GetNextSqrtPriceFromAmount1RoundingDown(z, sqrtPX96, liquidity, amountOut, false)
+	}
+	return u256GetNextSqrtPriceFromAmount0RoundingUp(z, sqrtPX96, liquidity, amountOut, false)
+}
+
+// SqrtPriceMath.getAmount0Delta, liquidity 为无符号数
+func u256GetAmount0Delta(z, sqrtRatioAX96, sqrtRatioBX96, liquidity *uint256.Int, roundUp bool) error {
+	if sqrtRatioAX96.Gt(sqrtRatioBX96) {
+		sqrtRatioAX96, sqrtRatioBX96 = sqrtRatioBX96, sqrtRatioAX96
+	}
+	var numerator1, numerator2 uint256.Int
+	numerator1.Lsh(liquidity, 96)
+	numerator2.Sub(sqrtRatioBX96, sqrtRatioAX96)
+	if roundUp {
+		if err := u256MulDivRoundingUp(z, &numerator1, &numerator2, sqrtRatioBX96); err != nil {
+			return err
+		}
+		u256DivRoundingUp(z, z, sqrtRatioAX96)
+		return nil
+	}
+	if err := u256MulDiv(z, &numerator1, &numerator2, sqrtRatioBX96); err != nil {
+		return err
+	}
+	z.Div(z, sqrtRatioAX96)
+	return nil
+}
+
+// SqrtPriceMath.getAmount1Delta, liquidity 为无符号数
+func u256GetAmount1Delta(z, sqrtRatioAX96, sqrtRatioBX96, liquidity *uint256.Int, roundUp bool) error {
+	if sqrtRatioAX96.Gt(sqrtRatioBX96) {
+		sqrtRatioAX96, sqrtRatioBX96 = sqrtRatioBX96, sqrtRatioAX96
+	}
+	var diff uint256.Int
+	diff.Sub(sqrtRatioBX96, sqrtRatioAX96)
+	if roundUp {
+		return u256MulDivRoundingUp(z, liquidity, &diff, u256Q96)
+	}
+	return u256MulDiv(z, liquidity, &diff, u256Q96)
+}
+
+// SwapMath.computeSwapStep, amountRemaining 为 int256, 非负数表示 exact input. sqrtRatioNextX96 不能与 sqrtRatioCurrentX96 相同
+func u256ComputeSwapStep(sqrtRatioNextX96, amountIn, amountOut, feeAmount, sqrtRatioCurrentX96, sqrtRatioTargetX96, liquidity, amountRemaining *uint256.Int, feePips uint64) error {
+	zeroForOne := !sqrtRatioCurrentX96.Lt(sqrtRatioTargetX96)
+	exactIn := amountRemaining.Sign() >= 0
+
+	var feeComplement, amountRemainingAbs uint256.Int
+	feeComplement.SetUint64(1000000 - feePips)
+	var err error
+	if exactIn {
+		amountRemainingAbs.Set(amountRemaining)
+		var amountRemainingLessFee uint256.Int
+		if err = u256MulDiv(&amountRemainingLessFee, amountRemaining, &feeComplement, u256MaxFee); err != nil {
+			return err
+		}
+		if zeroForOne {
+			err = u256GetAmount0Delta(amountIn, sqrtRatioTargetX96, sqrtRatioCurrentX96, liquidity, true)
+		} else {
+			err = u256GetAmount1Delta(amountIn, sqrtRatioCurrentX96, sqrtRatioTargetX96, liquidity, true)
+		}
+		if err != nil {
+			return err
+		}
+		if !amountRemainingLessFee.Lt(amountIn) {
+			sqrtRatioNextX96.Set(sqrtRatioTargetX96)
+		} else if err = u256GetNextSqrtPriceFromInput(sqrtRatioNextX96, sqrtRatioCurrentX96, liquidity, &amountRemainingLessFee, zeroForOne); err != nil {
+			return err
+		}
+	} else {
+		amountRemainingAbs.Neg(amountRemaining)
+		if zeroForOne {
+			err = u256GetAmount1Delta(amountOut, sqrtRatioTargetX96, sqrtRatioCurrentX96, liquidity, false)
+		} else {
+			err = u256GetAmount0Delta(amountOut, sqrtRatioCurrentX96, sqrtRatioTargetX96, liquidity, false)
+		}
+		if err != nil {
+			return err
+		}
+		if !amountRemainingAbs.Lt(amountOut) {
+			sqrtRatioNextX96.Set(sqrtRatioTargetX96)
+		} else if err = u256GetNextSqrtPriceFromOutput(sqrtRatioNextX96, sqrtRatioCurrentX96, liquidity, &amountRemainingAbs, zeroForOne); err != nil {
+			return err
+		}
+	}
+
+	max := sqrtRatioTargetX96.Eq(sqrtRatioNextX96)
+	if zeroForOne {
+		if !(max && exactIn) {
+			if err = u256GetAmount0Delta(amountIn, sqrtRatioNextX96, sqrtRatioCurrentX96, liquidity, true); err != nil {
+				return err
+			}
+		}
+		if !(max && !exactIn) {
+			if err = u256GetAmount1Delta(amountOut, sqrtRatioNextX96, sqrtRatioCurrentX96, liquidity, false); err != nil {
+				return err
+			}
+		}
+	} else {
+		if !(max && exactIn) {
+			if err = u256GetAmount1Delta(amountIn, sqrtRatioCurrentX96, sqrtRatioNextX96, liquidity, true); err != nil {
+				return err
+			}
+		}
+		if !(max && !exactIn) {
+			if err = u256GetAmount0Delta(amountOut, sqrtRatioCurrentX96, sqrtRatioNextX96, liquidity, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	// exact output 时输出不超过剩余数量
+	if !exactIn && amountOut.Gt(&amountRemainingAbs) {
+		amountOut.Set(&amountRemainingAbs)
+	}
+	if exactIn && !sqrtRatioNextX96.Eq(sqrtRatioTargetX96) {
+		// 没有到达目标价格, 剩余的输入全部作为手续费
+		feeAmount.Sub(amountRemaining, amountIn)
+		return nil
+	}
+	var feePipsX uint256.Int
+	feePipsX.SetUint64(feePips)
+	return u256MulDivRoundingUp(feeAmount, amountIn, &feePipsX, &feeComplement)
+}
+
+// LiquidityMath.addDelta, y 为 int256 补码
+func u256AddDelta(z, x, y *uint256.Int) error {
+	if y.Sign() < 0 {
+		var negY uint256.Int
+		negY.Neg(y)
+		if x.Lt(&negY) {
+			return UNDERFLOW
+		}
+		z.Sub(x, &negY)
+		return nil
+	}
+	z.Add(x, y)
+	if z.Gt(u256MaxUint128) {
+		return OVERFLOW
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package uniswap_v3_simulator
+
+import (
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/daoleno/uniswapv3-sdk/constants"
+	"github.com/daoleno/uniswapv3-sdk/utils"
+	"github.com/holiman/uint256"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestU256Conversion(t *testing.T) {
+	var x uint256.Int
+	minInt256 := decimal.NewFromBigInt(new(big.Int).Neg(new(big.Int).Lsh(big.NewInt(1), 255)), 0)
+	assert.True(t, i256FromDecimal(&x, minInt256))
+	assert.Equal(t, minInt256.String(), decimalFromI256(&x).String())
+	assert.False(t, i256FromDecimal(&x, minInt256.Sub(ONE)))
+	assert.False(t, i256FromDecimal(&x, minInt256.Neg()))
+	assert.True(t, i256FromDecimal(&x, decimal.NewFromInt(-5)))
+	assert.Equal(t, "-5", decimalFromI256(&x).String())
+	assert.Equal(t, MaxUint256.Sub(decimal.NewFromInt(4)).String(), decimalFromU256(&x).String())
+
+	assert.True(t, u256FromDecimal(&x, MaxUint256))
+	assert.False(t, u256FromDecimal(&x, MaxUint256.Add(ONE)))
+	assert.False(t, u256FromDecimal(&x, ONE.Neg()))
+}
+
+func TestU256TickMath(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	ticks := []int{MIN_TICK, MIN_TICK + 1, -1, 0, 1, MAX_TICK - 1, MAX_TICK}
+	for i := 0; i < 1000; i++ {
+		ticks = append(ticks, rnd.Intn(2*MAX_TICK+1)-MAX_TICK)
+	}
+	var ratio uint256.Int
+	for _, tick := range ticks {
+		assert.NoError(t, u256GetSqrtRatioAtTick(&ratio, tick))
+		expected, err := GetSqrtRatioAtTick(tick)
+		assert.NoError(t, err)
+		assert.Equal(t, expected.String(), ratio.ToBig().String(), "tick %d", tick)
+		sdk, err := utils.GetSqrtRatioAtTick(tick)
+		assert.NoError(t, err)
+		assert.Equal(t, sdk.String(), ratio.ToBig().String(), "tick %d", tick)
+
+		if tick == MAX_TICK {
+			continue
+		}
+		actual, err := u256GetTickAtSqrtRatio(&ratio)
+		assert.NoError(t, err)
+		assert.Equal(t, tick, actual)
+		if tick > MIN_TICK {
+			ratio.SubUint64(&ratio, 1)
+			actual, err = u256GetTickAtSqrtRatio(&ratio)
+			assert.NoError(t, err)
+			assert.Equal(t, tick-1, actual)
+		}
+	}
+
+	// 任意价格与 decimal 实现相同
+	span := new(big.Int).Sub(MAX_SQRT_RATIO.BigInt(), MIN_SQRT_RATIO.BigInt())
+	for i := 0; i < 1000; i++ {
+		price := new(big.Int).Rand(rnd, new(big.Int).Rsh(span, uint(rnd.Intn(150))))
+		price.Add(price, MIN_SQRT_RATIO.BigInt())
+		expected, err := GetTickAtSqrtRatio(decimal.NewFromBigInt(price, 0))
+		assert.NoError(t, err)
+		actual, err := u256GetTickAtSqrtRatio(uint256.MustFromBig(price))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, actual, "price %s", price)
+	}
+
+	assert.ErrorIs(t, u256GetSqrtRatioAtTick(&ratio, MIN_TICK-1), INVALID_TICK)
+	assert.ErrorIs(t, u256GetSqrtRatioAtTick(&ratio, MAX_TICK+1), INVALID_TICK)
+	_, err := u256GetTickAtSqrtRatio(u256MaxSqrtRatio)
+	assert.ErrorIs(t, err, ErrInvalidSqrtRatio)
+	_, err = u256GetTickAtSqrtRatio(ratio.SubUint64(u256MinSqrtRatio, 1))
+	assert.ErrorIs(t, err, ErrInvalidSqrtRatio)
+}
+
+func randomSqrtRatio(rnd *rand.Rand) *big.Int {
+	ratio, _ := utils.GetSqrtRatioAtTick(rnd.Intn(2*MAX_TICK) - MAX_TICK)
+	return ratio.Add(ratio, big.NewInt(rnd.Int63n(1<<32)))
+}
+
+func TestU256ComputeSwapStep(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	fees := []uint64{100, 500, 3000, 10000}
+	var sqrtRatioNextX96, amountIn, amountOut, feeAmount, amountRemainingX uint256.Int
+	for i := 0; i < 5000; i++ {
+		current, target := randomSqrtRatio(rnd), randomSqrtRatio(rnd)
+		if rnd.Intn(4) == 0 {
+			// 相邻的价格, 覆盖到达目标价格的情况
+			target = new(big.Int).Add(current, big.NewInt(rnd.Int63n(1<<40)-1<<39))
+			if target.Cmp(MIN_SQRT_RATIO.BigInt()) < 0 {
+				target = MIN_SQRT_RATIO.BigInt()
+			}
+		}
+		liquidity := new(big.Int).Rand(rnd, new(big.Int).Lsh(big.NewInt(1), uint(rnd.Intn(128))))
+		amountRemaining := new(big.Int).Rand(rnd, new(big.Int).Lsh(big.NewInt(1), uint(rnd.Intn(200)+1)))
+		if rnd.Intn(2) == 0 {
+			amountRemaining.Neg(amountRemaining)
+		}
+		fee := fees[rnd.Intn(len(fees))]
+
+		expectedNext, expectedIn, expectedOut, expectedFee, expectedErr := utils.ComputeSwapStep(current, target, liquidity, amountRemaining, constants.FeeAmount(fee))
+		assert.True(t, i256FromDecimal(&amountRemainingX, decimal.NewFromBigInt(amountRemaining, 0)))
+		err := u256ComputeSwapStep(&sqrtRatioNextX96, &amountIn, &amountOut, &feeAmount,
+			uint256.MustFromBig(current), uint256.MustFromBig(target), uint256.MustFromBig(liquidity), &amountRemainingX, fee)
+		if expectedErr != nil {
+			assert.Error(t, err)
+			continue
+		}
+		if !assert.NoError(t, err, "current %s target %s liquidity %s amount %s", current, target, liquidity, amountRemaining) {
+			continue
+		}
+		assert.Equal(t, expectedNext.String(), sqrtRatioNextX96.ToBig().String())
+		assert.Equal(t, expectedIn.String(), amountIn.ToBig().String())
+		assert.Equal(t, expectedOut.String(), amountOut.ToBig().String())
+		assert.Equal(t, expectedFee.String(), feeAmount.ToBig().String())
+	}
+}
+
+func TestU256AddDelta(t *testing.T) {
+	var z, y uint256.Int
+	assert.True(t, i256FromDecimal(&y, decimal.NewFromInt(-3)))
+	assert.NoError(t, u256AddDelta(&z, uint256.NewInt(5), &y))
+	assert.Equal(t, uint64(2), z.Uint64())
+	assert.ErrorIs(t, u256AddDelta(&z, uint256.NewInt(2), &y), UNDERFLOW)
+	assert.ErrorIs(t, u256AddDelta(&z, u256MaxUint128, u256One), OVERFLOW)
+}
@@ -0,0 +1,300 @@
+package uniswap_v3_simulator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/shopspring/decimal"
+	"github.com/sirupsen/logrus"
+)
+
+var ErrVerifyBlock = errors.New("pool state not at verify block")
+
+const DefaultPositionSamples = 20
+
+// StateDiff 模拟状态与链上状态不一致的字段
+type StateDiff struct {
+	Field string `json:"field"`
+	// tick index 或 position key, pool 级别的字段为空
+	Key       string `json:"key,omitempty"`
+	Chain     string `json:"chain"`
+	Simulated string `json:"simulated"`
+}
+
+type PoolVerifyReport struct {
+	Pool             string      `json:"pool"`
+	BlockNum         uint64      `json:"blockNum"`
+	TicksChecked     int         `json:"ticksChecked"`
+	PositionsChecked int         `json:"positionsChecked"`
+	Diffs            []StateDiff `json:"diffs,omitempty"`
+	Error            string      `json:"error,omitempty"`
+}
+
+func (r *PoolVerifyReport) OK() bool {
+	return r.Error == "" && len(r.Diffs) == 0
+}
+
+type VerifyReport struct {
+	BlockNum   uint64              `json:"blockNum"`
+	Pools      int                 `json:"pools"`
+	Mismatched int                 `json:"mismatched"`
+	Failed     int                 `json:"failed"`
+	Reports    []*PoolVerifyReport `json:"reports"`
+}
+
+func (r *VerifyReport) OK() bool {
+	return r.Mismatched == 0 && r.Failed == 0
+}
+
+func (r *VerifyReport) JSON() string {
+	bs, _ := json.MarshalIndent(r, "", "  ")
+	return string(bs)
+}
+
+type VerifyOptions struct {
+	// 每个 pool 抽查的 position 数量, 0 使用 DefaultPositionSamples, 负数不检查
+	PositionSamples int
+	// 只输出不一致的 pool
+	OnlyMismatched bool
+	// 比较的区块, 0 使用已同步到的区块, 其他区块使用 PoolAt 回放的状态
+	BlockNum uint64
+}
+
+func (r *PoolVerifyReport) diff(field, key string, chain, simulated interface{}) {
+	c, s := fmt.Sprint(chain), fmt.Sprint(simulated)
+	if c != s {
+		r.Diffs = append(r.Diffs, StateDiff{Field: field, Key: key, Chain: c, Simulated: s})
+	}
+}
+
+func (r *PoolVerifyReport) diffDecimal(field, key string, chain, simulated decimal.Decimal) {
+	if !chain.Equal(simulated) {
+		r.Diffs = append(r.Diffs, StateDiff{Field: field, Key: key, Chain: chain.String(), Simulated: simulated.String()})
+	}
+}
+
+func (r *PoolVerifyReport) diffTick(key string, chain, simulated *Tick) {
+	r.diffDecimal("tick.liquidityGross", key, chain.LiquidityGross, simulated.LiquidityGross)
+	r.diffDecimal("tick.liquidityNet", key, chain.LiquidityNet, simulated.LiquidityNet)
+	r.diffDecimal("tick.feeGrowthOutside0X128", key, chain.FeeGrowthOutside0X128, simulated.FeeGrowthOutside0X128)
+	r.diffDecimal("tick.feeGrowthOutside1X128", key, chain.FeeGrowthOutside1X128, simulated.FeeGrowthOutside1X128)
+	r.diff("tick.tickCumulativeOutside", key, chain.TickCumulativeOutside, simulated.TickCumulativeOutside)
+	r.diffDecimal("tick.secondsPerLiquidityOutsideX128", key, chain.SecondsPerLiquidityOutsideX128, simulated.SecondsPerLiquidityOutsideX128)
+	r.diff("tick.secondsOutside", key, chain.SecondsOutside, simulated.SecondsOutside)
+}
+
+// position key 格式为 owner_tickLower_tickUpper
+func parsePositionKey(key string) (string, int, int, bool) {
+	parts := strings.Split(key, "_")
+	if len(parts) != 3 {
+		return "", 0, 0, false
+	}
+	tickLower, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, 0, false
+	}
+	tickUpper, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return "", 0, 0, false
+	}
+	return parts[0], tickLower, tickUpper, true
+}
+
+// 按 key 排序后等间隔抽样, 同一个状态每次抽到的 position 相同
+func samplePositions(pm *PositionManager, n int) []string {
+	keys := make([]string, 0, len(pm.Positions))
+	for key := range pm.Positions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if n >= len(keys) {
+		return keys
+	}
+	samples := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		samples = append(samples, keys[i*len(keys)/n])
+	}
+	return samples
+}
+
+// Verify 比较 pool 与链上 blockNum 结束时的状态: slot0, liquidity, feeGrowthGlobal, 所有已初始化的 tick, 以及抽样的 position.
+// 调用方需要保证 pool 在 blockNum 时的状态就是当前状态
+func (p *CorePool) Verify(caller bind.ContractCaller, blockNum uint64, positionSamples int) (*PoolVerifyReport, error) {
+	chain := NewCorePoolFromConfig(p.PoolAddress, *NewPoolConfig(int64(p.TickSpacing), common.HexToAddress(p.Token0), common.HexToAddress(p.Token1), p.Fee))
+	err := chain.Load(caller, blockNum)
+	if err != nil {
+		return nil, err
+	}
+	report := &PoolVerifyReport{Pool: p.PoolAddress, BlockNum: blockNum}
+	report.diffDecimal("sqrtPriceX96", "", chain.SqrtPriceX96, p.SqrtPriceX96)
+	report.diff("tickCurrent", "", chain.TickCurrent, p.TickCurrent)
+	report.diffDecimal("liquidity", "", chain.Liquidity, p.Liquidity)
+	report.diffDecimal("feeGrowthGlobal0X128", "", chain.FeeGrowthGlobal0X128, p.FeeGrowthGlobal0X128)
+	report.diffDecimal("feeGrowthGlobal1X128", "", chain.FeeGrowthGlobal1X128, p.FeeGrowthGlobal1X128)
+	report.diff("feeProtocol", "", chain.FeeProtocol, p.FeeProtocol)
+	report.diffDecimal("protocolFees.token0", "", chain.ProtocolFeesToken0, p.ProtocolFeesToken0)
+	report.diffDecimal("protocolFees.token1", "", chain.ProtocolFeesToken1, p.ProtocolFeesToken1)
+	report.diff("observationIndex", "", chain.ObservationIndex, p.ObservationIndex)
+	report.diff("observationCardinality", "", chain.ObservationCardinality, p.ObservationCardinality)
+	report.diff("observationCardinalityNext", "", chain.ObservationCardinalityNext, p.ObservationCardinalityNext)
+
+	// 链上 tickBitmap 中的 tick 和模拟的 tick 都要检查, 任何一边缺失都是不一致
+	indexes := map[int]bool{}
+	for index := range chain.TickManager.Ticks {
+		indexes[index] = true
+	}
+	for index, tick := range p.TickManager.Ticks {
+		if !tick.LiquidityGross.IsZero() {
+			indexes[index] = true
+		}
+	}
+	sorted := make([]int, 0, len(indexes))
+	for index := range indexes {
+		sorted = append(sorted, index)
+	}
+	sort.Ints(sorted)
+	for _, index := range sorted {
+		key := strconv.Itoa(index)
+		chainTick, onChain := chain.TickManager.Ticks[index]
+		simulated, ok := p.TickManager.Ticks[index]
+		switch {
+		case !onChain:
+			report.diff("tick.initialized", key, false, true)
+		case !ok:
+			report.diff("tick.initialized", key, true, false)
+		default:
+			report.diffTick(key, chainTick, simulated)
+		}
+		report.TicksChecked += 1
+	}
+
+	if positionSamples > 0 && p.PositionManager != nil {
+		for _, key := range samplePositions(p.PositionManager, positionSamples) {
+			owner, tickLower, tickUpper, ok := parsePositionKey(key)
+			if !ok {
+				report.diff("position.key", key, "", key)
+				continue
+			}
+			chainPosition, err := p.LoadPosition(caller, blockNum, owner, tickLower, tickUpper)
+			if err != nil {
+				return nil, err
+			}
+			simulated := p.PositionManager.Positions[key]
+			report.diffDecimal("position.liquidity", key, chainPosition.Liquidity, simulated.Liquidity)
+			report.diffDecimal("position.feeGrowthInside0LastX128", key, chainPosition.FeeGrowthInside0LastX128, simulated.FeeGrowthInside0LastX128)
+			report.diffDecimal("position.feeGrowthInside1LastX128", key, chainPosition.FeeGrowthInside1LastX128, simulated.FeeGrowthInside1LastX128)
+			report.diffDecimal("position.tokensOwed0", key, chainPosition.TokensOwed0, simulated.TokensOwed0)
+			report.diffDecimal("position.tokensOwed1", key, chainPosition.TokensOwed1, simulated.TokensOwed1)
+			report.PositionsChecked += 1
+		}
+	}
+	return report, nil
+}
+
+// VerifyPool 在 opts.BlockNum 比较 pool 与链上状态, 默认使用已同步到的区块, 重启后从数据库中的 pool 得到已同步的区块
+func (pm *Simulator) VerifyPool(address common.Address, opts VerifyOptions) (*PoolVerifyReport, error) {
+	pm.lock.Lock()
+	pool, ok := pm.Pools[address]
+	if !ok {
+		pm.lock.Unlock()
+		return nil, fmt.Errorf("%w %s", ErrPoolNotExists, address)
+	}
+	// 复制后释放锁, 链上请求期间不阻塞同步
+	fork := pool.Clone()
+	synced, err := pm.MaxSyncedBlockNum()
+	pm.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if pm.caller == nil {
+		return nil, ErrNoContractCaller
+	}
+	blockNum := synced
+	if opts.BlockNum != 0 && opts.BlockNum != synced {
+		blockNum = opts.BlockNum
+		fork, err = pm.PoolAt(address, blockNum)
+		if err != nil {
+			return nil, err
+		}
+	} else if fork.CurrentBlockNum > blockNum {
+		return nil, fmt.Errorf("%w: pool %s at %d, synced %d", ErrVerifyBlock, address, fork.CurrentBlockNum, blockNum)
+	}
+	samples := opts.PositionSamples
+	if samples == 0 {
+		samples = DefaultPositionSamples
+	}
+	return fork.Verify(pm.caller, blockNum, samples)
+}
+
+// VerifyPools 在同一个区块检查所有 pool, 默认为当前同步到的区块, 之后部署的 pool 不检查.
+// 单个 pool 读取失败记录在报告中, 不影响其他 pool
+func (pm *Simulator) VerifyPools(opts VerifyOptions) (*VerifyReport, error) {
+	if pm.caller == nil {
+		return nil, ErrNoContractCaller
+	}
+	pm.lock.Lock()
+	blockNum, err := pm.MaxSyncedBlockNum()
+	if opts.BlockNum != 0 {
+		blockNum = opts.BlockNum
+	}
+	addresses := make([]common.Address, 0, len(pm.Pools))
+	for address, pool := range pm.Pools {
+		if pool.DeployBlockNum <= blockNum {
+			addresses = append(addresses, address)
+		}
+	}
+	pm.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	// 同步在检查期间继续, 每个 pool 都使用同一个区块
+	opts.BlockNum = blockNum
+	sort.Slice(addresses, func(i, j int) bool {
+		return strings.Compare(addresses[i].Hex(), addresses[j].Hex()) < 0
+	})
+
+	report := &VerifyReport{BlockNum: blockNum, Pools: len(addresses)}
+	for _, address := range addresses {
+		poolReport, err := pm.VerifyPool(address, opts)
+		if err != nil {
+			logrus.Warnf("verify pool %s failed: %s", address, err)
+			report.Failed += 1
+			report.Reports = append(report.Reports, &PoolVerifyReport{Pool: address.String(), BlockNum: blockNum, Error: err.Error()})
+			continue
+		}
+		if !poolReport.OK() {
+			logrus.Warnf("pool %s mismatch at block %d, %d diffs", address, poolReport.BlockNum, len(poolReport.Diffs))
+			report.Mismatched += 1
+		} else if opts.OnlyMismatched {
+			continue
+		}
+		report.Reports = append(report.Reports, poolReport)
+	}
+	return report, nil
+}
+
+// RunVerifier 每隔 interval 检查一次所有 pool, 报告交给 handle 处理, ctx 取消时返回
+func (pm *Simulator) RunVerifier(ctx context.Context, interval time.Duration, opts VerifyOptions, handle func(*VerifyReport)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		report, err := pm.VerifyPools(opts)
+		if err != nil {
+			return err
+		}
+		handle(report)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
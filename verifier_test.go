@@ -0,0 +1,67 @@
+package uniswap_v3_simulator
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimulator_VerifyPools(t *testing.T) {
+	pm := newTestSimulator(t)
+	pm.caller = newMockPoolCaller(t)
+	assert.NoError(t, pm.HandleLogs([]types.Log{testPoolCreatedLog(1)}))
+	pool, err := pm.LoadPoolFromChain(testPool, 100)
+	assert.NoError(t, err)
+	pm.currentBlock = 100
+	pool.PositionManager.Set(GetPositionKey(testOwner.Hex(), -600, 600), &Position{Liquidity: decimal.NewFromInt(1000000)})
+
+	report, err := pm.VerifyPools(VerifyOptions{})
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, 2, report.Reports[0].TicksChecked)
+	assert.Equal(t, 1, report.Reports[0].PositionsChecked)
+
+	pool.Liquidity = decimal.NewFromInt(1)
+	assert.NoError(t, pool.TickManager.Clear(600))
+	pool.PositionManager.Set(GetPositionKey(testOwner.Hex(), -60, 60), &Position{Liquidity: decimal.NewFromInt(5)})
+	report, err = pm.VerifyPools(VerifyOptions{OnlyMismatched: true})
+	assert.NoError(t, err)
+	assert.False(t, report.OK())
+	assert.Equal(t, 1, report.Mismatched)
+	assert.Equal(t, []StateDiff{
+		{Field: "liquidity", Chain: "1000000", Simulated: "1"},
+		{Field: "tick.initialized", Key: "600", Chain: "true", Simulated: "false"},
+		{Field: "position.liquidity", Key: GetPositionKey(testOwner.Hex(), -60, 60), Chain: "0", Simulated: "5"},
+	}, report.Reports[0].Diffs)
+
+	// pool 状态在同步区块之后
+	pool.CurrentBlockNum = 101
+	_, err = pm.VerifyPool(testPool, VerifyOptions{})
+	assert.ErrorIs(t, err, ErrVerifyBlock)
+}
+
+func TestSimulator_VerifyPoolsAtBlock(t *testing.T) {
+	pm := newTestSimulator(t)
+	pm.caller = newMockPoolCaller(t)
+	assert.NoError(t, pm.HandleLogs([]types.Log{testPoolCreatedLog(1)}))
+	pool, err := pm.LoadPoolFromChain(testPool, 100)
+	assert.NoError(t, err)
+	pool.PositionManager.Set(GetPositionKey(testOwner.Hex(), -600, 600), &Position{Liquidity: decimal.NewFromInt(1000000)})
+	pm.currentBlock = 120
+
+	// 所有 pool 都在同一个区块比较
+	report, err := pm.VerifyPools(VerifyOptions{BlockNum: 110})
+	assert.NoError(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, uint64(110), report.BlockNum)
+	assert.Equal(t, uint64(110), report.Reports[0].BlockNum)
+
+	// 从链上加载之前的状态无法得到
+	_, err = pm.VerifyPool(testPool, VerifyOptions{BlockNum: 50})
+	assert.ErrorIs(t, err, ErrStateUnavailable)
+	report, err = pm.VerifyPools(VerifyOptions{BlockNum: 50})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, report.Failed)
+}